@@ -1,37 +1,66 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-pg/pg/v10"
 	"github.com/google/uuid"
-	log2 "github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"io"
 	"net/http"
+	"net/url"
+	"payments/audit"
 	"payments/config"
+	"payments/events"
+	"payments/gateways"
+	"payments/logging"
+	"payments/messaging"
 	"payments/models"
+	"payments/store"
+	"payments/tracing"
 	"payments/utils"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	maxScheduledRetries = 500
+	defaultAuditEntries = 100
+	maxAuditEntries     = 1000
+)
+
 type Handler struct {
 	cfg               *config.Config
-	producer          *kafka.Producer
-	dbConn            *pg.DB
+	publisher         messaging.Publisher
+	transactions      store.TransactionRepository
+	users             store.UserRepository
+	auditLog          *audit.Log
+	callers           audit.Keys
+	admins            audit.Keys
 	availableGateways map[string]bool
+	logger            zerolog.Logger
 }
 
-func NewHandler(cfg *config.Config, producer *kafka.Producer, db *pg.DB, availableGateways map[string]bool) *Handler {
+// NewHandler returns the API handler. Every call is recorded in auditLog, and
+// transactions and users should record their changes in it too, see
+// audit.NewTransactions and audit.NewUsers. Only the admin keys of cfg.Auth
+// can read the audit log.
+func NewHandler(cfg *config.Config, publisher messaging.Publisher, transactions store.TransactionRepository, users store.UserRepository, auditLog *audit.Log, availableGateways map[string]bool) *Handler {
 	return &Handler{
 		cfg:               cfg,
-		producer:          producer,
-		dbConn:            db,
+		publisher:         publisher,
+		transactions:      transactions,
+		users:             users,
+		auditLog:          auditLog,
+		callers:           audit.NewKeys(slices.Concat(cfg.Auth.ApiKeys, cfg.Auth.AdminKeys)...),
+		admins:            audit.NewKeys(cfg.Auth.AdminKeys...),
 		availableGateways: availableGateways,
+		logger:            logging.Component("api"),
 	}
 }
 
@@ -54,27 +83,34 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("gateway not supported. Supported gateways are %v", gateWaysStr), http.StatusBadRequest)
 		return
 	}
-	var user models.User
-	count, err := h.dbConn.Model(&user).Where("gate_way = ? and account_id = ?", registerReq.GateWay, registerReq.AccountId).Count()
-	if err != nil {
-		log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
-		http.Error(w, "internal error adding user", http.StatusInternalServerError)
+	card := gateways.CardGateWays[registerReq.GateWay]
+	if card && (registerReq.CardToken == "" || registerReq.AccountId != "") {
+		http.Error(w, fmt.Sprintf("gateway %v takes a card_token instead of an account_id", registerReq.GateWay), http.StatusBadRequest)
 		return
 	}
-	if count > 0 {
-		http.Error(w, fmt.Sprintf("account %v on gateway %v already exists", registerReq.AccountId, registerReq.GateWay), http.StatusBadRequest)
+	if !card && registerReq.CardToken != "" {
+		http.Error(w, fmt.Sprintf("gateway %v takes an account_id, not a card_token", registerReq.GateWay), http.StatusBadRequest)
 		return
 	}
 	userGuid := uuid.NewString()
-	user = models.User{
+	user := models.User{
 		Guid:      userGuid,
 		GateWay:   registerReq.GateWay,
 		AccountId: registerReq.AccountId,
-		CreatedAt: utils.FmtTimestamp(time.Now()),
+		CardToken: registerReq.CardToken,
+		CreatedAt: utils.Now(),
+	}
+	err = h.users.Create(r.Context(), &user)
+	if errors.Is(err, store.ErrAlreadyExists) && card {
+		http.Error(w, fmt.Sprintf("card %v on gateway %v already exists", registerReq.CardToken, registerReq.GateWay), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, store.ErrAlreadyExists) {
+		http.Error(w, fmt.Sprintf("account %v on gateway %v already exists", registerReq.AccountId, registerReq.GateWay), http.StatusBadRequest)
+		return
 	}
-	_, err = h.dbConn.Model(&user).Insert()
 	if err != nil {
-		log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
 		http.Error(w, "internal error adding user", http.StatusInternalServerError)
 		return
 	}
@@ -82,6 +118,7 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 		UserGuid:  user.Guid,
 		GateWay:   user.GateWay,
 		AccountId: user.AccountId,
+		CardToken: user.CardToken,
 	}
 	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
@@ -100,7 +137,11 @@ func (h *Handler) Deposit(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		reqID = "unknown"
 	}
-	user, err := models.DbGetUser(h.dbConn, payRequest.UserGuid)
+	if payRequest.ReturnUrl != "" && !isWebUrl(payRequest.ReturnUrl) {
+		http.Error(w, "invalid return_url, expected an http or https url", http.StatusBadRequest)
+		return
+	}
+	user, err := h.users.Get(r.Context(), payRequest.UserGuid)
 	if err != nil {
 		http.Error(w, "user not found", http.StatusNotFound)
 		return
@@ -110,46 +151,35 @@ func (h *Handler) Deposit(w http.ResponseWriter, r *http.Request) {
 		Type:          string(models.Deposit),
 		UserId:        payRequest.UserGuid,
 		AccountId:     user.AccountId,
+		CardToken:     user.CardToken,
+		ReturnUrl:     payRequest.ReturnUrl,
 		GateWay:       user.GateWay,
 		Amount:        payRequest.Amount,
 		Currency:      payRequest.Currency,
-		CreatedAt:     utils.FmtTimestamp(time.Now()),
+		CreatedAt:     utils.Now(),
 		Status:        string(models.Pending),
 		RetryCount:    0,
 	}
-	_, err = h.dbConn.Model(&transaction).Insert()
-	if err != nil {
-		log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
-		http.Error(w, "internal error processing request", http.StatusInternalServerError)
+	// encoded before the transaction is stored, so a request the event
+	// schema rejects does not leave a transaction nobody will process
+	envelope, err := events.Encode(events.NewPaymentRequested(transaction))
+	if errors.Is(err, events.ErrInvalidEvent) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
-	jsonData, err := json.Marshal(transaction)
 	if err != nil {
-		log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
 		http.Error(w, "internal error processing request", http.StatusInternalServerError)
 		return
 	}
-	err = h.producer.Produce(
-		&kafka.Message{
-			Value: jsonData,
-			TopicPartition: kafka.TopicPartition{
-				Topic: &h.cfg.KafkaTopics.TransactionTopic, Partition: kafka.PartitionAny,
-			},
-		}, nil)
+	err = h.submit(r.Context(), reqID, &transaction, envelope)
 	if err != nil {
-		log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
 		http.Error(w, "internal error processing request", http.StatusInternalServerError)
 		return
 	}
-	h.producer.Flush(config.FlushTimeout)
-	log2.Info().Str("event", "deposit").Str("transaction_id", transaction.TransactionId).Float64("amount", payRequest.Amount).Str("account", utils.MaskString(transaction.AccountId)).Msg("Transaction received")
-	resp := PaymentResponse{
-		TransactionId: transaction.TransactionId,
-		Amount:        transaction.Amount,
-		Currency:      transaction.Currency,
-		Status:        transaction.Status,
-		Type:          transaction.Type,
-	}
+	h.logger.Info().Str("event", "deposit").Str("transaction_id", transaction.TransactionId).Float64("amount", payRequest.Amount).Str("account", utils.MaskString(transaction.AccountId)).Msg("Transaction received")
+	resp := newPaymentResponse(transaction)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(resp)
@@ -168,7 +198,7 @@ func (h *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		reqID = "unknown"
 	}
-	user, err := models.DbGetUser(h.dbConn, payRequest.UserGuid)
+	user, err := h.users.Get(r.Context(), payRequest.UserGuid)
 	if err != nil {
 		http.Error(w, "user not found", http.StatusNotFound)
 		return
@@ -178,77 +208,219 @@ func (h *Handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 		Type:          string(models.Withdraw),
 		UserId:        payRequest.UserGuid,
 		AccountId:     user.AccountId,
+		CardToken:     user.CardToken,
 		GateWay:       user.GateWay,
 		Amount:        payRequest.Amount,
 		Currency:      payRequest.Currency,
-		CreatedAt:     utils.FmtTimestamp(time.Now()),
+		CreatedAt:     utils.Now(),
 		Status:        string(models.Pending),
 		RetryCount:    0,
 	}
-	_, err = h.dbConn.Model(&transaction).Insert()
-	if err != nil {
-		log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
-		http.Error(w, "internal error processing request", http.StatusInternalServerError)
+	envelope, err := events.Encode(events.NewPaymentRequested(transaction))
+	if errors.Is(err, events.ErrInvalidEvent) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
-	jsonData, err := json.Marshal(transaction)
 	if err != nil {
 		http.Error(w, "internal error processing request", http.StatusInternalServerError)
 		return
 	}
-	err = h.producer.Produce(
-		&kafka.Message{
-			Value: jsonData,
-			TopicPartition: kafka.TopicPartition{
-				Topic: &h.cfg.KafkaTopics.TransactionTopic, Partition: kafka.PartitionAny,
-			},
-		}, nil)
+	err = h.submit(r.Context(), reqID, &transaction, envelope)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		http.Error(w, "internal error processing request", http.StatusInternalServerError)
 		return
 	}
-	h.producer.Flush(config.FlushTimeout)
-	resp := PaymentResponse{
-		TransactionId: transaction.TransactionId,
-		Amount:        transaction.Amount,
-		Currency:      transaction.Currency,
-		Status:        transaction.Status,
-		Type:          transaction.Type,
-	}
+	resp := newPaymentResponse(transaction)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(resp)
 }
 
+// submit stores a new transaction and requests its processing. It is stored
+// with a recovery time in next_attempt_at, so the retry scheduler submits it
+// should the request be lost; publish failures are therefore only logged once
+// the transaction is stored.
+func (h *Handler) submit(ctx context.Context, reqID string, transaction *models.Transaction, request messaging.Envelope) error {
+	recoverAt := transaction.CreatedAt.Add(h.cfg.Retry.RecoveryDelay)
+	transaction.NextAttemptAt = &recoverAt
+	err := h.transactions.Create(ctx, transaction)
+	if err != nil {
+		return err
+	}
+	msg := request.Message(h.cfg.KafkaTopics.TransactionTopic)
+	tracing.InjectMessage(ctx, msg)
+	err = h.publisher.Publish(ctx, msg)
+	if err != nil {
+		h.logger.Error().Err(err).Str("RequestID", reqID).Str("transaction_id", transaction.TransactionId).Time("next_attempt_at", recoverAt).Msg("Error requesting payment, left to the retry scheduler")
+	}
+	err = events.Publish(ctx, h.publisher, h.cfg.KafkaTopics.EventsTopic, events.NewTransactionCreated(*transaction, time.Now()))
+	if err != nil {
+		h.logger.Error().Err(err).Str("RequestID", reqID).Str("transaction_id", transaction.TransactionId).Msg("Error publishing lifecycle event")
+	}
+	return nil
+}
+
 func (h *Handler) CheckStatus(w http.ResponseWriter, r *http.Request) {
 	transactionId := chi.URLParam(r, "transaction_id")
-	var transaction models.Transaction
 	reqID, ok := r.Context().Value(middleware.RequestID).(string)
 	if !ok {
 		reqID = "unknown"
 	}
-	err := h.dbConn.Model(&transaction).Where("transaction_id = ?", transactionId).Select()
+	transaction, err := h.transactions.Get(r.Context(), transactionId)
 	if err != nil {
-		if errors.Is(err, pg.ErrNoRows) {
+		if errors.Is(err, store.ErrNotFound) {
 			http.Error(w, "transaction not found", http.StatusNotFound)
 			return
 		} else {
-			log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+			h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
 			http.Error(w, "internal error processing request", http.StatusInternalServerError)
 			return
 		}
 	}
-	resp := PaymentResponse{
-		TransactionId: transaction.TransactionId,
-		Amount:        transaction.Amount,
-		Currency:      transaction.Currency,
-		Status:        transaction.Status,
-		Type:          transaction.Type,
+	resp := newPaymentResponse(transaction)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+
+}
+
+// Return is where card gateways send customers back to after a 3-D Secure
+// challenge. A deposit waiting for the customer is scheduled to be submitted
+// again at once, the gateway telling how the challenge went, and the customer
+// is sent on to the deposit's return_url, or shown its status without one.
+func (h *Handler) Return(w http.ResponseWriter, r *http.Request) {
+	transactionId := chi.URLParam(r, "transaction_id")
+	reqID, ok := r.Context().Value(middleware.RequestID).(string)
+	if !ok {
+		reqID = "unknown"
+	}
+	transaction, err := h.transactions.Get(r.Context(), transactionId)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "transaction not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		http.Error(w, "internal error processing request", http.StatusInternalServerError)
+		return
+	}
+	if transaction.Status == string(models.PendingAction) {
+		transaction, err = h.resume(r.Context(), transaction)
+		if err != nil {
+			h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+			http.Error(w, "internal error processing request", http.StatusInternalServerError)
+			return
+		}
+	}
+	if transaction.ReturnUrl != "" {
+		http.Redirect(w, r, transaction.ReturnUrl, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPaymentResponse(transaction))
+}
+
+// resume schedules a deposit back from its 3-D Secure challenge to be submitted
+// again at once, and returns it as it is now.
+func (h *Handler) resume(ctx context.Context, transaction models.Transaction) (models.Transaction, error) {
+	now := utils.Now()
+	transaction.SetStatus(models.Pending, now)
+	transaction.ActionUrl = ""
+	transaction.NextAttemptAt = &now
+	err := h.transactions.Update(ctx, &transaction, models.PendingAction)
+	if errors.Is(err, store.ErrConflict) {
+		// the customer came back twice, or the gateway settled the
+		// transaction meanwhile
+		return h.transactions.Get(ctx, transaction.TransactionId)
+	}
+	if err != nil {
+		return transaction, err
+	}
+	// the retry scheduler publishes the transaction again. The change is
+	// committed, so a failure to publish its event is only logged.
+	err = events.Publish(ctx, h.publisher, h.cfg.KafkaTopics.EventsTopic, events.NewTransactionRetryScheduled(transaction, time.Now()))
+	if err != nil {
+		h.logger.Error().Err(err).Str("transaction_id", transaction.TransactionId).Msg("Error publishing lifecycle event")
+	}
+	return transaction, nil
+}
+
+// isWebUrl tells whether s is an absolute http or https url.
+func isWebUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (h *Handler) ScheduledRetries(w http.ResponseWriter, r *http.Request) {
+	reqID, ok := r.Context().Value(middleware.RequestID).(string)
+	if !ok {
+		reqID = "unknown"
+	}
+	transactions, err := h.transactions.ScheduledRetries(r.Context(), r.URL.Query().Get("gate_way"), maxScheduledRetries)
+	if err != nil {
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		http.Error(w, "internal error processing request", http.StatusInternalServerError)
+		return
+	}
+	resp := make([]ScheduledRetry, 0, len(transactions))
+	for _, transaction := range transactions {
+		resp = append(resp, ScheduledRetry{
+			TransactionId: transaction.TransactionId,
+			GateWay:       transaction.GateWay,
+			Type:          transaction.Type,
+			RetryCount:    transaction.RetryCount,
+			NextAttemptAt: Timestamp(*transaction.NextAttemptAt),
+		})
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
+}
 
+// AuditLog lists audit entries, newest first, filtered by the actor,
+// target_type, target_id, from and to (RFC 3339) query parameters.
+func (h *Handler) AuditLog(w http.ResponseWriter, r *http.Request) {
+	reqID, ok := r.Context().Value(middleware.RequestID).(string)
+	if !ok {
+		reqID = "unknown"
+	}
+	query := r.URL.Query()
+	filter := store.AuditFilter{
+		Actor:      query.Get("actor"),
+		TargetType: query.Get("target_type"),
+		TargetId:   query.Get("target_id"),
+		Limit:      defaultAuditEntries,
+	}
+	var err error
+	for param, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if query.Get(param) == "" {
+			continue
+		}
+		*value, err = time.Parse(time.RFC3339, query.Get(param))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s, expected an RFC 3339 time", param), http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Get("limit") != "" {
+		filter.Limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || filter.Limit < 1 || filter.Limit > maxAuditEntries {
+			http.Error(w, fmt.Sprintf("invalid limit, expected 1 to %d", maxAuditEntries), http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := h.auditLog.List(r.Context(), filter)
+	if err != nil {
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		http.Error(w, "internal error processing request", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []models.AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
 }
+
 func (h *Handler) PaymentCallback(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	transactionId := chi.URLParam(r, "transaction_id")
@@ -257,33 +429,29 @@ func (h *Handler) PaymentCallback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
-	payload := CallbackPayload{
+	envelope, err := events.Encode(events.GatewayCallbackReceived{
 		TransactionId: transactionId,
-		Payload:       bytesBody,
-	}
-	jsonData, err := json.Marshal(payload)
+		Body:          string(bytesBody),
+		ContentType:   r.Header.Get("Content-Type"),
+		ReceivedAt:    time.Now().UTC(),
+	})
 	reqID, ok := r.Context().Value(middleware.RequestID).(string)
 	if !ok {
 		reqID = "unknown"
 	}
 	if err != nil {
-		log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
 		http.Error(w, "internal error processing request", http.StatusInternalServerError)
 		return
 	}
-	err = h.producer.Produce(
-		&kafka.Message{
-			Value: jsonData,
-			TopicPartition: kafka.TopicPartition{
-				Topic: &h.cfg.KafkaTopics.CallbackTopic, Partition: kafka.PartitionAny,
-			},
-		}, nil)
+	msg := envelope.Message(h.cfg.KafkaTopics.CallbackTopic)
+	tracing.InjectMessage(r.Context(), msg)
+	err = h.publisher.Publish(r.Context(), msg)
 	if err != nil {
-		log2.Info().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
+		h.logger.Error().Str("event", "error").Str("RequestID", reqID).Msg(err.Error())
 		http.Error(w, "internal error processing request", http.StatusInternalServerError)
 		return
 	}
-	h.producer.Flush(config.FlushTimeout)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,371 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"payments/audit"
+	"payments/config"
+	"payments/events"
+	"payments/health"
+	"payments/messaging"
+	"payments/models"
+	"payments/store"
+	"testing"
+	"time"
+)
+
+type testApi struct {
+	router       http.Handler
+	bus          *messaging.MemoryBus
+	transactions *store.MemoryTransactionRepository
+	audit        *store.MemoryAuditRepository
+}
+
+func newTestApi() testApi {
+	return newTestApiPublishing(func(publisher messaging.Publisher) messaging.Publisher { return publisher })
+}
+
+// newTestApiPublishing returns an api publishing through wrap of the bus.
+func newTestApiPublishing(wrap func(messaging.Publisher) messaging.Publisher) testApi {
+	cfg := &config.Config{}
+	cfg.Retry.RecoveryDelay = time.Minute
+	cfg.Auth.ApiKeys = []string{"merchant-key"}
+	cfg.Auth.AdminKeys = []string{"admin-key"}
+	cfg.KafkaTopics.TransactionTopic = "pay.transaction"
+	cfg.KafkaTopics.CallbackTopic = "pay.callbacks"
+	cfg.KafkaTopics.EventsTopic = "payments.events"
+	bus := messaging.NewMemoryBus(1)
+	transactions := store.NewMemoryTransactionRepository()
+	entries := store.NewMemoryAuditRepository()
+	auditLog := audit.NewLog(entries, audit.SystemActor("api"))
+	handler := NewHandler(cfg, wrap(bus.Publisher()), audit.NewTransactions(transactions, auditLog), audit.NewUsers(store.NewMemoryUserRepository(), auditLog), auditLog, map[string]bool{"a": true, "c": true})
+	return testApi{
+		router:       NewRouter(handler, health.NewChecker()),
+		bus:          bus,
+		transactions: transactions,
+		audit:        entries,
+	}
+}
+
+func (a testApi) do(method, path string, body any) *httptest.ResponseRecorder {
+	return a.doWithKey("", method, path, body)
+}
+
+// doWithKey calls the api with key in the APIKeyHeader, if not empty.
+func (a testApi) doWithKey(key, method, path string, body any) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(jsonData))
+	if key != "" {
+		req.Header.Set(audit.APIKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func (a testApi) register(t *testing.T) RegisterResp {
+	rec := a.do(http.MethodPost, "/register", RegisterReq{GateWay: "a", AccountId: "234556780987"})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var resp RegisterResp
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	return resp
+}
+
+func TestHandler_Register(t *testing.T) {
+	api := newTestApi()
+	user := api.register(t)
+	assert.NotEmpty(t, user.UserGuid)
+
+	rec := api.do(http.MethodPost, "/register", RegisterReq{GateWay: "a", AccountId: "234556780987"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = api.do(http.MethodPost, "/register", RegisterReq{GateWay: "z", AccountId: "234556780987"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandler_Register_Card(t *testing.T) {
+	api := newTestApi()
+	rec := api.do(http.MethodPost, "/register", RegisterReq{GateWay: "c", CardToken: "card_4242"})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var user RegisterResp
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&user))
+	assert.Equal(t, "card_4242", user.CardToken)
+	assert.Empty(t, user.AccountId)
+	rec = api.do(http.MethodPost, "/register", RegisterReq{GateWay: "c", CardToken: "card_5555"})
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	for name, req := range map[string]RegisterReq{
+		"registered card":         {GateWay: "c", CardToken: "card_4242"},
+		"account on card gateway": {GateWay: "c", AccountId: "234556780987"},
+		"card and account":        {GateWay: "c", AccountId: "234556780987", CardToken: "card_6666"},
+		"card on account gateway": {GateWay: "a", CardToken: "card_6666"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := api.do(http.MethodPost, "/register", req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+
+	rec = api.do(http.MethodPost, "/deposit", PaymentRequest{Amount: 100, Currency: "EUR", UserGuid: user.UserGuid, ReturnUrl: "https://shop.example.com/paid"})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var resp PaymentResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	stored, err := api.transactions.Get(context.Background(), resp.TransactionId)
+	require.NoError(t, err)
+	assert.Equal(t, "card_4242", stored.CardToken)
+	assert.Equal(t, "https://shop.example.com/paid", stored.ReturnUrl)
+
+	rec = api.do(http.MethodPost, "/deposit", PaymentRequest{Amount: 100, Currency: "EUR", UserGuid: user.UserGuid, ReturnUrl: "javascript:alert(1)"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandler_Return(t *testing.T) {
+	api := newTestApi()
+	rec := api.do(http.MethodGet, "/return/unknown", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	transaction := models.Transaction{
+		TransactionId: "12345", Type: string(models.Deposit), GateWay: "c", CardToken: "card_4242", Amount: 100, Currency: "EUR",
+		Status: string(models.PendingAction), RetryCount: 1, ActionUrl: "https://acs.example.com/challenge/auth_1",
+		ReturnUrl: "https://shop.example.com/paid",
+	}
+	require.NoError(t, api.transactions.Create(context.Background(), &transaction))
+
+	rec = api.do(http.MethodGet, "/return/12345", nil)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "https://shop.example.com/paid", rec.Header().Get("Location"))
+	stored, err := api.transactions.Get(context.Background(), "12345")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Pending), stored.Status, "the deposit is submitted again")
+	require.NotNil(t, stored.NextAttemptAt)
+	assert.False(t, stored.NextAttemptAt.After(time.Now()))
+	assert.Empty(t, stored.ActionUrl)
+	lifecycle := api.bus.Messages("payments.events")
+	require.Len(t, lifecycle, 1)
+	assert.Equal(t, events.TransactionRetryScheduledType, lifecycle[0].Header(messaging.EventTypeHeader))
+
+	// coming back twice changes nothing
+	rec = api.do(http.MethodGet, "/return/12345", nil)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Len(t, api.bus.Messages("payments.events"), 1)
+
+	// without a return url, the customer is shown the status
+	transaction.TransactionId, transaction.ReturnUrl = "67890", ""
+	require.NoError(t, api.transactions.Create(context.Background(), &transaction))
+	rec = api.do(http.MethodGet, "/return/67890", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp PaymentResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, string(models.Pending), resp.Status)
+}
+
+func TestHandler_Deposit(t *testing.T) {
+	api := newTestApi()
+	user := api.register(t)
+
+	rec := api.do(http.MethodPost, "/deposit", PaymentRequest{Amount: 100, Currency: "USD", UserGuid: user.UserGuid})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var resp PaymentResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, string(models.Pending), resp.Status)
+
+	stored, err := api.transactions.Get(context.Background(), resp.TransactionId)
+	require.NoError(t, err)
+	assert.Equal(t, "a", stored.GateWay)
+	assert.Equal(t, string(models.Deposit), stored.Type)
+
+	messages := api.bus.Messages("pay.transaction")
+	require.Len(t, messages, 1)
+	assert.Equal(t, events.PaymentRequestedType, messages[0].Header(messaging.EventTypeHeader))
+	assert.Equal(t, []byte(resp.TransactionId), messages[0].Key)
+	var published events.PaymentRequested
+	require.NoError(t, events.DecodeMessage(&messages[0], &published))
+	assert.Equal(t, resp.TransactionId, published.TransactionId)
+
+	lifecycle := api.bus.Messages("payments.events")
+	require.Len(t, lifecycle, 1)
+	var created events.TransactionCreated
+	require.NoError(t, events.DecodeMessage(&lifecycle[0], &created))
+	assert.Equal(t, resp.TransactionId, created.TransactionId)
+	assert.Equal(t, user.UserGuid, created.UserId)
+	assert.Equal(t, 0, created.Sequence)
+}
+
+func TestHandler_ScheduledRetries(t *testing.T) {
+	api := newTestApi()
+	user := api.register(t)
+	rec := api.do(http.MethodPost, "/deposit", PaymentRequest{Amount: 100, Currency: "USD", UserGuid: user.UserGuid})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var resp PaymentResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+
+	// only scheduled to be recovered, should its request be lost
+	rec = api.do(http.MethodGet, "/retries", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	ctx := context.Background()
+	transaction, err := api.transactions.Get(ctx, resp.TransactionId)
+	require.NoError(t, err)
+	retryAt := time.Now().Add(time.Minute)
+	transaction.RetryCount = 1
+	transaction.NextAttemptAt = &retryAt
+	require.NoError(t, api.transactions.Update(ctx, &transaction, models.Pending))
+
+	rec = api.do(http.MethodGet, "/retries", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var retries []ScheduledRetry
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&retries))
+	require.Len(t, retries, 1)
+	assert.Equal(t, resp.TransactionId, retries[0].TransactionId)
+	assert.Equal(t, 1, retries[0].RetryCount)
+}
+
+// failingPublisher fails every publish to topic.
+type failingPublisher struct {
+	messaging.Publisher
+	topic string
+}
+
+func (p failingPublisher) Publish(ctx context.Context, msg *messaging.Message) error {
+	if msg.Topic == p.topic {
+		return errors.New("broker unavailable")
+	}
+	return p.Publisher.Publish(ctx, msg)
+}
+
+func TestHandler_Deposit_PublishFails(t *testing.T) {
+	for _, topic := range []string{"pay.transaction", "payments.events"} {
+		t.Run(topic, func(t *testing.T) {
+			api := newTestApiPublishing(func(publisher messaging.Publisher) messaging.Publisher {
+				return failingPublisher{Publisher: publisher, topic: topic}
+			})
+			user := api.register(t)
+
+			rec := api.do(http.MethodPost, "/deposit", PaymentRequest{Amount: 100, Currency: "USD", UserGuid: user.UserGuid})
+			require.Equal(t, http.StatusAccepted, rec.Code, "the transaction is stored, so a retry would duplicate it")
+			var resp PaymentResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			stored, err := api.transactions.Get(context.Background(), resp.TransactionId)
+			require.NoError(t, err)
+			require.NotNil(t, stored.NextAttemptAt, "the retry scheduler recovers a lost request")
+			assert.Equal(t, stored.CreatedAt.Add(time.Minute), *stored.NextAttemptAt)
+		})
+	}
+}
+
+func TestHandler_Deposit_InvalidEvent(t *testing.T) {
+	api := newTestApi()
+	user := api.register(t)
+	rec := api.do(http.MethodPost, "/deposit", PaymentRequest{Amount: 100, UserGuid: user.UserGuid})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Empty(t, api.bus.Messages("pay.transaction"))
+}
+
+func TestHandler_Deposit_UnknownUser(t *testing.T) {
+	api := newTestApi()
+	rec := api.do(http.MethodPost, "/deposit", PaymentRequest{Amount: 100, Currency: "USD", UserGuid: "unknown"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, api.bus.Messages("pay.transaction"))
+}
+
+func TestHandler_CheckStatus(t *testing.T) {
+	api := newTestApi()
+	rec := api.do(http.MethodGet, "/status/unknown", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	transaction := models.Transaction{
+		TransactionId: "12345", Status: string(models.Pending), Amount: 100, Currency: "USD", CreatedAt: createdAt,
+	}
+	transaction.SetStatus(models.Processing, createdAt.Add(time.Second))
+	transaction.SetStatus(models.Successful, createdAt.Add(time.Minute))
+	require.NoError(t, api.transactions.Create(context.Background(), &transaction))
+	rec = api.do(http.MethodGet, "/status/12345", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var body map[string]any
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(t, string(models.Successful), body["status"])
+	assert.Equal(t, "2024-05-01T10:00:00.123Z", body["created_at"])
+	assert.Equal(t, "2024-05-01T10:00:01.123Z", body["submitted_at"])
+	assert.Equal(t, "2024-05-01T10:01:00.123Z", body["completed_at"])
+	assert.Equal(t, body["completed_at"], body["updated_at"])
+	assert.NotContains(t, body, "failed_at")
+}
+
+func TestHandler_PaymentCallback(t *testing.T) {
+	api := newTestApi()
+	rec := api.do(http.MethodPost, "/callback/12345", map[string]string{"status": "successful"})
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	messages := api.bus.Messages("pay.callbacks")
+	require.Len(t, messages, 1)
+	assert.Equal(t, []byte("12345"), messages[0].Key)
+	var received events.GatewayCallbackReceived
+	require.NoError(t, events.DecodeMessage(&messages[0], &received))
+	assert.Equal(t, "12345", received.TransactionId)
+	assert.JSONEq(t, `{"status":"successful"}`, received.Body)
+}
+
+func TestHandler_AuditLog(t *testing.T) {
+	api := newTestApi()
+	user := api.register(t)
+	rec := api.doWithKey("merchant-key", http.MethodPost, "/deposit", PaymentRequest{Amount: 100, Currency: "USD", UserGuid: user.UserGuid})
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var resp PaymentResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+
+	actor := audit.APIKeyActor("merchant-key")
+	rec = api.doWithKey("admin-key", http.MethodGet, "/audit?actor="+actor, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var entries []models.AuditEntry
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&entries))
+	require.Len(t, entries, 2)
+	// newest first: the call is recorded once the handler returns
+	assert.Equal(t, "POST /deposit", entries[0].Action)
+	assert.JSONEq(t, `{"status":202}`, string(entries[0].After))
+	assert.Equal(t, "transaction.create", entries[1].Action)
+	assert.Equal(t, resp.TransactionId, entries[1].TargetId)
+	assert.NotEmpty(t, entries[1].RequestId)
+	assert.Equal(t, entries[0].RequestId, entries[1].RequestId)
+
+	rec = api.doWithKey("admin-key", http.MethodGet, "/audit?target_type=user&target_id="+user.UserGuid, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "user.create", entries[0].Action)
+	assert.Equal(t, audit.Anonymous, entries[0].Actor)
+
+	rec = api.doWithKey("admin-key", http.MethodGet, "/audit?from="+time.Now().Add(time.Hour).Format(time.RFC3339), nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	rec = api.doWithKey("admin-key", http.MethodGet, "/audit?from=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHandler_AuditLog_RequiresAdminKey(t *testing.T) {
+	api := newTestApi()
+	for _, key := range []string{"", "merchant-key", "guessed-key"} {
+		rec := api.doWithKey(key, http.MethodGet, "/audit", nil)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, "key %q", key)
+	}
+	rec := api.doWithKey("admin-key", http.MethodGet, "/audit", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestHandler_AuditLog_UnknownKeyIsAnonymous(t *testing.T) {
+	api := newTestApi()
+	rec := api.doWithKey("guessed-key", http.MethodGet, "/retries", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	entries, err := api.audit.List(context.Background(), store.AuditFilter{Actor: audit.Anonymous})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "GET /retries", entries[0].Action)
+}
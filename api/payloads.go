@@ -1,13 +1,49 @@
 package api
 
+import (
+	"encoding/json"
+	"payments/models"
+	"time"
+)
+
+// timestampFormat is RFC 3339 with milliseconds, the precision of every time
+// in responses.
+const timestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp is written to JSON in UTC, in timestampFormat.
+type Timestamp time.Time
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Time(t).UTC().Format(timestampFormat))
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var parsed time.Time
+	err := json.Unmarshal(data, &parsed)
+	*t = Timestamp(parsed)
+	return err
+}
+
+// optionalTimestamp returns nil for a time that is not set.
+func optionalTimestamp(t *time.Time) *Timestamp {
+	if t == nil {
+		return nil
+	}
+	timestamp := Timestamp(*t)
+	return &timestamp
+}
+
 type RegisterReq struct {
 	GateWay   string `json:"gate_way"`
 	AccountId string `json:"account_id"`
+	// CardToken is taken instead of AccountId by card gateways.
+	CardToken string `json:"card_token,omitempty"`
 }
 type RegisterResp struct {
 	UserGuid  string `json:"user_guid"`
 	GateWay   string `json:"gate_way"`
-	AccountId string `json:"account_id"`
+	AccountId string `json:"account_id,omitempty"`
+	CardToken string `json:"card_token,omitempty"`
 }
 
 type PaymentRequest struct {
@@ -15,6 +51,9 @@ type PaymentRequest struct {
 	Currency       string  `json:"currency"`
 	UserGuid       string  `json:"user_guid"`
 	ClientCallback string  `json:"callback"`
+	// ReturnUrl is where the customer is sent after a 3-D Secure challenge
+	// of a card deposit.
+	ReturnUrl string `json:"return_url,omitempty"`
 }
 type PaymentResponse struct {
 	TransactionId string  `json:"transaction_id"`
@@ -22,8 +61,49 @@ type PaymentResponse struct {
 	Currency      string  `json:"currency"`
 	Status        string  `json:"status"`
 	Type          string  `json:"type"`
+	// Attempts is the number of gateway calls made for the transaction.
+	Attempts int `json:"attempts"`
+	// GatewayReference is the gateway's id of the transaction, once known.
+	GatewayReference string `json:"gateway_reference,omitempty"`
+	// FailureCode and FailureMessage tell why the transaction, or its last
+	// attempt, failed.
+	FailureCode    string `json:"failure_code,omitempty"`
+	FailureMessage string `json:"failure_message,omitempty"`
+	// ActionUrl is where the customer completes a 3-D Secure challenge while
+	// the status is pending_action.
+	ActionUrl string `json:"action_url,omitempty"`
+	// CreatedAt is always set by the api; webhooks leave it out.
+	CreatedAt   *Timestamp `json:"created_at,omitempty"`
+	UpdatedAt   *Timestamp `json:"updated_at,omitempty"`
+	SubmittedAt *Timestamp `json:"submitted_at,omitempty"`
+	CompletedAt *Timestamp `json:"completed_at,omitempty"`
+	FailedAt    *Timestamp `json:"failed_at,omitempty"`
 }
-type CallbackPayload struct {
-	TransactionId string `json:"transaction_id"`
-	Payload       []byte `json:"payload"`
+
+func newPaymentResponse(transaction models.Transaction) PaymentResponse {
+	return PaymentResponse{
+		TransactionId:    transaction.TransactionId,
+		Amount:           transaction.Amount,
+		Currency:         transaction.Currency,
+		Status:           transaction.Status,
+		Type:             transaction.Type,
+		Attempts:         transaction.RetryCount,
+		GatewayReference: transaction.GatewayReference,
+		FailureCode:      transaction.FailureCode,
+		FailureMessage:   transaction.FailureMessage,
+		ActionUrl:        transaction.ActionUrl,
+		CreatedAt:        optionalTimestamp(&transaction.CreatedAt),
+		UpdatedAt:        optionalTimestamp(transaction.UpdatedAt),
+		SubmittedAt:      optionalTimestamp(transaction.SubmittedAt),
+		CompletedAt:      optionalTimestamp(transaction.CompletedAt),
+		FailedAt:         optionalTimestamp(transaction.FailedAt),
+	}
+}
+
+type ScheduledRetry struct {
+	TransactionId string    `json:"transaction_id"`
+	GateWay       string    `json:"gate_way"`
+	Type          string    `json:"type"`
+	RetryCount    int       `json:"retry_count"`
+	NextAttemptAt Timestamp `json:"next_attempt_at"`
 }
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"net/http"
+	"payments/audit"
+	"payments/health"
+	"payments/logging"
+	"payments/tracing"
+)
+
+// NewRouter mounts the handler and the health endpoints behind the API middleware.
+func NewRouter(handler *Handler, checker *health.Checker) http.Handler {
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(tracing.RequestIDMiddleware)
+	router.Use(logging.RequestLogger("api"))
+	router.Use(middleware.Recoverer)
+	router.Get("/healthz", checker.Liveness)
+	router.Get("/readyz", checker.Readiness)
+	router.Group(func(router chi.Router) {
+		router.Use(handler.auditLog.Middleware(handler.callers))
+		router.Post("/register", handler.Register)
+		router.Post("/deposit", handler.Deposit)
+		router.Post("/withdraw", handler.Withdraw)
+		router.Get("/status/{transaction_id}", handler.CheckStatus)
+		router.Post("/callback/{transaction_id}", handler.PaymentCallback)
+		router.Get("/return/{transaction_id}", handler.Return)
+		router.Get("/retries", handler.ScheduledRetries)
+		router.With(audit.RequireKey(handler.admins)).Get("/audit", handler.AuditLog)
+	})
+	return tracing.NewHandler(router, "api")
+}
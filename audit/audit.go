@@ -0,0 +1,96 @@
+// Package audit records who did what and when in the append-only audit log:
+// every API call, and every change made through the repositories it wraps.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-chi/chi/v5/middleware"
+	"payments/models"
+	"payments/store"
+	"time"
+)
+
+const (
+	TargetTransaction = "transaction"
+	TargetUser        = "user"
+)
+
+// Anonymous is the actor of API calls made without an API key.
+const Anonymous = "anonymous"
+
+// SystemActor is the actor of changes a service makes on its own, such as the
+// payment processor settling a transaction.
+func SystemActor(component string) string {
+	return "system:" + component
+}
+
+// APIKeyActor identifies a caller by a fingerprint of its API key, so the key
+// itself never reaches the audit log.
+func APIKeyActor(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "api_key:" + hex.EncodeToString(sum[:8])
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose changes are recorded as made by actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set by WithActor, or "" if there is none.
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// Log appends entries to the audit log. Changes made outside an API call are
+// recorded as made by its default actor.
+type Log struct {
+	entries store.AuditRepository
+	actor   string
+}
+
+func NewLog(entries store.AuditRepository, actor string) *Log {
+	return &Log{entries: entries, actor: actor}
+}
+
+// Record appends an entry for action on the target. before and after are
+// stored as JSON, nil leaves them out.
+func (l *Log) Record(ctx context.Context, action, targetType, targetId string, before, after any) error {
+	entry := models.AuditEntry{
+		OccurredAt: time.Now().UTC(),
+		Actor:      ActorFrom(ctx),
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetId,
+		RequestId:  middleware.GetReqID(ctx),
+	}
+	if entry.Actor == "" {
+		entry.Actor = l.actor
+	}
+	var err error
+	entry.Before, err = marshal(before)
+	if err != nil {
+		return err
+	}
+	entry.After, err = marshal(after)
+	if err != nil {
+		return err
+	}
+	return l.entries.Append(ctx, &entry)
+}
+
+func (l *Log) List(ctx context.Context, filter store.AuditFilter) ([]models.AuditEntry, error) {
+	return l.entries.List(ctx, filter)
+}
+
+func marshal(state any) (json.RawMessage, error) {
+	if state == nil {
+		return nil, nil
+	}
+	return json.Marshal(state)
+}
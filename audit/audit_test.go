@@ -0,0 +1,80 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"payments/models"
+	"payments/store"
+	"testing"
+	"time"
+)
+
+func TestTransactions_Update(t *testing.T) {
+	entries := store.NewMemoryAuditRepository()
+	transactions := NewTransactions(store.NewMemoryTransactionRepository(), NewLog(entries, SystemActor("payment_processor")))
+	ctx := context.Background()
+	transaction := models.Transaction{TransactionId: "tx-1", Status: string(models.Pending)}
+	require.NoError(t, transactions.Create(ctx, &transaction))
+
+	stale := transaction
+	transaction.Status = string(models.Processing)
+	require.NoError(t, transactions.Update(ctx, &transaction, models.Pending))
+	// a conflicting update changes nothing and is not recorded
+	stale.Status = string(models.Failed)
+	require.ErrorIs(t, transactions.Update(ctx, &stale, models.Pending), store.ErrConflict)
+
+	recorded, err := entries.List(ctx, store.AuditFilter{TargetType: TargetTransaction, TargetId: "tx-1"})
+	require.NoError(t, err)
+	require.Len(t, recorded, 2)
+	update := recorded[0]
+	assert.Equal(t, "transaction.update", update.Action)
+	assert.Equal(t, "system:payment_processor", update.Actor)
+	var before, after models.Transaction
+	require.NoError(t, json.Unmarshal(update.Before, &before))
+	require.NoError(t, json.Unmarshal(update.After, &after))
+	assert.Equal(t, string(models.Pending), before.Status)
+	assert.Equal(t, string(models.Processing), after.Status)
+	assert.Equal(t, before.Version+1, after.Version)
+	assert.Equal(t, "transaction.create", recorded[1].Action)
+	assert.Nil(t, recorded[1].Before)
+}
+
+func TestTransactions_ClaimDueRetries(t *testing.T) {
+	entries := store.NewMemoryAuditRepository()
+	transactions := NewTransactions(store.NewMemoryTransactionRepository(), NewLog(entries, SystemActor("payment_processor")))
+	ctx := context.Background()
+	past := time.Now().Add(-time.Second)
+	require.NoError(t, transactions.Create(ctx, &models.Transaction{TransactionId: "tx-1", Status: string(models.Pending), NextAttemptAt: &past}))
+
+	count, err := transactions.ClaimDueRetries(ctx, 10, func(models.Transaction) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	recorded, err := entries.List(ctx, store.AuditFilter{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, recorded, 1)
+	assert.Equal(t, "transaction.claim_retry", recorded[0].Action)
+}
+
+func TestLog_Actor(t *testing.T) {
+	entries := store.NewMemoryAuditRepository()
+	log := NewLog(entries, SystemActor("api"))
+	ctx := context.Background()
+	require.NoError(t, log.Record(ctx, "test", "", "", nil, nil))
+	require.NoError(t, log.Record(WithActor(ctx, APIKeyActor("key")), "test", "", "", nil, nil))
+
+	recorded, err := entries.List(ctx, store.AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, recorded, 2)
+	assert.Equal(t, APIKeyActor("key"), recorded[0].Actor)
+	assert.Equal(t, "system:api", recorded[1].Actor)
+}
+
+func TestKeys_Contains(t *testing.T) {
+	keys := NewKeys("merchant-key", "")
+	assert.True(t, keys.Contains("merchant-key"))
+	assert.False(t, keys.Contains("merchant-key2"))
+	assert.False(t, keys.Contains(""))
+	assert.False(t, NewKeys().Contains("merchant-key"))
+}
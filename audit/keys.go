@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// Keys is a set of API keys callers authenticate with.
+type Keys struct {
+	digests [][sha256.Size]byte
+}
+
+func NewKeys(keys ...string) Keys {
+	var set Keys
+	for _, key := range keys {
+		if key != "" {
+			set.digests = append(set.digests, sha256.Sum256([]byte(key)))
+		}
+	}
+	return set
+}
+
+// Contains reports whether key is in the set. It compares digests in constant
+// time, so the response time does not tell a caller how close a guess was.
+func (k Keys) Contains(key string) bool {
+	if key == "" {
+		return false
+	}
+	digest := sha256.Sum256([]byte(key))
+	found := 0
+	for _, candidate := range k.digests {
+		found |= subtle.ConstantTimeCompare(digest[:], candidate[:])
+	}
+	return found == 1
+}
+
+// RequireKey rejects requests without one of keys in the APIKeyHeader with
+// 401 Unauthorized. An empty set rejects every request.
+func RequireKey(keys Keys) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !keys.Contains(r.Header.Get(APIKeyHeader)) {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
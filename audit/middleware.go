@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"net/http"
+)
+
+// APIKeyHeader identifies the caller of an API call.
+const APIKeyHeader = "X-Api-Key"
+
+type requestOutcome struct {
+	Status int `json:"status"`
+}
+
+// Middleware records every API call. It sets the actor of the request's
+// context, so the changes the handlers make are recorded as made by the caller.
+// Callers are only identified by keys in keys, any other key is recorded as
+// Anonymous. It must run after middleware.RequestID and inside the chi router,
+// whose route pattern names the action.
+func (l *Log) Middleware(keys Keys) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return l.middleware(keys, next)
+	}
+}
+
+func (l *Log) middleware(keys Keys, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor := Anonymous
+		if key := r.Header.Get(APIKeyHeader); keys.Contains(key) {
+			actor = APIKeyActor(key)
+		}
+		ctx := WithActor(r.Context(), actor)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		action := r.Method + " " + r.URL.Path
+		if routeCtx := chi.RouteContext(ctx); routeCtx != nil && routeCtx.RoutePattern() != "" {
+			action = r.Method + " " + routeCtx.RoutePattern()
+		}
+		var targetType string
+		targetId := chi.URLParamFromCtx(ctx, "transaction_id")
+		if targetId != "" {
+			targetType = TargetTransaction
+		}
+		l.record(ctx, action, targetType, targetId, nil, requestOutcome{Status: status})
+	})
+}
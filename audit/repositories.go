@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5/middleware"
+	"payments/logging"
+	"payments/models"
+	"payments/store"
+)
+
+var (
+	_ store.TransactionRepository = (*Transactions)(nil)
+	_ store.UserRepository        = (*Users)(nil)
+)
+
+// Transactions records every change made through a TransactionRepository.
+//
+// The entry is appended once the change is committed. A change cannot be
+// undone at that point, so a failure to append it is logged rather than
+// returned.
+type Transactions struct {
+	store.TransactionRepository
+	log *Log
+}
+
+func NewTransactions(transactions store.TransactionRepository, log *Log) *Transactions {
+	return &Transactions{TransactionRepository: transactions, log: log}
+}
+
+func (t *Transactions) Create(ctx context.Context, transaction *models.Transaction) error {
+	err := t.TransactionRepository.Create(ctx, transaction)
+	if err != nil {
+		return err
+	}
+	t.log.record(ctx, "transaction.create", TargetTransaction, transaction.TransactionId, nil, *transaction)
+	return nil
+}
+
+// Update reads the transaction first to record its state before the update.
+// The update only succeeds at the version transaction was read at, so the
+// state read is the one replaced whenever its version matches.
+func (t *Transactions) Update(ctx context.Context, transaction *models.Transaction, expectedStatus models.TransactionStatus) error {
+	before, getErr := t.TransactionRepository.Get(ctx, transaction.TransactionId)
+	err := t.TransactionRepository.Update(ctx, transaction, expectedStatus)
+	if err != nil {
+		return err
+	}
+	var beforeState any
+	if getErr == nil && before.Version == transaction.Version-1 {
+		beforeState = before
+	}
+	t.log.record(ctx, "transaction.update", TargetTransaction, transaction.TransactionId, beforeState, *transaction)
+	return nil
+}
+
+func (t *Transactions) ClaimDueRetries(ctx context.Context, limit int, handle func(models.Transaction) error) (int, error) {
+	var claimed []models.Transaction
+	count, err := t.TransactionRepository.ClaimDueRetries(ctx, limit, func(transaction models.Transaction) error {
+		err := handle(transaction)
+		if err == nil {
+			claimed = append(claimed, transaction)
+		}
+		return err
+	})
+	if err != nil {
+		return count, err
+	}
+	for _, transaction := range claimed {
+		t.log.record(ctx, "transaction.claim_retry", TargetTransaction, transaction.TransactionId, nil, transaction)
+	}
+	return count, nil
+}
+
+// Users records every user created through a UserRepository.
+type Users struct {
+	store.UserRepository
+	log *Log
+}
+
+func NewUsers(users store.UserRepository, log *Log) *Users {
+	return &Users{UserRepository: users, log: log}
+}
+
+func (u *Users) Create(ctx context.Context, user *models.User) error {
+	err := u.UserRepository.Create(ctx, user)
+	if err != nil {
+		return err
+	}
+	u.log.record(ctx, "user.create", TargetUser, user.Guid, nil, *user)
+	return nil
+}
+
+// record appends an entry for a committed change, logging a failure. The entry
+// is appended even if ctx was cancelled in the meantime.
+func (l *Log) record(ctx context.Context, action, targetType, targetId string, before, after any) {
+	err := l.Record(context.WithoutCancel(ctx), action, targetType, targetId, before, after)
+	if err != nil {
+		logger := logging.Component("audit")
+		logger.Error().Str("RequestID", middleware.GetReqID(ctx)).Str("action", action).Str("target_id", targetId).Msg(err.Error())
+	}
+}
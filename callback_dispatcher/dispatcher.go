@@ -2,41 +2,103 @@ package callback_dispatcher
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/rs/zerolog"
 	"net/http"
 	"payments/api"
+	"payments/config"
+	"payments/events"
+	"payments/health"
+	"payments/logging"
+	"payments/messaging"
 	"payments/models"
+	"payments/tracing"
+	"payments/utils"
+	"payments/worker"
 )
 
 type CallbackDispatcher struct {
+	client  *http.Client
+	cfg     *config.Config
+	checker *health.Checker
+	logger  zerolog.Logger
 }
 
-func NewCallbackDispatcher() *CallbackDispatcher {
-	return &CallbackDispatcher{}
+// NewCallbackDispatcher returns a dispatcher that reports the circuit of every
+// client domain it calls to checker.
+func NewCallbackDispatcher(cfg *config.Config, checker *health.Checker) *CallbackDispatcher {
+	return &CallbackDispatcher{
+		client:  tracing.NewHTTPClient(),
+		cfg:     cfg,
+		checker: checker,
+		logger:  logging.Component("callback_dispatcher"),
+	}
 }
 
-func (d *CallbackDispatcher) Process(transaction models.Transaction) error {
+// HandleMessage is the worker.Handler for the dispatcher topic.
+func (d *CallbackDispatcher) HandleMessage(ctx context.Context, msg *messaging.Message) error {
+	var event events.PaymentStatusChanged
+	err := events.DecodeMessage(msg, &event)
+	if err != nil {
+		d.logger.Error().Err(err).Msg("Error decoding status change")
+		return worker.Permanent(err)
+	}
+	if event.ClientCallback == "" {
+		return nil
+	}
+	domain, err := utils.ExtractDomain(event.ClientCallback)
+	if err != nil {
+		d.logger.Error().Err(err).Str("transaction_id", event.TransactionId).Str("client_callback", event.ClientCallback).Msg("Error extracting callback domain")
+		return worker.Permanent(err)
+	}
+	// set up circuit breaker to client domain, picking up reloaded settings
+	hystrix.ConfigureCommand(domain, d.cfg.ClientDomainSettings(domain).HystrixConfig())
+	d.checker.WatchCircuit(domain)
+	ctx, span := tracing.StartConsumerSpan(ctx, msg, "callback_dispatcher.process")
+	defer span.End()
+	return hystrix.Do(domain, func() error {
+		return d.Process(ctx, event)
+	}, nil)
+}
+
+func (d *CallbackDispatcher) Process(ctx context.Context, event events.PaymentStatusChanged) error {
 	paymentResp := api.PaymentResponse{
-		TransactionId: transaction.TransactionId,
-		Amount:        transaction.Amount,
-		Currency:      transaction.Currency,
-		Status:        transaction.Status,
-		Type:          transaction.Type,
+		TransactionId:    event.TransactionId,
+		Amount:           event.Amount,
+		Currency:         event.Currency,
+		Status:           event.Status,
+		Type:             event.Type,
+		Attempts:         event.Attempts,
+		GatewayReference: event.GatewayReference,
+		FailureCode:      event.FailureCode,
+		FailureMessage:   event.FailureMessage,
+		ActionUrl:        event.ActionUrl,
+	}
+	changedAt := api.Timestamp(event.ChangedAt)
+	paymentResp.UpdatedAt = &changedAt
+	switch models.TransactionStatus(event.Status) {
+	case models.Successful:
+		paymentResp.CompletedAt = &changedAt
+	case models.Failed:
+		paymentResp.FailedAt = &changedAt
 	}
 	jsonData, err := json.Marshal(paymentResp)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, transaction.ClientCallback, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, event.ClientCallback, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := d.client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	// we might want to isolate client errors (4xx)
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return errors.New(fmt.Sprintf("client failed with status code %d", resp.StatusCode))
@@ -0,0 +1,66 @@
+package callback_dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"payments/api"
+	"payments/config"
+	"payments/events"
+	"payments/health"
+	"payments/models"
+	"payments/worker"
+	"testing"
+	"time"
+)
+
+func TestCallbackDispatcher_HandleMessage(t *testing.T) {
+	received := make(chan api.PaymentResponse, 1)
+	client := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resp api.PaymentResponse
+		json.NewDecoder(r.Body).Decode(&resp)
+		received <- resp
+	}))
+	defer client.Close()
+	envelope, err := events.Encode(events.PaymentStatusChanged{
+		TransactionId:    "12345",
+		Type:             string(models.Deposit),
+		Amount:           100,
+		Currency:         "USD",
+		Status:           string(models.Failed),
+		ClientCallback:   client.URL + "/payments",
+		ChangedAt:        time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Attempts:         1,
+		GatewayReference: "B000000000042",
+		FailureCode:      string(models.FailureLimitExceeded),
+		FailureMessage:   "Exceeds withdrawal frequency (gateway code 61)",
+	})
+	require.NoError(t, err)
+
+	dispatcher := NewCallbackDispatcher(&config.Config{}, health.NewChecker())
+	err = dispatcher.HandleMessage(context.Background(), envelope.Message("pay.dispatcher"))
+	require.NoError(t, err)
+	resp := <-received
+	assert.Equal(t, "12345", resp.TransactionId)
+	assert.Equal(t, string(models.Failed), resp.Status)
+	assert.Equal(t, 1, resp.Attempts)
+	assert.Equal(t, "B000000000042", resp.GatewayReference)
+	assert.Equal(t, string(models.FailureLimitExceeded), resp.FailureCode)
+	assert.Equal(t, "Exceeds withdrawal frequency (gateway code 61)", resp.FailureMessage)
+	require.NotNil(t, resp.FailedAt)
+	assert.Equal(t, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), time.Time(*resp.FailedAt))
+	assert.Nil(t, resp.CompletedAt)
+	assert.Nil(t, resp.CreatedAt)
+}
+
+func TestCallbackDispatcher_HandleMessage_UnexpectedEvent(t *testing.T) {
+	envelope, err := events.Encode(events.GatewayCallbackReceived{TransactionId: "12345", ReceivedAt: time.Now()})
+	require.NoError(t, err)
+
+	dispatcher := NewCallbackDispatcher(&config.Config{}, health.NewChecker())
+	err = dispatcher.HandleMessage(context.Background(), envelope.Message("pay.dispatcher"))
+	assert.True(t, worker.IsPermanent(err))
+}
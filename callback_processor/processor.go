@@ -1,72 +1,131 @@
 package callback_processor
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"github.com/go-pg/pg/v10"
-	"github.com/redis/go-redis/v9"
-	log2 "github.com/rs/zerolog/log"
-	"payments/api"
+	"github.com/rs/zerolog"
 	"payments/config"
+	"payments/events"
 	"payments/gateways"
+	"payments/logging"
+	"payments/messaging"
 	"payments/models"
+	"payments/store"
+	"payments/tracing"
 	"payments/utils"
+	"payments/worker"
 	"time"
 )
 
 type CallbackProcessor struct {
-	gateWays map[string]gateways.PaymentGateway
-	db       *pg.DB
-	redisDb  *redis.Client
-	cfg      *config.Config
-	producer *kafka.Producer
+	gateWays     map[string]gateways.PaymentGateway
+	transactions store.TransactionRepository
+	cfg          *config.Config
+	publisher    messaging.Publisher
+	logger       zerolog.Logger
 }
 
-func NewCallbackProcessor(cfg *config.Config, db *pg.DB, rdb *redis.Client, producer *kafka.Producer, gateways map[string]gateways.PaymentGateway) *CallbackProcessor {
+func NewCallbackProcessor(cfg *config.Config, transactions store.TransactionRepository, publisher messaging.Publisher, gateways map[string]gateways.PaymentGateway) *CallbackProcessor {
 	return &CallbackProcessor{
-		gateWays: gateways,
-		db:       db,
-		cfg:      cfg,
-		redisDb:  rdb,
-		producer: producer,
+		gateWays:     gateways,
+		transactions: transactions,
+		cfg:          cfg,
+		publisher:    publisher,
+		logger:       logging.Component("callback_processor"),
 	}
 }
-func (p CallbackProcessor) Process(payload api.CallbackPayload) error {
-	var transaction models.Transaction
-	err := p.db.Model(&transaction).Where("transaction_id = ?", payload.TransactionId).Select()
+
+// HandleMessage is the worker.Handler for the callback topic.
+func (p CallbackProcessor) HandleMessage(ctx context.Context, msg *messaging.Message) error {
+	var event events.GatewayCallbackReceived
+	err := events.DecodeMessage(msg, &event)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("Error decoding gateway callback")
+		return worker.Permanent(err)
+	}
+	ctx, span := tracing.StartConsumerSpan(ctx, msg, "callback_processor.process")
+	defer span.End()
+	return p.Process(ctx, event)
+}
+
+func (p CallbackProcessor) Process(ctx context.Context, event events.GatewayCallbackReceived) error {
+	transaction, err := p.transactions.Get(ctx, event.TransactionId)
 	if err != nil {
 		return err
 	}
+	expectedStatus := models.TransactionStatus(transaction.Status)
+	if expectedStatus == models.Successful || expectedStatus == models.Failed {
+		// a redelivered callback, the transaction is settled already. Its
+		// events are published again in case that failed the first time;
+		// the lifecycle event has the same id, so consumers drop the copy.
+		p.logger.Info().Str("transaction_id", transaction.TransactionId).Str("status", transaction.Status).Msg("Transaction is settled already, ignoring callback")
+		changedAt := time.Now().UTC()
+		if transaction.UpdatedAt != nil {
+			changedAt = *transaction.UpdatedAt
+		}
+		changed, err := events.Encode(events.NewPaymentStatusChanged(transaction, changedAt))
+		if err != nil {
+			return err
+		}
+		return p.publish(ctx, transaction, changed)
+	}
 	gateway, ok := p.gateWays[transaction.GateWay]
 	if !ok {
 		return errors.New("gateway not found")
 	}
-	resp, err := gateway.HandleCallback(payload.Payload)
+	resp, err := gateway.HandleCallback([]byte(event.Body))
+	if errors.Is(err, gateways.ErrMalformedCallback) {
+		p.logger.Error().Err(err).Str("transaction_id", transaction.TransactionId).Msg("Malformed gateway callback")
+		return worker.Permanent(err)
+	}
 	if err != nil {
 		return err
 	}
-	mutexLock := utils.GetMutexLock(p.redisDb, config.TransactionDomain, transaction.TransactionId)
-	err = mutexLock.Lock()
+	transaction.SetStatus(models.TransactionStatus(resp.Status), utils.Now())
+	if resp.Reference != "" {
+		transaction.GatewayReference = resp.Reference
+	}
+	if resp.Status == string(models.Failed) {
+		code := resp.FailureCode
+		if code == "" {
+			code = models.FailureDeclined
+		}
+		transaction.SetFailure(code, resp.FailureMessage)
+	} else {
+		// a failure of an earlier attempt
+		transaction.SetFailure("", "")
+	}
+	// a callback can beat the retry of a gateway call that timed out
+	transaction.NextAttemptAt = nil
+	// encoded first, so the update is not committed without its event
+	changed, err := events.Encode(events.NewPaymentStatusChanged(transaction, *transaction.UpdatedAt))
 	if err != nil {
 		return err
 	}
-	transaction.Status = resp.Status
-	transaction.UpdatedAt = utils.FmtTimestamp(time.Now())
-	_, err = p.db.Model(&transaction).Where("transaction_id = ?", transaction.TransactionId).Update()
-	mutexLock.Unlock()
+	// on a conflict the message is retried against the latest version
+	err = p.transactions.Update(ctx, &transaction, expectedStatus)
 	if err != nil {
 		return err
 	}
-	jsonData, _ := json.Marshal(transaction)
-	err = p.producer.Produce(
-		&kafka.Message{
-			Value: jsonData,
-			TopicPartition: kafka.TopicPartition{
-				Topic: &p.cfg.KafkaTopics.TransactionTopic, Partition: kafka.PartitionAny,
-			},
-		}, nil)
-	p.producer.Flush(config.FlushTimeout)
-	log2.Info().Str("event", "deposit").Str("transaction_id", transaction.TransactionId).Float64("amount", transaction.Amount).Str("account", utils.MaskString(transaction.AccountId)).Msg("Transaction processed")
+	err = p.publish(ctx, transaction, changed)
+	if err != nil {
+		return err
+	}
+	p.logger.Info().Str("event", "deposit").Str("transaction_id", transaction.TransactionId).Float64("amount", transaction.Amount).Str("account", utils.MaskString(transaction.AccountId)).Msg("Transaction processed")
+	return nil
+}
+
+// publish sends changed, the status change of transaction, to the dispatcher,
+// and the lifecycle event of transaction if it is settled.
+func (p CallbackProcessor) publish(ctx context.Context, transaction models.Transaction, changed messaging.Envelope) error {
+	msg := changed.Message(p.cfg.KafkaTopics.DispatcherTopic)
+	tracing.InjectMessage(ctx, msg)
+	err := p.publisher.Publish(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if settled := events.NewTransactionSettled(transaction, time.Now()); settled != nil {
+		return events.Publish(ctx, p.publisher, p.cfg.KafkaTopics.EventsTopic, settled)
+	}
 	return nil
 }
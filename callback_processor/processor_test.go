@@ -0,0 +1,236 @@
+package callback_processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"payments/config"
+	"payments/events"
+	"payments/gateways"
+	"payments/messaging"
+	"payments/models"
+	"payments/store"
+	"payments/worker"
+	"testing"
+	"time"
+)
+
+type fakeGateway struct {
+	err         error
+	status      string
+	reference   string
+	failureCode models.FailureCode
+}
+
+func (g fakeGateway) Deposit(ctx context.Context, transaction models.Transaction) error {
+	return nil
+}
+
+func (g fakeGateway) Withdraw(ctx context.Context, transaction models.Transaction) error {
+	return nil
+}
+
+func (g fakeGateway) HandleCallback(payload []byte) (gateways.GateWayResponse, error) {
+	if g.err != nil {
+		return gateways.GateWayResponse{}, g.err
+	}
+	return gateways.GateWayResponse{Status: g.status, Reference: g.reference, FailureCode: g.failureCode, FailureMessage: string(g.failureCode)}, nil
+}
+
+func TestCallbackProcessor_Process(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.KafkaTopics.DispatcherTopic = "pay.dispatcher"
+	cfg.KafkaTopics.EventsTopic = "payments.events"
+	transactions := store.NewMemoryTransactionRepository()
+	require.NoError(t, transactions.Create(context.Background(), &models.Transaction{
+		TransactionId: "12345", GateWay: "a", Type: string(models.Deposit), Amount: 10, Currency: "USD", Status: string(models.Processing),
+	}))
+	bus := messaging.NewMemoryBus(1)
+	gateWays := map[string]gateways.PaymentGateway{"a": fakeGateway{status: string(models.Successful)}}
+	processor := NewCallbackProcessor(cfg, transactions, bus.Publisher(), gateWays)
+
+	err := processor.Process(context.Background(), events.GatewayCallbackReceived{TransactionId: "12345", Body: `{}`})
+	require.NoError(t, err)
+	stored, err := transactions.Get(context.Background(), "12345")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Successful), stored.Status)
+	require.NotNil(t, stored.CompletedAt)
+	assert.Equal(t, time.UTC, stored.CompletedAt.Location())
+	assert.Nil(t, stored.FailedAt)
+
+	messages := bus.Messages("pay.dispatcher")
+	require.Len(t, messages, 1)
+	var changed events.PaymentStatusChanged
+	require.NoError(t, events.DecodeMessage(&messages[0], &changed))
+	assert.Equal(t, string(models.Successful), changed.Status)
+	assert.Equal(t, []byte("12345"), messages[0].Key)
+
+	lifecycle := bus.Messages("payments.events")
+	require.Len(t, lifecycle, 1)
+	var succeeded events.TransactionSucceeded
+	require.NoError(t, events.DecodeMessage(&lifecycle[0], &succeeded))
+	assert.Equal(t, stored.Version, succeeded.Sequence)
+}
+
+func TestCallbackProcessor_Process_Declined(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.KafkaTopics.DispatcherTopic = "pay.dispatcher"
+	cfg.KafkaTopics.EventsTopic = "payments.events"
+	transactions := store.NewMemoryTransactionRepository()
+	require.NoError(t, transactions.Create(context.Background(), &models.Transaction{
+		TransactionId: "12345", GateWay: "a", Type: string(models.Withdraw), Amount: 10, Currency: "USD", Status: string(models.Processing), RetryCount: 2,
+	}))
+	bus := messaging.NewMemoryBus(1)
+	gateWays := map[string]gateways.PaymentGateway{"a": fakeGateway{status: string(models.Failed), reference: "A-1", failureCode: models.FailureInsufficientFunds}}
+	processor := NewCallbackProcessor(cfg, transactions, bus.Publisher(), gateWays)
+
+	err := processor.Process(context.Background(), events.GatewayCallbackReceived{TransactionId: "12345", Body: `{}`})
+	require.NoError(t, err)
+	stored, err := transactions.Get(context.Background(), "12345")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Failed), stored.Status)
+	assert.Equal(t, "A-1", stored.GatewayReference)
+	assert.Equal(t, string(models.FailureInsufficientFunds), stored.FailureCode)
+	assert.NotEmpty(t, stored.FailureMessage)
+
+	messages := bus.Messages("pay.dispatcher")
+	require.Len(t, messages, 1)
+	var changed events.PaymentStatusChanged
+	require.NoError(t, events.DecodeMessage(&messages[0], &changed))
+	assert.Equal(t, 2, changed.Attempts)
+	assert.Equal(t, "A-1", changed.GatewayReference)
+	assert.Equal(t, stored.FailureCode, changed.FailureCode)
+
+	lifecycle := bus.Messages("payments.events")
+	require.Len(t, lifecycle, 1)
+	var failed events.TransactionFailed
+	require.NoError(t, events.DecodeMessage(&lifecycle[0], &failed))
+	assert.Equal(t, stored.FailureCode, failed.FailureCode)
+}
+
+func TestCallbackProcessor_Process_Settled(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.KafkaTopics.DispatcherTopic = "pay.dispatcher"
+	cfg.KafkaTopics.EventsTopic = "payments.events"
+	transactions := store.NewMemoryTransactionRepository()
+	require.NoError(t, transactions.Create(context.Background(), &models.Transaction{
+		TransactionId: "12345", GateWay: "a", Type: string(models.Deposit), Amount: 10, Currency: "USD", Status: string(models.Failed),
+	}))
+	bus := messaging.NewMemoryBus(1)
+	gateWays := map[string]gateways.PaymentGateway{"a": fakeGateway{status: string(models.Successful)}}
+	processor := NewCallbackProcessor(cfg, transactions, bus.Publisher(), gateWays)
+
+	err := processor.Process(context.Background(), events.GatewayCallbackReceived{TransactionId: "12345", Body: `{}`})
+	require.NoError(t, err)
+	stored, err := transactions.Get(context.Background(), "12345")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Failed), stored.Status)
+	// the events are published again, with the status the transaction has
+	messages := bus.Messages("pay.dispatcher")
+	require.Len(t, messages, 1)
+	var changed events.PaymentStatusChanged
+	require.NoError(t, events.DecodeMessage(&messages[0], &changed))
+	assert.Equal(t, string(models.Failed), changed.Status)
+	// the failed event has the id it had the first time
+	lifecycle := bus.Messages("payments.events")
+	require.Len(t, lifecycle, 1)
+	var failed events.TransactionFailed
+	require.NoError(t, events.DecodeMessage(&lifecycle[0], &failed))
+	assert.Equal(t, events.NewTransactionFailed(stored, time.Now()).EventId, failed.EventId)
+}
+
+// failingPublisher fails the first publish to topic.
+type failingPublisher struct {
+	messaging.Publisher
+	topic  string
+	failed bool
+}
+
+func (p *failingPublisher) Publish(ctx context.Context, msg *messaging.Message) error {
+	if msg.Topic == p.topic && !p.failed {
+		p.failed = true
+		return errors.New("broker unavailable")
+	}
+	return p.Publisher.Publish(ctx, msg)
+}
+
+func TestCallbackProcessor_Process_DispatcherPublishFails(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.KafkaTopics.DispatcherTopic = "pay.dispatcher"
+	cfg.KafkaTopics.EventsTopic = "payments.events"
+	transactions := store.NewMemoryTransactionRepository()
+	require.NoError(t, transactions.Create(context.Background(), &models.Transaction{
+		TransactionId: "12345", GateWay: "a", Type: string(models.Deposit), Amount: 10, Currency: "USD", Status: string(models.Processing),
+	}))
+	bus := messaging.NewMemoryBus(1)
+	gateWays := map[string]gateways.PaymentGateway{"a": fakeGateway{status: string(models.Successful)}}
+	publisher := &failingPublisher{Publisher: bus.Publisher(), topic: "pay.dispatcher"}
+	processor := NewCallbackProcessor(cfg, transactions, publisher, gateWays)
+
+	callback := events.GatewayCallbackReceived{TransactionId: "12345", Body: `{}`}
+	require.Error(t, processor.Process(context.Background(), callback))
+	stored, err := transactions.Get(context.Background(), "12345")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Successful), stored.Status, "the transaction is settled before publishing")
+	assert.Empty(t, bus.Messages("pay.dispatcher"))
+
+	// the callback is redelivered
+	require.NoError(t, processor.Process(context.Background(), callback))
+	messages := bus.Messages("pay.dispatcher")
+	require.Len(t, messages, 1, "the client is notified after all")
+	var changed events.PaymentStatusChanged
+	require.NoError(t, events.DecodeMessage(&messages[0], &changed))
+	assert.Equal(t, string(models.Successful), changed.Status)
+	assert.Equal(t, *stored.UpdatedAt, changed.ChangedAt)
+	lifecycle := bus.Messages("payments.events")
+	require.Len(t, lifecycle, 1)
+	var succeeded events.TransactionSucceeded
+	require.NoError(t, events.DecodeMessage(&lifecycle[0], &succeeded))
+}
+
+func TestCallbackProcessor_Process_CancelsScheduledRetry(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.KafkaTopics.DispatcherTopic = "pay.dispatcher"
+	cfg.KafkaTopics.EventsTopic = "payments.events"
+	transactions := store.NewMemoryTransactionRepository()
+	nextAttemptAt := time.Now().Add(time.Minute)
+	// the gateway call timed out, but the gateway went on to settle the payment
+	require.NoError(t, transactions.Create(context.Background(), &models.Transaction{
+		TransactionId: "12345", GateWay: "a", Type: string(models.Deposit), Amount: 10, Currency: "USD", Status: string(models.Pending), NextAttemptAt: &nextAttemptAt,
+		FailureCode: string(models.FailureGatewayTimeout), FailureMessage: "hystrix: timeout",
+	}))
+	gateWays := map[string]gateways.PaymentGateway{"a": fakeGateway{status: string(models.Successful)}}
+	processor := NewCallbackProcessor(cfg, transactions, messaging.NewMemoryBus(1).Publisher(), gateWays)
+
+	err := processor.Process(context.Background(), events.GatewayCallbackReceived{TransactionId: "12345", Body: `{}`})
+	require.NoError(t, err)
+	stored, err := transactions.Get(context.Background(), "12345")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Successful), stored.Status)
+	assert.Nil(t, stored.NextAttemptAt)
+	assert.Empty(t, stored.FailureCode, "the failed attempt is no longer reported")
+	assert.Empty(t, stored.FailureMessage)
+}
+
+func TestCallbackProcessor_Process_UnknownTransaction(t *testing.T) {
+	processor := NewCallbackProcessor(&config.Config{}, store.NewMemoryTransactionRepository(), messaging.NewMemoryBus(1).Publisher(), nil)
+	err := processor.Process(context.Background(), events.GatewayCallbackReceived{TransactionId: "12345"})
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestCallbackProcessor_Process_Malformed(t *testing.T) {
+	transactions := store.NewMemoryTransactionRepository()
+	require.NoError(t, transactions.Create(context.Background(), &models.Transaction{
+		TransactionId: "12345", GateWay: "a", Type: string(models.Deposit), Amount: 10, Currency: "USD", Status: string(models.Processing),
+	}))
+	gateWays := map[string]gateways.PaymentGateway{"a": fakeGateway{err: fmt.Errorf("%w: no transaction id", gateways.ErrMalformedCallback)}}
+	processor := NewCallbackProcessor(&config.Config{}, transactions, messaging.NewMemoryBus(1).Publisher(), gateWays)
+
+	err := processor.Process(context.Background(), events.GatewayCallbackReceived{TransactionId: "12345", Body: `{}`})
+	assert.True(t, worker.IsPermanent(err), "a malformed callback fails the same way again")
+	stored, err := transactions.Get(context.Background(), "12345")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Processing), stored.Status)
+}
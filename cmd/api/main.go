@@ -3,62 +3,74 @@ package main
 import (
 	"context"
 	"errors"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"payments/api"
+	"payments/audit"
 	"payments/config"
+	"payments/encryption"
+	"payments/health"
+	"payments/logging"
+	"payments/messaging/kafka"
+	"payments/store"
+	"payments/tracing"
 	"payments/utils"
 	"syscall"
 	"time"
 )
 
 func main() {
-	router := chi.NewRouter()
-	router.Use(middleware.RequestID)
-	router.Use(middleware.Logger)
-	router.Use(middleware.Recoverer)
+	logger := logging.Component("main")
 	cfg, err := config.ReadConfig()
 	if err != nil {
-		log.Fatalf("failed to read config file %v", err)
+		logger.Fatal().Err(err).Msg("Failed to read config")
 	}
-	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": cfg.Kafka.Server})
+	logging.Init(cfg, "api")
+	logger = logging.Component("main")
+	shutdownTracing, err := tracing.Init("api", cfg.Tracing.Exporter)
 	if err != nil {
-		log.Fatalf("failed to create kafka producer: %v", err)
+		logger.Fatal().Err(err).Msg("Failed to set up tracing")
 	}
-	defer producer.Close()
+	defer shutdownTracing(context.Background())
+	publisher, err := kafka.NewPublisher(cfg.Kafka.Server, cfg.Kafka.FlushTimeout)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create kafka producer")
+	}
+	defer publisher.Close()
 	dbConn := utils.NewDbConnection(cfg)
-	availableGateways := map[string]bool{"a": true, "b": true}
-	handler := api.NewHandler(cfg, producer, dbConn, availableGateways)
-	router.Post("/register", handler.Register)
-	router.Post("/deposit", handler.Deposit)
-	router.Post("/withdraw", handler.Withdraw)
-	router.Get("/status/{transaction_id}", handler.CheckStatus)
-	router.Post("/callback/{transaction_id}", handler.PaymentCallback)
+	availableGateways := map[string]bool{"a": true, "b": true, "c": true}
+	cipher, err := encryption.NewLocalCipher(cfg.Encryption.KeyFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to read encryption keys")
+	}
+	auditLog := audit.NewLog(store.NewPostgresAuditRepository(dbConn), audit.SystemActor("api"))
+	transactions := audit.NewTransactions(encryption.NewTransactions(store.NewPostgresTransactionRepository(dbConn), cipher), auditLog)
+	users := audit.NewUsers(encryption.NewUsers(store.NewPostgresUserRepository(dbConn), cipher), auditLog)
+	handler := api.NewHandler(cfg, publisher, transactions, users, auditLog, availableGateways)
+	checker := health.NewChecker()
+	checker.AddCheck("postgres", health.PostgresCheck(dbConn))
+	checker.AddCheck("kafka", health.BrokerCheck(publisher))
 
 	srv := &http.Server{
 		Addr:    ":8080",
-		Handler: router,
+		Handler: api.NewRouter(handler, checker),
 	}
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("Server error: %v", err)
+			logger.Fatal().Err(err).Msg("Server error")
 		}
 	}()
-	log.Println("Server is running on :8080")
+	logger.Info().Str("addr", srv.Addr).Msg("Server is running")
 	<-stop
-	log.Println("Shutting down gracefully...")
+	logger.Info().Msg("Shutting down gracefully")
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		logger.Fatal().Err(err).Msg("Server forced to shutdown")
 	}
 
-	log.Println("Server stopped")
+	logger.Info().Msg("Server stopped")
 }
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
-	"github.com/afex/hystrix-go/hystrix"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"log"
+	"context"
 	"payments/callback_dispatcher"
 	"payments/config"
-	"payments/models"
-	"payments/utils"
+	"payments/health"
+	"payments/logging"
+	"payments/messaging/kafka"
+	"payments/tracing"
+	"payments/worker"
 )
 
 func main() {
@@ -17,54 +16,33 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	consumer, err := utils.NewConsumer(cfg.Kafka.Server, config.DispatcherConsumerGroup)
+	logging.Init(cfg, "callback_dispatcher")
+	shutdownTracing, err := tracing.Init("callback_dispatcher", cfg.Tracing.Exporter)
 	if err != nil {
 		panic(err)
 	}
-	err = consumer.Subscribe(cfg.KafkaTopics.DispatcherTopic, nil)
+	defer shutdownTracing(context.Background())
+	subscriber, err := kafka.NewSubscriber(cfg.Kafka.Server, cfg.Kafka.ConsumerGroups.Dispatcher)
 	if err != nil {
 		panic(err)
 	}
-	processor := callback_dispatcher.NewCallbackDispatcher()
-	for {
-		msg, err := consumer.ReadMessage(-1)
-		if err != nil {
-			var kafkaError kafka.Error
-			if errors.As(err, &kafkaError) && kafkaError.Code() == kafka.ErrTimedOut {
-				continue // No message received, keep polling
-			}
-			log.Printf("Error reading message from Kafka topic %s: %v", cfg.KafkaTopics.TransactionTopic, err)
-			continue
-		}
-		log.Printf("Message on %s: %s\n", msg.TopicPartition, string(msg.Value))
-		var callbackPayload models.Transaction
-		err = json.Unmarshal(msg.Value, &callbackPayload)
-		if err != nil {
-			log.Printf("Error unmarshalling transaction: %v", err)
-			continue
-		}
-		if callbackPayload.ClientCallback == "" {
-			continue
-		}
-		domain, err := utils.ExtractDomain(callbackPayload.ClientCallback)
-		if err != nil {
-			log.Printf("Error extracting domain: %v : %v", callbackPayload.ClientCallback, err)
-			continue
-		}
-		// set up circuit breaker to client domain
-		hystrix.ConfigureCommand(
-			domain,
-			hystrix.CommandConfig{
-				Timeout:               config.GateWayTimeout,
-				MaxConcurrentRequests: config.MaxConcurrentRequests,
-				ErrorPercentThreshold: config.ErrorPercentThreshold,
-				SleepWindow:           config.CircuitBreakSleepWindow,
-			},
-		)
-		hystrix.Go(domain, func() error {
-			err := processor.Process(callbackPayload)
-			return err
-		}, nil)
+	// only used to dead-letter callbacks the client keeps rejecting
+	publisher, err := kafka.NewPublisher(cfg.Kafka.Server, cfg.Kafka.FlushTimeout)
+	if err != nil {
+		panic(err)
+	}
+	cfg.WatchReload(logging.Component("config"), func() {}) // client domain commands are configured per message
+	checker := health.NewChecker()
+	checker.AddCheck("kafka", health.BrokerCheck(subscriber))
+	checker.AddDegradedCheck("kafka_assignment", health.ConsumerAssignmentCheck(subscriber))
+	processor := callback_dispatcher.NewCallbackDispatcher(cfg, checker)
+	healthServer := health.Serve(cfg.Health.Addr, checker)
 
+	runtime := worker.NewRuntime("callback_dispatcher", subscriber, publisher, worker.NewOptions(cfg))
+	runtime.OnShutdown(healthServer.Shutdown)
+	err = runtime.Run(cfg.KafkaTopics.DispatcherTopic, processor.HandleMessage)
+	if err != nil {
+		logger := logging.Component("main")
+		logger.Error().Err(err).Msg("Error shutting down")
 	}
 }
@@ -1,15 +1,19 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"log"
-	"payments/api"
+	"context"
+	"payments/audit"
 	"payments/callback_processor"
 	"payments/config"
+	"payments/encryption"
 	"payments/gateways"
+	"payments/health"
+	"payments/logging"
+	"payments/messaging/kafka"
+	"payments/store"
+	"payments/tracing"
 	"payments/utils"
+	"payments/worker"
 )
 
 func main() {
@@ -17,43 +21,43 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	consumer, err := utils.NewConsumer(cfg.Kafka.Server, config.CallbackConsumerGroup)
+	logging.Init(cfg, "callback_processor")
+	logger := logging.Component("main")
+	shutdownTracing, err := tracing.Init("callback_processor", cfg.Tracing.Exporter)
 	if err != nil {
 		panic(err)
 	}
-	err = consumer.Subscribe(cfg.KafkaTopics.CallbackTopic, nil)
+	defer shutdownTracing(context.Background())
+	subscriber, err := kafka.NewSubscriber(cfg.Kafka.Server, cfg.Kafka.ConsumerGroups.Callback)
 	if err != nil {
 		panic(err)
 	}
-	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": cfg.Kafka.Server})
+	publisher, err := kafka.NewPublisher(cfg.Kafka.Server, cfg.Kafka.FlushTimeout)
 	if err != nil {
 		panic(err)
 	}
 	db := utils.NewDbConnection(cfg)
-	rdb := utils.NewRedisConnection(cfg)
-	gateWays := map[string]gateways.PaymentGateway{
-		"a": gateways.NewGateWayA(cfg.Network.GateWayAUrl, "/withdraw", "/deposit", cfg.Network.CallbackPrefix),
-		"b": gateways.NewGateWayB(cfg.Network.GateWayBUrl, cfg.Network.CallbackPrefix),
+	cipher, err := encryption.NewLocalCipher(cfg.Encryption.KeyFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to read encryption keys")
+	}
+	auditLog := audit.NewLog(store.NewPostgresAuditRepository(db), audit.SystemActor("callback_processor"))
+	transactions := audit.NewTransactions(encryption.NewTransactions(store.NewPostgresTransactionRepository(db), cipher), auditLog)
+	gateWays, err := gateways.New(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to set up gateways")
 	}
-	processor := callback_processor.NewCallbackProcessor(cfg, db, rdb, producer, gateWays)
-	for {
-		msg, err := consumer.ReadMessage(-1)
-		if err != nil {
-			var kafkaError kafka.Error
-			if errors.As(err, &kafkaError) && kafkaError.Code() == kafka.ErrTimedOut {
-				continue // No message received, keep polling
-			}
-			log.Printf("Error reading message from Kafka topic %s: %v", cfg.KafkaTopics.TransactionTopic, err)
-			continue
-		}
-		log.Printf("Message on %s: %s\n", msg.TopicPartition, string(msg.Value))
-		var callbackPayload api.CallbackPayload
-		err = json.Unmarshal(msg.Value, &callbackPayload)
-		if err != nil {
-			log.Printf("Error unmarshalling transaction: %v", err)
-			continue
-		}
-		go processor.Process(callbackPayload)
+	processor := callback_processor.NewCallbackProcessor(cfg, transactions, publisher, gateWays)
+	checker := health.NewChecker()
+	checker.AddCheck("postgres", health.PostgresCheck(db))
+	checker.AddCheck("kafka", health.BrokerCheck(subscriber))
+	checker.AddDegradedCheck("kafka_assignment", health.ConsumerAssignmentCheck(subscriber))
+	healthServer := health.Serve(cfg.Health.Addr, checker)
 
+	runtime := worker.NewRuntime("callback_processor", subscriber, publisher, worker.NewOptions(cfg))
+	runtime.OnShutdown(healthServer.Shutdown)
+	err = runtime.Run(cfg.KafkaTopics.CallbackTopic, processor.HandleMessage)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error shutting down")
 	}
 }
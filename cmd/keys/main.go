@@ -0,0 +1,107 @@
+// Command keys manages the key file account ids are encrypted under and
+// re-encrypts stored account ids.
+//
+//	keys generate -file keys.json -key 2024-01
+//	keys rotate -file keys.json -key 2024-07
+//	keys reencrypt
+//	keys retire -file keys.json -key 2024-01
+//
+// reencrypt reads the database settings and ENCRYPTION_KEY_FILE from the
+// environment, like the services.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"payments/config"
+	"payments/encryption"
+	"payments/logging"
+	"payments/store"
+	"payments/utils"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	path := flags.String("file", os.Getenv("ENCRYPTION_KEY_FILE"), "key file")
+	keyId := flags.String("key", "", "key id")
+	flags.Parse(os.Args[2:])
+
+	var err error
+	switch os.Args[1] {
+	case "generate":
+		err = generate(*path, *keyId)
+	case "rotate":
+		err = updateKeyFile(*path, func(file *encryption.KeyFile) error {
+			return file.Rotate(*keyId)
+		})
+	case "retire":
+		err = updateKeyFile(*path, func(file *encryption.KeyFile) error {
+			return file.Retire(*keyId)
+		})
+	case "reencrypt":
+		err = reencrypt(context.Background(), *path)
+	default:
+		usage()
+	}
+	if err != nil {
+		logger := logging.Component("keys")
+		logger.Fatal().Err(err).Str("command", os.Args[1]).Msg("Command failed")
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: keys generate|rotate|retire|reencrypt [-file path] [-key id]")
+	os.Exit(2)
+}
+
+func generate(path, keyId string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	file, err := encryption.NewKeyFile(keyId)
+	if err != nil {
+		return err
+	}
+	return file.Write(path)
+}
+
+func updateKeyFile(path string, update func(*encryption.KeyFile) error) error {
+	file, err := encryption.ReadKeyFile(path)
+	if err != nil {
+		return err
+	}
+	err = update(file)
+	if err != nil {
+		return err
+	}
+	return file.Write(path)
+}
+
+func reencrypt(ctx context.Context, path string) error {
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		return err
+	}
+	cipher, err := encryption.NewLocalCipher(path)
+	if err != nil {
+		return err
+	}
+	db := utils.NewDbConnection(cfg)
+	defer db.Close()
+	users, err := encryption.Reencrypt(ctx, cipher, store.NewPostgresUserRepository(db), true)
+	if err != nil {
+		return err
+	}
+	transactions, err := encryption.Reencrypt(ctx, cipher, store.NewPostgresTransactionRepository(db), false)
+	if err != nil {
+		return err
+	}
+	logger := logging.Component("keys")
+	logger.Info().Int("users", users).Int("transactions", transactions).Msg("Re-encrypted the account ids")
+	return nil
+}
@@ -1,28 +1,23 @@
 package main
 
 import (
-	"encoding/xml"
-	"log"
+	"fmt"
 	"payments/gateways"
+	"payments/soap"
 )
 
 func main() {
-	withdrawReq := gateways.WithdrawEnvelope{
-		SoapEnv: "http://schemas.xmlsoap.org/soap/envelope/",
-		Web:     "http://example.com/",
-		Body: gateways.WithdrawBody{
-			Withdraw: gateways.WithdrawRequest{
-				Account:       "234556780987",
-				TransactionID: "xxxxxxxxx",
-				Amount:        100,
-				Currency:      "USD",
-			},
+	withdrawReq := gateways.WithdrawRequest{
+		PaymentRequest: gateways.PaymentRequest{
+			TransactionId: "xxxxxxxxx",
+			Account:       "234556780987",
+			Amount:        100,
+			Currency:      "USD",
 		},
 	}
-	req, err := xml.MarshalIndent(withdrawReq, "", "  ")
+	soapReq, err := soap.Marshal(soap.Envelope{Version: soap.V11, Body: withdrawReq})
 	if err != nil {
 		panic(err)
 	}
-	soapReq := append([]byte(xml.Header), req...)
-	log.Println(string(soapReq))
+	fmt.Println(string(soapReq))
 }
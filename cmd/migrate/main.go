@@ -0,0 +1,95 @@
+// Command migrate applies the migrations in sql/migrations to the database
+// configured by the PG_* environment variables, and rolls them back.
+//
+//	migrate up [-to version]
+//	migrate down [-steps n]
+//	migrate status
+//	migrate validate
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog"
+	"os"
+	"os/signal"
+	"payments/config"
+	"payments/logging"
+	"payments/sql/migrations"
+	"payments/utils"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	to := flags.Int("to", 0, "version to migrate up to, the latest if 0")
+	steps := flags.Int("steps", 1, "number of migrations to roll back")
+	flags.Parse(os.Args[2:])
+
+	logger := logging.Component("migrate")
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to read config")
+	}
+	logging.Init(cfg, "migrate")
+	logger = logging.Component("migrate")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	db := utils.NewDbConnection(cfg)
+	defer db.Close()
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to set up migrations")
+	}
+
+	switch os.Args[1] {
+	case "up":
+		applied, err := migrator.Up(ctx, *to)
+		report(logger, "applied", applied, err)
+	case "down":
+		rolledBack, err := migrator.Down(ctx, *steps)
+		report(logger, "rolled back", rolledBack, err)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to read migration status")
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\n", status.Migration, appliedAt)
+		}
+	case "validate":
+		err = migrator.Validate(ctx)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Invalid migrations")
+		}
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: migrate up [-to version] | down [-steps n] | status | validate")
+	os.Exit(2)
+}
+
+// report logs the migrations run before failing with err, if any.
+func report(logger zerolog.Logger, verb string, migrations []migrations.Migration, err error) {
+	for _, migration := range migrations {
+		logger.Info().Str("migration", migration.String()).Msg(verb)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Migration failed")
+	}
+	if len(migrations) == 0 {
+		logger.Info().Msg("nothing " + verb)
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"log"
+	"context"
+	"payments/audit"
 	"payments/config"
+	"payments/encryption"
 	"payments/gateways"
-	"payments/models"
+	"payments/health"
+	"payments/logging"
+	"payments/messaging/kafka"
 	"payments/payment_processor"
+	"payments/store"
+	"payments/tracing"
 	"payments/utils"
+	"payments/worker"
 )
 
 func main() {
@@ -17,48 +21,51 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	consumer, err := utils.NewConsumer(cfg.Kafka.Server, "transactions")
+	logging.Init(cfg, "payment_processor")
+	logger := logging.Component("main")
+	shutdownTracing, err := tracing.Init("payment_processor", cfg.Tracing.Exporter)
 	if err != nil {
 		panic(err)
 	}
-	err = consumer.Subscribe(cfg.KafkaTopics.TransactionTopic, nil)
+	defer shutdownTracing(context.Background())
+	subscriber, err := kafka.NewSubscriber(cfg.Kafka.Server, cfg.Kafka.ConsumerGroups.Transaction)
 	if err != nil {
 		panic(err)
 	}
-	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": cfg.Kafka.Server})
+	publisher, err := kafka.NewPublisher(cfg.Kafka.Server, cfg.Kafka.FlushTimeout)
 	if err != nil {
 		panic(err)
 	}
 	db := utils.NewDbConnection(cfg)
-	rdb := utils.NewRedisConnection(cfg)
-	gateWays := map[string]gateways.PaymentGateway{
-		"a": gateways.NewGateWayA(cfg.Network.GateWayAUrl, "/withdraw", "/deposit", cfg.Network.CallbackPrefix),
-		"b": gateways.NewGateWayB(cfg.Network.GateWayBUrl, cfg.Network.CallbackPrefix),
+	cipher, err := encryption.NewLocalCipher(cfg.Encryption.KeyFile)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to read encryption keys")
+	}
+	auditLog := audit.NewLog(store.NewPostgresAuditRepository(db), audit.SystemActor("payment_processor"))
+	transactions := audit.NewTransactions(encryption.NewTransactions(store.NewPostgresTransactionRepository(db), cipher), auditLog)
+	gateWays, err := gateways.New(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to set up gateways")
 	}
 
-	processor := payment_processor.NewPaymentProcessor(cfg, db, rdb, producer, gateWays)
-	for {
-		msg, err := consumer.ReadMessage(-1)
-
-		if err != nil {
-			var kafkaError kafka.Error
-			if errors.As(err, &kafkaError) && kafkaError.Code() == kafka.ErrTimedOut {
-				continue // No message received, keep polling
-			}
-			log.Printf("Error reading message from Kafka topic %s: %v", cfg.KafkaTopics.TransactionTopic, err)
-			continue
-		}
-		log.Printf("Message on %s: %s\n", msg.TopicPartition, string(msg.Value))
-		var transaction models.Transaction
-		err = json.Unmarshal(msg.Value, &transaction)
-		if err != nil {
-			log.Printf("Error unmarshalling transaction: %v", err)
-			continue
-		}
-		err = processor.Process(transaction) // process sequentially, launch goroutine downstream
-		if err != nil {
-			log.Printf("Error processing transaction: %s: %v", transaction.TransactionId, err)
-		}
+	processor := payment_processor.NewPaymentProcessor(cfg, transactions, publisher, gateWays)
+	cfg.WatchReload(logging.Component("config"), processor.ConfigureCommands)
+	checker := health.NewChecker()
+	checker.AddCheck("postgres", health.PostgresCheck(db))
+	checker.AddCheck("kafka", health.BrokerCheck(subscriber))
+	checker.AddDegradedCheck("kafka_assignment", health.ConsumerAssignmentCheck(subscriber))
+	for name := range gateWays {
+		checker.WatchCircuit(name)
+	}
+	healthServer := health.Serve(cfg.Health.Addr, checker)
 
+	scheduler := payment_processor.NewRetryScheduler(cfg, transactions, publisher)
+	scheduler.Start()
+	runtime := worker.NewRuntime("payment_processor", subscriber, publisher, worker.NewOptions(cfg))
+	runtime.OnShutdown(scheduler.Stop)
+	runtime.OnShutdown(healthServer.Shutdown)
+	err = runtime.Run(cfg.KafkaTopics.TransactionTopic, processor.HandleMessage)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error shutting down")
 	}
 }
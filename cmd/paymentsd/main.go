@@ -0,0 +1,197 @@
+// Command paymentsd runs the api, payment processor, callback processor and
+// callback dispatcher in one process for local development. Postgres is
+// embedded and Kafka is replaced by an in-memory bus, so nothing has to run
+// besides this binary.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"golang.org/x/sync/errgroup"
+	"net/http"
+	"os/signal"
+	"payments/api"
+	"payments/audit"
+	"payments/callback_dispatcher"
+	"payments/callback_processor"
+	"payments/config"
+	"payments/encryption"
+	"payments/gateways"
+	"payments/health"
+	"payments/logging"
+	"payments/messaging"
+	"payments/payment_processor"
+	"payments/sql/migrations"
+	"payments/store"
+	"payments/tracing"
+	"payments/utils"
+	"payments/worker"
+	"syscall"
+	"time"
+)
+
+func main() {
+	logger := logging.Component("main")
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to read config")
+	}
+	logging.Init(cfg, "paymentsd")
+	logger = logging.Component("main")
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	err = run(ctx, cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("paymentsd stopped")
+	}
+}
+
+// devDefaults fills in the settings the docker-compose files would otherwise provide.
+func devDefaults(cfg *config.Config) {
+	setDefault(&cfg.KafkaTopics.TransactionTopic, "pay.transaction")
+	setDefault(&cfg.KafkaTopics.CallbackTopic, "pay.callbacks")
+	setDefault(&cfg.KafkaTopics.DispatcherTopic, "pay.dispatcher")
+	setDefault(&cfg.Network.CallbackPrefix, "http://"+cfg.Dev.ApiAddr+"/callback")
+	setDefault(&cfg.Network.ReturnPrefix, "http://"+cfg.Dev.ApiAddr+"/return")
+	setDefault(&cfg.Network.GateWayAUrl, "http://a.gateway.com")
+	setDefault(&cfg.Network.GateWayBUrl, "http://b.gateway.com")
+	setDefault(&cfg.Network.GateWayCUrl, "http://c.gateway.com")
+	setDefault(&cfg.Database.Database, "exinity_payments")
+	setDefault(&cfg.Database.Username, "exinity")
+	setDefault(&cfg.Database.Password, "exinity")
+	cfg.Database.HostName = fmt.Sprintf("localhost:%d", cfg.Dev.PostgresPort)
+}
+
+func setDefault(value *string, def string) {
+	if *value == "" {
+		*value = def
+	}
+}
+
+// devCipher reads the keys from ENCRYPTION_KEY_FILE if set. Otherwise it
+// makes up keys that only last as long as the process, so account ids stored
+// in DEV_DATA_DIR cannot be read after a restart.
+func devCipher(cfg *config.Config) (*encryption.Cipher, error) {
+	if cfg.Encryption.KeyFile != "" {
+		return encryption.NewLocalCipher(cfg.Encryption.KeyFile)
+	}
+	file, err := encryption.NewKeyFile("dev")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := encryption.NewLocalKeyProvider(file)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.NewCipher(keys), nil
+}
+
+// run serves until ctx is cancelled, then drains the workers and stops Postgres.
+func run(ctx context.Context, cfg *config.Config) error {
+	devDefaults(cfg)
+	shutdownTracing, err := tracing.Init("paymentsd", cfg.Tracing.Exporter)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	postgresConfig := embeddedpostgres.DefaultConfig().
+		Port(cfg.Dev.PostgresPort).
+		Database(cfg.Database.Database).
+		Username(cfg.Database.Username).
+		Password(cfg.Database.Password)
+	if cfg.Dev.DataDir != "" {
+		postgresConfig = postgresConfig.DataPath(cfg.Dev.DataDir)
+	}
+	postgres := embeddedpostgres.NewDatabase(postgresConfig)
+	err = postgres.Start()
+	if err != nil {
+		return fmt.Errorf("starting embedded postgres: %w", err)
+	}
+	defer postgres.Stop()
+	db := utils.NewDbConnection(cfg)
+	defer db.Close()
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(ctx, 0)
+	if err != nil {
+		return err
+	}
+	cipher, err := devCipher(cfg)
+	if err != nil {
+		return err
+	}
+	auditEntries := store.NewPostgresAuditRepository(db)
+	// each component records its changes as its own actor
+	componentTransactions := func(component string) store.TransactionRepository {
+		transactions := encryption.NewTransactions(store.NewPostgresTransactionRepository(db), cipher)
+		return audit.NewTransactions(transactions, audit.NewLog(auditEntries, audit.SystemActor(component)))
+	}
+
+	bus := messaging.NewMemoryBus(cfg.Dev.Partitions)
+	gateWays, err := gateways.New(cfg)
+	if err != nil {
+		return fmt.Errorf("setting up gateways: %w", err)
+	}
+	checker := health.NewChecker()
+	checker.AddCheck("postgres", health.PostgresCheck(db))
+	for name := range gateWays {
+		checker.WatchCircuit(name)
+	}
+
+	paymentProcessor := payment_processor.NewPaymentProcessor(cfg, componentTransactions("payment_processor"), bus.Publisher(), gateWays)
+	cfg.WatchReload(logging.Component("config"), paymentProcessor.ConfigureCommands)
+	callbackProcessor := callback_processor.NewCallbackProcessor(cfg, componentTransactions("callback_processor"), bus.Publisher(), gateWays)
+	dispatcher := callback_dispatcher.NewCallbackDispatcher(cfg, checker)
+	scheduler := payment_processor.NewRetryScheduler(cfg, componentTransactions("payment_processor"), bus.Publisher())
+	scheduler.Start()
+	defer scheduler.Stop(context.Background())
+
+	auditLog := audit.NewLog(auditEntries, audit.SystemActor("api"))
+	users := audit.NewUsers(encryption.NewUsers(store.NewPostgresUserRepository(db), cipher), auditLog)
+	handler := api.NewHandler(cfg, bus.Publisher(), componentTransactions("api"), users, auditLog, map[string]bool{"a": true, "b": true, "c": true})
+	srv := &http.Server{
+		Addr:    cfg.Dev.ApiAddr,
+		Handler: api.NewRouter(handler, checker),
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	consumers := []struct {
+		name    string
+		group   string
+		topic   string
+		handler worker.Handler
+	}{
+		{"payment_processor", cfg.Kafka.ConsumerGroups.Transaction, cfg.KafkaTopics.TransactionTopic, paymentProcessor.HandleMessage},
+		{"callback_processor", cfg.Kafka.ConsumerGroups.Callback, cfg.KafkaTopics.CallbackTopic, callbackProcessor.HandleMessage},
+		{"callback_dispatcher", cfg.Kafka.ConsumerGroups.Dispatcher, cfg.KafkaTopics.DispatcherTopic, dispatcher.HandleMessage},
+	}
+	for _, consumer := range consumers {
+		subscriber := bus.Subscriber(consumer.group)
+		checker.AddDegradedCheck(consumer.name+"_assignment", health.ConsumerAssignmentCheck(subscriber))
+		runtime := worker.NewRuntime(consumer.name, subscriber, bus.Publisher(), worker.NewOptions(cfg))
+		group.Go(func() error {
+			return runtime.RunContext(ctx, consumer.topic, consumer.handler)
+		})
+	}
+	logger := logging.Component("main")
+	group.Go(func() error {
+		logger.Info().Str("addr", cfg.Dev.ApiAddr).Msg("Server is running")
+		err := srv.ListenAndServe()
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	})
+	group.Go(func() error {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	})
+	return group.Wait()
+}
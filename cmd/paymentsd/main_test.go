@@ -0,0 +1,87 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"payments/api"
+	"payments/config"
+	"payments/models"
+	"testing"
+	"time"
+)
+
+func TestDepositFlow(t *testing.T) {
+	cfg, err := config.ReadConfig()
+	require.NoError(t, err)
+	cfg.Dev.ApiAddr = "localhost:18080"
+	cfg.Dev.PostgresPort = 15433
+	cfg.Dev.DataDir = t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, cfg)
+	}()
+	baseUrl := "http://" + cfg.Dev.ApiAddr
+	waitReady(t, baseUrl, done)
+
+	var user api.RegisterResp
+	post(t, baseUrl+"/register", api.RegisterReq{GateWay: "a", AccountId: "234556780987"}, http.StatusCreated, &user)
+	var payment api.PaymentResponse
+	post(t, baseUrl+"/deposit", api.PaymentRequest{Amount: 100, Currency: "USD", UserGuid: user.UserGuid}, http.StatusAccepted, &payment)
+
+	// the simulated gateway fails some calls and settles the rest at random
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(baseUrl + "/status/" + payment.TransactionId)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		var status api.PaymentResponse
+		if json.NewDecoder(resp.Body).Decode(&status) != nil {
+			return false
+		}
+		return status.Status == string(models.Successful) || status.Status == string(models.Failed)
+	}, time.Minute, 500*time.Millisecond, "transaction was not settled")
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+// waitReady fails the test if run returns before the api reports ready.
+func waitReady(t *testing.T, baseUrl string, done <-chan error) {
+	// the first run downloads the postgres binaries
+	deadline := time.After(2 * time.Minute)
+	for {
+		select {
+		case err := <-done:
+			t.Fatalf("paymentsd stopped: %v", err)
+		case <-deadline:
+			t.Fatal("paymentsd did not become ready")
+		case <-time.After(500 * time.Millisecond):
+		}
+		resp, err := http.Get(baseUrl + "/readyz")
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return
+		}
+	}
+}
+
+func post(t *testing.T, url string, body any, status int, out any) {
+	jsonData, err := json.Marshal(body)
+	require.NoError(t, err)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, status, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+}
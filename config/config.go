@@ -1,15 +1,31 @@
 package config
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"errors"
+	"fmt"
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sync"
+	"time"
+)
 
 type Config struct {
 	KafkaTopics struct {
 		TransactionTopic string `envconfig:"TRANSACTION_TOPIC"`
 		CallbackTopic    string `envconfig:"CALLBACK_TOPIC"`
 		DispatcherTopic  string `envconfig:"DISPATCHER_TOPIC"`
+		DeadLetterTopic  string `envconfig:"DEAD_LETTER_TOPIC" default:"pay.dlq"`
+		EventsTopic      string `envconfig:"EVENTS_TOPIC" default:"payments.events"`
 	}
 	Kafka struct {
-		Server string `envconfig:"KAFKA_SERVER"`
+		Server         string `envconfig:"KAFKA_SERVER"`
+		FlushTimeout   int    `envconfig:"KAFKA_FLUSH_TIMEOUT" default:"1000"`
+		ConsumerGroups struct {
+			Transaction string `envconfig:"TRANSACTION_CONSUMER_GROUP" default:"transactions"`
+			Callback    string `envconfig:"CALLBACK_CONSUMER_GROUP" default:"callback_group"`
+			Dispatcher  string `envconfig:"DISPATCHER_CONSUMER_GROUP" default:"dispatcher_consumer"`
+		}
 	}
 	Database struct {
 		HostName string `envconfig:"PG_HOST"`
@@ -17,23 +33,131 @@ type Config struct {
 		Username string `envconfig:"PG_USER"`
 		Password string `envconfig:"PG_PASSWORD"`
 	}
-	Redis struct {
-		HostName string `envconfig:"REDIS_HOST"`
-		Password string `envconfig:"REDIS_PASSWORD"`
-		Username string `envconfig:"REDIS_USER"`
-	}
 	Network struct {
 		CallbackPrefix string `envconfig:"API_CALLBACK_PREFIX"`
-		GateWayAUrl    string `envconfig:"GATEWAY_A_URL"`
-		GateWayBUrl    string `envconfig:"GATEWAY_B_URL"`
+		// ReturnPrefix is where card gateways send customers back to after
+		// a 3-D Secure challenge, followed by the transaction id.
+		ReturnPrefix string `envconfig:"API_RETURN_PREFIX"`
+		GateWayAUrl  string `envconfig:"GATEWAY_A_URL"`
+		GateWayBUrl  string `envconfig:"GATEWAY_B_URL"`
+		GateWayCUrl  string `envconfig:"GATEWAY_C_URL"`
+		// SimulateGateWays answers the calls to the gateways' endpoints
+		// in-process and has them send callbacks of their own, see
+		// gateways/simulator.go.
+		SimulateGateWays bool `envconfig:"SIMULATE_GATEWAYS" default:"true"`
+	}
+	Auth struct {
+		// ApiKeys identify the callers in the audit log, any other key is
+		// recorded as anonymous.
+		ApiKeys []string `envconfig:"API_KEYS"`
+		// AdminKeys grant access to the audit log, which is closed without them.
+		AdminKeys []string `envconfig:"ADMIN_API_KEYS"`
+	}
+	GateWayB struct {
+		// Username and Password authenticate calls to gateway B with a
+		// WS-Security UsernameToken, which is left out without a username.
+		Username       string `envconfig:"GATEWAY_B_USERNAME"`
+		Password       string `envconfig:"GATEWAY_B_PASSWORD"`
+		PasswordDigest bool   `envconfig:"GATEWAY_B_PASSWORD_DIGEST" default:"true"`
+		// TimestampTTL is how long a call stays valid, 0 to send no Timestamp.
+		TimestampTTL time.Duration `envconfig:"GATEWAY_B_TIMESTAMP_TTL" default:"5m"`
+		// SOAPVersion is the version of SOAP gateway B speaks, 1.1 or 1.2.
+		SOAPVersion string `envconfig:"GATEWAY_B_SOAP_VERSION" default:"1.1"`
+	}
+	Resilience     Resilience  `yaml:"resilience"`
+	GateWayClients HTTPClients `yaml:"gateway_clients"`
+	Retry          struct {
+		PollInterval time.Duration `envconfig:"RETRY_POLL_INTERVAL" default:"1s"`
+		BatchSize    int           `envconfig:"RETRY_BATCH_SIZE" default:"100"`
+		// RecoveryDelay is how long after its creation the retry scheduler
+		// submits a transaction whose payment request was lost.
+		RecoveryDelay time.Duration `envconfig:"RETRY_RECOVERY_DELAY" default:"1m"`
+		// ActionTimeout is how long a card payment waits for the customer to
+		// pass its 3-D Secure challenge before the retry scheduler fails it.
+		ActionTimeout time.Duration `envconfig:"RETRY_ACTION_TIMEOUT" default:"30m"`
+	}
+	Worker struct {
+		ShutdownTimeout         time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
+		MaxInFlightPerPartition int           `envconfig:"MAX_IN_FLIGHT_PER_PARTITION" default:"8"`
+		MaxAttempts             int           `envconfig:"MAX_MESSAGE_ATTEMPTS" default:"3"`
+	}
+	Health struct {
+		Addr string `envconfig:"HEALTH_ADDR" default:":8081"`
+	}
+	Tracing struct {
+		Exporter string `envconfig:"TRACING_EXPORTER" default:"none"`
 	}
+	Logging    Logging `yaml:"logging"`
+	Encryption struct {
+		// KeyFile holds the keys account ids are encrypted under, see cmd/keys.
+		KeyFile string `envconfig:"ENCRYPTION_KEY_FILE"`
+	}
+	// Dev only applies to cmd/paymentsd, which runs every service in one process.
+	Dev struct {
+		ApiAddr      string `envconfig:"DEV_API_ADDR" default:"localhost:8080"`
+		PostgresPort uint32 `envconfig:"DEV_PG_PORT" default:"5433"`
+		DataDir      string `envconfig:"DEV_DATA_DIR"`
+		Partitions   int    `envconfig:"DEV_PARTITIONS" default:"4"`
+	}
+	File string `envconfig:"CONFIG_FILE" yaml:"-"`
+
+	mu sync.RWMutex
 }
 
+// ReadConfig reads the environment, then the YAML file named by CONFIG_FILE if
+// set. Values in the file take precedence over the environment.
 func ReadConfig() (*Config, error) {
 	var config Config
 	err := envconfig.Process("", &config)
 	if err != nil {
 		return nil, err
 	}
+	if config.File != "" {
+		data, err := os.ReadFile(config.File)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", config.File, err)
+		}
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
+
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Kafka.FlushTimeout <= 0 {
+		errs = append(errs, errors.New("kafka flush timeout must be positive"))
+	}
+	if c.Worker.MaxInFlightPerPartition <= 0 {
+		errs = append(errs, errors.New("max in-flight messages per partition must be positive"))
+	}
+	if c.Worker.MaxAttempts <= 0 {
+		errs = append(errs, errors.New("max message attempts must be positive"))
+	}
+	if c.Retry.PollInterval <= 0 {
+		errs = append(errs, errors.New("retry poll interval must be positive"))
+	}
+	if c.Retry.RecoveryDelay <= 0 {
+		errs = append(errs, errors.New("retry recovery delay must be positive"))
+	}
+	if c.Retry.ActionTimeout <= 0 {
+		errs = append(errs, errors.New("retry action timeout must be positive"))
+	}
+	if c.GateWayB.SOAPVersion != "1.1" && c.GateWayB.SOAPVersion != "1.2" {
+		errs = append(errs, fmt.Errorf("gateway b soap version must be 1.1 or 1.2, not %q", c.GateWayB.SOAPVersion))
+	}
+	errs = append(errs, c.Resilience.validate()...)
+	errs = append(errs, c.GateWayClients.validate()...)
+	errs = append(errs, c.Logging.validate()...)
+	err := errors.Join(errs...)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadConfig_Defaults(t *testing.T) {
+	cfg, err := ReadConfig()
+	assert.NoError(t, err)
+
+	assert.Equal(t, CommandSettings{
+		Timeout:               1000,
+		MaxConcurrentRequests: 100,
+		ErrorPercentThreshold: 25,
+		SleepWindow:           5000,
+		MaxRetries:            4,
+	}, cfg.GateWaySettings("a"))
+	assert.Equal(t, 1000, cfg.Kafka.FlushTimeout)
+	assert.Equal(t, "transactions", cfg.Kafka.ConsumerGroups.Transaction)
+	assert.Equal(t, "1.1", cfg.GateWayB.SOAPVersion)
+}
+
+func TestReadConfig_Overrides(t *testing.T) {
+	t.Setenv("MAX_CONCURRENT_REQUESTS", "50")
+	t.Setenv("CONFIG_FILE", filepath.Join("testdata", "resilience.yml"))
+	cfg, err := ReadConfig()
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		settings CommandSettings
+		expected CommandSettings
+	}{
+		{
+			name:     "Gateway without override uses file and env defaults",
+			settings: cfg.GateWaySettings("a"),
+			expected: CommandSettings{Timeout: 2000, MaxConcurrentRequests: 50, ErrorPercentThreshold: 25, SleepWindow: 5000, MaxRetries: 4},
+		},
+		{
+			name:     "Gateway override",
+			settings: cfg.GateWaySettings("b"),
+			expected: CommandSettings{Timeout: 3000, MaxConcurrentRequests: 50, ErrorPercentThreshold: 25, SleepWindow: 5000, MaxRetries: 6},
+		},
+		{
+			name:     "Client domain override",
+			settings: cfg.ClientDomainSettings("slow.example.com"),
+			expected: CommandSettings{Timeout: 5000, MaxConcurrentRequests: 50, ErrorPercentThreshold: 25, SleepWindow: 10000, MaxRetries: 4},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.settings)
+		})
+	}
+	assert.Equal(t, 6, cfg.MaxGateWayRetries("b"))
+	assert.Equal(t, 0, cfg.MaxGateWayRetries("c"), "a zero overrides the default")
+}
+
+func TestReadConfig_Invalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, os.WriteFile(file, []byte("resilience:\n  gate_ways:\n    a:\n      error_percent_threshold: 150\n"), 0o600))
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("GATEWAY_TIMEOUT", "-1")
+	t.Setenv("GATEWAY_B_SOAP_VERSION", "2")
+
+	_, err := ReadConfig()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "resilience.defaults: timeout must be positive")
+	assert.Contains(t, err.Error(), "resilience.gate_ways.a: error_percent_threshold must be between 1 and 100")
+	assert.Contains(t, err.Error(), `gateway b soap version must be 1.1 or 1.2, not "2"`)
+}
+
+func TestReadConfig_LogLevels(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("LOG_LEVELS", "payment_processor:debug")
+	cfg, err := ReadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, zerolog.DebugLevel, cfg.Logging.LogLevel("payment_processor"))
+	assert.Equal(t, zerolog.WarnLevel, cfg.Logging.LogLevel("api"))
+	assert.Contains(t, cfg.Logging.RedactFields, "account_id")
+
+	t.Setenv("LOG_LEVELS", "api:loud")
+	_, err = ReadConfig()
+	assert.ErrorContains(t, err, "logging.levels.api")
+}
+
+func TestReadConfig_GateWayClients(t *testing.T) {
+	t.Setenv("GATEWAY_PROXY", "http://proxy.internal:3128")
+	t.Setenv("CONFIG_FILE", filepath.Join("testdata", "gateway_clients.yml"))
+	cfg, err := ReadConfig()
+	assert.NoError(t, err)
+
+	a := cfg.GateWayClient("a")
+	assert.Equal(t, 10*time.Second, a.Timeout)
+	assert.Equal(t, time.Second, a.DialTimeout)
+	assert.Equal(t, "http://proxy.internal:3128", a.Proxy)
+	assert.Empty(t, a.CertFile)
+	b := cfg.GateWayClient("b")
+	assert.Equal(t, 20*time.Second, b.Timeout)
+	assert.Equal(t, time.Second, b.DialTimeout)
+	assert.Equal(t, "/etc/payments/gateway-b.key", b.KeyFile)
+
+	t.Setenv("GATEWAY_CERT_FILE", "/etc/payments/client.pem")
+	t.Setenv("GATEWAY_PROXY", "proxy.internal")
+	t.Setenv("GATEWAY_PINNED_CERTS", "not-a-hash")
+	t.Setenv("CONFIG_FILE", "")
+	_, err = ReadConfig()
+	assert.ErrorContains(t, err, "gateway_clients.defaults: cert_file and key_file go together")
+	assert.ErrorContains(t, err, "gateway_clients.defaults: invalid proxy")
+	assert.ErrorContains(t, err, `gateway_clients.defaults: pinned cert "not-a-hash"`)
+}
+
+func TestConfig_Reload(t *testing.T) {
+	cfg, err := ReadConfig()
+	assert.NoError(t, err)
+
+	t.Setenv("CONFIG_FILE", filepath.Join("testdata", "resilience.yml"))
+	assert.NoError(t, cfg.Reload())
+	assert.Equal(t, 3000, cfg.GateWaySettings("b").Timeout)
+
+	t.Setenv("GATEWAY_TIMEOUT", "0")
+	t.Setenv("CONFIG_FILE", "")
+	assert.Error(t, cfg.Reload())
+	assert.Equal(t, 3000, cfg.GateWaySettings("b").Timeout, "invalid config is not applied")
+}
+
+func TestConfig_Reload_ResilienceOnly(t *testing.T) {
+	cfg, err := ReadConfig()
+	assert.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "config.yml")
+	assert.NoError(t, os.WriteFile(file, []byte("resilience:\n  defaults:\n    timeout: 2000\ngateway_clients:\n  defaults:\n    timeout: 0s\n"), 0o600))
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("GATEWAY_B_SOAP_VERSION", "2")
+	assert.NoError(t, cfg.Reload(), "settings that need a restart are not read")
+	assert.Equal(t, 2000, cfg.GateWaySettings("a").Timeout)
+	assert.Equal(t, 10*time.Second, cfg.GateWayClient("a").Timeout)
+	assert.Equal(t, "1.1", cfg.GateWayB.SOAPVersion)
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// HTTPClient tunes the http client a gateway is called with. In overrides a
+// zero value inherits the default. The clients are built at startup, so
+// changes need a restart.
+type HTTPClient struct {
+	// Timeout caps a whole request, including reading the response. The
+	// hystrix timeout of the gateway usually cancels the request first.
+	Timeout               time.Duration `envconfig:"GATEWAY_HTTP_TIMEOUT" default:"10s" yaml:"timeout"`
+	DialTimeout           time.Duration `envconfig:"GATEWAY_DIAL_TIMEOUT" default:"3s" yaml:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration `envconfig:"GATEWAY_TLS_HANDSHAKE_TIMEOUT" default:"5s" yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `envconfig:"GATEWAY_RESPONSE_HEADER_TIMEOUT" default:"5s" yaml:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `envconfig:"GATEWAY_IDLE_CONN_TIMEOUT" default:"90s" yaml:"idle_conn_timeout"`
+	MaxIdleConnsPerHost   int           `envconfig:"GATEWAY_MAX_IDLE_CONNS_PER_HOST" default:"16" yaml:"max_idle_conns_per_host"`
+	// MaxConnsPerHost limits the connections open to the gateway, 0 for no limit.
+	MaxConnsPerHost int `envconfig:"GATEWAY_MAX_CONNS_PER_HOST" default:"64" yaml:"max_conns_per_host"`
+	// CAFile is a PEM bundle of the CAs the gateway's certificate is checked
+	// against instead of the system roots.
+	CAFile string `envconfig:"GATEWAY_CA_FILE" yaml:"ca_file"`
+	// CertFile and KeyFile are the PEM client certificate and key presented to
+	// gateways that require mutual TLS.
+	CertFile string `envconfig:"GATEWAY_CERT_FILE" yaml:"cert_file"`
+	KeyFile  string `envconfig:"GATEWAY_KEY_FILE" yaml:"key_file"`
+	// PinnedCerts are base64 SHA-256 hashes of public keys (SPKI), as in
+	// HPKP. If set, the gateway's certificate chain must hold one of them on
+	// top of being valid.
+	PinnedCerts []string `envconfig:"GATEWAY_PINNED_CERTS" yaml:"pinned_certs"`
+	// Proxy is the url of the proxy gateway calls go through. Without one the
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY variables apply.
+	Proxy string `envconfig:"GATEWAY_PROXY" yaml:"proxy"`
+}
+
+type HTTPClients struct {
+	Defaults HTTPClient            `yaml:"defaults"`
+	GateWays map[string]HTTPClient `ignored:"true" yaml:"gate_ways"`
+}
+
+func (c HTTPClient) merge(override HTTPClient) HTTPClient {
+	if override.Timeout != 0 {
+		c.Timeout = override.Timeout
+	}
+	if override.DialTimeout != 0 {
+		c.DialTimeout = override.DialTimeout
+	}
+	if override.TLSHandshakeTimeout != 0 {
+		c.TLSHandshakeTimeout = override.TLSHandshakeTimeout
+	}
+	if override.ResponseHeaderTimeout != 0 {
+		c.ResponseHeaderTimeout = override.ResponseHeaderTimeout
+	}
+	if override.IdleConnTimeout != 0 {
+		c.IdleConnTimeout = override.IdleConnTimeout
+	}
+	if override.MaxIdleConnsPerHost != 0 {
+		c.MaxIdleConnsPerHost = override.MaxIdleConnsPerHost
+	}
+	if override.MaxConnsPerHost != 0 {
+		c.MaxConnsPerHost = override.MaxConnsPerHost
+	}
+	if override.CAFile != "" {
+		c.CAFile = override.CAFile
+	}
+	if override.CertFile != "" {
+		c.CertFile = override.CertFile
+		c.KeyFile = override.KeyFile
+	}
+	if len(override.PinnedCerts) > 0 {
+		c.PinnedCerts = override.PinnedCerts
+	}
+	if override.Proxy != "" {
+		c.Proxy = override.Proxy
+	}
+	return c
+}
+
+func (c HTTPClient) validate(name string) []error {
+	var errs []error
+	timeouts := []struct {
+		field   string
+		timeout time.Duration
+	}{
+		{"timeout", c.Timeout},
+		{"dial_timeout", c.DialTimeout},
+		{"tls_handshake_timeout", c.TLSHandshakeTimeout},
+		{"response_header_timeout", c.ResponseHeaderTimeout},
+		{"idle_conn_timeout", c.IdleConnTimeout},
+	}
+	for _, t := range timeouts {
+		if t.timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: %s cannot be negative", name, t.field))
+		}
+	}
+	if c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		errs = append(errs, fmt.Errorf("%s: connection limits cannot be negative", name))
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s: cert_file and key_file go together", name))
+	}
+	for _, pin := range c.PinnedCerts {
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			errs = append(errs, fmt.Errorf("%s: pinned cert %q is not a base64 SHA-256 hash", name, pin))
+		}
+	}
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err == nil && proxy.Host == "" {
+			err = errors.New("no host")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid proxy: %w", name, err))
+		}
+	}
+	return errs
+}
+
+func (c HTTPClients) validate() []error {
+	errs := c.Defaults.validate("gateway_clients.defaults")
+	for name, override := range c.GateWays {
+		errs = append(errs, c.Defaults.merge(override).validate("gateway_clients.gate_ways."+name)...)
+	}
+	return errs
+}
+
+// GateWayClient returns the http client settings for gateWay.
+func (c *Config) GateWayClient(gateWay string) HTTPClient {
+	return c.GateWayClients.Defaults.merge(c.GateWayClients.GateWays[gateWay])
+}
@@ -1,7 +0,0 @@
-package config
-
-const GateWayTimeout = 1000
-const MaxConcurrentRequests = 100
-const ErrorPercentThreshold = 25
-const MaxGateWayRetries = 4
-const CircuitBreakSleepWindow = 5000
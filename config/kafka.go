@@ -1,5 +0,0 @@
-package config
-
-const FlushTimeout = 1000
-const CallbackConsumerGroup = "callback_group"
-const DispatcherConsumerGroup = "dispatcher_consumer"
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+)
+
+// Logging configures the logger every service writes through, see the logging package.
+type Logging struct {
+	// Level applies to components without a level of their own in Levels.
+	Level string `envconfig:"LOG_LEVEL" default:"info" yaml:"level"`
+	// Levels maps a component, such as payment_processor or api, to its level.
+	// In the environment it is written as payment_processor:debug,api:warn.
+	Levels map[string]string `envconfig:"LOG_LEVELS" yaml:"levels"`
+	// RedactFields are the log fields masked wherever they appear, compared
+	// case-insensitively.
+	RedactFields []string `envconfig:"LOG_REDACT_FIELDS" default:"account_id,account,account_number,card_number,pan,cvv,password,secret,token,api_key,authorization" yaml:"redact_fields"`
+}
+
+// LogLevel returns the level of component.
+func (l Logging) LogLevel(component string) zerolog.Level {
+	level, ok := l.Levels[component]
+	if !ok {
+		level = l.Level
+	}
+	parsed, err := zerolog.ParseLevel(level)
+	if err != nil {
+		// rejected by validate
+		return zerolog.InfoLevel
+	}
+	return parsed
+}
+
+func (l Logging) validate() []error {
+	var errs []error
+	_, err := zerolog.ParseLevel(l.Level)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("logging.level: %w", err))
+	}
+	for component, level := range l.Levels {
+		_, err = zerolog.ParseLevel(level)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logging.levels.%s: %w", component, err))
+		}
+	}
+	return errs
+}
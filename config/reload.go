@@ -0,0 +1,73 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Reload reads the resilience settings from the environment and config file
+// again and applies them. Everything else needs a restart to change, so the
+// rest of the file is not read.
+func (c *Config) Reload() error {
+	resilience, err := readResilience()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Resilience = resilience
+	return nil
+}
+
+// readResilience reads the resilience settings alone, from the environment and
+// the resilience section of the YAML file named by CONFIG_FILE if set.
+func readResilience() (Resilience, error) {
+	var fresh struct {
+		Resilience Resilience `yaml:"resilience"`
+		File       string     `envconfig:"CONFIG_FILE" yaml:"-"`
+	}
+	err := envconfig.Process("", &fresh)
+	if err != nil {
+		return Resilience{}, err
+	}
+	if fresh.File != "" {
+		data, err := os.ReadFile(fresh.File)
+		if err != nil {
+			return Resilience{}, err
+		}
+		err = yaml.Unmarshal(data, &fresh)
+		if err != nil {
+			return Resilience{}, fmt.Errorf("parsing %s: %w", fresh.File, err)
+		}
+	}
+	err = errors.Join(fresh.Resilience.validate()...)
+	if err != nil {
+		return Resilience{}, fmt.Errorf("invalid config: %w", err)
+	}
+	return fresh.Resilience, nil
+}
+
+// WatchReload reloads the config on SIGHUP and calls onReload after every
+// successful reload. An invalid config is logged to logger and the current one
+// is kept.
+func (c *Config) WatchReload(logger zerolog.Logger, onReload func()) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			err := c.Reload()
+			if err != nil {
+				logger.Error().Err(err).Msg("Keeping current config, reload failed")
+				continue
+			}
+			logger.Info().Msg("Config reloaded")
+			onReload()
+		}
+	}()
+}
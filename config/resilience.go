@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"github.com/afex/hystrix-go/hystrix"
+)
+
+// CommandSettings tunes the hystrix command wrapping calls to a gateway or to a
+// client's callback domain. Timeout and SleepWindow are in milliseconds.
+type CommandSettings struct {
+	Timeout               int `envconfig:"GATEWAY_TIMEOUT" default:"1000" yaml:"timeout"`
+	MaxConcurrentRequests int `envconfig:"MAX_CONCURRENT_REQUESTS" default:"100" yaml:"max_concurrent_requests"`
+	ErrorPercentThreshold int `envconfig:"ERROR_PERCENT_THRESHOLD" default:"25" yaml:"error_percent_threshold"`
+	SleepWindow           int `envconfig:"CIRCUIT_BREAK_SLEEP_WINDOW" default:"5000" yaml:"sleep_window"`
+	MaxRetries            int `envconfig:"MAX_GATEWAY_RETRIES" default:"4" yaml:"max_retries"`
+}
+
+// CommandOverrides overrides the default settings for one gateway or client
+// domain. A setting left out inherits the default, so a zero is a value of its
+// own, such as max_retries: 0 to never retry.
+type CommandOverrides struct {
+	Timeout               *int `yaml:"timeout"`
+	MaxConcurrentRequests *int `yaml:"max_concurrent_requests"`
+	ErrorPercentThreshold *int `yaml:"error_percent_threshold"`
+	SleepWindow           *int `yaml:"sleep_window"`
+	MaxRetries            *int `yaml:"max_retries"`
+}
+
+type Resilience struct {
+	Defaults      CommandSettings             `yaml:"defaults"`
+	GateWays      map[string]CommandOverrides `ignored:"true" yaml:"gate_ways"`
+	ClientDomains map[string]CommandOverrides `ignored:"true" yaml:"client_domains"`
+}
+
+func (s CommandSettings) merge(override CommandOverrides) CommandSettings {
+	if override.Timeout != nil {
+		s.Timeout = *override.Timeout
+	}
+	if override.MaxConcurrentRequests != nil {
+		s.MaxConcurrentRequests = *override.MaxConcurrentRequests
+	}
+	if override.ErrorPercentThreshold != nil {
+		s.ErrorPercentThreshold = *override.ErrorPercentThreshold
+	}
+	if override.SleepWindow != nil {
+		s.SleepWindow = *override.SleepWindow
+	}
+	if override.MaxRetries != nil {
+		s.MaxRetries = *override.MaxRetries
+	}
+	return s
+}
+
+func (s CommandSettings) validate(name string) []error {
+	var errs []error
+	if s.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("%s: timeout must be positive", name))
+	}
+	if s.MaxConcurrentRequests <= 0 {
+		errs = append(errs, fmt.Errorf("%s: max_concurrent_requests must be positive", name))
+	}
+	if s.ErrorPercentThreshold <= 0 || s.ErrorPercentThreshold > 100 {
+		errs = append(errs, fmt.Errorf("%s: error_percent_threshold must be between 1 and 100", name))
+	}
+	if s.SleepWindow <= 0 {
+		errs = append(errs, fmt.Errorf("%s: sleep_window must be positive", name))
+	}
+	if s.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("%s: max_retries cannot be negative", name))
+	}
+	return errs
+}
+
+func (s CommandSettings) HystrixConfig() hystrix.CommandConfig {
+	return hystrix.CommandConfig{
+		Timeout:               s.Timeout,
+		MaxConcurrentRequests: s.MaxConcurrentRequests,
+		ErrorPercentThreshold: s.ErrorPercentThreshold,
+		SleepWindow:           s.SleepWindow,
+	}
+}
+
+func (r Resilience) validate() []error {
+	errs := r.Defaults.validate("resilience.defaults")
+	for name, override := range r.GateWays {
+		errs = append(errs, r.Defaults.merge(override).validate("resilience.gate_ways."+name)...)
+	}
+	for domain, override := range r.ClientDomains {
+		errs = append(errs, r.Defaults.merge(override).validate("resilience.client_domains."+domain)...)
+	}
+	return errs
+}
+
+// GateWaySettings returns the command settings for gateWay.
+func (c *Config) GateWaySettings(gateWay string) CommandSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Resilience.Defaults.merge(c.Resilience.GateWays[gateWay])
+}
+
+// ClientDomainSettings returns the command settings for callbacks to domain.
+func (c *Config) ClientDomainSettings(domain string) CommandSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Resilience.Defaults.merge(c.Resilience.ClientDomains[domain])
+}
+
+// MaxGateWayRetries returns how many attempts a transaction gets on gateWay
+// before it is failed.
+func (c *Config) MaxGateWayRetries(gateWay string) int {
+	return c.GateWaySettings(gateWay).MaxRetries
+}
@@ -0,0 +1,168 @@
+// Package encryption encrypts the gateway account ids of users and
+// transactions at rest.
+//
+// Every value is encrypted under a data key of its own, which is stored
+// alongside it wrapped under a key encryption key held by a KeyProvider
+// (envelope encryption). Rotating the key encryption key only takes a new key
+// in the provider; Reencrypt moves existing values to it.
+//
+// Encrypted values cannot be compared, so users are looked up by a blind
+// index, an HMAC of the account id, and messages carry a token derived the
+// same way rather than the account id.
+package encryption
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// prefix starts every encrypted value, followed by the key id, the
+	// wrapped data key and the sealed value, separated by separator.
+	prefix    = "enc1"
+	separator = ":"
+	// tokenPrefix starts every token, telling them apart from account ids.
+	tokenPrefix = "tok_"
+)
+
+// ErrMalformed is returned for encrypted values that cannot be decrypted.
+var ErrMalformed = errors.New("encryption: malformed value")
+
+// Cipher encrypts values under data keys wrapped by a KeyProvider.
+type Cipher struct {
+	keys KeyProvider
+}
+
+func NewCipher(keys KeyProvider) *Cipher {
+	return &Cipher{keys: keys}
+}
+
+// NewLocalCipher returns a Cipher whose keys are read from the key file at path.
+func NewLocalCipher(path string) (*Cipher, error) {
+	file, err := ReadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := NewLocalKeyProvider(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(keys), nil
+}
+
+// IsEncrypted reports whether value was returned by Encrypt.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix+separator)
+}
+
+// Encrypt encrypts plaintext under a new data key.
+func (c *Cipher) Encrypt(ctx context.Context, plaintext string) (string, error) {
+	dataKey, err := randomKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	keyId, wrapped, err := c.keys.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("encryption: wrapping data key: %w", err)
+	}
+	return strings.Join([]string{
+		prefix,
+		keyId,
+		base64.RawURLEncoding.EncodeToString(wrapped),
+		base64.RawURLEncoding.EncodeToString(sealed),
+	}, separator), nil
+}
+
+// Decrypt decrypts what Encrypt returned. Values that are not encrypted,
+// written before encryption was introduced, are returned as they are.
+func (c *Cipher) Decrypt(ctx context.Context, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	keyId, wrapped, sealed, err := parse(value)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := c.keys.UnwrapKey(ctx, keyId, wrapped)
+	if err != nil {
+		return "", fmt.Errorf("encryption: unwrapping data key: %w", err)
+	}
+	plaintext, err := open(dataKey, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Reencrypt encrypts value again under the current key encryption key, and
+// encrypts values that are not encrypted yet. It reports false, returning
+// value as it is, if value already is encrypted under the current key.
+func (c *Cipher) Reencrypt(ctx context.Context, value string) (string, bool, error) {
+	current, err := c.keys.CurrentKeyId(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	if IsEncrypted(value) {
+		keyId, _, _, err := parse(value)
+		if err != nil {
+			return "", false, err
+		}
+		if keyId == current {
+			return value, false, nil
+		}
+	}
+	plaintext, err := c.Decrypt(ctx, value)
+	if err != nil {
+		return "", false, err
+	}
+	encrypted, err := c.Encrypt(ctx, plaintext)
+	if err != nil {
+		return "", false, err
+	}
+	return encrypted, true, nil
+}
+
+// BlindIndex returns the blind index of accountId, the same for the same
+// account id, to look up encrypted account ids by.
+func (c *Cipher) BlindIndex(ctx context.Context, accountId string) (string, error) {
+	mac, err := c.keys.MAC(ctx, []byte("account_index"+separator+accountId))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(mac), nil
+}
+
+// Token returns the token standing for accountId outside the services. Like
+// the blind index it is the same for the same account id and cannot be
+// reversed, but the two cannot be matched against each other.
+func (c *Cipher) Token(ctx context.Context, accountId string) (string, error) {
+	mac, err := c.keys.MAC(ctx, []byte("account_token"+separator+accountId))
+	if err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(mac[:18]), nil
+}
+
+func parse(value string) (keyId string, wrapped, sealed []byte, err error) {
+	parts := strings.Split(value, separator)
+	if len(parts) != 4 {
+		return "", nil, nil, ErrMalformed
+	}
+	wrapped, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, ErrMalformed
+	}
+	sealed, err = base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", nil, nil, ErrMalformed
+	}
+	return parts[1], wrapped, sealed, nil
+}
@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"payments/models"
+	"payments/store"
+	"testing"
+)
+
+func newTestCipher(t *testing.T) (*Cipher, *KeyFile) {
+	file, err := NewKeyFile("k1")
+	require.NoError(t, err)
+	keys, err := NewLocalKeyProvider(file)
+	require.NoError(t, err)
+	return NewCipher(keys), file
+}
+
+func TestCipher_Encrypt(t *testing.T) {
+	ctx := context.Background()
+	cipher, _ := newTestCipher(t)
+
+	first, err := cipher.Encrypt(ctx, "234556780987")
+	require.NoError(t, err)
+	second, err := cipher.Encrypt(ctx, "234556780987")
+	require.NoError(t, err)
+	assert.True(t, IsEncrypted(first))
+	assert.NotContains(t, first, "234556780987")
+	assert.NotEqual(t, first, second)
+
+	for _, value := range []string{first, second} {
+		plaintext, err := cipher.Decrypt(ctx, value)
+		require.NoError(t, err)
+		assert.Equal(t, "234556780987", plaintext)
+	}
+
+	plaintext, err := cipher.Decrypt(ctx, "234556780987")
+	require.NoError(t, err)
+	assert.Equal(t, "234556780987", plaintext, "values stored before encryption are returned as they are")
+
+	_, err = cipher.Decrypt(ctx, first[:len(first)-4])
+	assert.ErrorIs(t, err, ErrMalformed)
+	other, _ := newTestCipher(t)
+	_, err = other.Decrypt(ctx, first)
+	assert.Error(t, err)
+}
+
+func TestCipher_BlindIndexAndToken(t *testing.T) {
+	ctx := context.Background()
+	cipher, file := newTestCipher(t)
+
+	index, err := cipher.BlindIndex(ctx, "234556780987")
+	require.NoError(t, err)
+	token, err := cipher.Token(ctx, "234556780987")
+	require.NoError(t, err)
+	assert.NotContains(t, index, "234556780987")
+	assert.Regexp(t, `^tok_[\w-]+$`, token)
+
+	require.NoError(t, file.Rotate("k2"))
+	again, err := cipher.BlindIndex(ctx, "234556780987")
+	require.NoError(t, err)
+	assert.Equal(t, index, again, "rotating the key encryption key keeps the blind index")
+	again, err = cipher.Token(ctx, "234556780987")
+	require.NoError(t, err)
+	assert.Equal(t, token, again)
+
+	other, err := cipher.BlindIndex(ctx, "234556780988")
+	require.NoError(t, err)
+	assert.NotEqual(t, index, other)
+}
+
+func TestKeyFile_ReadWrite(t *testing.T) {
+	file, err := NewKeyFile("k1")
+	require.NoError(t, err)
+	require.NoError(t, file.Rotate("k2"))
+	assert.Error(t, file.Rotate("k2"))
+	assert.Error(t, file.Rotate("k:3"))
+	assert.Error(t, file.Retire("k2"), "the current key cannot be retired")
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, file.Write(path))
+	read, err := ReadKeyFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, file, read)
+
+	require.NoError(t, read.Retire("k1"))
+	assert.ErrorIs(t, read.Retire("k1"), ErrUnknownKey)
+}
+
+func TestUsers_UniqueByBlindIndex(t *testing.T) {
+	ctx := context.Background()
+	cipher, _ := newTestCipher(t)
+	memory := store.NewMemoryUserRepository()
+	users := NewUsers(memory, cipher)
+
+	require.NoError(t, users.Create(ctx, &models.User{Guid: "1", GateWay: "a", AccountId: "234556780987"}))
+	assert.ErrorIs(t, users.Create(ctx, &models.User{Guid: "2", GateWay: "a", AccountId: "234556780987"}), store.ErrAlreadyExists)
+	require.NoError(t, users.Create(ctx, &models.User{Guid: "3", GateWay: "b", AccountId: "234556780987"}))
+
+	stored, err := memory.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.True(t, IsEncrypted(stored.EncryptedAccountId))
+	user, err := users.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "234556780987", user.AccountId)
+}
+
+func TestUsers_CardToken(t *testing.T) {
+	ctx := context.Background()
+	cipher, _ := newTestCipher(t)
+	memory := store.NewMemoryUserRepository()
+	users := NewUsers(memory, cipher)
+
+	require.NoError(t, users.Create(ctx, &models.User{Guid: "1", GateWay: "c", CardToken: "card_4242"}))
+	require.NoError(t, users.Create(ctx, &models.User{Guid: "2", GateWay: "c", CardToken: "card_5555"}), "card users do not share a blind index")
+	assert.ErrorIs(t, users.Create(ctx, &models.User{Guid: "3", GateWay: "c", CardToken: "card_4242"}), store.ErrAlreadyExists)
+
+	stored, err := memory.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.Empty(t, stored.EncryptedAccountId)
+	assert.Empty(t, stored.AccountIndex)
+	user, err := users.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.Empty(t, user.AccountId)
+	assert.Equal(t, "card_4242", user.CardToken)
+
+	transactions := NewTransactions(store.NewMemoryTransactionRepository(), cipher)
+	require.NoError(t, transactions.Create(ctx, &models.Transaction{TransactionId: "tx-1", CardToken: "card_4242"}))
+	read, err := transactions.Get(ctx, "tx-1")
+	require.NoError(t, err)
+	assert.Empty(t, read.EncryptedAccountId)
+	assert.Empty(t, read.AccountToken)
+	assert.Equal(t, "card_4242", read.CardToken)
+}
+
+func TestTransactions_AccountIdNeverSerialized(t *testing.T) {
+	ctx := context.Background()
+	cipher, _ := newTestCipher(t)
+	transactions := NewTransactions(store.NewMemoryTransactionRepository(), cipher)
+
+	transaction := models.Transaction{TransactionId: "tx-1", AccountId: "234556780987", Status: string(models.Pending)}
+	require.NoError(t, transactions.Create(ctx, &transaction))
+	assert.NotEmpty(t, transaction.AccountToken)
+
+	read, err := transactions.Get(ctx, "tx-1")
+	require.NoError(t, err)
+	assert.Equal(t, "234556780987", read.AccountId)
+	assert.Equal(t, transaction.AccountToken, read.AccountToken)
+	data, err := json.Marshal(read)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "234556780987")
+
+	read.Status = string(models.Processing)
+	read.EncryptedAccountId = ""
+	require.NoError(t, transactions.Update(ctx, &read, models.Pending))
+	read, err = transactions.Get(ctx, "tx-1")
+	require.NoError(t, err)
+	assert.Equal(t, "234556780987", read.AccountId, "updates leave the encrypted account id as it is")
+}
+
+func TestReencrypt(t *testing.T) {
+	ctx := context.Background()
+	cipher, file := newTestCipher(t)
+	memory := store.NewMemoryUserRepository()
+	users := NewUsers(memory, cipher)
+	require.NoError(t, users.Create(ctx, &models.User{Guid: "1", GateWay: "a", AccountId: "234556780987"}))
+	// stored before encryption
+	require.NoError(t, memory.Create(ctx, &models.User{Guid: "2", GateWay: "a", EncryptedAccountId: "234556780988"}))
+	// a card user, with no account id to encrypt
+	require.NoError(t, users.Create(ctx, &models.User{Guid: "3", GateWay: "c", CardToken: "card_4242"}))
+
+	count, err := Reencrypt(ctx, cipher, memory, true)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	user, err := users.Get(ctx, "2")
+	require.NoError(t, err)
+	assert.True(t, IsEncrypted(user.EncryptedAccountId))
+	assert.Equal(t, "234556780988", user.AccountId)
+	index, err := cipher.BlindIndex(ctx, "234556780988")
+	require.NoError(t, err)
+	assert.Equal(t, index, user.AccountIndex)
+
+	require.NoError(t, file.Rotate("k2"))
+	count, err = Reencrypt(ctx, cipher, memory, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	require.NoError(t, file.Retire("k1"))
+	for _, guid := range []string{"1", "2"} {
+		_, err := users.Get(ctx, guid)
+		assert.NoError(t, err, "nothing is left under the retired key")
+	}
+
+	count, err = Reencrypt(ctx, cipher, memory, true)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
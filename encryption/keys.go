@@ -0,0 +1,215 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keySize is the size of every key, AES-256 and HMAC-SHA256.
+const keySize = 32
+
+// ErrUnknownKey is returned for data keys wrapped under a key the provider does not hold.
+var ErrUnknownKey = errors.New("encryption: unknown key")
+
+// KeyProvider holds the key encryption keys and the index key, which never
+// leave it. In production it is a KMS; LocalKeyProvider stands in for one.
+type KeyProvider interface {
+	// CurrentKeyId returns the id of the key WrapKey encrypts under.
+	CurrentKeyId(ctx context.Context) (string, error)
+	// WrapKey encrypts a data key under the current key encryption key.
+	WrapKey(ctx context.Context, dataKey []byte) (keyId string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped under keyId.
+	UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error)
+	// MAC returns the HMAC of data under the index key. Unlike the key
+	// encryption keys, the index key is never rotated: that would change
+	// every blind index and token.
+	MAC(ctx context.Context, data []byte) ([]byte, error)
+}
+
+// KeyFile is the JSON file LocalKeyProvider reads its keys from. Keys are
+// base64 encoded.
+type KeyFile struct {
+	Current  string            `json:"current"`
+	Keys     map[string][]byte `json:"keys"`
+	IndexKey []byte            `json:"index_key"`
+}
+
+// NewKeyFile returns a key file with a random index key and a random key
+// encryption key named keyId.
+func NewKeyFile(keyId string) (*KeyFile, error) {
+	indexKey, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+	file := &KeyFile{Keys: map[string][]byte{}, IndexKey: indexKey}
+	err = file.Rotate(keyId)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func ReadKeyFile(path string) (*KeyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file KeyFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file %s: %w", path, err)
+	}
+	err = file.validate()
+	if err != nil {
+		return nil, fmt.Errorf("reading key file %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// Write writes f to path, readable by its owner only.
+func (f *KeyFile) Write(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// Rotate adds a random key encryption key named keyId and makes it current.
+// The keys it replaces are kept to decrypt what was encrypted under them.
+func (f *KeyFile) Rotate(keyId string) error {
+	if keyId == "" || strings.Contains(keyId, separator) {
+		return fmt.Errorf("encryption: invalid key id %q", keyId)
+	}
+	if _, ok := f.Keys[keyId]; ok {
+		return fmt.Errorf("encryption: key %q already exists", keyId)
+	}
+	key, err := randomKey()
+	if err != nil {
+		return err
+	}
+	f.Keys[keyId] = key
+	f.Current = keyId
+	return nil
+}
+
+// Retire removes the key encryption key named keyId. Nothing encrypted under
+// it can be decrypted afterwards, so only retire a key once Reencrypt left
+// nothing under it.
+func (f *KeyFile) Retire(keyId string) error {
+	if keyId == f.Current {
+		return fmt.Errorf("encryption: key %q is current", keyId)
+	}
+	if _, ok := f.Keys[keyId]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownKey, keyId)
+	}
+	delete(f.Keys, keyId)
+	return nil
+}
+
+func (f *KeyFile) validate() error {
+	if _, ok := f.Keys[f.Current]; !ok {
+		return fmt.Errorf("current key %q is missing", f.Current)
+	}
+	for keyId, key := range f.Keys {
+		if len(key) != keySize {
+			return fmt.Errorf("key %q must be %d bytes", keyId, keySize)
+		}
+	}
+	if len(f.IndexKey) != keySize {
+		return fmt.Errorf("index key must be %d bytes", keySize)
+	}
+	return nil
+}
+
+var _ KeyProvider = (*LocalKeyProvider)(nil)
+
+// LocalKeyProvider keeps the keys of a KeyFile in memory. It stands in for a
+// KMS in development and tests.
+type LocalKeyProvider struct {
+	file *KeyFile
+}
+
+func NewLocalKeyProvider(file *KeyFile) (*LocalKeyProvider, error) {
+	err := file.validate()
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+	return &LocalKeyProvider{file: file}, nil
+}
+
+func (p *LocalKeyProvider) CurrentKeyId(ctx context.Context) (string, error) {
+	return p.file.Current, nil
+}
+
+func (p *LocalKeyProvider) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(p.file.Keys[p.file.Current], dataKey)
+	return p.file.Current, wrapped, err
+}
+
+func (p *LocalKeyProvider) UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error) {
+	key, ok := p.file.Keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyId)
+	}
+	return open(key, wrapped)
+}
+
+func (p *LocalKeyProvider) MAC(ctx context.Context, data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, p.file.IndexKey)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func randomKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// seal encrypts plaintext with AES-GCM under key, prefixing the nonce.
+func seal(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts what seal returned.
+func open(key, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformed, err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,208 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"payments/models"
+	"payments/store"
+	"time"
+)
+
+var (
+	_ store.TransactionRepository = (*Transactions)(nil)
+	_ store.UserRepository        = (*Users)(nil)
+)
+
+// Transactions encrypts the account ids of the transactions it stores and
+// decrypts those it reads, filling in their tokens.
+type Transactions struct {
+	store.TransactionRepository
+	cipher *Cipher
+}
+
+func NewTransactions(transactions store.TransactionRepository, cipher *Cipher) *Transactions {
+	return &Transactions{TransactionRepository: transactions, cipher: cipher}
+}
+
+// Create sets the encrypted account id and the token of transaction. Card
+// payments have no account id and are stored as they are.
+func (t *Transactions) Create(ctx context.Context, transaction *models.Transaction) error {
+	if transaction.AccountId == "" {
+		return t.TransactionRepository.Create(ctx, transaction)
+	}
+	var err error
+	transaction.EncryptedAccountId, err = t.cipher.Encrypt(ctx, transaction.AccountId)
+	if err != nil {
+		return err
+	}
+	transaction.AccountToken, err = t.cipher.Token(ctx, transaction.AccountId)
+	if err != nil {
+		return err
+	}
+	return t.TransactionRepository.Create(ctx, transaction)
+}
+
+func (t *Transactions) Get(ctx context.Context, transactionId string) (models.Transaction, error) {
+	transaction, err := t.TransactionRepository.Get(ctx, transactionId)
+	if err != nil {
+		return transaction, err
+	}
+	err = t.decrypt(ctx, &transaction)
+	return transaction, err
+}
+
+func (t *Transactions) ScheduledRetries(ctx context.Context, gateWay string, limit int) ([]models.Transaction, error) {
+	transactions, err := t.TransactionRepository.ScheduledRetries(ctx, gateWay, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range transactions {
+		err = t.decrypt(ctx, &transactions[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return transactions, nil
+}
+
+func (t *Transactions) ClaimDueRetries(ctx context.Context, limit int, handle func(models.Transaction) error) (int, error) {
+	return t.TransactionRepository.ClaimDueRetries(ctx, limit, func(transaction models.Transaction) error {
+		err := t.decrypt(ctx, &transaction)
+		if err != nil {
+			return err
+		}
+		return handle(transaction)
+	})
+}
+
+func (t *Transactions) StaleActions(ctx context.Context, before time.Time, limit int) ([]models.Transaction, error) {
+	transactions, err := t.TransactionRepository.StaleActions(ctx, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range transactions {
+		err = t.decrypt(ctx, &transactions[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return transactions, nil
+}
+
+func (t *Transactions) decrypt(ctx context.Context, transaction *models.Transaction) error {
+	if transaction.EncryptedAccountId == "" {
+		return nil
+	}
+	var err error
+	transaction.AccountId, err = t.cipher.Decrypt(ctx, transaction.EncryptedAccountId)
+	if err != nil {
+		return err
+	}
+	transaction.AccountToken, err = t.cipher.Token(ctx, transaction.AccountId)
+	return err
+}
+
+// Users encrypts the account ids of the users it stores, indexing them, and
+// decrypts those it reads.
+type Users struct {
+	store.UserRepository
+	cipher *Cipher
+}
+
+func NewUsers(users store.UserRepository, cipher *Cipher) *Users {
+	return &Users{UserRepository: users, cipher: cipher}
+}
+
+// Create sets the encrypted account id and the blind index of user. Users of
+// card gateways have no account id and are stored as they are, as they would
+// all share the blind index of the empty id.
+func (u *Users) Create(ctx context.Context, user *models.User) error {
+	if user.AccountId == "" {
+		return u.UserRepository.Create(ctx, user)
+	}
+	var err error
+	user.EncryptedAccountId, err = u.cipher.Encrypt(ctx, user.AccountId)
+	if err != nil {
+		return err
+	}
+	user.AccountIndex, err = u.cipher.BlindIndex(ctx, user.AccountId)
+	if err != nil {
+		return err
+	}
+	return u.UserRepository.Create(ctx, user)
+}
+
+func (u *Users) Get(ctx context.Context, guid string) (models.User, error) {
+	user, err := u.UserRepository.Get(ctx, guid)
+	if err != nil || user.EncryptedAccountId == "" {
+		return user, err
+	}
+	user.AccountId, err = u.cipher.Decrypt(ctx, user.EncryptedAccountId)
+	return user, err
+}
+
+// reencryptBatch is the number of accounts Reencrypt reads at a time.
+const reencryptBatch = 100
+
+// Reencrypt encrypts every account id in accounts not encrypted under the
+// current key encryption key again, including account ids stored before
+// encryption, and sets their blind index if indexed is set. It returns the
+// number of account ids it rewrote.
+//
+// Run it after rotating the key encryption key, once every service has been
+// restarted with the new key, and after upgrading a database whose account
+// ids are not encrypted yet.
+func Reencrypt(ctx context.Context, cipher *Cipher, accounts store.EncryptedAccountRepository, indexed bool) (int, error) {
+	count := 0
+	after := ""
+	for {
+		batch, err := accounts.EncryptedAccounts(ctx, after, reencryptBatch)
+		if err != nil {
+			return count, err
+		}
+		for _, account := range batch {
+			rewritten, err := reencrypt(ctx, cipher, accounts, account, indexed)
+			if err != nil {
+				return count, err
+			}
+			if rewritten {
+				count++
+			}
+		}
+		if len(batch) < reencryptBatch {
+			return count, nil
+		}
+		after = batch[len(batch)-1].Id
+	}
+}
+
+// reencrypt rewrites account, unless it was rewritten since it was read.
+func reencrypt(ctx context.Context, cipher *Cipher, accounts store.EncryptedAccountRepository, account store.EncryptedAccount, indexed bool) (bool, error) {
+	previous := account.EncryptedAccountId
+	var changed bool
+	var err error
+	account.EncryptedAccountId, changed, err = cipher.Reencrypt(ctx, previous)
+	if err != nil {
+		return false, err
+	}
+	if indexed && account.AccountIndex == "" {
+		accountId, err := cipher.Decrypt(ctx, account.EncryptedAccountId)
+		if err != nil {
+			return false, err
+		}
+		index, err := cipher.BlindIndex(ctx, accountId)
+		if err != nil {
+			return false, err
+		}
+		account.AccountIndex = index
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	err = accounts.ReplaceEncryptedAccount(ctx, account, previous)
+	if errors.Is(err, store.ErrConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
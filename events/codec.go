@@ -0,0 +1,132 @@
+package events
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"io/fs"
+	"path"
+	"payments/messaging"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidEvent = errors.New("events: invalid event")
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+type schemaKey struct {
+	eventType string
+	version   int
+}
+
+// schemas holds every embedded schema, compiled once. The files are part of
+// the binary, so a broken one is a programming error.
+var schemas = mustCompileSchemas()
+
+func mustCompileSchemas() map[schemaKey]*jsonschema.Schema {
+	names, err := fs.Glob(schemaFiles, "schemas/*.json")
+	if err != nil {
+		panic(err)
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+	compiled := map[schemaKey]*jsonschema.Schema{}
+	for _, name := range names {
+		key, err := parseSchemaName(path.Base(name))
+		if err != nil {
+			panic(err)
+		}
+		data, err := schemaFiles.ReadFile(name)
+		if err != nil {
+			panic(err)
+		}
+		err = compiler.AddResource(name, bytes.NewReader(data))
+		if err != nil {
+			panic(err)
+		}
+		compiled[key] = compiler.MustCompile(name)
+	}
+	return compiled
+}
+
+// parseSchemaName splits a file name such as payment.requested.v1.json.
+func parseSchemaName(name string) (schemaKey, error) {
+	base := strings.TrimSuffix(name, ".json")
+	i := strings.LastIndex(base, ".v")
+	if i < 0 {
+		return schemaKey{}, fmt.Errorf("schema %s is not named <type>.v<version>.json", name)
+	}
+	version, err := strconv.Atoi(base[i+2:])
+	if err != nil {
+		return schemaKey{}, fmt.Errorf("schema %s is not named <type>.v<version>.json", name)
+	}
+	return schemaKey{eventType: base[:i], version: version}, nil
+}
+
+// Encode validates event against the schema of its version and wraps it in an envelope.
+func Encode(event Event) (messaging.Envelope, error) {
+	envelope, err := messaging.NewEnvelope(event.EventType(), event.EventVersion(), event.EventKey(), event)
+	if err != nil {
+		return messaging.Envelope{}, err
+	}
+	err = validate(event.EventType(), event.EventVersion(), envelope.Payload)
+	if err != nil {
+		return messaging.Envelope{}, err
+	}
+	return envelope, nil
+}
+
+// Decode checks that envelope holds an event of event's type at a version no
+// newer than the latest of event's, validates the payload against the schema of the
+// envelope's version and decodes it into event, which must be a pointer.
+func Decode(envelope messaging.Envelope, event Event) error {
+	maxVersion := event.EventVersion()
+	if multiVersion, ok := event.(multiVersionEvent); ok {
+		maxVersion = multiVersion.LatestEventVersion()
+	}
+	err := envelope.Expect(event.EventType(), maxVersion)
+	if err != nil {
+		return err
+	}
+	version := envelope.Version
+	if version == 0 {
+		// published before envelopes carried a version
+		version = 1
+	}
+	err = validate(event.EventType(), version, envelope.Payload)
+	if err != nil {
+		return err
+	}
+	return envelope.Decode(event)
+}
+
+// DecodeMessage opens the envelope of msg and decodes it into event.
+func DecodeMessage(msg *messaging.Message, event Event) error {
+	envelope, err := messaging.OpenEnvelope(msg)
+	if err != nil {
+		return err
+	}
+	return Decode(envelope, event)
+}
+
+func validate(eventType string, version int, payload []byte) error {
+	schema, ok := schemas[schemaKey{eventType: eventType, version: version}]
+	if !ok {
+		return fmt.Errorf("%w: no schema for %s version %d", ErrInvalidEvent, eventType, version)
+	}
+	var document any
+	err := json.Unmarshal(payload, &document)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+	err = schema.Validate(document)
+	if err != nil {
+		return fmt.Errorf("%w: %s version %d: %v", ErrInvalidEvent, eventType, version, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package events defines the messages the services exchange over the message
+// bus. Every event type has a JSON Schema per version in schemas/, which Encode
+// and Decode validate payloads against, so a change to these types or to the
+// models cannot silently break a running consumer.
+package events
+
+import (
+	"payments/models"
+	"time"
+)
+
+type Event interface {
+	EventType() string
+	EventVersion() int
+	// EventKey orders events, see messaging.Message.Key.
+	EventKey() string
+}
+
+// multiVersionEvent is implemented by events published at the oldest version
+// that can carry them, so consumers only need upgrading for what they cannot
+// read yet. Decode accepts up to LatestEventVersion.
+type multiVersionEvent interface {
+	LatestEventVersion() int
+}
+
+const (
+	PaymentRequestedType        = "payment.requested"
+	GatewayCallbackReceivedType = "gateway.callback_received"
+	PaymentStatusChangedType    = "payment.status_changed"
+)
+
+// PaymentRequested asks the payment processor to submit a transaction to its gateway.
+type PaymentRequested struct {
+	TransactionId string  `json:"transaction_id"`
+	Type          string  `json:"type"`
+	GateWay       string  `json:"gate_way"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	RetryCount    int     `json:"retry_count"`
+}
+
+func NewPaymentRequested(transaction models.Transaction) PaymentRequested {
+	return PaymentRequested{
+		TransactionId: transaction.TransactionId,
+		Type:          transaction.Type,
+		GateWay:       transaction.GateWay,
+		Amount:        transaction.Amount,
+		Currency:      transaction.Currency,
+		RetryCount:    transaction.RetryCount,
+	}
+}
+
+func (e PaymentRequested) EventType() string { return PaymentRequestedType }
+func (e PaymentRequested) EventVersion() int { return 1 }
+func (e PaymentRequested) EventKey() string  { return e.TransactionId }
+
+// GatewayCallbackReceived carries a gateway's callback, in the gateway's own
+// format, to the callback processor.
+type GatewayCallbackReceived struct {
+	TransactionId string    `json:"transaction_id"`
+	Body          string    `json:"body"`
+	ContentType   string    `json:"content_type,omitempty"`
+	ReceivedAt    time.Time `json:"received_at"`
+}
+
+func (e GatewayCallbackReceived) EventType() string { return GatewayCallbackReceivedType }
+func (e GatewayCallbackReceived) EventVersion() int { return 1 }
+func (e GatewayCallbackReceived) EventKey() string  { return e.TransactionId }
+
+// PaymentStatusChanged tells the callback dispatcher a transaction was settled.
+// Version 2 added the pending_action status and ActionUrl. Only status changes
+// that need them are published as version 2, so dispatchers that only know
+// version 1 keep receiving every other notification.
+type PaymentStatusChanged struct {
+	TransactionId  string    `json:"transaction_id"`
+	Type           string    `json:"type"`
+	Status         string    `json:"status"`
+	Amount         float64   `json:"amount"`
+	Currency       string    `json:"currency"`
+	ClientCallback string    `json:"client_callback,omitempty"`
+	ChangedAt      time.Time `json:"changed_at"`
+	// Attempts is the number of gateway calls made for the transaction.
+	Attempts         int    `json:"attempts,omitempty"`
+	GatewayReference string `json:"gateway_reference,omitempty"`
+	FailureCode      string `json:"failure_code,omitempty"`
+	FailureMessage   string `json:"failure_message,omitempty"`
+	// ActionUrl is where the customer completes a 3-D Secure challenge, while
+	// the status is pending_action.
+	ActionUrl string `json:"action_url,omitempty"`
+}
+
+func NewPaymentStatusChanged(transaction models.Transaction, changedAt time.Time) PaymentStatusChanged {
+	return PaymentStatusChanged{
+		TransactionId:    transaction.TransactionId,
+		Type:             transaction.Type,
+		Status:           transaction.Status,
+		Amount:           transaction.Amount,
+		Currency:         transaction.Currency,
+		ClientCallback:   transaction.ClientCallback,
+		ChangedAt:        changedAt,
+		Attempts:         transaction.RetryCount,
+		GatewayReference: transaction.GatewayReference,
+		FailureCode:      transaction.FailureCode,
+		FailureMessage:   transaction.FailureMessage,
+		ActionUrl:        transaction.ActionUrl,
+	}
+}
+
+func (e PaymentStatusChanged) EventType() string { return PaymentStatusChangedType }
+
+func (e PaymentStatusChanged) EventVersion() int {
+	if e.Status == string(models.PendingAction) || e.ActionUrl != "" {
+		return 2
+	}
+	return 1
+}
+
+func (e PaymentStatusChanged) LatestEventVersion() int { return 2 }
+func (e PaymentStatusChanged) EventKey() string        { return e.TransactionId }
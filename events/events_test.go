@@ -0,0 +1,280 @@
+package events
+
+import (
+	"encoding/json"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"payments/messaging"
+	"payments/models"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// current lists the version of every event type the services publish. Adding a
+// type or bumping a version without a schema fails TestSchemas_MatchEvents.
+var current = []Event{
+	PaymentRequested{},
+	GatewayCallbackReceived{},
+	// the latest version; settled transactions are still published as version 1
+	PaymentStatusChanged{Status: string(models.PendingAction)},
+	TransactionCreated{},
+	TransactionSubmitted{},
+	TransactionRetryScheduled{},
+	TransactionActionRequired{},
+	TransactionSucceeded{},
+	TransactionFailed{},
+}
+
+type schemaDocument struct {
+	Required   []string                   `json:"required"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+func readSchema(t *testing.T, event Event) schemaDocument {
+	data, err := schemaFiles.ReadFile("schemas/" + event.EventType() + ".v" + strconv.Itoa(event.EventVersion()) + ".json")
+	require.NoError(t, err)
+	var document schemaDocument
+	require.NoError(t, json.Unmarshal(data, &document))
+	return document
+}
+
+func jsonFields(typ reflect.Type) []string {
+	var fields []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous {
+			fields = append(fields, jsonFields(field.Type)...)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// A field renamed, added or removed in Go without a matching schema change
+// would change what is published under an existing version.
+func TestSchemas_MatchEvents(t *testing.T) {
+	for _, event := range current {
+		t.Run(event.EventType(), func(t *testing.T) {
+			document := readSchema(t, event)
+			var properties []string
+			for property := range document.Properties {
+				properties = append(properties, property)
+			}
+			fields := jsonFields(reflect.TypeOf(event))
+			assert.ElementsMatch(t, properties, fields)
+			assert.Subset(t, fields, document.Required)
+		})
+	}
+}
+
+// producedEvents returns every event the services publish, in every status.
+func producedEvents() []Event {
+	nextAttemptAt := time.Date(2024, 11, 2, 10, 16, 30, 0, time.UTC)
+	transaction := models.Transaction{
+		TransactionId:    "tx-1",
+		UserId:           "user-1",
+		AccountToken:     "tok_1",
+		Type:             string(models.Deposit),
+		GateWay:          "c",
+		Amount:           10,
+		Currency:         "USD",
+		ClientCallback:   "https://merchant.example/callback",
+		RetryCount:       1,
+		GatewayReference: "C-1",
+		Version:          1,
+	}
+	now := time.Date(2024, 11, 2, 10, 15, 30, 0, time.UTC)
+	var produced []Event
+	for _, status := range []models.TransactionStatus{models.Pending, models.Processing, models.PendingAction, models.Successful, models.Failed} {
+		transaction := transaction
+		transaction.Status = string(status)
+		switch status {
+		case models.Pending:
+			transaction.NextAttemptAt = &nextAttemptAt
+			transaction.SetFailure(models.FailureGatewayTimeout, "hystrix: timeout")
+			produced = append(produced, NewTransactionCreated(transaction, now), NewTransactionRetryScheduled(transaction, now))
+		case models.Processing:
+			produced = append(produced, NewTransactionSubmitted(transaction, now))
+		case models.PendingAction:
+			transaction.ActionUrl = "https://c.gateway.com/3ds/C-1"
+			produced = append(produced, NewTransactionActionRequired(transaction, now))
+		case models.Failed:
+			transaction.SetFailure(models.FailureDeclined, "declined")
+			produced = append(produced, NewTransactionSettled(transaction, now))
+		default:
+			produced = append(produced, NewTransactionSettled(transaction, now))
+		}
+		produced = append(produced, NewPaymentRequested(transaction), NewPaymentStatusChanged(transaction, now))
+	}
+	return append(produced, GatewayCallbackReceived{TransactionId: "tx-1", Body: `{}`, ContentType: "application/json", ReceivedAt: now})
+}
+
+// testdata/released holds the schemas as they were first published. Consumers
+// built against them keep running after a release, so a released schema must
+// not change and what is published under its version must keep validating
+// against it. Copy a schema there when publishing its version.
+func TestSchemas_CompatibleWithReleased(t *testing.T) {
+	names, err := filepath.Glob("testdata/released/*.json")
+	require.NoError(t, err)
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+	releasedSchemas := map[schemaKey]*jsonschema.Schema{}
+	for _, name := range names {
+		key, err := parseSchemaName(filepath.Base(name))
+		require.NoError(t, err)
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		current, err := schemaFiles.ReadFile("schemas/" + filepath.Base(name))
+		require.NoError(t, err, "released schemas are never removed")
+		assert.JSONEq(t, string(data), string(current), "%s was changed after its release, add a version instead", name)
+		releasedSchemas[key] = compiler.MustCompile(name)
+	}
+
+	for _, event := range producedEvents() {
+		schema, ok := releasedSchemas[schemaKey{eventType: event.EventType(), version: event.EventVersion()}]
+		require.True(t, ok, "%s version %d has no released schema", event.EventType(), event.EventVersion())
+		envelope, err := Encode(event)
+		require.NoError(t, err)
+		var document any
+		require.NoError(t, json.Unmarshal(envelope.Payload, &document))
+		assert.NoError(t, schema.Validate(document), "%s version %d", event.EventType(), event.EventVersion())
+	}
+}
+
+// The fixtures stand for messages already on the topics. They must keep
+// decoding after any change to the event types.
+func TestFixtures_Decode(t *testing.T) {
+	fixtures := map[string]Event{
+		PaymentRequestedType:        &PaymentRequested{},
+		GatewayCallbackReceivedType: &GatewayCallbackReceived{},
+		PaymentStatusChangedType:    &PaymentStatusChanged{},
+	}
+	for eventType, event := range fixtures {
+		t.Run(eventType, func(t *testing.T) {
+			data, err := os.ReadFile("testdata/" + eventType + ".v1.json")
+			require.NoError(t, err)
+			envelope := messaging.Envelope{Type: eventType, Version: 1, Payload: data}
+			require.NoError(t, Decode(envelope, event))
+			assert.Equal(t, "5f0c1a52-3c5e-4b8e-9d0a-7f2b6f1e9a10", event.EventKey())
+
+			// re-encoding must also pass the schema
+			decoded := reflect.ValueOf(event).Elem().Interface().(Event)
+			_, err = Encode(decoded)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	event := PaymentStatusChanged{
+		TransactionId: "tx-1",
+		Type:          string(models.Deposit),
+		Status:        string(models.Successful),
+		Amount:        10,
+		Currency:      "USD",
+		ChangedAt:     time.Date(2024, 11, 2, 10, 15, 30, 0, time.UTC),
+	}
+	envelope, err := Encode(event)
+	require.NoError(t, err)
+	msg := envelope.Message("pay.dispatcher")
+	assert.Equal(t, []byte("tx-1"), msg.Key)
+	assert.Equal(t, PaymentStatusChangedType, msg.Header(messaging.EventTypeHeader))
+	assert.Equal(t, "1", msg.Header(messaging.EventVersionHeader))
+
+	var decoded PaymentStatusChanged
+	require.NoError(t, DecodeMessage(msg, &decoded))
+	assert.Equal(t, event, decoded)
+
+	event.Status = string(models.PendingAction)
+	event.ActionUrl = "https://c.gateway.com/3ds/C-1"
+	envelope, err = Encode(event)
+	require.NoError(t, err)
+	msg = envelope.Message("pay.dispatcher")
+	assert.Equal(t, "2", msg.Header(messaging.EventVersionHeader))
+
+	decoded = PaymentStatusChanged{}
+	require.NoError(t, DecodeMessage(msg, &decoded))
+	assert.Equal(t, event, decoded)
+}
+
+// Dispatchers that only know version 1 must keep receiving the notifications
+// of settled transactions.
+func TestPaymentStatusChanged_SettledValidatesAgainstV1(t *testing.T) {
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+	released := compiler.MustCompile("testdata/released/payment.status_changed.v1.json")
+	transaction := models.Transaction{
+		TransactionId:    "tx-1",
+		Type:             string(models.Deposit),
+		GateWay:          "c",
+		Amount:           10,
+		Currency:         "USD",
+		Status:           string(models.Successful),
+		RetryCount:       1,
+		GatewayReference: "C-1",
+	}
+	for _, status := range []models.TransactionStatus{models.Successful, models.Failed} {
+		transaction.Status = string(status)
+		envelope, err := Encode(NewPaymentStatusChanged(transaction, time.Now()))
+		require.NoError(t, err)
+		assert.Equal(t, 1, envelope.Version, status)
+		var document any
+		require.NoError(t, json.Unmarshal(envelope.Payload, &document))
+		assert.NoError(t, released.Validate(document), status)
+	}
+}
+
+func TestEncode_Invalid(t *testing.T) {
+	_, err := Encode(PaymentRequested{})
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+
+	_, err = Encode(PaymentStatusChanged{TransactionId: "tx-1", Type: "deposit", Status: "settled", Currency: "USD"})
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+}
+
+func TestDecode_Unexpected(t *testing.T) {
+	envelope, err := Encode(PaymentRequested{TransactionId: "tx-1", Type: "deposit", GateWay: "a", Amount: 10, Currency: "USD"})
+	require.NoError(t, err)
+
+	var changed PaymentStatusChanged
+	assert.ErrorIs(t, Decode(envelope, &changed), messaging.ErrUnexpectedEvent)
+
+	envelope.Version = 2
+	var requested PaymentRequested
+	assert.ErrorIs(t, Decode(envelope, &requested), messaging.ErrUnexpectedEvent)
+}
+
+func TestDecode_InvalidPayload(t *testing.T) {
+	envelope := messaging.Envelope{Type: PaymentRequestedType, Version: 1, Payload: []byte(`{"transaction_id":"tx-1"}`)}
+	var requested PaymentRequested
+	assert.ErrorIs(t, Decode(envelope, &requested), ErrInvalidEvent)
+}
+
+// Before the event types, the payment processor consumed models.Transaction
+// as is, without envelope headers. Those messages still decode.
+func TestDecode_LegacyTransaction(t *testing.T) {
+	transaction := models.Transaction{
+		TransactionId: "tx-1",
+		UserId:        "user-1",
+		Type:          string(models.Withdraw),
+		GateWay:       "b",
+		Amount:        25,
+		Currency:      "EUR",
+		Status:        string(models.Pending),
+		RetryCount:    1,
+	}
+	data, err := json.Marshal(transaction)
+	require.NoError(t, err)
+
+	var requested PaymentRequested
+	require.NoError(t, DecodeMessage(&messaging.Message{Topic: "pay.transaction", Value: data}, &requested))
+	assert.Equal(t, NewPaymentRequested(transaction), requested)
+}
@@ -0,0 +1,176 @@
+package events
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"payments/models"
+	"time"
+)
+
+// Lifecycle events are published to the public events topic, one for every
+// state change of a transaction, for consumers outside the payments services.
+const (
+	TransactionCreatedType        = "transaction.created"
+	TransactionSubmittedType      = "transaction.submitted"
+	TransactionRetryScheduledType = "transaction.retry_scheduled"
+	TransactionActionRequiredType = "transaction.action_required"
+	TransactionSucceededType      = "transaction.succeeded"
+	TransactionFailedType         = "transaction.failed"
+)
+
+// eventNamespace derives the event ids, see TransactionEvent.EventId.
+var eventNamespace = uuid.MustParse("ab5209d5-47cd-4496-8c2a-b0d93e19990f")
+
+// TransactionEvent is the state of a transaction after a change.
+type TransactionEvent struct {
+	// EventId is derived from the event type, the transaction and the
+	// sequence, so an event published twice has the same id both times.
+	EventId       string `json:"event_id"`
+	TransactionId string `json:"transaction_id"`
+	// Sequence increases with every change of the transaction, starting at 0
+	// for transaction.created. It can skip numbers.
+	Sequence   int       `json:"sequence"`
+	OccurredAt time.Time `json:"occurred_at"`
+	UserId     string    `json:"user_id"`
+	// AccountToken stands for the gateway account id, which is never published.
+	AccountToken string `json:"account_token,omitempty"`
+	Type         string `json:"type"`
+	Status       string `json:"status"`
+	GateWay      string `json:"gate_way"`
+	// GatewayReference is the gateway's id of the transaction, once known.
+	GatewayReference string  `json:"gateway_reference,omitempty"`
+	Amount           float64 `json:"amount"`
+	Currency         string  `json:"currency"`
+}
+
+func newTransactionEvent(eventType string, transaction models.Transaction, occurredAt time.Time) TransactionEvent {
+	name := fmt.Sprintf("%s/%s/%d", eventType, transaction.TransactionId, transaction.Version)
+	return TransactionEvent{
+		EventId:          uuid.NewSHA1(eventNamespace, []byte(name)).String(),
+		TransactionId:    transaction.TransactionId,
+		Sequence:         transaction.Version,
+		OccurredAt:       occurredAt.UTC(),
+		UserId:           transaction.UserId,
+		AccountToken:     transaction.AccountToken,
+		Type:             transaction.Type,
+		Status:           transaction.Status,
+		GateWay:          transaction.GateWay,
+		GatewayReference: transaction.GatewayReference,
+		Amount:           transaction.Amount,
+		Currency:         transaction.Currency,
+	}
+}
+
+func (e TransactionEvent) EventVersion() int { return 1 }
+func (e TransactionEvent) EventKey() string  { return e.TransactionId }
+
+// TransactionCreated is published when the api accepts a deposit or withdrawal.
+type TransactionCreated struct {
+	TransactionEvent
+}
+
+func NewTransactionCreated(transaction models.Transaction, occurredAt time.Time) TransactionCreated {
+	return TransactionCreated{newTransactionEvent(TransactionCreatedType, transaction, occurredAt)}
+}
+
+func (e TransactionCreated) EventType() string { return TransactionCreatedType }
+
+// TransactionSubmitted is published when the payment processor sends the
+// transaction to its gateway, once per attempt.
+type TransactionSubmitted struct {
+	TransactionEvent
+	Attempt int `json:"attempt"`
+}
+
+func NewTransactionSubmitted(transaction models.Transaction, occurredAt time.Time) TransactionSubmitted {
+	return TransactionSubmitted{
+		TransactionEvent: newTransactionEvent(TransactionSubmittedType, transaction, occurredAt),
+		Attempt:          transaction.RetryCount,
+	}
+}
+
+func (e TransactionSubmitted) EventType() string { return TransactionSubmittedType }
+
+// TransactionRetryScheduled is published when a gateway call failed and the
+// transaction will be submitted again at NextAttemptAt. The failure is that of
+// the attempt.
+type TransactionRetryScheduled struct {
+	TransactionEvent
+	Attempt        int       `json:"attempt"`
+	NextAttemptAt  time.Time `json:"next_attempt_at"`
+	FailureCode    string    `json:"failure_code,omitempty"`
+	FailureMessage string    `json:"failure_message,omitempty"`
+}
+
+func NewTransactionRetryScheduled(transaction models.Transaction, occurredAt time.Time) TransactionRetryScheduled {
+	event := TransactionRetryScheduled{
+		TransactionEvent: newTransactionEvent(TransactionRetryScheduledType, transaction, occurredAt),
+		Attempt:          transaction.RetryCount,
+		FailureCode:      transaction.FailureCode,
+		FailureMessage:   transaction.FailureMessage,
+	}
+	if transaction.NextAttemptAt != nil {
+		event.NextAttemptAt = transaction.NextAttemptAt.UTC()
+	}
+	return event
+}
+
+func (e TransactionRetryScheduled) EventType() string { return TransactionRetryScheduledType }
+
+// TransactionActionRequired is published when a card gateway sent the
+// customer to a 3-D Secure challenge at ActionUrl. The transaction is
+// submitted again once they are back.
+type TransactionActionRequired struct {
+	TransactionEvent
+	ActionUrl string `json:"action_url"`
+}
+
+func NewTransactionActionRequired(transaction models.Transaction, occurredAt time.Time) TransactionActionRequired {
+	return TransactionActionRequired{
+		TransactionEvent: newTransactionEvent(TransactionActionRequiredType, transaction, occurredAt),
+		ActionUrl:        transaction.ActionUrl,
+	}
+}
+
+func (e TransactionActionRequired) EventType() string { return TransactionActionRequiredType }
+
+// TransactionSucceeded is published when the gateway settled the transaction.
+type TransactionSucceeded struct {
+	TransactionEvent
+}
+
+func NewTransactionSucceeded(transaction models.Transaction, occurredAt time.Time) TransactionSucceeded {
+	return TransactionSucceeded{newTransactionEvent(TransactionSucceededType, transaction, occurredAt)}
+}
+
+func (e TransactionSucceeded) EventType() string { return TransactionSucceededType }
+
+// TransactionFailed is published when the gateway declined the transaction or
+// it ran out of retries.
+type TransactionFailed struct {
+	TransactionEvent
+	FailureCode    string `json:"failure_code,omitempty"`
+	FailureMessage string `json:"failure_message,omitempty"`
+}
+
+func NewTransactionFailed(transaction models.Transaction, occurredAt time.Time) TransactionFailed {
+	return TransactionFailed{
+		TransactionEvent: newTransactionEvent(TransactionFailedType, transaction, occurredAt),
+		FailureCode:      transaction.FailureCode,
+		FailureMessage:   transaction.FailureMessage,
+	}
+}
+
+func (e TransactionFailed) EventType() string { return TransactionFailedType }
+
+// NewTransactionSettled returns the TransactionSucceeded or TransactionFailed
+// event of a settled transaction, or nil if it is not settled.
+func NewTransactionSettled(transaction models.Transaction, occurredAt time.Time) Event {
+	switch models.TransactionStatus(transaction.Status) {
+	case models.Successful:
+		return NewTransactionSucceeded(transaction, occurredAt)
+	case models.Failed:
+		return NewTransactionFailed(transaction, occurredAt)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package events
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"payments/models"
+	"testing"
+	"time"
+)
+
+func TestLifecycle_EventIds(t *testing.T) {
+	transaction := models.Transaction{
+		TransactionId: "tx-1",
+		UserId:        "user-1",
+		Type:          string(models.Deposit),
+		GateWay:       "a",
+		Amount:        10,
+		Currency:      "USD",
+		Status:        string(models.Pending),
+	}
+	created := NewTransactionCreated(transaction, time.Now())
+	// republishing the same change yields the same id
+	assert.Equal(t, created.EventId, NewTransactionCreated(transaction, time.Now().Add(time.Second)).EventId)
+	assert.Equal(t, 0, created.Sequence)
+
+	transaction.Status = string(models.Processing)
+	transaction.RetryCount = 1
+	transaction.Version = 1
+	submitted := NewTransactionSubmitted(transaction, time.Now())
+	assert.NotEqual(t, created.EventId, submitted.EventId)
+	assert.Equal(t, 1, submitted.Sequence)
+	assert.Equal(t, 1, submitted.Attempt)
+
+	for _, event := range []Event{created, submitted} {
+		_, err := Encode(event)
+		assert.NoError(t, err, event.EventType())
+	}
+}
+
+func TestLifecycle_Settled(t *testing.T) {
+	transaction := models.Transaction{
+		TransactionId: "tx-1",
+		Type:          string(models.Withdraw),
+		GateWay:       "b",
+		Amount:        10,
+		Currency:      "USD",
+		Status:        string(models.Successful),
+		Version:       2,
+	}
+	event := NewTransactionSettled(transaction, time.Now())
+	require.IsType(t, TransactionSucceeded{}, event)
+	envelope, err := Encode(event)
+	require.NoError(t, err)
+	assert.Equal(t, TransactionSucceededType, envelope.Type)
+	assert.Equal(t, "tx-1", envelope.Key)
+
+	transaction.Status = string(models.Failed)
+	assert.IsType(t, TransactionFailed{}, NewTransactionSettled(transaction, time.Now()))
+
+	transaction.Status = string(models.Processing)
+	assert.Nil(t, NewTransactionSettled(transaction, time.Now()))
+}
+
+func TestLifecycle_StatusMustMatchType(t *testing.T) {
+	transaction := models.Transaction{
+		TransactionId: "tx-1",
+		Type:          string(models.Deposit),
+		GateWay:       "a",
+		Amount:        10,
+		Currency:      "USD",
+		Status:        string(models.Failed),
+	}
+	_, err := Encode(NewTransactionSucceeded(transaction, time.Now()))
+	assert.ErrorIs(t, err, ErrInvalidEvent)
+}
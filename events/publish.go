@@ -0,0 +1,18 @@
+package events
+
+import (
+	"context"
+	"payments/messaging"
+	"payments/tracing"
+)
+
+// Publish encodes event and publishes it to topic with the trace context of ctx.
+func Publish(ctx context.Context, publisher messaging.Publisher, topic string, event Event) error {
+	envelope, err := Encode(event)
+	if err != nil {
+		return err
+	}
+	msg := envelope.Message(topic)
+	tracing.InjectMessage(ctx, msg)
+	return publisher.Publish(ctx, msg)
+}
@@ -0,0 +1,102 @@
+package gateways
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"payments/config"
+	"payments/tracing"
+	"time"
+)
+
+// ErrPinMismatch is returned when a gateway's certificate chain holds none of
+// the pinned public keys.
+var ErrPinMismatch = errors.New("gateways: certificate does not match any pinned key")
+
+// NewHTTPClient returns the client a gateway is called with, tuned by
+// settings. Requests are traced.
+func NewHTTPClient(settings config.HTTPClient) (*http.Client, error) {
+	return newHTTPClient(settings, false)
+}
+
+// newHTTPClient returns the client of NewHTTPClient, answering the requests
+// of simulated calls itself if simulated is set.
+func newHTTPClient(settings config.HTTPClient, simulated bool) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if settings.Proxy != "" {
+		proxyUrl, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("gateways: invalid proxy: %w", err)
+		}
+		proxy = http.ProxyURL(proxyUrl)
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: settings.DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   settings.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: settings.ResponseHeaderTimeout,
+		IdleConnTimeout:       settings.IdleConnTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   settings.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       settings.MaxConnsPerHost,
+	}
+	var roundTripper http.RoundTripper = transport
+	if simulated {
+		roundTripper = simulatedTransport{next: transport}
+	}
+	return &http.Client{
+		Timeout:   settings.Timeout,
+		Transport: tracing.NewTransport(roundTripper),
+	}, nil
+}
+
+func newTLSConfig(settings config.HTTPClient) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if settings.CAFile != "" {
+		bundle, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("gateways: reading CA bundle: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("gateways: no certificates in CA bundle " + settings.CAFile)
+		}
+	}
+	if len(settings.PinnedCerts) > 0 {
+		pins := map[string]bool{}
+		for _, pin := range settings.PinnedCerts {
+			pins[pin] = true
+		}
+		// runs after the chain is verified, so a pin narrows what is trusted
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range state.PeerCertificates {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(hash[:])] {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("gateways: loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,154 @@
+package gateways
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"payments/config"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) *http.Client {
+	client, err := NewHTTPClient(config.HTTPClient{Timeout: 5 * time.Second})
+	require.NoError(t, err)
+	return client
+}
+
+// writePEM writes blocks of the given type to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, blockType string, blocks ...[]byte) string {
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: block})...)
+	}
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+// newClientCert returns a self-signed client certificate and its key.
+func newClientCert(t *testing.T) (*x509.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "payments"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return cert, der, keyDer
+}
+
+func TestNewHTTPClient_MutualTLS(t *testing.T) {
+	cert, certDer, keyDer := newClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	dir := t.TempDir()
+	settings := config.HTTPClient{
+		Timeout: 5 * time.Second,
+		CAFile:  writePEM(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw),
+	}
+
+	client, err := NewHTTPClient(settings)
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	assert.Error(t, err, "the server requires a client certificate")
+
+	settings.CertFile = writePEM(t, dir, "client.pem", "CERTIFICATE", certDer)
+	settings.KeyFile = writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDer)
+	client, err = NewHTTPClient(settings)
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+}
+
+func TestNewHTTPClient_PinnedCerts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	hash := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(hash[:])
+
+	client, err := NewHTTPClient(config.HTTPClient{CAFile: caFile, PinnedCerts: []string{pin}})
+	require.NoError(t, err)
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	other := sha256.Sum256([]byte("another key"))
+	client, err = NewHTTPClient(config.HTTPClient{CAFile: caFile, PinnedCerts: []string{base64.StdEncoding.EncodeToString(other[:])}})
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	assert.ErrorIs(t, err, ErrPinMismatch)
+}
+
+func TestNewHTTPClient_InvalidTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewHTTPClient(config.HTTPClient{CAFile: writePEM(t, dir, "empty.pem", "CERTIFICATE")})
+	assert.ErrorContains(t, err, "no certificates")
+
+	_, err = NewHTTPClient(config.HTTPClient{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: filepath.Join(dir, "missing.key")})
+	assert.ErrorContains(t, err, "loading client certificate")
+}
+
+func TestNewHTTPClient_Proxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(config.HTTPClient{Proxy: proxy.URL})
+	require.NoError(t, err)
+	resp, err := client.Get("http://gateway.invalid/deposit")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "http://gateway.invalid/deposit", <-proxied)
+}
+
+func TestNewHTTPClient_Timeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewHTTPClient(config.HTTPClient{ResponseHeaderTimeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, server.URL+"/deposit", nil)
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.Error(t, err)
+	assert.Equal(t, KindTimeout, transportError(err).Kind)
+}
@@ -0,0 +1,276 @@
+package gateways
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"payments/config"
+	"payments/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This file is what an implementation of PaymentGateway must do, as tests any
+// of them can run: describe the implementation with a conformance and pass it
+// to runConformance from a test of its own, see TestGateWayA_Conformance. The
+// implementation calls a fakeGateway, a real http server, so the tests share
+// no state and run as the gateway is called in production.
+
+// fakeGateway stands in for the API of a gateway. It answers calls with the
+// replies queued, the last of them for every call after, and records the calls.
+type fakeGateway struct {
+	*httptest.Server
+	mu      sync.Mutex
+	replies []http.HandlerFunc
+	calls   []fakeCall
+}
+
+// fakeCall is a call a fakeGateway received.
+type fakeCall struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	f := &fakeGateway{replies: []http.HandlerFunc{replyStatus(http.StatusAccepted)}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// reply queues the replies to the next calls.
+func (f *fakeGateway) reply(replies ...http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replies = replies
+}
+
+// received returns the calls received so far.
+func (f *fakeGateway) received() []fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeCall(nil), f.calls...)
+}
+
+func (f *fakeGateway) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeCall{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+	reply := f.replies[0]
+	if len(f.replies) > 1 {
+		f.replies = f.replies[1:]
+	}
+	f.mu.Unlock()
+	reply(w, r)
+}
+
+// replyStatus replies with statusCode and no body.
+func replyStatus(statusCode int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+	}
+}
+
+// replyNever does not reply until the caller gives up.
+func replyNever(w http.ResponseWriter, r *http.Request) {
+	<-r.Context().Done()
+}
+
+// conformance describes an implementation of PaymentGateway to
+// runConformance.
+type conformance struct {
+	// newGateway returns the gateway calling the fakeGateway at url with
+	// client.
+	newGateway func(client *http.Client, url string) PaymentGateway
+	// accepted replies to the calls of a transaction the gateway accepts.
+	accepted http.HandlerFunc
+	// declined replies to a call the gateway refuses outright as the account
+	// does not exist.
+	declined http.HandlerFunc
+	// transactionId reads the id of the transaction a call submitted.
+	transactionId func(t *testing.T, call fakeCall) string
+	// callback returns the callback the gateway sends for the transaction
+	// once it has status, declined for insufficient funds if it failed.
+	callback func(t *testing.T, transactionId string, status models.TransactionStatus) []byte
+	// malformed are callbacks the gateway cannot have sent, by name.
+	malformed map[string][]byte
+}
+
+// runConformance runs the tests every implementation of PaymentGateway must
+// pass.
+func runConformance(t *testing.T, c conformance) {
+	newTransaction := func(txType models.TransactionType) models.Transaction {
+		return models.Transaction{
+			TransactionId: "3f1c2b7e-8d4a-4c6f-a1e9-5b0d7c2e9f41",
+			Type:          string(txType),
+			AccountId:     "234556780987",
+			Amount:        100.50,
+			Currency:      "USD",
+		}
+	}
+	submit := func(ctx context.Context, g PaymentGateway, transaction models.Transaction) error {
+		if transaction.Type == string(models.Withdraw) {
+			return g.Withdraw(ctx, transaction)
+		}
+		return g.Deposit(ctx, transaction)
+	}
+	newClient := func(t *testing.T, timeout time.Duration) *http.Client {
+		client, err := NewHTTPClient(config.HTTPClient{Timeout: timeout})
+		require.NoError(t, err)
+		return client
+	}
+
+	for _, txType := range []models.TransactionType{models.Deposit, models.Withdraw} {
+		t.Run(string(txType)+" accepted", func(t *testing.T) {
+			fake := newFakeGateway(t)
+			fake.reply(c.accepted)
+			g := c.newGateway(newClient(t, 5*time.Second), fake.URL)
+			transaction := newTransaction(txType)
+
+			require.NoError(t, submit(context.Background(), g, transaction))
+			// a card gateway goes on to capture what the first call authorized
+			calls := fake.received()
+			require.NotEmpty(t, calls)
+			assert.Equal(t, transaction.TransactionId, c.transactionId(t, calls[0]))
+		})
+	}
+
+	t.Run("status codes", func(t *testing.T) {
+		tests := []struct {
+			statusCode int
+			kind       ErrorKind
+			code       models.FailureCode
+		}{
+			{http.StatusBadRequest, KindRejected, models.FailureInvalidRequest},
+			{http.StatusUnauthorized, KindRejected, models.FailureInvalidRequest},
+			{http.StatusNotFound, KindRejected, models.FailureInvalidRequest},
+			{http.StatusRequestTimeout, KindTimeout, models.FailureGatewayTimeout},
+			{http.StatusTooManyRequests, KindServer, models.FailureGatewayError},
+			{http.StatusInternalServerError, KindServer, models.FailureGatewayError},
+			{http.StatusBadGateway, KindServer, models.FailureGatewayError},
+			{http.StatusServiceUnavailable, KindServer, models.FailureGatewayError},
+			{http.StatusGatewayTimeout, KindTimeout, models.FailureGatewayTimeout},
+		}
+		fake := newFakeGateway(t)
+		g := c.newGateway(newClient(t, 5*time.Second), fake.URL)
+		for _, test := range tests {
+			t.Run(http.StatusText(test.statusCode), func(t *testing.T) {
+				fake.reply(replyStatus(test.statusCode))
+
+				err := submit(context.Background(), g, newTransaction(models.Deposit))
+				var gatewayErr *Error
+				require.ErrorAs(t, err, &gatewayErr)
+				assert.Equal(t, test.statusCode, gatewayErr.StatusCode)
+				assert.Equal(t, test.kind, gatewayErr.Kind)
+				assert.Equal(t, test.code, gatewayErr.Code)
+				assert.Equal(t, test.kind != KindRejected, IsRetryable(err))
+			})
+		}
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		fake := newFakeGateway(t)
+		fake.reply(c.declined)
+		g := c.newGateway(newClient(t, 5*time.Second), fake.URL)
+
+		err := submit(context.Background(), g, newTransaction(models.Deposit))
+		var gatewayErr *Error
+		require.ErrorAs(t, err, &gatewayErr)
+		assert.Equal(t, KindDeclined, gatewayErr.Kind)
+		assert.Equal(t, models.FailureInvalidAccount, gatewayErr.Code)
+		assert.NotEmpty(t, gatewayErr.Message)
+		assert.False(t, IsRetryable(err))
+	})
+
+	t.Run("client timeout", func(t *testing.T) {
+		fake := newFakeGateway(t)
+		fake.reply(replyNever)
+		g := c.newGateway(newClient(t, 100*time.Millisecond), fake.URL)
+
+		err := submit(context.Background(), g, newTransaction(models.Deposit))
+		var gatewayErr *Error
+		require.ErrorAs(t, err, &gatewayErr)
+		assert.Equal(t, KindTimeout, gatewayErr.Kind)
+		assert.True(t, IsRetryable(err))
+	})
+
+	t.Run("context deadline", func(t *testing.T) {
+		fake := newFakeGateway(t)
+		fake.reply(replyNever)
+		g := c.newGateway(newClient(t, 5*time.Second), fake.URL)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err := submit(ctx, g, newTransaction(models.Deposit))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.True(t, IsRetryable(err))
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		fake := newFakeGateway(t)
+		fake.Close()
+		g := c.newGateway(newClient(t, 5*time.Second), fake.URL)
+
+		err := submit(context.Background(), g, newTransaction(models.Deposit))
+		var gatewayErr *Error
+		require.ErrorAs(t, err, &gatewayErr)
+		assert.Equal(t, KindNetwork, gatewayErr.Kind)
+		assert.True(t, IsRetryable(err))
+	})
+
+	t.Run("resubmission", func(t *testing.T) {
+		// the first call goes through but its response is lost, and the
+		// gateway recognizes the retry as a duplicate
+		fake := newFakeGateway(t)
+		fake.reply(replyStatus(http.StatusGatewayTimeout), replyStatus(http.StatusConflict))
+		g := c.newGateway(newClient(t, 5*time.Second), fake.URL)
+		transaction := newTransaction(models.Deposit)
+
+		err := submit(context.Background(), g, transaction)
+		require.True(t, IsRetryable(err))
+		assert.NoError(t, submit(context.Background(), g, transaction), "a duplicate is accepted")
+		calls := fake.received()
+		require.Len(t, calls, 2)
+		assert.Equal(t, transaction.TransactionId, c.transactionId(t, calls[0]))
+		assert.Equal(t, transaction.TransactionId, c.transactionId(t, calls[1]), "a resubmission is of the same transaction")
+	})
+
+	t.Run("successful callback", func(t *testing.T) {
+		g := c.newGateway(newClient(t, 5*time.Second), "http://gateway.invalid")
+
+		resp, err := g.HandleCallback(c.callback(t, "tx-1", models.Successful))
+		require.NoError(t, err)
+		assert.Equal(t, "tx-1", resp.TransactionId)
+		assert.Equal(t, string(models.Successful), resp.Status)
+		assert.Empty(t, resp.FailureCode)
+		assert.Empty(t, resp.FailureMessage)
+	})
+
+	t.Run("failed callback", func(t *testing.T) {
+		g := c.newGateway(newClient(t, 5*time.Second), "http://gateway.invalid")
+
+		resp, err := g.HandleCallback(c.callback(t, "tx-1", models.Failed))
+		require.NoError(t, err)
+		assert.Equal(t, "tx-1", resp.TransactionId)
+		assert.Equal(t, string(models.Failed), resp.Status)
+		assert.Equal(t, models.FailureInsufficientFunds, resp.FailureCode)
+		assert.NotEmpty(t, resp.FailureMessage)
+	})
+
+	t.Run("malformed callbacks", func(t *testing.T) {
+		g := c.newGateway(newClient(t, 5*time.Second), "http://gateway.invalid")
+		require.NotEmpty(t, c.malformed)
+		for name, payload := range c.malformed {
+			t.Run(name, func(t *testing.T) {
+				_, err := g.HandleCallback(payload)
+				assert.ErrorIs(t, err, ErrMalformedCallback)
+			})
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package gateways
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"payments/models"
+	"payments/soap"
+)
+
+// maxErrorBody caps how much of an error response is read for its details.
+const maxErrorBody = 64 << 10
+
+// ErrorKind classifies a failed gateway call. Network, timeout and server
+// errors are retryable; rejected and declined calls fail the same way again.
+type ErrorKind int
+
+const (
+	// KindNetwork is a call that got no response, e.g. a refused connection.
+	KindNetwork ErrorKind = iota + 1
+	// KindTimeout is a call the gateway did not answer in time.
+	KindTimeout
+	// KindServer is a 5xx or 429 response, or a SOAP Server fault.
+	KindServer
+	// KindRejected is a request the gateway found invalid: a 4xx response or a
+	// SOAP Client or Sender fault without a decline code.
+	KindRejected
+	// KindDeclined is a payment the gateway refused outright, with a decline
+	// code, instead of in its callback.
+	KindDeclined
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindNetwork:
+		return "network"
+	case KindTimeout:
+		return "timeout"
+	case KindServer:
+		return "server"
+	case KindRejected:
+		return "rejected"
+	case KindDeclined:
+		return "declined"
+	default:
+		return fmt.Sprintf("ErrorKind(%d)", int(k))
+	}
+}
+
+// Error is a failed gateway call.
+type Error struct {
+	Kind ErrorKind
+	// StatusCode is that of the response, 0 if there was none.
+	StatusCode int
+	// Code is the failure recorded on the transaction.
+	Code    models.FailureCode
+	Message string
+	// Fault is the SOAP fault gateway B answered with, if it did.
+	Fault *soap.Fault
+	// Err is the error of the http client, for network errors and timeouts.
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return "gateway call failed: " + e.Message
+	}
+	return fmt.Sprintf("gateway failed with status code %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable tells whether the call can succeed if made again.
+func (e *Error) Retryable() bool {
+	return e.Kind == KindNetwork || e.Kind == KindTimeout || e.Kind == KindServer
+}
+
+// IsRetryable tells whether a call that failed with err can succeed if made
+// again. Errors that are not an *Error are retryable.
+func IsRetryable(err error) bool {
+	var gatewayErr *Error
+	if errors.As(err, &gatewayErr) {
+		return gatewayErr.Retryable()
+	}
+	return true
+}
+
+// ActionRequired is the error of a card payment the customer has to
+// authenticate with 3-D Secure before the gateway goes on with it. It is no
+// failure: the payment waits at models.PendingAction until the customer is
+// back from RedirectUrl, and is then submitted again.
+type ActionRequired struct {
+	// RedirectUrl is where the customer completes the challenge.
+	RedirectUrl string
+	// Reference is the gateway's id of the payment.
+	Reference string
+}
+
+func (e *ActionRequired) Error() string {
+	return "customer action required at " + e.RedirectUrl
+}
+
+// transportError classifies an error of http.Client.Do.
+func transportError(err error) *Error {
+	gatewayErr := &Error{Kind: KindNetwork, Code: models.FailureGatewayError, Message: err.Error(), Err: err}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		gatewayErr.Kind = KindTimeout
+		gatewayErr.Code = models.FailureGatewayTimeout
+	}
+	return gatewayErr
+}
+
+// statusError classifies a response with a status code other than 2xx, with
+// the error code and message the gateway sent, if any. clientError tells
+// whether the gateway blamed the request.
+func statusError(statusCode int, clientError bool, codes map[string]models.FailureCode, code, message string) *Error {
+	gatewayErr := &Error{StatusCode: statusCode, Message: describe(code, message)}
+	if code == "" && message == "" {
+		gatewayErr.Message = http.StatusText(statusCode)
+	}
+	mapped, known := codes[code]
+	switch {
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusGatewayTimeout || mapped == models.FailureGatewayTimeout:
+		gatewayErr.Kind, gatewayErr.Code = KindTimeout, models.FailureGatewayTimeout
+	case !clientError || mapped == models.FailureGatewayError:
+		gatewayErr.Kind, gatewayErr.Code = KindServer, models.FailureGatewayError
+	case known:
+		gatewayErr.Kind, gatewayErr.Code = KindDeclined, mapped
+	default:
+		gatewayErr.Kind, gatewayErr.Code = KindRejected, models.FailureInvalidRequest
+	}
+	return gatewayErr
+}
+
+// isDuplicate tells whether a status code is the gateway reporting a call as
+// the resubmission of a transaction it has already accepted. The call is a
+// success then: the callback of the first submission is still to come.
+func isDuplicate(statusCode int) bool {
+	return statusCode == http.StatusConflict
+}
+
+// isClientError tells whether a status code blames the request. 408 and 429
+// are the gateway's to recover from.
+func isClientError(statusCode int) bool {
+	return statusCode >= 400 && statusCode < 500 &&
+		statusCode != http.StatusRequestTimeout && statusCode != http.StatusTooManyRequests
+}
+
+// gateWayAError is the JSON body of gateway A's error responses.
+type gateWayAError struct {
+	ErrorCode    string `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// gateWayAStatusError classifies an error response of gateway A.
+func gateWayAStatusError(resp *http.Response) *Error {
+	var body gateWayAError
+	// a body that is not the gateway's JSON is left out
+	json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&body)
+	return statusError(resp.StatusCode, isClientError(resp.StatusCode), gateWayACodes, body.ErrorCode, body.ErrorMessage)
+}
+
+// gateWayCError is the JSON body of gateway C's error responses.
+type gateWayCError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// gateWayCStatusError classifies an error response of gateway C.
+func gateWayCStatusError(resp *http.Response) *Error {
+	var body gateWayCError
+	// a body that is not the gateway's JSON is left out
+	json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&body)
+	return statusError(resp.StatusCode, isClientError(resp.StatusCode), gateWayCCodes, body.Code, body.Message)
+}
+
+// gateWayBError classifies an error of a call to gateway B, by its SOAP fault
+// if it answered with one and by its status code if not.
+func gateWayBError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return transportError(err)
+	}
+	var statusErr *soap.StatusError
+	if !errors.As(err, &statusErr) {
+		return err
+	}
+	fault := statusErr.Fault
+	if fault == nil {
+		return statusError(statusErr.StatusCode, isClientError(statusErr.StatusCode), gateWayBCodes, "", "")
+	}
+	var detail FaultDetail
+	// a detail that is not the gateway's is left out
+	fault.DecodeDetail(&detail)
+	gatewayErr := statusError(statusErr.StatusCode, fault.Client(), gateWayBCodes, detail.ResponseCode, fault.String)
+	gatewayErr.Fault = fault
+	return gatewayErr
+}
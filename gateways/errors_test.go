@@ -0,0 +1,78 @@
+package gateways
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/url"
+	"payments/models"
+	"payments/soap"
+	"testing"
+)
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		statusCode  int
+		clientError bool
+		code        string
+		kind        ErrorKind
+		failureCode models.FailureCode
+	}{
+		{http.StatusServiceUnavailable, false, "", KindServer, models.FailureGatewayError},
+		{http.StatusTooManyRequests, false, "", KindServer, models.FailureGatewayError},
+		{http.StatusGatewayTimeout, false, "", KindTimeout, models.FailureGatewayTimeout},
+		{http.StatusBadRequest, true, "", KindRejected, models.FailureInvalidRequest},
+		{http.StatusBadRequest, true, "UNKNOWN", KindRejected, models.FailureInvalidRequest},
+		{http.StatusPaymentRequired, true, "INSUFFICIENT_FUNDS", KindDeclined, models.FailureInsufficientFunds},
+		{http.StatusUnprocessableEntity, true, "INTERNAL_ERROR", KindServer, models.FailureGatewayError},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d %s", test.statusCode, test.code), func(t *testing.T) {
+			err := statusError(test.statusCode, test.clientError, gateWayACodes, test.code, "")
+			assert.Equal(t, test.kind, err.Kind)
+			assert.Equal(t, test.failureCode, err.Code)
+			assert.Equal(t, test.kind == KindServer || test.kind == KindTimeout, err.Retryable())
+		})
+	}
+}
+
+func TestTransportError(t *testing.T) {
+	err := transportError(fmt.Errorf("Post: %w", context.DeadlineExceeded))
+	assert.Equal(t, KindTimeout, err.Kind)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = transportError(errors.New("connection refused"))
+	assert.Equal(t, KindNetwork, err.Kind)
+	assert.True(t, IsRetryable(err))
+}
+
+func TestGateWayBError(t *testing.T) {
+	err := gateWayBError(&url.Error{Op: "Post", URL: "http://gateway-b", Err: context.DeadlineExceeded})
+	assert.True(t, IsRetryable(err))
+
+	err = gateWayBError(&soap.StatusError{StatusCode: http.StatusServiceUnavailable})
+	var gatewayErr *Error
+	require.ErrorAs(t, err, &gatewayErr)
+	assert.Equal(t, KindServer, gatewayErr.Kind)
+
+	detail, marshalErr := xml.Marshal(FaultDetail{ResponseCode: "51"})
+	require.NoError(t, marshalErr)
+	fault := &soap.Fault{Code: "env:Sender", String: "Insufficient funds", Detail: detail}
+	err = gateWayBError(&soap.StatusError{StatusCode: http.StatusInternalServerError, Fault: fault})
+	require.ErrorAs(t, err, &gatewayErr)
+	assert.Equal(t, KindDeclined, gatewayErr.Kind)
+	assert.Equal(t, models.FailureInsufficientFunds, gatewayErr.Code)
+	assert.Same(t, fault, gatewayErr.Fault)
+
+	marshalErr = errors.New("xml: unsupported type")
+	assert.Same(t, marshalErr, gateWayBError(marshalErr), "errors before the call are returned as they are")
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, IsRetryable(errors.New("unclassified")))
+	assert.False(t, IsRetryable(fmt.Errorf("depositing: %w", &Error{Kind: KindRejected})))
+}
@@ -0,0 +1,66 @@
+package gateways
+
+import (
+	"fmt"
+	"payments/models"
+)
+
+// gateWayACodes maps the error codes of gateway A's callbacks to failure codes.
+var gateWayACodes = map[string]models.FailureCode{
+	"DO_NOT_HONOR":       models.FailureDeclined,
+	"INSUFFICIENT_FUNDS": models.FailureInsufficientFunds,
+	"ACCOUNT_NOT_FOUND":  models.FailureInvalidAccount,
+	"ACCOUNT_CLOSED":     models.FailureInvalidAccount,
+	"LIMIT_EXCEEDED":     models.FailureLimitExceeded,
+	"INTERNAL_ERROR":     models.FailureGatewayError,
+}
+
+// gateWayBCodes maps the ISO 8583 response codes of gateway B's callbacks to
+// failure codes.
+var gateWayBCodes = map[string]models.FailureCode{
+	"05": models.FailureDeclined,
+	"51": models.FailureInsufficientFunds,
+	"14": models.FailureInvalidAccount,
+	"61": models.FailureLimitExceeded,
+	"91": models.FailureGatewayTimeout,
+	"96": models.FailureGatewayError,
+}
+
+// gateWayCCodes maps the decline codes of gateway C, in its error responses,
+// declined authorizations and webhooks, to failure codes.
+var gateWayCCodes = map[string]models.FailureCode{
+	"card_declined":         models.FailureDeclined,
+	"authentication_failed": models.FailureDeclined,
+	"authorization_expired": models.FailureDeclined,
+	"insufficient_funds":    models.FailureInsufficientFunds,
+	"invalid_card":          models.FailureInvalidAccount,
+	"expired_card":          models.FailureInvalidAccount,
+	"limit_exceeded":        models.FailureLimitExceeded,
+	"issuer_unavailable":    models.FailureGatewayTimeout,
+	"processing_error":      models.FailureGatewayError,
+}
+
+// failure fills in the failure of a failed callback from the gateway's error
+// code and message. Codes missing from codes are declines; the gateway's code
+// is kept in the message.
+func failure(resp *GateWayResponse, codes map[string]models.FailureCode, code, message string) {
+	if resp.Status != string(models.Failed) {
+		return
+	}
+	resp.FailureCode = models.FailureDeclined
+	if mapped, ok := codes[code]; ok {
+		resp.FailureCode = mapped
+	}
+	resp.FailureMessage = describe(code, message)
+	if code == "" && message == "" {
+		resp.FailureMessage = "declined by the gateway"
+	}
+}
+
+// describe is the message of a failure, keeping the gateway's code.
+func describe(code, message string) string {
+	if code == "" {
+		return message
+	}
+	return fmt.Sprintf("%s (gateway code %s)", message, code)
+}
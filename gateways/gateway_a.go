@@ -2,46 +2,55 @@ package gateways
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
-	"github.com/h2non/gock"
-	"log"
-	"math/rand"
 	"net/http"
 	"payments/models"
 	"payments/utils"
-	"time"
 )
 
+// GateWayACallback is the JSON body of gateway A's callbacks.
+type GateWayACallback struct {
+	TransactionId string `json:"transaction_id"`
+	Status        string `json:"status"`
+	Reference     string `json:"reference"`
+	ErrorCode     string `json:"error_code,omitempty"`
+	ErrorMessage  string `json:"error_message,omitempty"`
+}
+
 type GateWayA struct {
+	client         *http.Client
 	gateWayDomain  string
 	withdrawPath   string
 	depositPath    string
 	callbackPrefix string
+	simulated      bool
 }
 
-func NewGateWayA(gateWayDomain, withdrawPath, depositPath, callbackPrefix string) *GateWayA {
+// NewGateWayA returns gateway A, simulated if simulated is set, which takes a
+// client of New.
+func NewGateWayA(client *http.Client, gateWayDomain, withdrawPath, depositPath, callbackPrefix string, simulated bool) *GateWayA {
 	return &GateWayA{
+		client:         client,
 		gateWayDomain:  gateWayDomain,
 		withdrawPath:   withdrawPath,
 		depositPath:    depositPath,
 		callbackPrefix: callbackPrefix,
+		simulated:      simulated,
 	}
 }
 
-func (g *GateWayA) Deposit(transaction models.Transaction) error {
-	err := g.transact(transaction)
+func (g *GateWayA) Deposit(ctx context.Context, transaction models.Transaction) error {
+	err := g.transact(ctx, transaction)
 	return err
 }
 
-func (g *GateWayA) Withdraw(transaction models.Transaction) error {
-	err := g.transact(transaction)
+func (g *GateWayA) Withdraw(ctx context.Context, transaction models.Transaction) error {
+	err := g.transact(ctx, transaction)
 	return err
 }
 
-func (g *GateWayA) transact(transaction models.Transaction) error {
-	defer gock.Off() //
+func (g *GateWayA) transact(ctx context.Context, transaction models.Transaction) error {
 	var path string
 	switch transaction.Type {
 	case string(models.Deposit):
@@ -49,7 +58,6 @@ func (g *GateWayA) transact(transaction models.Transaction) error {
 	case string(models.Withdraw):
 		path = g.withdrawPath
 	}
-	url := g.gateWayDomain + path
 	url, err := utils.JoinUrlPaths(g.gateWayDomain, path)
 	if err != nil {
 		return err
@@ -58,46 +66,8 @@ func (g *GateWayA) transact(transaction models.Transaction) error {
 	if err != nil {
 		return err
 	}
-	// we simulate a third of failures
-	rChoice := rand.Intn(3)
-	if rChoice == 2 { // failure path
-		rStatus := rand.Intn(5) + 500
-		gock.New(g.gateWayDomain).Post(path).Reply(rStatus)
-	} else {
-		defer func() {
-
-			rSeconds := rand.Intn(5)
-			var status string
-			rChoice := rand.Intn(3)
-			if rChoice == 2 {
-				status = string(models.Failed)
-			} else {
-				status = string(models.Successful)
-			}
-			resp := GateWayResponse{
-				TransactionId: transaction.TransactionId,
-				Status:        status,
-			}
-			time.AfterFunc(time.Second*time.Duration(rSeconds), func() {
-				jsonData, err := json.Marshal(resp)
-				if err != nil {
-					log.Printf("Error marshalling json %s", err)
-					return
-				}
-				req, err := http.NewRequest(http.MethodPost, callbackUrl, bytes.NewBuffer(jsonData))
-				if err != nil {
-					log.Printf("error generating request %v", err)
-				}
-				_, err = http.DefaultClient.Do(req)
-				if err != nil {
-					log.Printf("error making request %s", err)
-				}
-
-			})
-
-		}()
-		gock.New(g.gateWayDomain).Post(path).Reply(202)
-
+	if g.simulated {
+		ctx = g.simulate(ctx, transaction, path, callbackUrl)
 	}
 	gateWayReq := GateWayRequest{
 		TransactionId: transaction.TransactionId,
@@ -110,23 +80,39 @@ func (g *GateWayA) transact(transaction models.Transaction) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := g.client.Do(req)
 	if err != nil {
-		return err
+		return transportError(err)
+	}
+	defer resp.Body.Close()
+	if isDuplicate(resp.StatusCode) {
+		return nil
 	}
-	// we might want to isolate client errors (4xx)
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return errors.New(fmt.Sprintf("gateway failed with status code %d", resp.StatusCode))
+		return gateWayAStatusError(resp)
 	}
 	return nil
 }
 
 func (g *GateWayA) HandleCallback(payload []byte) (GateWayResponse, error) {
-	var resp GateWayResponse
-	err := json.Unmarshal(payload, &resp)
-	return resp, err
+	var callback GateWayACallback
+	err := json.Unmarshal(payload, &callback)
+	if err != nil {
+		return GateWayResponse{}, malformed(err)
+	}
+	resp := GateWayResponse{
+		TransactionId: callback.TransactionId,
+		Status:        callback.Status,
+		Reference:     callback.Reference,
+	}
+	err = checkCallback(resp)
+	if err != nil {
+		return GateWayResponse{}, err
+	}
+	failure(&resp, gateWayACodes, callback.ErrorCode, callback.ErrorMessage)
+	return resp, nil
 }
@@ -1,14 +1,17 @@
 package gateways
 
 import (
-	"github.com/h2non/gock"
+	"context"
+	"encoding/json"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
 	"payments/models"
 	"testing"
 )
 
 func TestNewGateWayA(t *testing.T) {
-	gateWay := NewGateWayA("https://gateway.example.com", "/withdraw", "/deposit", "https://callback.example.com")
+	gateWay := NewGateWayA(newTestClient(t), "https://gateway.example.com", "/withdraw", "/deposit", "https://callback.example.com", false)
 	assert.NotNil(t, gateWay)
 	assert.Equal(t, "https://gateway.example.com", gateWay.gateWayDomain)
 	assert.Equal(t, "/withdraw", gateWay.withdrawPath)
@@ -16,97 +19,117 @@ func TestNewGateWayA(t *testing.T) {
 	assert.Equal(t, "https://callback.example.com", gateWay.callbackPrefix)
 }
 
-func TestGateWayA_Deposit_Success(t *testing.T) {
-	gock.Off() // Clean up previous mocks
-	defer gock.Off()
-
-	transaction := models.Transaction{
-		TransactionId: "12345",
-		Amount:        100.0,
-		Currency:      "USD",
-		Type:          string(models.Deposit),
-	}
-
-	gock.New("https://gateway.example.com").
-		Post("/deposit").
-		Reply(202) // HTTP 202 Accepted
-
-	gock.New("https://callback.example.com").
-		Post("12345").
-		Reply(200) // Simulating callback success
-
-	gateWay := NewGateWayA("https://gateway.example.com", "/withdraw", "/deposit", "https://callback.example.com")
-	err := gateWay.Deposit(transaction)
-
-	assert.NoError(t, err)
+func TestGateWayA_Conformance(t *testing.T) {
+	runConformance(t, conformance{
+		newGateway: func(client *http.Client, url string) PaymentGateway {
+			return NewGateWayA(client, url, "/withdraw", "/deposit", "https://callback.example.com", false)
+		},
+		accepted: replyStatus(http.StatusAccepted),
+		declined: replyGateWayAError(http.StatusBadRequest, "ACCOUNT_NOT_FOUND", "Account not found"),
+		transactionId: func(t *testing.T, call fakeCall) string {
+			var req GateWayRequest
+			require.NoError(t, json.Unmarshal(call.Body, &req))
+			return req.TransactionId
+		},
+		callback: func(t *testing.T, transactionId string, status models.TransactionStatus) []byte {
+			callback := GateWayACallback{TransactionId: transactionId, Status: string(status), Reference: "A-00000042"}
+			if status == models.Failed {
+				callback.ErrorCode, callback.ErrorMessage = "INSUFFICIENT_FUNDS", "Insufficient funds"
+			}
+			data, err := json.Marshal(callback)
+			require.NoError(t, err)
+			return data
+		},
+		malformed: map[string][]byte{
+			"not json":          []byte(`<TransactionResponse/>`),
+			"truncated":         []byte(`{"transaction_id":"tx-1","status":"succ`),
+			"wrong type":        []byte(`{"transaction_id":12345,"status":"successful"}`),
+			"no transaction id": []byte(`{"status":"successful"}`),
+			"unknown status":    []byte(`{"transaction_id":"tx-1","status":"SUCCESS"}`),
+		},
+	})
 }
-func TestGateWayA_Withdraw_Success(t *testing.T) {
-	gock.Off() // Clean up previous mocks
-	defer gock.Off()
 
-	// Setting up mock HTTP response
-	transaction := models.Transaction{
-		TransactionId: "12345",
-		Amount:        100.0,
-		Currency:      "USD",
-		Type:          string(models.Withdraw),
+// replyGateWayAError replies with an error of gateway A.
+func replyGateWayAError(statusCode int, code, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(gateWayAError{ErrorCode: code, ErrorMessage: message})
 	}
-
-	gock.New("https://gateway.example.com").
-		Post("/withdraw").
-		Reply(202) // HTTP 202 Accepted
-
-	gock.New("https://callback.example.com").
-		Post("12345").
-		Reply(200) // Simulating callback success
-
-	gateWay := NewGateWayA("https://gateway.example.com", "/withdraw", "/deposit", "https://callback.example.com")
-	err := gateWay.Withdraw(transaction)
-
-	assert.NoError(t, err)
 }
 
-func TestGateWayA_Deposit_Failure(t *testing.T) {
-	gock.Off() // Clean up previous mocks
-	defer gock.Off()
-
-	// Setting up mock HTTP response for failure
-	transaction := models.Transaction{
+func TestGateWayA_Paths(t *testing.T) {
+	fake := newFakeGateway(t)
+	gateWay := NewGateWayA(newTestClient(t), fake.URL, "/withdraw", "/deposit", "https://callback.example.com", false)
+	transaction := models.Transaction{TransactionId: "12345", Type: string(models.Deposit), Amount: 100.0, Currency: "USD", AccountId: "234556780987"}
+
+	require.NoError(t, gateWay.Deposit(context.Background(), transaction))
+	transaction.Type = string(models.Withdraw)
+	require.NoError(t, gateWay.Withdraw(context.Background(), transaction))
+
+	calls := fake.received()
+	require.Len(t, calls, 2)
+	assert.Equal(t, "/deposit", calls[0].Path)
+	assert.Equal(t, "/withdraw", calls[1].Path)
+	var req GateWayRequest
+	require.NoError(t, json.Unmarshal(calls[1].Body, &req))
+	assert.Equal(t, GateWayRequest{
 		TransactionId: "12345",
 		Amount:        100.0,
 		Currency:      "USD",
-		Type:          string(models.Deposit),
-	}
-
-	gock.New("https://gateway.example.com").
-		Post("/deposit").
-		Reply(500) // Simulate an internal server error
-
-	gateWay := NewGateWayA("https://gateway.example.com", "/withdraw", "/deposit", "https://callback.example.com")
-	err := gateWay.Deposit(transaction)
-
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "gateway failed with status code 500")
+		CallbackUrl:   "https://callback.example.com/12345",
+		Account:       "234556780987",
+	}, req)
 }
-func TestGateWayA_Withdraw_Failure(t *testing.T) {
-	gock.Off() // Clean up previous mocks
-	defer gock.Off()
 
-	// Setting up mock HTTP response for failure
-	transaction := models.Transaction{
-		TransactionId: "12345",
-		Amount:        100.0,
-		Currency:      "USD",
-		Type:          string(models.Withdraw),
+func TestGateWayA_HandleCallback(t *testing.T) {
+	g := NewGateWayA(newTestClient(t), "https://gateway.example.com", "/withdraw", "/deposit", "https://callback.example.com", false)
+	tests := map[string]struct {
+		payload string
+		want    GateWayResponse
+	}{
+		"successful": {
+			payload: `{"transaction_id":"12345","status":"successful","reference":"A-00000042"}`,
+			want:    GateWayResponse{TransactionId: "12345", Status: "successful", Reference: "A-00000042"},
+		},
+		"declined": {
+			payload: `{"transaction_id":"12345","status":"failed","reference":"A-00000042","error_code":"ACCOUNT_CLOSED","error_message":"Account is closed"}`,
+			want: GateWayResponse{TransactionId: "12345", Status: "failed", Reference: "A-00000042",
+				FailureCode: models.FailureInvalidAccount, FailureMessage: "Account is closed (gateway code ACCOUNT_CLOSED)"},
+		},
+		"unknown code": {
+			payload: `{"transaction_id":"12345","status":"failed","error_code":"FRAUD_SUSPECTED","error_message":"Suspected fraud"}`,
+			want: GateWayResponse{TransactionId: "12345", Status: "failed",
+				FailureCode: models.FailureDeclined, FailureMessage: "Suspected fraud (gateway code FRAUD_SUSPECTED)"},
+		},
+		"no code": {
+			payload: `{"transaction_id":"12345","status":"failed"}`,
+			want: GateWayResponse{TransactionId: "12345", Status: "failed",
+				FailureCode: models.FailureDeclined, FailureMessage: "declined by the gateway"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := g.HandleCallback([]byte(test.payload))
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, resp)
+		})
 	}
+}
 
-	gock.New("https://gateway.example.com").
-		Post("/withdraw").
-		Reply(500) // Simulate an internal server error
+func TestGateWayA_Deposit_Rejected(t *testing.T) {
+	fake := newFakeGateway(t)
+	fake.reply(replyGateWayAError(http.StatusBadRequest, "ACCOUNT_NOT_FOUND", "Account not found"))
+	transaction := models.Transaction{TransactionId: "12345", Amount: 100.0, Currency: "USD", Type: string(models.Deposit)}
 
-	gateWay := NewGateWayA("https://gateway.example.com", "/withdraw", "/deposit", "https://callback.example.com")
-	err := gateWay.Withdraw(transaction)
+	gateWay := NewGateWayA(newTestClient(t), fake.URL, "/withdraw", "/deposit", "https://callback.example.com", false)
+	err := gateWay.Deposit(context.Background(), transaction)
 
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "gateway failed with status code 500")
+	var gatewayErr *Error
+	assert.ErrorAs(t, err, &gatewayErr)
+	assert.False(t, IsRetryable(err))
+	assert.Equal(t, KindDeclined, gatewayErr.Kind)
+	assert.Equal(t, models.FailureInvalidAccount, gatewayErr.Code)
+	assert.Equal(t, "gateway failed with status code 400: Account not found (gateway code ACCOUNT_NOT_FOUND)", err.Error())
 }
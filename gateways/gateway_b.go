@@ -1,204 +1,145 @@
 package gateways
 
 import (
-	"bytes"
+	"context"
 	"encoding/xml"
 	"errors"
-	"fmt"
-	"github.com/h2non/gock"
-	"log"
-	"math/rand"
 	"net/http"
 	"payments/models"
+	"payments/soap"
 	"payments/utils"
 	"time"
 )
 
-type WithdrawEnvelope struct {
-	XMLName xml.Name     `xml:"soapenv:Envelope"`
-	SoapEnv string       `xml:"xmlns:soapenv,attr"`
-	Web     string       `xml:"xmlns:web,attr"`
-	Body    WithdrawBody `xml:"soapenv:Body"`
-}
-type WithdrawBody struct {
-	Withdraw WithdrawRequest `xml:"web:Withdraw"`
-}
-type WithdrawRequest struct {
-	Account       string  `xml:"xmlns:account,attr"`
-	TransactionID string  `xml:"xmlns:transaction,attr"`
-	Amount        float64 `xml:"xmlns:amount,attr"`
-	Currency      string  `xml:"xmlns:currency,attr"`
-	Callback      string  `xml:"xmlns:callback,attr"`
-}
+// GateWayBNamespace is the target namespace of gateway B's service, described
+// in gateway_b.wsdl. The types below are those of its schema.
+const GateWayBNamespace = "urn:gateway-b:payments:v1"
 
-type DepositEnvelope struct {
-	XMLName xml.Name    `xml:"soapenv:Envelope"`
-	SoapEnv string      `xml:"xmlns:soapenv,attr"`
-	Web     string      `xml:"xmlns:web,attr"`
-	Body    DepositBody `xml:"soapenv:Body"`
-}
+// SOAP actions of gateway B's operations.
+const (
+	GateWayBDepositAction  = GateWayBNamespace + "/Deposit"
+	GateWayBWithdrawAction = GateWayBNamespace + "/Withdraw"
+)
 
-type DepositBody struct {
-	Deposit DepositRequest `xml:"web:Deposit"`
+// PaymentRequest is the content of the Deposit and Withdraw requests.
+type PaymentRequest struct {
+	TransactionId string  `xml:"TransactionId"`
+	Account       string  `xml:"Account"`
+	Amount        float64 `xml:"Amount"`
+	Currency      string  `xml:"Currency"`
+	CallbackUrl   string  `xml:"CallbackUrl"`
 }
 
 type DepositRequest struct {
-	Account       string  `xml:"xmlns:account,attr"`
-	TransactionID string  `xml:"xmlns:transaction,attr"`
-	Amount        float64 `xml:"xmlns:amount,attr"`
-	Currency      string  `xml:"xmlns:currency,attr"`
-	Callback      string  `xml:"xmlns:callback,attr"`
-}
-type EnvelopeResponse struct {
-	XMLName xml.Name `xml:"Envelope"`
-	Body    BodyResponse
+	XMLName xml.Name `xml:"urn:gateway-b:payments:v1 Deposit"`
+	PaymentRequest
 }
 
-type BodyResponse struct {
-	TransactionResponse TransactionResponse `xml:"TransactionResponse"`
+type WithdrawRequest struct {
+	XMLName xml.Name `xml:"urn:gateway-b:payments:v1 Withdraw"`
+	PaymentRequest
 }
+
+// TransactionResponse is the body of gateway B's callbacks.
 type TransactionResponse struct {
-	TransactionId string `xml:"TransactionId"`
-	Status        string `xml:"Status"`
+	XMLName          xml.Name `xml:"urn:gateway-b:payments:v1 TransactionResponse"`
+	TransactionId    string   `xml:"TransactionId"`
+	Status           string   `xml:"Status"`
+	Reference        string   `xml:"Reference,omitempty"`
+	ResponseCode     string   `xml:"ResponseCode,omitempty"`
+	ErrorDescription string   `xml:"ErrorDescription,omitempty"`
+}
+
+// FaultDetail is the detail of gateway B's faults.
+type FaultDetail struct {
+	XMLName      xml.Name `xml:"urn:gateway-b:payments:v1 FaultDetail"`
+	ResponseCode string   `xml:"ResponseCode,omitempty"`
 }
 
 type GateWayB struct {
+	client         *soap.Client
 	gateWayUrl     string
 	callbackPrefix string
+	simulated      bool
 }
 
-func NewGateWayB(gateWayUrl, callbackPrefix string) *GateWayB {
+// NewGateWayB returns gateway B, speaking version of SOAP, authenticating with
+// a WS-Security header if security is set and simulated if simulated is set,
+// which takes a client of New.
+func NewGateWayB(client *http.Client, gateWayUrl, callbackPrefix string, version soap.Version, security *WSSecurity, simulated bool) *GateWayB {
+	soapClient := soap.NewClient(client, gateWayUrl, version)
+	if security != nil {
+		soapClient.Header = func() ([]any, error) {
+			header, err := security.Header(time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return []any{header}, nil
+		}
+	}
 	return &GateWayB{
+		client:         soapClient,
 		gateWayUrl:     gateWayUrl,
 		callbackPrefix: callbackPrefix,
+		simulated:      simulated,
 	}
 }
 
-func (g *GateWayB) transact(transaction models.Transaction) error {
-	defer gock.Off()
-	var payload []byte
+func (g *GateWayB) transact(ctx context.Context, transaction models.Transaction) error {
 	callbackUrl, err := utils.JoinUrlPaths(g.callbackPrefix, transaction.TransactionId)
 	if err != nil {
 		return err
 	}
-	switch transaction.Type {
-	case string(models.Deposit):
-		depositEnvelope := DepositEnvelope{
-			SoapEnv: "http://schemas.xmlsoap.org/soap/envelope/",
-			Web:     g.gateWayUrl,
-			Body: DepositBody{
-				Deposit: DepositRequest{
-					Account:  transaction.AccountId,
-					Amount:   transaction.Amount,
-					Currency: transaction.Currency,
-					Callback: callbackUrl,
-				},
-			},
-		}
-		payload, err = xml.Marshal(depositEnvelope)
-		if err != nil {
-			return err
-		}
-
-	case string(models.Withdraw):
-		withdrawEnvelope := WithdrawEnvelope{
-			SoapEnv: "http://schemas.xmlsoap.org/soap/envelope/",
-			Web:     g.gateWayUrl,
-			Body: WithdrawBody{
-				Withdraw: WithdrawRequest{
-					Account:  transaction.AccountId,
-					Amount:   transaction.Amount,
-					Currency: transaction.Currency,
-					Callback: callbackUrl,
-				},
-			},
-		}
-		payload, err = xml.Marshal(withdrawEnvelope)
-		if err != nil {
-			return err
-		}
+	request := PaymentRequest{
+		TransactionId: transaction.TransactionId,
+		Account:       transaction.AccountId,
+		Amount:        transaction.Amount,
+		Currency:      transaction.Currency,
+		CallbackUrl:   callbackUrl,
 	}
-	soapReq := append([]byte(xml.Header), payload...)
-	// we simulate a third of failures
-	rChoice := rand.Intn(3)
-	if rChoice == 2 {
-		rStatus := rand.Intn(5) + 500
-		gock.New(g.gateWayUrl).Post("/").Reply(rStatus)
-	} else {
-		defer func() {
-
-			rSeconds := rand.Intn(5) // simulate callback delay
-			var status string
-			rChoice := rand.Intn(3)
-			if rChoice == 2 {
-				status = string(models.Failed)
-			} else {
-				status = string(models.Successful)
-			}
-
-			respPayload := EnvelopeResponse{
-				Body: BodyResponse{
-					TransactionResponse: TransactionResponse{
-						TransactionId: transaction.TransactionId,
-						Status:        status,
-					},
-				},
-			}
-			time.AfterFunc(time.Second*time.Duration(rSeconds), func() {
-				xmlData, err := xml.Marshal(respPayload)
-				if err != nil {
-					log.Printf("Error marshalling json %s", err)
-					return
-				}
-				xmlData = append([]byte(xml.Header), xmlData...)
-				req, err := http.NewRequest(http.MethodPost, callbackUrl, bytes.NewBuffer(xmlData))
-				if err != nil {
-					log.Printf("error generating request %v", err)
-				}
-				_, err = http.DefaultClient.Do(req)
-				if err != nil {
-					log.Printf("error making request %s", err)
-				}
-
-			})
-
-		}()
-		gock.New(g.gateWayUrl).Post("/").Reply(202)
+	action, body := GateWayBDepositAction, any(DepositRequest{PaymentRequest: request})
+	if transaction.Type == string(models.Withdraw) {
+		action, body = GateWayBWithdrawAction, WithdrawRequest{PaymentRequest: request}
 	}
-	req, err := http.NewRequest(http.MethodPost, g.gateWayUrl, bytes.NewBuffer(soapReq))
-	if err != nil {
-		return err
+	if g.simulated {
+		ctx = g.simulate(ctx, transaction, callbackUrl)
 	}
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	err = g.client.Call(ctx, action, body, nil)
+	var statusErr *soap.StatusError
+	if errors.As(err, &statusErr) && isDuplicate(statusErr.StatusCode) {
+		return nil
 	}
-	// we might want to isolate client errors (4xx)
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return errors.New(fmt.Sprintf("gateway failed with status code %d", resp.StatusCode))
+	if err != nil {
+		return gateWayBError(err)
 	}
 	return nil
 }
 
-func (g *GateWayB) Deposit(transaction models.Transaction) error {
-	err := g.transact(transaction)
+func (g *GateWayB) Deposit(ctx context.Context, transaction models.Transaction) error {
+	err := g.transact(ctx, transaction)
 	return err
 }
-func (g *GateWayB) Withdraw(transaction models.Transaction) error {
-	err := g.transact(transaction)
+func (g *GateWayB) Withdraw(ctx context.Context, transaction models.Transaction) error {
+	err := g.transact(ctx, transaction)
 	return err
 }
 
 func (g *GateWayB) HandleCallback(payload []byte) (GateWayResponse, error) {
-	var resp EnvelopeResponse
+	var transactionResp TransactionResponse
 	var gateWayResponse GateWayResponse
-	err := xml.Unmarshal(payload, &resp)
+	err := soap.Unmarshal(payload, g.client.Version(), &transactionResp)
 	if err != nil {
-		return gateWayResponse, err
+		return gateWayResponse, malformed(err)
 	}
 	gateWayResponse = GateWayResponse{
-		TransactionId: resp.Body.TransactionResponse.TransactionId,
-		Status:        resp.Body.TransactionResponse.Status,
+		TransactionId: transactionResp.TransactionId,
+		Status:        transactionResp.Status,
+		Reference:     transactionResp.Reference,
+	}
+	err = checkCallback(gateWayResponse)
+	if err != nil {
+		return GateWayResponse{}, err
 	}
+	failure(&gateWayResponse, gateWayBCodes, transactionResp.ResponseCode, transactionResp.ErrorDescription)
 	return gateWayResponse, nil
 }
@@ -1,91 +1,247 @@
 package gateways
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/xml"
-	"github.com/h2non/gock"
+	"flag"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"payments/config"
 	"payments/models"
+	"payments/soap"
 	"testing"
+	"time"
 )
 
-func TestGateWayB_Deposit(t *testing.T) {
-	defer gock.Off() // Disable HTTP intercepting after the test
-
-	g := NewGateWayB("http://mock-gateway.com", "http://callback.com")
-	transaction := models.Transaction{
-		TransactionId: "12345",
-		Type:          string(models.Deposit),
-		Amount:        100.50,
-		Currency:      "USD",
-	}
-
-	// Mock the gateway response
-	gock.New("http://mock-gateway.com").
-		Post("/").
-		Reply(202)
-
-	err := g.Deposit(transaction)
+func TestGateWayB_HandleCallback_Declined(t *testing.T) {
+	g := NewGateWayB(newTestClient(t), "http://mock-gateway.com", "http://callback.com", soap.V11, nil, false)
+	xmlData, err := soap.Marshal(soap.Envelope{
+		Version: soap.V11,
+		Body: TransactionResponse{
+			TransactionId:    "12345",
+			Status:           string(models.Failed),
+			Reference:        "B000000000042",
+			ResponseCode:     "51",
+			ErrorDescription: "Insufficient funds",
+		},
+	})
+	assert.NoError(t, err)
 
+	callbackResp, err := g.HandleCallback(xmlData)
 	assert.NoError(t, err)
-	assert.True(t, gock.IsDone()) // Ensure the mock was called
+	assert.Equal(t, "B000000000042", callbackResp.Reference)
+	assert.Equal(t, models.FailureInsufficientFunds, callbackResp.FailureCode)
+	assert.Equal(t, "Insufficient funds (gateway code 51)", callbackResp.FailureMessage)
 }
-func TestGateWayB_Withdraw(t *testing.T) {
-	defer gock.Off()
-
-	g := NewGateWayB("http://mock-gateway.com", "http://callback.com")
-	transaction := models.Transaction{
-		TransactionId: "54321",
-		Type:          string(models.Withdraw),
-		Amount:        50.75,
-		Currency:      "USD",
+func TestGateWayB_Conformance(t *testing.T) {
+	for _, version := range []soap.Version{soap.V11, soap.V12} {
+		other := soap.V12
+		if version == soap.V12 {
+			other = soap.V11
+		}
+		envelope := func(t *testing.T, version soap.Version, body any) []byte {
+			data, err := soap.Marshal(soap.Envelope{Version: version, Body: body})
+			require.NoError(t, err)
+			return data
+		}
+		t.Run("SOAP "+version.String(), func(t *testing.T) {
+			runConformance(t, conformance{
+				newGateway: func(client *http.Client, url string) PaymentGateway {
+					return NewGateWayB(client, url, "http://callback.com", version, nil, false)
+				},
+				accepted: replyStatus(http.StatusAccepted),
+				declined: func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write(simulatedFault(version))
+				},
+				transactionId: func(t *testing.T, call fakeCall) string {
+					var req PaymentRequest
+					require.NoError(t, soap.Unmarshal(call.Body, version, &req))
+					return req.TransactionId
+				},
+				callback: func(t *testing.T, transactionId string, status models.TransactionStatus) []byte {
+					resp := TransactionResponse{TransactionId: transactionId, Status: string(status), Reference: "B000000000042"}
+					if status == models.Failed {
+						resp.ResponseCode, resp.ErrorDescription = "51", "Insufficient funds"
+					}
+					return envelope(t, version, resp)
+				},
+				malformed: map[string][]byte{
+					"not xml":            []byte(`{"transaction_id":"tx-1","status":"successful"}`),
+					"not an envelope":    []byte(`<TransactionResponse xmlns="urn:gateway-b:payments:v1"><TransactionId>tx-1</TransactionId><Status>successful</Status></TransactionResponse>`),
+					"other soap version": envelope(t, other, TransactionResponse{TransactionId: "tx-1", Status: string(models.Successful)}),
+					"fault":              simulatedFault(version),
+					"no namespace": envelope(t, version, struct {
+						XMLName       xml.Name `xml:"TransactionResponse"`
+						TransactionId string
+						Status        string
+					}{TransactionId: "tx-1", Status: string(models.Successful)}),
+					"no transaction id": envelope(t, version, TransactionResponse{Status: string(models.Successful)}),
+					"unknown status":    envelope(t, version, TransactionResponse{TransactionId: "tx-1", Status: "SUCCESS"}),
+				},
+			})
+		})
 	}
-
-	gock.New("http://mock-gateway.com").
-		Post("/").
-		Reply(202)
-
-	err := g.Withdraw(transaction)
-
-	assert.NoError(t, err)
-	assert.True(t, gock.IsDone())
 }
-func TestGateWayB_HandleCallback(t *testing.T) {
-	g := NewGateWayB("http://mock-gateway.com", "http://callback.com")
 
-	respPayload := EnvelopeResponse{
-		Body: BodyResponse{
-			TransactionResponse: TransactionResponse{
-				TransactionId: "12345",
-				Status:        "SUCCESS",
-			},
-		},
+func TestGateWayB_Deposit_Fault(t *testing.T) {
+	fake := newFakeGateway(t)
+	fake.reply(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(simulatedFault(soap.V11))
+	})
+	g := NewGateWayB(newTestClient(t), fake.URL, "http://callback.com", soap.V11, nil, false)
+	transaction := models.Transaction{TransactionId: "12345", Type: string(models.Deposit), Amount: 100.50, Currency: "USD"}
+
+	err := g.Deposit(context.Background(), transaction)
+
+	var gatewayErr *Error
+	assert.ErrorAs(t, err, &gatewayErr)
+	assert.False(t, IsRetryable(err), "a Client fault is permanent whatever the status code")
+	assert.Equal(t, models.FailureInvalidAccount, gatewayErr.Code)
+	if assert.NotNil(t, gatewayErr.Fault) {
+		assert.Equal(t, "soapenv:Client", gatewayErr.Fault.Code)
+		var detail FaultDetail
+		require.NoError(t, gatewayErr.Fault.DecodeDetail(&detail))
+		assert.Equal(t, "14", detail.ResponseCode)
 	}
+}
 
-	xmlData, err := xml.Marshal(respPayload)
-	assert.NoError(t, err)
-
-	callbackResp, err := g.HandleCallback(xmlData)
-	assert.NoError(t, err)
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
 
-	assert.Equal(t, "12345", callbackResp.TransactionId)
-	assert.Equal(t, "SUCCESS", callbackResp.Status)
+// assertGolden compares got with testdata/name, rewriting it with -update.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		require.NoError(t, os.WriteFile(path, got, 0o644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
 }
-func TestGateWayB_Transact_Error(t *testing.T) {
-	g := NewGateWayB("http://mock-gateway.com", "http://callback.com")
-	transaction := models.Transaction{
-		TransactionId: "error-id",
-		Type:          string(models.Deposit),
-		Amount:        100.50,
-		Currency:      "USD",
+
+func TestGateWayB_Requests(t *testing.T) {
+	tests := []struct {
+		golden      string
+		version     soap.Version
+		txType      models.TransactionType
+		soapAction  string
+		contentType string
+	}{
+		{"gateway_b_deposit.soap1.1.xml", soap.V11, models.Deposit, `"urn:gateway-b:payments:v1/Deposit"`, "text/xml; charset=utf-8"},
+		{"gateway_b_withdraw.soap1.1.xml", soap.V11, models.Withdraw, `"urn:gateway-b:payments:v1/Withdraw"`, "text/xml; charset=utf-8"},
+		{"gateway_b_deposit.soap1.2.xml", soap.V12, models.Deposit, "", `application/soap+xml; action="urn:gateway-b:payments:v1/Deposit"; charset=utf-8`},
+	}
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			var header http.Header
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header.Clone()
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer server.Close()
+			g := NewGateWayB(server.Client(), server.URL, "http://callback.com", test.version, nil, false)
+			transaction := models.Transaction{
+				TransactionId: "7d4a0c1e-5b2f-4f7a-9c3e-2a1b0d9e8f76",
+				Type:          string(test.txType),
+				AccountId:     "234556780987",
+				Amount:        100.50,
+				Currency:      "USD",
+			}
+
+			var err error
+			if test.txType == models.Withdraw {
+				err = g.Withdraw(context.Background(), transaction)
+			} else {
+				err = g.Deposit(context.Background(), transaction)
+			}
+			require.NoError(t, err)
+			assertGolden(t, test.golden, body)
+			assert.Equal(t, test.soapAction, header.Get("SOAPAction"))
+			assert.Equal(t, test.contentType, header.Get("Content-Type"))
+		})
 	}
+}
 
-	// Mock the gateway response with an error
-	gock.New("http://mock-gateway.com").
-		Post("/").
-		Reply(500)
+func TestGateWayB_Deposit_SenderFault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", soap.V12.ContentType(""))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(simulatedFault(soap.V12))
+	}))
+	defer server.Close()
+	g := NewGateWayB(server.Client(), server.URL, "http://callback.com", soap.V12, nil, false)
+
+	err := g.Deposit(context.Background(), models.Transaction{TransactionId: "12345", Type: string(models.Deposit), Amount: 100.50, Currency: "USD"})
+	var gatewayErr *Error
+	require.ErrorAs(t, err, &gatewayErr)
+	assert.False(t, IsRetryable(err))
+	assert.Equal(t, models.FailureInvalidAccount, gatewayErr.Code)
+	assert.Equal(t, "Invalid account (gateway code 14)", gatewayErr.Message)
+}
 
-	err := g.Deposit(transaction)
+// soapRequest is what a stand-in for gateway B reads of a request.
+type soapRequest struct {
+	Security struct {
+		Timestamp struct {
+			Expires string `xml:"Expires"`
+		} `xml:"Timestamp"`
+		UsernameToken struct {
+			Username string `xml:"Username"`
+			Password string `xml:"Password"`
+			Nonce    string `xml:"Nonce"`
+			Created  string `xml:"Created"`
+		} `xml:"UsernameToken"`
+	} `xml:"Header>Security"`
+	Deposit struct {
+		Amount string `xml:"Amount"`
+	} `xml:"Body>Deposit"`
+}
 
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "gateway failed with status code 500")
+func TestGateWayB_Deposit_MutualTLSAndWSSecurity(t *testing.T) {
+	cert, certDer, keyDer := newClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	received := make(chan soapRequest, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req soapRequest
+		assert.NoError(t, xml.NewDecoder(r.Body).Decode(&req))
+		received <- req
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	dir := t.TempDir()
+	client, err := NewHTTPClient(config.HTTPClient{
+		Timeout:  5 * time.Second,
+		CAFile:   writePEM(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw),
+		CertFile: writePEM(t, dir, "client.pem", "CERTIFICATE", certDer),
+		KeyFile:  writePEM(t, dir, "client.key", "EC PRIVATE KEY", keyDer),
+	})
+	require.NoError(t, err)
+	security := &WSSecurity{Username: "merchant", Password: "s3cret", Digest: true, TTL: time.Minute}
+	g := NewGateWayB(client, server.URL, "http://callback.com", soap.V11, security, false)
+
+	err = g.Deposit(context.Background(), models.Transaction{TransactionId: "12345", Type: string(models.Deposit), Amount: 100.50, Currency: "USD"})
+	require.NoError(t, err)
+	req := <-received
+	token := req.Security.UsernameToken
+	assert.Equal(t, "merchant", token.Username)
+	nonce, err := base64.StdEncoding.DecodeString(token.Nonce)
+	require.NoError(t, err)
+	assert.Equal(t, PasswordDigestOf(nonce, token.Created, "s3cret"), token.Password)
+	assert.NotEmpty(t, req.Security.Timestamp.Expires)
+	assert.Equal(t, "100.5", req.Deposit.Amount)
 }
@@ -0,0 +1,312 @@
+package gateways
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"payments/models"
+	"payments/utils"
+)
+
+// Gateway C is a card processor. Users pay with a card token it issued rather
+// than an account id. A deposit authorizes the card, which may take a 3-D
+// Secure challenge first, then captures the authorization, voiding it if the
+// capture is refused; a withdrawal is a payout to the card. Every call carries
+// an Idempotency-Key, so a resubmitted transaction picks up where the last
+// attempt stopped. A deposit back from its challenge is not authorized again:
+// the gateway would replay the challenge, so the authorization is looked up.
+
+// Statuses of gateway C's authorizations.
+const (
+	GateWayCAuthorized     = "authorized"
+	GateWayCRequiresAction = "requires_action"
+	GateWayCCaptured       = "captured"
+	GateWayCDeclined       = "declined"
+	GateWayCVoided         = "voided"
+)
+
+// Types of gateway C's webhooks.
+const (
+	GateWayCPaymentCaptured      = "payment.captured"
+	GateWayCPaymentDeclined      = "payment.declined"
+	GateWayCAuthorizationExpired = "authorization.expired"
+	GateWayCAuthorizationVoided  = "authorization.voided"
+	GateWayCPayoutPaid           = "payout.paid"
+	GateWayCPayoutFailed         = "payout.failed"
+)
+
+// gateWayCWebhookStatuses maps the types of webhooks to the status they
+// settle a transaction with.
+var gateWayCWebhookStatuses = map[string]models.TransactionStatus{
+	GateWayCPaymentCaptured:      models.Successful,
+	GateWayCPayoutPaid:           models.Successful,
+	GateWayCPaymentDeclined:      models.Failed,
+	GateWayCAuthorizationExpired: models.Failed,
+	GateWayCAuthorizationVoided:  models.Failed,
+	GateWayCPayoutFailed:         models.Failed,
+}
+
+// GateWayCAuthorizationRequest is the JSON body of an authorization.
+type GateWayCAuthorizationRequest struct {
+	TransactionId string  `json:"transaction_id"`
+	CardToken     string  `json:"card_token"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	// ReturnUrl is where the customer is sent after a 3-D Secure challenge.
+	ReturnUrl   string `json:"return_url"`
+	CallbackUrl string `json:"callback_url"`
+}
+
+// GateWayCPayoutRequest is the JSON body of a payout.
+type GateWayCPayoutRequest struct {
+	TransactionId string  `json:"transaction_id"`
+	CardToken     string  `json:"card_token"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	CallbackUrl   string  `json:"callback_url"`
+}
+
+// GateWayCAuthorization is an authorization as gateway C answers calls on it.
+type GateWayCAuthorization struct {
+	Id            string `json:"id"`
+	TransactionId string `json:"transaction_id"`
+	Status        string `json:"status"`
+	// RedirectUrl is set while Status is requires_action.
+	RedirectUrl    string `json:"redirect_url,omitempty"`
+	DeclineCode    string `json:"decline_code,omitempty"`
+	DeclineMessage string `json:"decline_message,omitempty"`
+}
+
+// GateWayCWebhook is the JSON body of gateway C's webhooks.
+type GateWayCWebhook struct {
+	Type          string `json:"type"`
+	TransactionId string `json:"transaction_id"`
+	// Reference is the id of the authorization or payout.
+	Reference      string `json:"reference"`
+	DeclineCode    string `json:"decline_code,omitempty"`
+	DeclineMessage string `json:"decline_message,omitempty"`
+}
+
+type GateWayC struct {
+	client         *http.Client
+	gateWayUrl     string
+	callbackPrefix string
+	returnPrefix   string
+	simulated      bool
+}
+
+// NewGateWayC returns gateway C, sending customers back from 3-D Secure
+// challenges to returnPrefix and simulated if simulated is set, which takes a
+// client of New.
+func NewGateWayC(client *http.Client, gateWayUrl, callbackPrefix, returnPrefix string, simulated bool) *GateWayC {
+	return &GateWayC{
+		client:         client,
+		gateWayUrl:     gateWayUrl,
+		callbackPrefix: callbackPrefix,
+		returnPrefix:   returnPrefix,
+		simulated:      simulated,
+	}
+}
+
+// Deposit authorizes the card and captures the authorization. It returns an
+// *ActionRequired if the customer has to pass a 3-D Secure challenge first,
+// whose authorization is then the transaction's GatewayReference.
+func (g *GateWayC) Deposit(ctx context.Context, transaction models.Transaction) error {
+	callbackUrl, err := utils.JoinUrlPaths(g.callbackPrefix, transaction.TransactionId)
+	if err != nil {
+		return err
+	}
+	returnUrl, err := utils.JoinUrlPaths(g.returnPrefix, transaction.TransactionId)
+	if err != nil {
+		return err
+	}
+	if g.simulated {
+		ctx = g.simulate(ctx, transaction, callbackUrl, returnUrl)
+	}
+	var authorization GateWayCAuthorization
+	if transaction.GatewayReference != "" {
+		// back from the challenge of this authorization
+		err = g.get(ctx, "/authorizations/"+transaction.GatewayReference, &authorization)
+		if err != nil {
+			return err
+		}
+	} else {
+		accepted, err := g.post(ctx, "/authorizations", transaction.TransactionId, GateWayCAuthorizationRequest{
+			TransactionId: transaction.TransactionId,
+			CardToken:     transaction.CardToken,
+			Amount:        transaction.Amount,
+			Currency:      transaction.Currency,
+			ReturnUrl:     returnUrl,
+			CallbackUrl:   callbackUrl,
+		}, &authorization)
+		if err != nil || !accepted {
+			return err
+		}
+	}
+	switch authorization.Status {
+	case GateWayCAuthorized:
+		return g.capture(ctx, transaction, authorization)
+	case GateWayCCaptured:
+		// captured by an earlier attempt, whose response was lost
+		return nil
+	case GateWayCRequiresAction:
+		return &ActionRequired{RedirectUrl: authorization.RedirectUrl, Reference: authorization.Id}
+	case GateWayCDeclined, GateWayCVoided:
+		return gateWayCDecline(authorization)
+	default:
+		return &Error{Kind: KindServer, Code: models.FailureGatewayError, Message: fmt.Sprintf("unknown authorization status %q", authorization.Status)}
+	}
+}
+
+// capture captures authorization, voiding it if the capture fails for good
+// so the funds are not held until it expires.
+func (g *GateWayC) capture(ctx context.Context, transaction models.Transaction, authorization GateWayCAuthorization) error {
+	var captured GateWayCAuthorization
+	_, err := g.post(ctx, "/authorizations/"+authorization.Id+"/capture", transaction.TransactionId+"/capture", nil, &captured)
+	if err == nil && captured.Status == GateWayCDeclined {
+		err = gateWayCDecline(captured)
+	}
+	if err == nil || IsRetryable(err) {
+		return err
+	}
+	_, voidErr := g.post(ctx, "/authorizations/"+authorization.Id+"/void", transaction.TransactionId+"/void", nil, nil)
+	if voidErr != nil {
+		return fmt.Errorf("%w (voiding the authorization failed: %v)", err, voidErr)
+	}
+	return err
+}
+
+// Withdraw pays the amount out to the card.
+func (g *GateWayC) Withdraw(ctx context.Context, transaction models.Transaction) error {
+	callbackUrl, err := utils.JoinUrlPaths(g.callbackPrefix, transaction.TransactionId)
+	if err != nil {
+		return err
+	}
+	if g.simulated {
+		ctx = g.simulate(ctx, transaction, callbackUrl, "")
+	}
+	_, err = g.post(ctx, "/payouts", transaction.TransactionId, GateWayCPayoutRequest{
+		TransactionId: transaction.TransactionId,
+		CardToken:     transaction.CardToken,
+		Amount:        transaction.Amount,
+		Currency:      transaction.Currency,
+		CallbackUrl:   callbackUrl,
+	}, nil)
+	return err
+}
+
+// post calls path with body and decodes the response into response unless it
+// is nil or the response has no body. A duplicate is accepted only if it says
+// where the earlier call stands, otherwise its outcome is left to the webhook.
+func (g *GateWayC) post(ctx context.Context, path, idempotencyKey string, body, response any) (accepted bool, err error) {
+	url, err := utils.JoinUrlPaths(g.gateWayUrl, path)
+	if err != nil {
+		return false, err
+	}
+	var reqBody io.Reader = http.NoBody
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		reqBody = bytes.NewReader(jsonData)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, reqBody)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return false, transportError(err)
+	}
+	defer resp.Body.Close()
+	duplicate := isDuplicate(resp.StatusCode)
+	if !duplicate && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		return false, gateWayCStatusError(resp)
+	}
+	if response == nil {
+		return true, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return false, transportError(err)
+	}
+	if len(data) == 0 {
+		return !duplicate, nil
+	}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		return false, &Error{Kind: KindServer, StatusCode: resp.StatusCode, Code: models.FailureGatewayError, Message: "invalid response: " + err.Error()}
+	}
+	return true, nil
+}
+
+// get reads path into response.
+func (g *GateWayC) get(ctx context.Context, path string, response any) error {
+	url, err := utils.JoinUrlPaths(g.gateWayUrl, path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return transportError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return gateWayCStatusError(resp)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(response)
+	if err != nil {
+		return &Error{Kind: KindServer, StatusCode: resp.StatusCode, Code: models.FailureGatewayError, Message: "invalid response: " + err.Error()}
+	}
+	return nil
+}
+
+// gateWayCDecline is the error of a declined authorization or capture.
+func gateWayCDecline(authorization GateWayCAuthorization) *Error {
+	code := models.FailureDeclined
+	if mapped, ok := gateWayCCodes[authorization.DeclineCode]; ok && mapped != models.FailureGatewayError && mapped != models.FailureGatewayTimeout {
+		code = mapped
+	}
+	message := describe(authorization.DeclineCode, authorization.DeclineMessage)
+	if message == "" {
+		message = "authorization " + authorization.Status
+	}
+	return &Error{Kind: KindDeclined, Code: code, Message: message}
+}
+
+func (g *GateWayC) HandleCallback(payload []byte) (GateWayResponse, error) {
+	var webhook GateWayCWebhook
+	err := json.Unmarshal(payload, &webhook)
+	if err != nil {
+		return GateWayResponse{}, malformed(err)
+	}
+	status, ok := gateWayCWebhookStatuses[webhook.Type]
+	if !ok {
+		return GateWayResponse{}, fmt.Errorf("%w: unknown webhook type %q", ErrMalformedCallback, webhook.Type)
+	}
+	resp := GateWayResponse{
+		TransactionId: webhook.TransactionId,
+		Status:        string(status),
+		Reference:     webhook.Reference,
+	}
+	err = checkCallback(resp)
+	if err != nil {
+		return GateWayResponse{}, err
+	}
+	code := webhook.DeclineCode
+	if code == "" && webhook.Type == GateWayCAuthorizationExpired {
+		code = "authorization_expired"
+	}
+	failure(&resp, gateWayCCodes, code, webhook.DeclineMessage)
+	return resp, nil
+}
@@ -0,0 +1,291 @@
+package gateways
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"payments/models"
+	"testing"
+)
+
+func newTestGateWayC(t *testing.T, url string) *GateWayC {
+	return NewGateWayC(newTestClient(t), url, "https://callback.example.com", "https://api.example.com/return", false)
+}
+
+func TestGateWayC_Conformance(t *testing.T) {
+	runConformance(t, conformance{
+		newGateway: func(client *http.Client, url string) PaymentGateway {
+			return NewGateWayC(client, url, "https://callback.example.com", "https://api.example.com/return", false)
+		},
+		accepted: replyGateWayC(GateWayCAuthorized),
+		declined: replyGateWayCError(http.StatusPaymentRequired, "invalid_card", "Invalid card"),
+		transactionId: func(t *testing.T, call fakeCall) string {
+			var req GateWayCAuthorizationRequest
+			require.NoError(t, json.Unmarshal(call.Body, &req))
+			return req.TransactionId
+		},
+		callback: func(t *testing.T, transactionId string, status models.TransactionStatus) []byte {
+			webhook := GateWayCWebhook{Type: GateWayCPaymentCaptured, TransactionId: transactionId, Reference: "auth_1"}
+			if status == models.Failed {
+				webhook.Type = GateWayCPaymentDeclined
+				webhook.DeclineCode, webhook.DeclineMessage = "insufficient_funds", "Insufficient funds"
+			}
+			data, err := json.Marshal(webhook)
+			require.NoError(t, err)
+			return data
+		},
+		malformed: map[string][]byte{
+			"not json":          []byte(`<TransactionResponse/>`),
+			"truncated":         []byte(`{"type":"payment.captured","transaction_id":"tx-1`),
+			"no transaction id": []byte(`{"type":"payment.captured","reference":"auth_1"}`),
+			"unknown type":      []byte(`{"type":"payment.refunded","transaction_id":"tx-1"}`),
+			"no type":           []byte(`{"transaction_id":"tx-1","status":"successful"}`),
+		},
+	})
+}
+
+// replyGateWayC replies as gateway C does to the calls of a transaction: with
+// an authorization of status, captured when captured, and an accepted payout.
+func replyGateWayC(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorization := GateWayCAuthorization{Id: "auth_1", Status: status}
+		switch r.URL.Path {
+		case "/payouts":
+			w.WriteHeader(http.StatusAccepted)
+			return
+		case "/authorizations":
+			var req GateWayCAuthorizationRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			authorization.TransactionId = req.TransactionId
+			if status == GateWayCRequiresAction {
+				authorization.RedirectUrl = "https://acs.example.com/challenge/auth_1"
+			}
+		case "/authorizations/auth_1":
+			// looked up after its 3-D Secure challenge
+			if status == GateWayCRequiresAction {
+				authorization.RedirectUrl = "https://acs.example.com/challenge/auth_1"
+			}
+		case "/authorizations/auth_1/capture":
+			authorization.Status = GateWayCCaptured
+		case "/authorizations/auth_1/void":
+			authorization.Status = GateWayCVoided
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(authorization)
+	}
+}
+
+// replyGateWayCError replies with an error of gateway C.
+func replyGateWayCError(statusCode int, code, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(gateWayCError{Code: code, Message: message})
+	}
+}
+
+func newCardTransaction(txType models.TransactionType) models.Transaction {
+	return models.Transaction{TransactionId: "12345", Type: string(txType), Amount: 100.0, Currency: "EUR", CardToken: "card_4242"}
+}
+
+func paths(calls []fakeCall) []string {
+	var paths []string
+	for _, call := range calls {
+		paths = append(paths, call.Path)
+	}
+	return paths
+}
+
+func TestGateWayC_Deposit(t *testing.T) {
+	fake := newFakeGateway(t)
+	fake.reply(replyGateWayC(GateWayCAuthorized))
+	g := newTestGateWayC(t, fake.URL)
+
+	require.NoError(t, g.Deposit(context.Background(), newCardTransaction(models.Deposit)))
+	calls := fake.received()
+	assert.Equal(t, []string{"/authorizations", "/authorizations/auth_1/capture"}, paths(calls))
+	assert.Equal(t, "12345", calls[0].Header.Get("Idempotency-Key"))
+	assert.Equal(t, "12345/capture", calls[1].Header.Get("Idempotency-Key"))
+	var req GateWayCAuthorizationRequest
+	require.NoError(t, json.Unmarshal(calls[0].Body, &req))
+	assert.Equal(t, GateWayCAuthorizationRequest{
+		TransactionId: "12345",
+		CardToken:     "card_4242",
+		Amount:        100.0,
+		Currency:      "EUR",
+		ReturnUrl:     "https://api.example.com/return/12345",
+		CallbackUrl:   "https://callback.example.com/12345",
+	}, req)
+}
+
+func TestGateWayC_Withdraw(t *testing.T) {
+	fake := newFakeGateway(t)
+	fake.reply(replyGateWayC(GateWayCAuthorized))
+	g := newTestGateWayC(t, fake.URL)
+
+	require.NoError(t, g.Withdraw(context.Background(), newCardTransaction(models.Withdraw)))
+	calls := fake.received()
+	assert.Equal(t, []string{"/payouts"}, paths(calls))
+	assert.Equal(t, "12345", calls[0].Header.Get("Idempotency-Key"))
+	var req GateWayCPayoutRequest
+	require.NoError(t, json.Unmarshal(calls[0].Body, &req))
+	assert.Equal(t, "card_4242", req.CardToken)
+}
+
+func TestGateWayC_Deposit_RequiresAction(t *testing.T) {
+	fake := newFakeGateway(t)
+	fake.reply(replyGateWayC(GateWayCRequiresAction))
+	g := newTestGateWayC(t, fake.URL)
+	transaction := newCardTransaction(models.Deposit)
+
+	err := g.Deposit(context.Background(), transaction)
+	var actionRequired *ActionRequired
+	require.ErrorAs(t, err, &actionRequired)
+	assert.Equal(t, "https://acs.example.com/challenge/auth_1", actionRequired.RedirectUrl)
+	assert.Equal(t, "auth_1", actionRequired.Reference)
+	assert.Equal(t, []string{"/authorizations"}, paths(fake.received()), "nothing is captured before the challenge")
+
+	// the customer passed the challenge and the deposit is submitted again,
+	// with the authorization as its reference
+	transaction.GatewayReference = actionRequired.Reference
+	fake.reply(replyGateWayC(GateWayCAuthorized))
+	require.NoError(t, g.Deposit(context.Background(), transaction))
+	calls := fake.received()
+	assert.Equal(t, []string{"/authorizations", "/authorizations/auth_1", "/authorizations/auth_1/capture"}, paths(calls))
+	assert.Equal(t, http.MethodGet, calls[1].Method, "the authorization is looked up, not made again")
+}
+
+func TestGateWayC_Deposit_ChallengeNotPassed(t *testing.T) {
+	// the customer came back without passing the challenge
+	fake := newFakeGateway(t)
+	fake.reply(replyGateWayC(GateWayCRequiresAction))
+	g := newTestGateWayC(t, fake.URL)
+	transaction := newCardTransaction(models.Deposit)
+	transaction.GatewayReference = "auth_1"
+
+	var actionRequired *ActionRequired
+	require.ErrorAs(t, g.Deposit(context.Background(), transaction), &actionRequired)
+	assert.Equal(t, "https://acs.example.com/challenge/auth_1", actionRequired.RedirectUrl)
+	assert.Equal(t, "auth_1", actionRequired.Reference)
+	assert.Equal(t, []string{"/authorizations/auth_1"}, paths(fake.received()))
+}
+
+func TestGateWayC_Deposit_Captured(t *testing.T) {
+	// an earlier attempt captured the authorization, but its response was lost
+	fake := newFakeGateway(t)
+	fake.reply(replyGateWayC(GateWayCCaptured))
+	g := newTestGateWayC(t, fake.URL)
+
+	require.NoError(t, g.Deposit(context.Background(), newCardTransaction(models.Deposit)))
+	assert.Equal(t, []string{"/authorizations"}, paths(fake.received()))
+}
+
+func TestGateWayC_Deposit_Duplicate(t *testing.T) {
+	fake := newFakeGateway(t)
+	authorized := replyGateWayC(GateWayCAuthorized)
+	fake.reply(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/authorizations" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(GateWayCAuthorization{Id: "auth_1", TransactionId: "12345", Status: GateWayCAuthorized})
+			return
+		}
+		authorized(w, r)
+	})
+	g := newTestGateWayC(t, fake.URL)
+
+	require.NoError(t, g.Deposit(context.Background(), newCardTransaction(models.Deposit)))
+	assert.Equal(t, []string{"/authorizations", "/authorizations/auth_1/capture"}, paths(fake.received()),
+		"the authorization a duplicate reports is captured")
+}
+
+func TestGateWayC_Deposit_Declined(t *testing.T) {
+	fake := newFakeGateway(t)
+	fake.reply(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(GateWayCAuthorization{Id: "auth_1", Status: GateWayCDeclined,
+			DeclineCode: "insufficient_funds", DeclineMessage: "Insufficient funds"})
+	})
+	g := newTestGateWayC(t, fake.URL)
+
+	err := g.Deposit(context.Background(), newCardTransaction(models.Deposit))
+	var gatewayErr *Error
+	require.ErrorAs(t, err, &gatewayErr)
+	assert.Equal(t, KindDeclined, gatewayErr.Kind)
+	assert.Equal(t, models.FailureInsufficientFunds, gatewayErr.Code)
+	assert.Equal(t, "Insufficient funds (gateway code insufficient_funds)", gatewayErr.Message)
+	assert.Equal(t, []string{"/authorizations"}, paths(fake.received()))
+}
+
+func TestGateWayC_Capture_Refused(t *testing.T) {
+	authorized := replyGateWayC(GateWayCAuthorized)
+	tests := map[string]struct {
+		capture   http.HandlerFunc
+		retryable bool
+		calls     []string
+	}{
+		"declined": {
+			capture: replyGateWayCError(http.StatusPaymentRequired, "limit_exceeded", "Limit exceeded"),
+			calls:   []string{"/authorizations", "/authorizations/auth_1/capture", "/authorizations/auth_1/void"},
+		},
+		"unavailable": {
+			capture:   replyStatus(http.StatusServiceUnavailable),
+			retryable: true,
+			calls:     []string{"/authorizations", "/authorizations/auth_1/capture"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeGateway(t)
+			fake.reply(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/authorizations/auth_1/capture" {
+					test.capture(w, r)
+					return
+				}
+				authorized(w, r)
+			})
+			g := newTestGateWayC(t, fake.URL)
+
+			err := g.Deposit(context.Background(), newCardTransaction(models.Deposit))
+			require.Error(t, err)
+			assert.Equal(t, test.retryable, IsRetryable(err))
+			assert.Equal(t, test.calls, paths(fake.received()), "only an authorization that cannot be captured is voided")
+		})
+	}
+}
+
+func TestGateWayC_HandleCallback(t *testing.T) {
+	g := newTestGateWayC(t, "https://gateway.example.com")
+	tests := map[string]struct {
+		payload string
+		want    GateWayResponse
+	}{
+		"payout paid": {
+			payload: `{"type":"payout.paid","transaction_id":"12345","reference":"po_1"}`,
+			want:    GateWayResponse{TransactionId: "12345", Status: "successful", Reference: "po_1"},
+		},
+		"payout failed": {
+			payload: `{"type":"payout.failed","transaction_id":"12345","reference":"po_1","decline_code":"expired_card","decline_message":"Card expired"}`,
+			want: GateWayResponse{TransactionId: "12345", Status: "failed", Reference: "po_1",
+				FailureCode: models.FailureInvalidAccount, FailureMessage: "Card expired (gateway code expired_card)"},
+		},
+		"authorization expired": {
+			payload: `{"type":"authorization.expired","transaction_id":"12345","reference":"auth_1","decline_message":"The customer did not authenticate"}`,
+			want: GateWayResponse{TransactionId: "12345", Status: "failed", Reference: "auth_1",
+				FailureCode: models.FailureDeclined, FailureMessage: "The customer did not authenticate (gateway code authorization_expired)"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := g.HandleCallback([]byte(test.payload))
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, resp)
+		})
+	}
+}
@@ -1,13 +1,68 @@
 package gateways
 
-import "payments/models"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"payments/config"
+	"payments/models"
+	"payments/soap"
+)
 
+// ErrMalformedCallback is returned by HandleCallback for a payload the gateway
+// cannot have sent: one that does not parse, or without a transaction id or a
+// final status.
+var ErrMalformedCallback = errors.New("gateways: malformed callback")
+
+// CardGateWays are the gateways paying with card tokens rather than account
+// ids, see models.User.CardToken.
+var CardGateWays = map[string]bool{"c": true}
+
+// PaymentGateway is a payment gateway. conformance_test.go tells what an
+// implementation must do, and can be run against any of them.
 type PaymentGateway interface {
-	Deposit(models.Transaction) error
-	Withdraw(models.Transaction) error
+	Deposit(context.Context, models.Transaction) error
+	Withdraw(context.Context, models.Transaction) error
 	HandleCallback([]byte) (GateWayResponse, error)
 }
 
+// New returns the gateways by name, each calling with the http client
+// configured for it, which answers the calls itself if the gateways are
+// simulated.
+func New(cfg *config.Config) (map[string]PaymentGateway, error) {
+	simulated := cfg.Network.SimulateGateWays
+	clientA, err := newHTTPClient(cfg.GateWayClient("a"), simulated)
+	if err != nil {
+		return nil, fmt.Errorf("gateway a: %w", err)
+	}
+	clientB, err := newHTTPClient(cfg.GateWayClient("b"), simulated)
+	if err != nil {
+		return nil, fmt.Errorf("gateway b: %w", err)
+	}
+	clientC, err := newHTTPClient(cfg.GateWayClient("c"), simulated)
+	if err != nil {
+		return nil, fmt.Errorf("gateway c: %w", err)
+	}
+	version, err := soap.ParseVersion(cfg.GateWayB.SOAPVersion)
+	if err != nil {
+		return nil, fmt.Errorf("gateway b: %w", err)
+	}
+	var security *WSSecurity
+	if cfg.GateWayB.Username != "" {
+		security = &WSSecurity{
+			Username: cfg.GateWayB.Username,
+			Password: cfg.GateWayB.Password,
+			Digest:   cfg.GateWayB.PasswordDigest,
+			TTL:      cfg.GateWayB.TimestampTTL,
+		}
+	}
+	return map[string]PaymentGateway{
+		"a": NewGateWayA(clientA, cfg.Network.GateWayAUrl, "/withdraw", "/deposit", cfg.Network.CallbackPrefix, simulated),
+		"b": NewGateWayB(clientB, cfg.Network.GateWayBUrl, cfg.Network.CallbackPrefix, version, security, simulated),
+		"c": NewGateWayC(clientC, cfg.Network.GateWayCUrl, cfg.Network.CallbackPrefix, cfg.Network.ReturnPrefix, simulated),
+	}, nil
+}
+
 type GateWayRequest struct {
 	TransactionId string  `json:"transaction_id"`
 	Amount        float64 `json:"amount"`
@@ -15,7 +70,30 @@ type GateWayRequest struct {
 	CallbackUrl   string  `json:"callback_url"`
 	Account       string  `json:"account"`
 }
+
+// GateWayResponse is a gateway's callback, normalized.
 type GateWayResponse struct {
 	TransactionId string `json:"transaction_id"`
 	Status        string `json:"status"`
+	// Reference is the gateway's own id of the transaction.
+	Reference string `json:"reference,omitempty"`
+	// FailureCode and FailureMessage are only set if Status is failed.
+	FailureCode    models.FailureCode `json:"failure_code,omitempty"`
+	FailureMessage string             `json:"failure_message,omitempty"`
+}
+
+// malformed wraps the error of parsing a callback.
+func malformed(err error) error {
+	return fmt.Errorf("%w: %w", ErrMalformedCallback, err)
+}
+
+// checkCallback checks a parsed callback is complete.
+func checkCallback(resp GateWayResponse) error {
+	if resp.TransactionId == "" {
+		return fmt.Errorf("%w: no transaction id", ErrMalformedCallback)
+	}
+	if resp.Status != string(models.Successful) && resp.Status != string(models.Failed) {
+		return fmt.Errorf("%w: unknown status %q", ErrMalformedCallback, resp.Status)
+	}
+	return nil
 }
@@ -0,0 +1,316 @@
+package gateways
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"math/rand"
+	"net/http"
+	"payments/logging"
+	"payments/models"
+	"payments/soap"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The gateways are simulated unless configured otherwise: each call carries
+// the responses its endpoints answer with in its context, failing a third of
+// the calls, and the calls that go
+// through are answered with a callback a few seconds later, declining a third
+// of the transactions. Gateway C declines deposits as it authorizes them
+// instead, and sends a third of them to a 3-D Secure challenge the customer
+// passes a few seconds later. The responses are only seen by the call they
+// were made for, so concurrent calls do not answer each other's requests.
+
+// simulation is the responses of a simulated call, each answering one
+// request.
+type simulation struct {
+	mu        sync.Mutex
+	responses []*simulatedResponse
+}
+
+type simulatedResponse struct {
+	method string
+	path   string
+	status int
+	header http.Header
+	body   []byte
+}
+
+type simulationKey struct{}
+
+// withSimulation returns ctx carrying a new simulation.
+func withSimulation(ctx context.Context) (context.Context, *simulation) {
+	sim := &simulation{}
+	return context.WithValue(ctx, simulationKey{}, sim), sim
+}
+
+// reply answers the next method request to a url ending in path with status.
+func (s *simulation) reply(method, path string, status int) *simulatedResponse {
+	resp := &simulatedResponse{method: method, path: strings.TrimSuffix(path, "/"), status: status, header: http.Header{}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, resp)
+	return resp
+}
+
+// take removes and returns the response to req, nil if there is none.
+func (s *simulation) take(req *http.Request) *simulatedResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, resp := range s.responses {
+		if resp.method == req.Method && strings.HasSuffix(strings.TrimSuffix(req.URL.Path, "/"), resp.path) {
+			s.responses = append(s.responses[:i], s.responses[i+1:]...)
+			return resp
+		}
+	}
+	return nil
+}
+
+// JSON sets the body of the response to v.
+func (r *simulatedResponse) JSON(v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		logSimulationError(err, "Error marshalling json")
+		return
+	}
+	r.header.Set("Content-Type", "application/json")
+	r.body = body
+}
+
+// Body sets the body of the response.
+func (r *simulatedResponse) Body(body []byte) {
+	r.body = body
+}
+
+// simulatedTransport answers the requests of a simulated call with its
+// responses, and sends any other request on with next.
+type simulatedTransport struct {
+	next http.RoundTripper
+}
+
+func (t simulatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sim, ok := req.Context().Value(simulationKey{}).(*simulation)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	resp := sim.take(req)
+	if resp == nil {
+		return t.next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", resp.status, http.StatusText(resp.status)),
+		StatusCode:    resp.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        resp.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(resp.body)),
+		ContentLength: int64(len(resp.body)),
+		Request:       req,
+	}, nil
+}
+
+func (g *GateWayA) simulate(ctx context.Context, transaction models.Transaction, path, callbackUrl string) context.Context {
+	ctx, sim := withSimulation(ctx)
+	if rand.Intn(3) == 2 {
+		// some of the failures are rejections
+		if rand.Intn(5) == 0 {
+			sim.reply(http.MethodPost, path, http.StatusBadRequest).
+				JSON(gateWayAError{ErrorCode: "ACCOUNT_NOT_FOUND", ErrorMessage: "Account not found"})
+		} else {
+			sim.reply(http.MethodPost, path, rand.Intn(5)+500)
+		}
+		return ctx
+	}
+	sim.reply(http.MethodPost, path, http.StatusAccepted)
+	resp := GateWayACallback{
+		TransactionId: transaction.TransactionId,
+		Status:        string(models.Successful),
+		Reference:     fmt.Sprintf("A-%08d", rand.Intn(100000000)),
+	}
+	if rand.Intn(3) == 2 {
+		resp.Status = string(models.Failed)
+		resp.ErrorCode, resp.ErrorMessage = simulatedDecline(gateWayACodes)
+	}
+	jsonData, err := json.Marshal(resp)
+	if err != nil {
+		logSimulationError(err, "Error marshalling json")
+		return ctx
+	}
+	simulateCallback(ctx, g.client, callbackUrl, jsonData)
+	return ctx
+}
+
+func (g *GateWayB) simulate(ctx context.Context, transaction models.Transaction, callbackUrl string) context.Context {
+	ctx, sim := withSimulation(ctx)
+	if rand.Intn(3) == 2 {
+		// some of the failures are rejections, answered with a Client fault
+		if rand.Intn(5) == 0 {
+			sim.reply(http.MethodPost, "/", http.StatusInternalServerError).
+				Body(simulatedFault(g.client.Version()))
+		} else {
+			sim.reply(http.MethodPost, "/", rand.Intn(5)+500)
+		}
+		return ctx
+	}
+	sim.reply(http.MethodPost, "/", http.StatusAccepted)
+	transactionResp := TransactionResponse{
+		TransactionId: transaction.TransactionId,
+		Status:        string(models.Successful),
+		Reference:     fmt.Sprintf("B%012d", rand.Int63n(1000000000000)),
+	}
+	if rand.Intn(3) == 2 {
+		transactionResp.Status = string(models.Failed)
+		transactionResp.ResponseCode, transactionResp.ErrorDescription = simulatedDecline(gateWayBCodes)
+	}
+	xmlData, err := soap.Marshal(soap.Envelope{Version: g.client.Version(), Body: transactionResp})
+	if err != nil {
+		logSimulationError(err, "Error marshalling xml")
+		return ctx
+	}
+	simulateCallback(ctx, g.client.HTTPClient(), callbackUrl, xmlData)
+	return ctx
+}
+
+func (g *GateWayC) simulate(ctx context.Context, transaction models.Transaction, callbackUrl, returnUrl string) context.Context {
+	ctx, sim := withSimulation(ctx)
+	path := "/payouts"
+	deposit := transaction.Type == string(models.Deposit)
+	if deposit {
+		path = "/authorizations"
+	}
+	// a deposit back from its 3-D Secure challenge looks its authorization up
+	resumed := deposit && transaction.GatewayReference != ""
+	method, callPath := http.MethodPost, path
+	if resumed {
+		method, callPath = http.MethodGet, path+"/"+transaction.GatewayReference
+	}
+	if rand.Intn(3) == 2 {
+		// some of the failures are rejections
+		if rand.Intn(5) == 0 {
+			sim.reply(method, callPath, http.StatusPaymentRequired).
+				JSON(gateWayCError{Code: "invalid_card", Message: "Invalid card"})
+		} else {
+			sim.reply(method, callPath, rand.Intn(5)+500)
+		}
+		return ctx
+	}
+	reference := fmt.Sprintf("C-%010d", rand.Int63n(10000000000))
+	webhook := GateWayCWebhook{
+		Type:          GateWayCPayoutPaid,
+		TransactionId: transaction.TransactionId,
+		Reference:     reference,
+	}
+	if deposit {
+		authorization := GateWayCAuthorization{Id: reference, TransactionId: transaction.TransactionId, Status: GateWayCAuthorized}
+		if resumed {
+			// the customer passed the challenge
+			authorization.Id = transaction.GatewayReference
+			webhook.Reference = transaction.GatewayReference
+			sim.reply(method, callPath, http.StatusOK).JSON(authorization)
+		} else {
+			switch {
+			case rand.Intn(3) == 2:
+				authorization.Status = GateWayCRequiresAction
+				authorization.RedirectUrl = g.gateWayUrl + "/3ds/" + reference
+				sim.reply(method, callPath, http.StatusCreated).JSON(authorization)
+				// the customer passes the challenge and is sent back, once the
+				// transaction waits for them
+				simulateRequest(ctx, g.client, time.Second*time.Duration(1+rand.Intn(5)), http.MethodGet, returnUrl, nil)
+				return ctx
+			case rand.Intn(3) == 2:
+				authorization.Status = GateWayCDeclined
+				authorization.DeclineCode, authorization.DeclineMessage = simulatedDecline(gateWayCCodes)
+				sim.reply(method, callPath, http.StatusCreated).JSON(authorization)
+				return ctx
+			}
+			sim.reply(method, callPath, http.StatusCreated).JSON(authorization)
+		}
+		captured := authorization
+		captured.Status = GateWayCCaptured
+		sim.reply(http.MethodPost, path+"/"+authorization.Id+"/capture", http.StatusOK).JSON(captured)
+		webhook.Type = GateWayCPaymentCaptured
+	} else {
+		sim.reply(method, callPath, http.StatusAccepted)
+		if rand.Intn(3) == 2 {
+			webhook.Type = GateWayCPayoutFailed
+			webhook.DeclineCode, webhook.DeclineMessage = simulatedDecline(gateWayCCodes)
+		}
+	}
+	jsonData, err := json.Marshal(webhook)
+	if err != nil {
+		logSimulationError(err, "Error marshalling json")
+		return ctx
+	}
+	simulateCallback(ctx, g.client, callbackUrl, jsonData)
+	return ctx
+}
+
+// simulatedFault is the fault the simulated gateway B rejects requests with.
+func simulatedFault(version soap.Version) []byte {
+	detail, err := xml.Marshal(FaultDetail{ResponseCode: "14"})
+	if err != nil {
+		panic(err)
+	}
+	fault, err := soap.Marshal(soap.Envelope{Version: version, Body: &soap.Fault{
+		Code:   version.ClientFaultCode(),
+		String: "Invalid account",
+		Detail: detail,
+	}})
+	if err != nil {
+		panic(err)
+	}
+	return fault
+}
+
+// simulateCallback posts body to callbackUrl after a random delay.
+func simulateCallback(ctx context.Context, client *http.Client, callbackUrl string, body []byte) {
+	simulateRequest(ctx, client, time.Second*time.Duration(rand.Intn(5)), http.MethodPost, callbackUrl, body)
+}
+
+// simulateRequest sends a request to url after delay.
+func simulateRequest(ctx context.Context, client *http.Client, delay time.Duration, method, url string, body []byte) {
+	// the request outlives the gateway call, so only carry its trace over
+	callbackCtx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+	time.AfterFunc(delay, func() {
+		req, err := http.NewRequestWithContext(callbackCtx, method, url, bytes.NewReader(body))
+		if err != nil {
+			logSimulationError(err, "Error generating request")
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			logSimulationError(err, "Error making request")
+			return
+		}
+		resp.Body.Close()
+	})
+}
+
+// logSimulationError logs what kept a simulated gateway from answering.
+func logSimulationError(err error, msg string) {
+	logger := logging.Component("simulator")
+	logger.Error().Err(err).Msg(msg)
+}
+
+// simulatedDecline picks one of the error codes of a simulated gateway at
+// random.
+func simulatedDecline(codes map[string]models.FailureCode) (code, message string) {
+	n := rand.Intn(len(codes))
+	for code, failureCode := range codes {
+		if n == 0 {
+			return code, strings.ReplaceAll(string(failureCode), "_", " ")
+		}
+		n--
+	}
+	return "", ""
+}
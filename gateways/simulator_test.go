@@ -0,0 +1,92 @@
+package gateways
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"payments/config"
+	"payments/models"
+	"payments/soap"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The simulated gateways live at an address that does not resolve, so a call
+// answered by another's responses, or by none, fails with a network error.
+func TestSimulatedGateWays_ConcurrentCalls(t *testing.T) {
+	callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(callbacks.Close)
+	client, err := newHTTPClient(config.HTTPClient{Timeout: 5 * time.Second}, true)
+	require.NoError(t, err)
+	gateWays := map[string]PaymentGateway{
+		"a": NewGateWayA(client, "http://gateway-a.invalid", "/withdraw", "/deposit", callbacks.URL, true),
+		"b": NewGateWayB(client, "http://gateway-b.invalid", callbacks.URL, soap.V11, nil, true),
+		"c": NewGateWayC(client, "http://gateway-c.invalid", callbacks.URL, callbacks.URL, true),
+	}
+
+	var wg sync.WaitGroup
+	for name, gateWay := range gateWays {
+		for i := 0; i < 20; i++ {
+			transaction := models.Transaction{
+				TransactionId: fmt.Sprintf("%s-%d", name, i),
+				Type:          string(models.Deposit),
+				Amount:        10,
+				Currency:      "USD",
+			}
+			call := gateWay.Deposit
+			switch i % 3 {
+			case 1:
+				transaction.Type = string(models.Withdraw)
+				call = gateWay.Withdraw
+			case 2:
+				// back from a 3-D Secure challenge, for gateway C
+				transaction.GatewayReference = "C-0000000042"
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := call(context.Background(), transaction)
+				var gateWayErr *Error
+				if errors.As(err, &gateWayErr) {
+					assert.NotEqual(t, KindNetwork, gateWayErr.Kind, "%s: %v", transaction.TransactionId, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestSimulatedTransport_PassesOtherRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	t.Cleanup(server.Close)
+	client, err := newHTTPClient(config.HTTPClient{Timeout: 5 * time.Second}, true)
+	require.NoError(t, err)
+
+	ctx, sim := withSimulation(context.Background())
+	sim.reply(http.MethodPost, "/deposit", http.StatusAccepted)
+	for _, test := range []struct {
+		ctx    context.Context
+		method string
+		status int
+	}{
+		{ctx, http.MethodGet, http.StatusTeapot},
+		{context.Background(), http.MethodPost, http.StatusTeapot},
+		{ctx, http.MethodPost, http.StatusAccepted},
+		// each response answers a single request
+		{ctx, http.MethodPost, http.StatusTeapot},
+	} {
+		req, err := http.NewRequestWithContext(test.ctx, test.method, server.URL+"/deposit", nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, test.status, resp.StatusCode)
+	}
+}
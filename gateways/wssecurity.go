@@ -0,0 +1,116 @@
+package gateways
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"time"
+)
+
+// Namespaces and value types of the OASIS WS-Security 1.0 UsernameToken profile.
+const (
+	wsseNamespace       = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"
+	wsuNamespace        = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd"
+	PasswordText        = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordText"
+	PasswordDigest      = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest"
+	base64BinaryEncoded = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary"
+)
+
+// wsuTimeFormat is the UTC format of wsu:Created and wsu:Expires.
+const wsuTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// Security is a WS-Security header block, see WSSecurity. Its mustUnderstand
+// attribute is in the namespace of the envelope, see package soap.
+type Security struct {
+	XMLName        xml.Name       `xml:"wsse:Security"`
+	Wsse           string         `xml:"xmlns:wsse,attr"`
+	Wsu            string         `xml:"xmlns:wsu,attr"`
+	MustUnderstand string         `xml:"soapenv:mustUnderstand,attr,omitempty"`
+	Timestamp      *WSTimestamp   `xml:"wsu:Timestamp,omitempty"`
+	UsernameToken  *UsernameToken `xml:"wsse:UsernameToken,omitempty"`
+}
+
+type WSTimestamp struct {
+	Id      string `xml:"wsu:Id,attr,omitempty"`
+	Created string `xml:"wsu:Created"`
+	Expires string `xml:"wsu:Expires,omitempty"`
+}
+
+type UsernameToken struct {
+	Id       string        `xml:"wsu:Id,attr,omitempty"`
+	Username string        `xml:"wsse:Username"`
+	Password Password      `xml:"wsse:Password"`
+	Nonce    *EncodedValue `xml:"wsse:Nonce,omitempty"`
+	Created  string        `xml:"wsu:Created,omitempty"`
+}
+
+type Password struct {
+	Type  string `xml:"Type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type EncodedValue struct {
+	EncodingType string `xml:"EncodingType,attr"`
+	Value        string `xml:",chardata"`
+}
+
+// WSSecurity builds the WS-Security header authenticating requests with a
+// UsernameToken. With Digest the password is sent as the base64 SHA-1 of the
+// nonce, the creation time and the password, so it cannot be replayed once
+// the gateway has seen the nonce; without, it is sent as is and the transport
+// must be trusted with it.
+type WSSecurity struct {
+	Username string
+	Password string
+	Digest   bool
+	// TTL is how long the request is valid for, stated in a Timestamp. No
+	// Timestamp is sent if it is 0.
+	TTL time.Duration
+}
+
+// Header returns the header block of a request made at now. Every call has a
+// fresh nonce.
+func (w WSSecurity) Header(now time.Time) (*Security, error) {
+	now = now.UTC()
+	created := now.Format(wsuTimeFormat)
+	token := &UsernameToken{
+		Id:       "UsernameToken-1",
+		Username: w.Username,
+		Password: Password{Type: PasswordText, Value: w.Password},
+		Created:  created,
+	}
+	if w.Digest {
+		nonce := make([]byte, 16)
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+		token.Password = Password{Type: PasswordDigest, Value: PasswordDigestOf(nonce, created, w.Password)}
+		token.Nonce = &EncodedValue{EncodingType: base64BinaryEncoded, Value: base64.StdEncoding.EncodeToString(nonce)}
+	}
+	security := &Security{
+		Wsse:           wsseNamespace,
+		Wsu:            wsuNamespace,
+		MustUnderstand: "1",
+		UsernameToken:  token,
+	}
+	if w.TTL > 0 {
+		security.Timestamp = &WSTimestamp{
+			Id:      "Timestamp-1",
+			Created: created,
+			Expires: now.Add(w.TTL).Format(wsuTimeFormat),
+		}
+	}
+	return security, nil
+}
+
+// PasswordDigestOf is the password digest of the UsernameToken profile,
+// base64(SHA-1(nonce + created + password)).
+func PasswordDigestOf(nonce []byte, created, password string) string {
+	digest := sha1.New()
+	digest.Write(nonce)
+	digest.Write([]byte(created))
+	digest.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(digest.Sum(nil))
+}
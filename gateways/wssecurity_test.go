@@ -0,0 +1,50 @@
+package gateways
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestWSSecurity_Header(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	wsSecurity := WSSecurity{Username: "merchant", Password: "s3cret", Digest: true, TTL: 5 * time.Minute}
+
+	security, err := wsSecurity.Header(now)
+	require.NoError(t, err)
+	token := security.UsernameToken
+	assert.Equal(t, "merchant", token.Username)
+	assert.Equal(t, "2024-05-01T10:00:00.000Z", token.Created)
+	assert.Equal(t, PasswordDigest, token.Password.Type)
+	require.NotNil(t, token.Nonce)
+	nonce, err := base64.StdEncoding.DecodeString(token.Nonce.Value)
+	require.NoError(t, err)
+	assert.Equal(t, PasswordDigestOf(nonce, token.Created, "s3cret"), token.Password.Value)
+	assert.NotContains(t, token.Password.Value, "s3cret")
+	assert.Equal(t, "2024-05-01T10:05:00.000Z", security.Timestamp.Expires)
+
+	again, err := wsSecurity.Header(now)
+	require.NoError(t, err)
+	assert.NotEqual(t, token.Nonce.Value, again.UsernameToken.Nonce.Value, "every header has a fresh nonce")
+}
+
+func TestWSSecurity_Header_PasswordText(t *testing.T) {
+	security, err := WSSecurity{Username: "merchant", Password: "s3cret"}.Header(time.Now())
+	require.NoError(t, err)
+	assert.Nil(t, security.Timestamp)
+	assert.Nil(t, security.UsernameToken.Nonce)
+
+	data, err := xml.Marshal(security)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `<wsse:Password Type="`+PasswordText+`">s3cret</wsse:Password>`)
+}
+
+func TestPasswordDigestOf(t *testing.T) {
+	nonce, err := base64.StdEncoding.DecodeString("LKqI6G/AikKCQrN0zqZFlg==")
+	require.NoError(t, err)
+	// base64(sha1(nonce + created + password)), worked out independently
+	assert.Equal(t, "tuOSpGlFlIXsozq4HFNeeGeFLEI=", PasswordDigestOf(nonce, "2010-09-16T07:50:45Z", "userpassword"))
+}
@@ -0,0 +1,40 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"github.com/go-pg/pg/v10"
+	"payments/messaging"
+)
+
+func PostgresCheck(db *pg.DB) Check {
+	return func(ctx context.Context) error {
+		return db.Ping(ctx)
+	}
+}
+
+// pinger is implemented by messaging publishers and subscribers.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// BrokerCheck asks the message broker for cluster metadata within the check deadline.
+func BrokerCheck(client pinger) Check {
+	return func(ctx context.Context) error {
+		return client.Ping(ctx)
+	}
+}
+
+// ConsumerAssignmentCheck fails while the consumer group has not assigned any partitions to the subscriber.
+func ConsumerAssignmentCheck(subscriber messaging.Subscriber) Check {
+	return func(ctx context.Context) error {
+		partitions, err := subscriber.Assignment()
+		if err != nil {
+			return err
+		}
+		if len(partitions) == 0 {
+			return errors.New("no partitions assigned")
+		}
+		return nil
+	}
+}
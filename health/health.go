@@ -0,0 +1,175 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/afex/hystrix-go/hystrix"
+	"net/http"
+	"payments/logging"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	Ok          Status = "ok"
+	Degraded    Status = "degraded"
+	Unavailable Status = "unavailable"
+)
+
+const checkTimeout = 2 * time.Second
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+type Check func(ctx context.Context) error
+
+type CheckResult struct {
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status Status                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type namedCheck struct {
+	name     string
+	check    Check
+	critical bool
+}
+
+// Checker aggregates dependency checks into a readiness report. Critical checks
+// make the service unavailable when they fail, the others and open hystrix
+// circuits only mark it as degraded.
+type Checker struct {
+	mu          sync.RWMutex
+	checks      []namedCheck
+	circuits    map[string]bool
+	circuitOpen func(name string) bool
+}
+
+func NewChecker() *Checker {
+	return &Checker{
+		circuits:    map[string]bool{},
+		circuitOpen: hystrixCircuitOpen,
+	}
+}
+
+// AddCheck registers a dependency the service cannot serve without.
+func (c *Checker) AddCheck(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check, critical: true})
+}
+
+// AddDegradedCheck registers a check whose failure leaves the service usable.
+func (c *Checker) AddDegradedCheck(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// WatchCircuit reports the service as degraded while the named hystrix circuit is open.
+func (c *Checker) WatchCircuit(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.circuits[name] = true
+}
+
+func (c *Checker) Check(ctx context.Context) Report {
+	c.mu.RLock()
+	checks := append([]namedCheck(nil), c.checks...)
+	circuits := make([]string, 0, len(c.circuits))
+	for name := range c.circuits {
+		circuits = append(circuits, name)
+	}
+	c.mu.RUnlock()
+	sort.Strings(circuits)
+
+	report := Report{Status: Ok, Checks: map[string]CheckResult{}}
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			results[i] = CheckResult{Status: Ok}
+			if err := check.check(checkCtx); err != nil {
+				results[i] = CheckResult{Status: Degraded, Error: err.Error()}
+				if check.critical {
+					results[i].Status = Unavailable
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for i, check := range checks {
+		report.Checks[check.name] = results[i]
+		report.Status = worst(report.Status, results[i].Status)
+	}
+	for _, name := range circuits {
+		result := CheckResult{Status: Ok}
+		if c.circuitOpen(name) {
+			result = CheckResult{Status: Degraded, Error: ErrCircuitOpen.Error()}
+		}
+		report.Checks["circuit:"+name] = result
+		report.Status = worst(report.Status, result.Status)
+	}
+	return report
+}
+
+// Liveness answers /healthz. It only tells that the process is serving requests.
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Report{Status: Ok})
+}
+
+// Readiness answers /readyz with 503 when a critical dependency is down.
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	report := c.Check(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == Unavailable {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Serve exposes the health endpoints on addr for services without an api router.
+func Serve(addr string, checker *Checker) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", checker.Liveness)
+	mux.HandleFunc("/readyz", checker.Readiness)
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	logger := logging.Component("health")
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error().Err(err).Msg("Health server error")
+		}
+	}()
+	return srv
+}
+
+func worst(a, b Status) Status {
+	rank := map[Status]int{Ok: 0, Degraded: 1, Unavailable: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+func hystrixCircuitOpen(name string) bool {
+	circuit, _, err := hystrix.GetCircuit(name)
+	if err != nil {
+		return false
+	}
+	return circuit.IsOpen()
+}
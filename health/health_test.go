@@ -0,0 +1,113 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func okCheck(ctx context.Context) error {
+	return nil
+}
+
+func failingCheck(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestChecker_Check(t *testing.T) {
+	testCases := []struct {
+		name         string
+		setup        func(c *Checker)
+		openCircuits map[string]bool
+		expected     Status
+	}{
+		{
+			name:     "No checks",
+			setup:    func(c *Checker) {},
+			expected: Ok,
+		},
+		{
+			name: "All checks pass",
+			setup: func(c *Checker) {
+				c.AddCheck("postgres", okCheck)
+				c.AddDegradedCheck("kafka_assignment", okCheck)
+				c.WatchCircuit("a")
+			},
+			expected: Ok,
+		},
+		{
+			name: "Critical check fails",
+			setup: func(c *Checker) {
+				c.AddCheck("postgres", failingCheck)
+				c.AddCheck("redis", okCheck)
+			},
+			expected: Unavailable,
+		},
+		{
+			name: "Degraded check fails",
+			setup: func(c *Checker) {
+				c.AddCheck("postgres", okCheck)
+				c.AddDegradedCheck("kafka_assignment", failingCheck)
+			},
+			expected: Degraded,
+		},
+		{
+			name: "Circuit open",
+			setup: func(c *Checker) {
+				c.AddCheck("postgres", okCheck)
+				c.WatchCircuit("a")
+				c.WatchCircuit("b")
+			},
+			openCircuits: map[string]bool{"b": true},
+			expected:     Degraded,
+		},
+		{
+			name: "Critical failure outranks open circuit",
+			setup: func(c *Checker) {
+				c.AddCheck("postgres", failingCheck)
+				c.WatchCircuit("a")
+			},
+			openCircuits: map[string]bool{"a": true},
+			expected:     Unavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checker := NewChecker()
+			checker.circuitOpen = func(name string) bool { return tc.openCircuits[name] }
+			tc.setup(checker)
+			report := checker.Check(context.Background())
+			assert.Equal(t, tc.expected, report.Status)
+		})
+	}
+}
+
+func TestChecker_Readiness(t *testing.T) {
+	checker := NewChecker()
+	checker.AddCheck("postgres", failingCheck)
+	checker.AddCheck("redis", okCheck)
+
+	rec := httptest.NewRecorder()
+	checker.Readiness(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	var report Report
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, CheckResult{Status: Unavailable, Error: "connection refused"}, report.Checks["postgres"])
+	assert.Equal(t, CheckResult{Status: Ok}, report.Checks["redis"])
+}
+
+func TestChecker_Liveness(t *testing.T) {
+	checker := NewChecker()
+	checker.AddCheck("postgres", failingCheck)
+
+	rec := httptest.NewRecorder()
+	checker.Liveness(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
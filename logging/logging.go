@@ -0,0 +1,62 @@
+// Package logging sets up the zerolog logger every service writes through.
+// Entries are JSON, tagged with the service and component, and pass through a
+// Redactor, so personal data and secrets are masked whatever a call site logs.
+package logging
+
+import (
+	"bytes"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	stdlog "log"
+	"os"
+	"payments/config"
+	"sync"
+)
+
+var (
+	mu     sync.RWMutex
+	levels = config.Logging{Level: zerolog.LevelTraceValue}
+)
+
+// New returns a logger writing redacted entries to out, tagged with service
+// and at the level configured for it.
+func New(out io.Writer, cfg config.Logging, service string) zerolog.Logger {
+	redactor := NewRedactor(cfg.RedactFields)
+	return zerolog.New(redactor.Writer(out)).
+		Level(cfg.LogLevel(service)).
+		With().Timestamp().Str("service", service).
+		Logger()
+}
+
+// Init makes the logger of service the global zerolog logger and routes the
+// standard library's log package through it. Components' loggers pick up the
+// levels configured for them from then on.
+func Init(cfg *config.Config, service string) zerolog.Logger {
+	logger := New(os.Stderr, cfg.Logging, service)
+	mu.Lock()
+	levels = cfg.Logging
+	log.Logger = logger
+	mu.Unlock()
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(stdWriter{logger: logger})
+	return logger
+}
+
+// Component returns the global logger tagged with component, at the level
+// configured for it.
+func Component(component string) zerolog.Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	return log.Logger.With().Str("component", component).Logger().Level(levels.LogLevel(component))
+}
+
+// stdWriter logs what the standard library's log package writes at info level.
+type stdWriter struct {
+	logger zerolog.Logger
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	w.logger.Info().Msg(string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
@@ -0,0 +1,162 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Redacted replaces the query string of URLs and the values of redacted fields
+// that are not strings.
+const Redacted = "REDACTED"
+
+var (
+	urlPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+	// cardPattern matches runs of 13 to 19 digits, optionally grouped by
+	// spaces or dashes. Only runs passing the Luhn check are masked.
+	cardPattern = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+// Redactor masks personal data and secrets in log entries.
+type Redactor struct {
+	fields map[string]bool
+}
+
+// NewRedactor returns a Redactor masking fields, compared case-insensitively,
+// besides URL query strings and card numbers.
+func NewRedactor(fields []string) *Redactor {
+	r := &Redactor{fields: map[string]bool{}}
+	for _, field := range fields {
+		r.fields[strings.ToLower(strings.TrimSpace(field))] = true
+	}
+	return r
+}
+
+// String drops the query strings of URLs in s and masks card numbers but
+// their last four digits.
+func (r *Redactor) String(s string) string {
+	s = urlPattern.ReplaceAllStringFunc(s, redactURL)
+	return cardPattern.ReplaceAllStringFunc(s, maskCard)
+}
+
+// Value redacts v, a value decoded from JSON, including any objects and
+// arrays nested in it.
+func (r *Redactor) Value(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if r.fields[strings.ToLower(key)] {
+				v[key] = mask(value)
+			} else {
+				v[key] = r.Value(value)
+			}
+		}
+		return v
+	case []any:
+		for i, value := range v {
+			v[i] = r.Value(value)
+		}
+		return v
+	case string:
+		return r.String(v)
+	}
+	return v
+}
+
+// Writer returns a writer redacting the JSON log lines written to it before
+// passing them on to out. Lines that are not JSON are redacted as strings.
+func (r *Redactor) Writer(out io.Writer) io.Writer {
+	return &redactingWriter{out: out, redactor: r}
+}
+
+type redactingWriter struct {
+	out      io.Writer
+	redactor *Redactor
+}
+
+// Write is called by zerolog once per entry.
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	var entry any
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	var line []byte
+	if err := decoder.Decode(&entry); err != nil {
+		line = []byte(w.redactor.String(string(p)))
+	} else {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		err = encoder.Encode(w.redactor.Value(entry))
+		if err != nil {
+			return 0, err
+		}
+		line = buf.Bytes()
+	}
+	_, err := w.out.Write(line)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// mask keeps the last four characters of a string, enough to tell values apart.
+func mask(v any) any {
+	s, ok := v.(string)
+	if !ok {
+		return Redacted
+	}
+	if len(s) <= 4 {
+		return "****"
+	}
+	return strings.Repeat("*", len(s)-4) + s[len(s)-4:]
+}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if u.User != nil {
+		u.User = url.User(Redacted)
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = Redacted
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+func maskCard(match string) string {
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, match)
+	if !luhn(digits) {
+		return match
+	}
+	return strings.Repeat("*", len(digits)-4) + digits[len(digits)-4:]
+}
+
+func luhn(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
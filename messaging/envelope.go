@@ -0,0 +1,96 @@
+package messaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	EventTypeHeader    = "event.type"
+	EventVersionHeader = "event.version"
+)
+
+var ErrUnexpectedEvent = errors.New("messaging: unexpected event")
+
+// Envelope is the typed form of a message. The event type and version travel
+// as headers and the payload as JSON, so consumers can tell what a message
+// holds before decoding it.
+type Envelope struct {
+	Type    string
+	Version int
+	Key     string
+	Headers map[string]string
+	Payload json.RawMessage
+}
+
+// NewEnvelope encodes payload as a version of eventType keyed by key.
+func NewEnvelope(eventType string, version int, key string, payload any) (Envelope, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Type:    eventType,
+		Version: version,
+		Key:     key,
+		Headers: map[string]string{},
+		Payload: data,
+	}, nil
+}
+
+// Message returns the message carrying the envelope on topic.
+func (e Envelope) Message(topic string) *Message {
+	msg := &Message{Topic: topic, Value: e.Payload}
+	if e.Key != "" {
+		msg.Key = []byte(e.Key)
+	}
+	for key, value := range e.Headers {
+		msg.SetHeader(key, value)
+	}
+	msg.SetHeader(EventTypeHeader, e.Type)
+	msg.SetHeader(EventVersionHeader, strconv.Itoa(e.Version))
+	return msg
+}
+
+// OpenEnvelope reads the envelope of msg. Messages published before envelopes
+// were introduced have no event type and version 0.
+func OpenEnvelope(msg *Message) (Envelope, error) {
+	envelope := Envelope{
+		Type:    msg.Header(EventTypeHeader),
+		Key:     string(msg.Key),
+		Headers: map[string]string{},
+		Payload: msg.Value,
+	}
+	if version := msg.Header(EventVersionHeader); version != "" {
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return Envelope{}, fmt.Errorf("invalid %s header %q: %w", EventVersionHeader, version, err)
+		}
+		envelope.Version = v
+	}
+	for _, header := range msg.Headers {
+		if header.Key != EventTypeHeader && header.Key != EventVersionHeader {
+			envelope.Headers[header.Key] = string(header.Value)
+		}
+	}
+	return envelope, nil
+}
+
+// Expect returns ErrUnexpectedEvent unless the envelope holds eventType at a
+// version up to maxVersion. Untyped envelopes are accepted as the expected type.
+func (e Envelope) Expect(eventType string, maxVersion int) error {
+	if e.Type != "" && e.Type != eventType {
+		return fmt.Errorf("%w: got %s, want %s", ErrUnexpectedEvent, e.Type, eventType)
+	}
+	if e.Version > maxVersion {
+		return fmt.Errorf("%w: %s version %d is newer than %d", ErrUnexpectedEvent, eventType, e.Version, maxVersion)
+	}
+	return nil
+}
+
+// Decode unmarshals the payload into v.
+func (e Envelope) Decode(v any) error {
+	return json.Unmarshal(e.Payload, v)
+}
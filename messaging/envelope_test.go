@@ -0,0 +1,57 @@
+package messaging
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+type testPayload struct {
+	Id     string `json:"id"`
+	Amount int    `json:"amount"`
+}
+
+func TestEnvelope_RoundTrip(t *testing.T) {
+	envelope, err := NewEnvelope("test.created", 2, "id-1", testPayload{Id: "id-1", Amount: 10})
+	require.NoError(t, err)
+	envelope.Headers["traceparent"] = "00-abc-def-01"
+
+	msg := envelope.Message("t")
+	assert.Equal(t, "t", msg.Topic)
+	assert.Equal(t, []byte("id-1"), msg.Key)
+	assert.Equal(t, "test.created", msg.Header(EventTypeHeader))
+	assert.Equal(t, "2", msg.Header(EventVersionHeader))
+	assert.Equal(t, "00-abc-def-01", msg.Header("traceparent"))
+
+	opened, err := OpenEnvelope(msg)
+	require.NoError(t, err)
+	assert.Equal(t, envelope.Type, opened.Type)
+	assert.Equal(t, envelope.Version, opened.Version)
+	assert.Equal(t, envelope.Key, opened.Key)
+	assert.Equal(t, envelope.Headers, opened.Headers)
+	var payload testPayload
+	require.NoError(t, opened.Decode(&payload))
+	assert.Equal(t, testPayload{Id: "id-1", Amount: 10}, payload)
+}
+
+func TestOpenEnvelope_Untyped(t *testing.T) {
+	opened, err := OpenEnvelope(&Message{Topic: "t", Value: []byte(`{"id":"id-1"}`)})
+	require.NoError(t, err)
+	assert.Equal(t, "", opened.Type)
+	assert.Equal(t, 0, opened.Version)
+	assert.NoError(t, opened.Expect("test.created", 1))
+}
+
+func TestOpenEnvelope_InvalidVersion(t *testing.T) {
+	msg := &Message{Topic: "t"}
+	msg.SetHeader(EventVersionHeader, "one")
+	_, err := OpenEnvelope(msg)
+	assert.Error(t, err)
+}
+
+func TestEnvelope_Expect(t *testing.T) {
+	envelope := Envelope{Type: "test.created", Version: 2}
+	assert.NoError(t, envelope.Expect("test.created", 2))
+	assert.ErrorIs(t, envelope.Expect("test.deleted", 2), ErrUnexpectedEvent)
+	assert.ErrorIs(t, envelope.Expect("test.created", 1), ErrUnexpectedEvent)
+}
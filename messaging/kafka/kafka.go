@@ -0,0 +1,210 @@
+// Package kafka implements the messaging interfaces on confluent-kafka-go, and
+// is the only package that links librdkafka.
+package kafka
+
+import (
+	"context"
+	"errors"
+	confluent "github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"payments/messaging"
+	"time"
+)
+
+var (
+	_ messaging.Publisher  = (*Publisher)(nil)
+	_ messaging.Subscriber = (*Subscriber)(nil)
+)
+
+type Publisher struct {
+	producer     *confluent.Producer
+	flushTimeout int
+}
+
+func NewPublisher(server string, flushTimeout int) (*Publisher, error) {
+	producer, err := confluent.NewProducer(&confluent.ConfigMap{"bootstrap.servers": server})
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{
+		producer:     producer,
+		flushTimeout: flushTimeout,
+	}, nil
+}
+
+func (p *Publisher) Publish(ctx context.Context, msg *messaging.Message) error {
+	deliveries := make(chan confluent.Event, 1)
+	err := p.producer.Produce(&confluent.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: toKafkaHeaders(msg.Headers),
+		TopicPartition: confluent.TopicPartition{
+			Topic: &msg.Topic, Partition: confluent.PartitionAny,
+		},
+	}, deliveries)
+	if err != nil {
+		return err
+	}
+	select {
+	case event := <-deliveries:
+		delivery, ok := event.(*confluent.Message)
+		if !ok {
+			return event.(confluent.Error)
+		}
+		if delivery.TopicPartition.Error != nil {
+			return delivery.TopicPartition.Error
+		}
+		msg.Partition = delivery.TopicPartition.Partition
+		msg.Offset = int64(delivery.TopicPartition.Offset)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Publisher) Ping(ctx context.Context) error {
+	return ping(ctx, p.producer)
+}
+
+func (p *Publisher) Close() error {
+	defer p.producer.Close()
+	if remaining := p.producer.Flush(p.flushTimeout); remaining > 0 {
+		return errors.New("producer closed with undelivered messages")
+	}
+	return nil
+}
+
+type Subscriber struct {
+	consumer *confluent.Consumer
+}
+
+// NewSubscriber creates a consumer in groupId. Offsets are only committed
+// through Commit.
+func NewSubscriber(server, groupId string) (*Subscriber, error) {
+	consumer, err := confluent.NewConsumer(&confluent.ConfigMap{
+		"bootstrap.servers":  server,
+		"group.id":           groupId,
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Subscriber{consumer: consumer}, nil
+}
+
+func (s *Subscriber) Subscribe(topic string, onRevoked func(partitions []messaging.Partition)) error {
+	return s.consumer.Subscribe(topic, func(c *confluent.Consumer, event confluent.Event) error {
+		revoked, ok := event.(confluent.RevokedPartitions)
+		if ok && onRevoked != nil {
+			onRevoked(fromKafkaPartitions(revoked.Partitions))
+		}
+		return nil
+	})
+}
+
+func (s *Subscriber) Poll(timeout time.Duration) (*messaging.Message, error) {
+	msg, err := s.consumer.ReadMessage(timeout)
+	if err != nil {
+		var kafkaError confluent.Error
+		if errors.As(err, &kafkaError) && kafkaError.Code() == confluent.ErrTimedOut {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var topic string
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	headers := make([]messaging.Header, 0, len(msg.Headers))
+	for _, header := range msg.Headers {
+		headers = append(headers, messaging.Header{Key: header.Key, Value: header.Value})
+	}
+	return &messaging.Message{
+		Topic:     topic,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   headers,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
+	}, nil
+}
+
+func (s *Subscriber) Commit(offsets []messaging.Offset) error {
+	partitions := make([]confluent.TopicPartition, 0, len(offsets))
+	for _, offset := range offsets {
+		topic := offset.Topic
+		partitions = append(partitions, confluent.TopicPartition{
+			Topic: &topic, Partition: offset.Partition.Partition, Offset: confluent.Offset(offset.Offset),
+		})
+	}
+	_, err := s.consumer.CommitOffsets(partitions)
+	return err
+}
+
+func (s *Subscriber) Pause(partitions []messaging.Partition) error {
+	return s.consumer.Pause(toKafkaPartitions(partitions))
+}
+
+func (s *Subscriber) Resume(partitions []messaging.Partition) error {
+	return s.consumer.Resume(toKafkaPartitions(partitions))
+}
+
+func (s *Subscriber) Assignment() ([]messaging.Partition, error) {
+	partitions, err := s.consumer.Assignment()
+	if err != nil {
+		return nil, err
+	}
+	return fromKafkaPartitions(partitions), nil
+}
+
+func (s *Subscriber) Ping(ctx context.Context) error {
+	return ping(ctx, s.consumer)
+}
+
+func (s *Subscriber) Close() error {
+	return s.consumer.Close()
+}
+
+// metadataClient is implemented by both confluent.Producer and confluent.Consumer.
+type metadataClient interface {
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*confluent.Metadata, error)
+}
+
+// ping asks the brokers for cluster metadata within the context deadline.
+func ping(ctx context.Context, client metadataClient) error {
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	_, err := client.GetMetadata(nil, false, int(timeout.Milliseconds()))
+	return err
+}
+
+func toKafkaHeaders(headers []messaging.Header) []confluent.Header {
+	kafkaHeaders := make([]confluent.Header, 0, len(headers))
+	for _, header := range headers {
+		kafkaHeaders = append(kafkaHeaders, confluent.Header{Key: header.Key, Value: header.Value})
+	}
+	return kafkaHeaders
+}
+
+func fromKafkaPartitions(topicPartitions []confluent.TopicPartition) []messaging.Partition {
+	partitions := make([]messaging.Partition, 0, len(topicPartitions))
+	for _, tp := range topicPartitions {
+		var topic string
+		if tp.Topic != nil {
+			topic = *tp.Topic
+		}
+		partitions = append(partitions, messaging.Partition{Topic: topic, Partition: tp.Partition})
+	}
+	return partitions
+}
+
+func toKafkaPartitions(partitions []messaging.Partition) []confluent.TopicPartition {
+	topicPartitions := make([]confluent.TopicPartition, 0, len(partitions))
+	for _, partition := range partitions {
+		topic := partition.Topic
+		topicPartitions = append(topicPartitions, confluent.TopicPartition{Topic: &topic, Partition: partition.Partition})
+	}
+	return topicPartitions
+}
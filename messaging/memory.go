@@ -0,0 +1,258 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("messaging: closed")
+
+// MemoryBus is an in-process stand-in for Kafka. Topics are split into
+// partitions by message key and keep every message, and consumer groups track
+// their committed offsets. Each group is expected to have a single subscriber,
+// which is assigned every partition of the topic.
+type MemoryBus struct {
+	mu          sync.Mutex
+	partitions  int
+	topics      map[string]*memoryTopic
+	groups      map[string]map[Partition]int64
+	published   chan struct{}
+	nextKeyless int
+}
+
+type memoryTopic struct {
+	partitions [][]*Message
+}
+
+func NewMemoryBus(partitions int) *MemoryBus {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &MemoryBus{
+		partitions: partitions,
+		topics:     map[string]*memoryTopic{},
+		groups:     map[string]map[Partition]int64{},
+		published:  make(chan struct{}),
+	}
+}
+
+// topic must be called with the lock held.
+func (b *MemoryBus) topic(name string) *memoryTopic {
+	topic, ok := b.topics[name]
+	if !ok {
+		topic = &memoryTopic{partitions: make([][]*Message, b.partitions)}
+		b.topics[name] = topic
+	}
+	return topic
+}
+
+func (b *MemoryBus) publish(msg *Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var partition int
+	if msg.Key == nil {
+		partition = b.nextKeyless % b.partitions
+		b.nextKeyless++
+	} else {
+		hash := fnv.New32a()
+		hash.Write(msg.Key)
+		partition = int(hash.Sum32() % uint32(b.partitions))
+	}
+	topic := b.topic(msg.Topic)
+	stored := *msg
+	stored.Headers = append([]Header(nil), msg.Headers...)
+	stored.Partition = int32(partition)
+	stored.Offset = int64(len(topic.partitions[partition]))
+	topic.partitions[partition] = append(topic.partitions[partition], &stored)
+	msg.Partition = stored.Partition
+	msg.Offset = stored.Offset
+	// wake up every poller waiting for messages
+	close(b.published)
+	b.published = make(chan struct{})
+}
+
+// Messages returns a copy of everything published to topic, partition by partition.
+func (b *MemoryBus) Messages(topic string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var messages []Message
+	if t, ok := b.topics[topic]; ok {
+		for _, partition := range t.partitions {
+			for _, msg := range partition {
+				messages = append(messages, *msg)
+			}
+		}
+	}
+	return messages
+}
+
+func (b *MemoryBus) Publisher() *MemoryPublisher {
+	return &MemoryPublisher{bus: b}
+}
+
+func (b *MemoryBus) Subscriber(group string) *MemorySubscriber {
+	return &MemorySubscriber{bus: b, group: group}
+}
+
+type MemoryPublisher struct {
+	bus *MemoryBus
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.bus.publish(msg)
+	return nil
+}
+
+func (p *MemoryPublisher) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (p *MemoryPublisher) Close() error {
+	return nil
+}
+
+type MemorySubscriber struct {
+	bus      *MemoryBus
+	group    string
+	topic    string
+	mu       sync.Mutex
+	position map[Partition]int64
+	paused   map[Partition]bool
+	next     int
+	closed   bool
+}
+
+func (s *MemorySubscriber) Subscribe(topic string, onRevoked func(partitions []Partition)) error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bus.topic(topic)
+	committed, ok := s.bus.groups[s.group]
+	if !ok {
+		committed = map[Partition]int64{}
+		s.bus.groups[s.group] = committed
+	}
+	s.topic = topic
+	s.position = map[Partition]int64{}
+	for i := 0; i < s.bus.partitions; i++ {
+		partition := Partition{Topic: topic, Partition: int32(i)}
+		s.position[partition] = committed[partition]
+	}
+	return nil
+}
+
+func (s *MemorySubscriber) Poll(timeout time.Duration) (*Message, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		msg, published, err := s.nextMessage()
+		if msg != nil || err != nil {
+			return msg, err
+		}
+		select {
+		case <-published:
+		case <-deadline.C:
+			return nil, nil
+		}
+	}
+}
+
+// nextMessage takes the next unread message, visiting partitions round robin.
+// When there is none it returns the channel closed by the next publish.
+func (s *MemorySubscriber) nextMessage() (*Message, chan struct{}, error) {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil, ErrClosed
+	}
+	if s.topic == "" {
+		return nil, s.bus.published, nil
+	}
+	topic := s.bus.topic(s.topic)
+	for i := 0; i < s.bus.partitions; i++ {
+		index := (s.next + i) % s.bus.partitions
+		partition := Partition{Topic: s.topic, Partition: int32(index)}
+		position := s.position[partition]
+		if !s.paused[partition] && position < int64(len(topic.partitions[index])) {
+			s.position[partition] = position + 1
+			s.next = index + 1
+			msg := *topic.partitions[index][position]
+			msg.Headers = append([]Header(nil), msg.Headers...)
+			return &msg, nil, nil
+		}
+	}
+	return nil, s.bus.published, nil
+}
+
+func (s *MemorySubscriber) Commit(offsets []Offset) error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	committed := s.bus.groups[s.group]
+	for _, offset := range offsets {
+		committed[offset.Partition] = offset.Offset
+	}
+	return nil
+}
+
+func (s *MemorySubscriber) Pause(partitions []Partition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused == nil {
+		s.paused = map[Partition]bool{}
+	}
+	for _, partition := range partitions {
+		s.paused[partition] = true
+	}
+	return nil
+}
+
+func (s *MemorySubscriber) Resume(partitions []Partition) error {
+	s.mu.Lock()
+	for _, partition := range partitions {
+		delete(s.paused, partition)
+	}
+	s.mu.Unlock()
+	// wake up a poller waiting for messages, which may be waiting already
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	close(s.bus.published)
+	s.bus.published = make(chan struct{})
+	return nil
+}
+
+// Committed returns the group's committed offset for partition.
+func (s *MemorySubscriber) Committed(partition Partition) int64 {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	return s.bus.groups[s.group][partition]
+}
+
+func (s *MemorySubscriber) Assignment() ([]Partition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	partitions := make([]Partition, 0, len(s.position))
+	for i := 0; i < len(s.position); i++ {
+		partitions = append(partitions, Partition{Topic: s.topic, Partition: int32(i)})
+	}
+	return partitions, nil
+}
+
+func (s *MemorySubscriber) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemorySubscriber) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,105 @@
+package messaging
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemoryBus_KeyedMessagesShareAPartition(t *testing.T) {
+	bus := NewMemoryBus(4)
+	publisher := bus.Publisher()
+	var partitions []int32
+	for i := 0; i < 3; i++ {
+		msg := &Message{Topic: "t", Key: []byte("tx-1"), Value: []byte{byte(i)}}
+		require.NoError(t, publisher.Publish(context.Background(), msg))
+		assert.Equal(t, int64(i), msg.Offset)
+		partitions = append(partitions, msg.Partition)
+	}
+	assert.Equal(t, []int32{partitions[0], partitions[0], partitions[0]}, partitions)
+}
+
+func TestMemorySubscriber_Poll(t *testing.T) {
+	bus := NewMemoryBus(2)
+	subscriber := bus.Subscriber("group")
+	require.NoError(t, subscriber.Subscribe("t", nil))
+
+	msg, err := subscriber.Poll(10 * time.Millisecond)
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		bus.Publisher().Publish(context.Background(), &Message{Topic: "t", Value: []byte("hello")})
+	}()
+	msg, err = subscriber.Poll(time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, "hello", string(msg.Value))
+}
+
+func TestMemorySubscriber_ResumesFromCommittedOffset(t *testing.T) {
+	bus := NewMemoryBus(1)
+	publisher := bus.Publisher()
+	for _, value := range []string{"a", "b", "c"} {
+		require.NoError(t, publisher.Publish(context.Background(), &Message{Topic: "t", Value: []byte(value)}))
+	}
+	first := bus.Subscriber("group")
+	require.NoError(t, first.Subscribe("t", nil))
+	msg, err := first.Poll(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(msg.Value))
+	partition := Partition{Topic: "t", Partition: 0}
+	require.NoError(t, first.Commit([]Offset{{Partition: partition, Offset: msg.Offset + 1}}))
+	require.NoError(t, first.Close())
+
+	second := bus.Subscriber("group")
+	require.NoError(t, second.Subscribe("t", nil))
+	msg, err = second.Poll(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(msg.Value))
+	assert.Equal(t, int64(1), second.Committed(partition))
+
+	// another group reads the topic from the start
+	other := bus.Subscriber("other")
+	require.NoError(t, other.Subscribe("t", nil))
+	msg, err = other.Poll(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(msg.Value))
+}
+
+func TestMemorySubscriber_Pause(t *testing.T) {
+	bus := NewMemoryBus(1)
+	publisher := bus.Publisher()
+	for _, value := range []string{"a", "b"} {
+		require.NoError(t, publisher.Publish(context.Background(), &Message{Topic: "t", Value: []byte(value)}))
+	}
+	subscriber := bus.Subscriber("group")
+	require.NoError(t, subscriber.Subscribe("t", nil))
+	msg, err := subscriber.Poll(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(msg.Value))
+
+	partition := Partition{Topic: "t", Partition: 0}
+	require.NoError(t, subscriber.Pause([]Partition{partition}))
+	msg, err = subscriber.Poll(10 * time.Millisecond)
+	require.NoError(t, err)
+	assert.Nil(t, msg, "a paused partition is not polled")
+
+	require.NoError(t, subscriber.Resume([]Partition{partition}))
+	msg, err = subscriber.Poll(time.Second)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, "b", string(msg.Value), "a resumed partition goes on where it stopped")
+}
+
+func TestMemorySubscriber_Close(t *testing.T) {
+	bus := NewMemoryBus(1)
+	subscriber := bus.Subscriber("group")
+	require.NoError(t, subscriber.Subscribe("t", nil))
+	require.NoError(t, subscriber.Close())
+	_, err := subscriber.Poll(time.Millisecond)
+	assert.ErrorIs(t, err, ErrClosed)
+}
@@ -0,0 +1,76 @@
+package messaging
+
+import (
+	"context"
+	"time"
+)
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+type Message struct {
+	Topic     string
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Partition int32
+	Offset    int64
+}
+
+func (m *Message) Header(key string) string {
+	for _, header := range m.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// SetHeader replaces the header with the same key, or adds it.
+func (m *Message) SetHeader(key, value string) {
+	for i, header := range m.Headers {
+		if header.Key == key {
+			m.Headers[i].Value = []byte(value)
+			return
+		}
+	}
+	m.Headers = append(m.Headers, Header{Key: key, Value: []byte(value)})
+}
+
+type Partition struct {
+	Topic     string
+	Partition int32
+}
+
+// Offset is the next offset of a partition to deliver to its consumer group.
+type Offset struct {
+	Partition
+	Offset int64
+}
+
+type Publisher interface {
+	// Publish sends msg and waits for the broker to acknowledge it.
+	Publish(ctx context.Context, msg *Message) error
+	Ping(ctx context.Context) error
+	// Close delivers outstanding messages and releases the publisher.
+	Close() error
+}
+
+type Subscriber interface {
+	// Subscribe joins the consumer group on topic. onRevoked is called from
+	// Poll when partitions are taken away, before they are handed to another
+	// member, so their work can be finished and committed.
+	Subscribe(topic string, onRevoked func(partitions []Partition)) error
+	// Poll returns the next message, or nil when none arrives within timeout.
+	Poll(timeout time.Duration) (*Message, error)
+	Commit(offsets []Offset) error
+	// Pause stops Poll returning messages of partitions, while the consumer
+	// keeps its place in the group, until they are resumed.
+	Pause(partitions []Partition) error
+	Resume(partitions []Partition) error
+	Assignment() ([]Partition, error)
+	Ping(ctx context.Context) error
+	Close() error
+}
@@ -1,6 +1,9 @@
 package models
 
-import "github.com/go-pg/pg/v10"
+import (
+	"encoding/json"
+	"time"
+)
 
 type TransactionType string
 
@@ -14,36 +17,128 @@ type TransactionStatus string
 const (
 	Pending    TransactionStatus = "pending"
 	Processing TransactionStatus = "processing"
-	Failed     TransactionStatus = "failed"
-	Successful TransactionStatus = "successful"
+	// PendingAction is a card payment waiting for the customer to complete a
+	// 3-D Secure challenge at Transaction.ActionUrl. It is submitted again
+	// once they return.
+	PendingAction TransactionStatus = "pending_action"
+	Failed        TransactionStatus = "failed"
+	Successful    TransactionStatus = "successful"
+)
+
+// FailureCode tells why a transaction or an attempt failed, the same whatever
+// the gateway. Gateways map their own error codes to these.
+type FailureCode string
+
+const (
+	// FailureDeclined is a decline the gateway gave no more specific reason for.
+	FailureDeclined          FailureCode = "declined"
+	FailureInsufficientFunds FailureCode = "insufficient_funds"
+	FailureInvalidAccount    FailureCode = "invalid_account"
+	FailureLimitExceeded     FailureCode = "limit_exceeded"
+	// FailureInvalidRequest is a request the gateway rejected as invalid.
+	FailureInvalidRequest FailureCode = "invalid_request"
+	// FailureGatewayError is an error on the gateway's side.
+	FailureGatewayError FailureCode = "gateway_error"
+	// FailureGatewayTimeout is a gateway that did not answer in time.
+	FailureGatewayTimeout FailureCode = "gateway_timeout"
+	// FailureCircuitOpen is an attempt not made as the gateway's circuit was open.
+	FailureCircuitOpen FailureCode = "circuit_open"
+	// FailureRetriesExhausted is a transaction whose every attempt failed.
+	FailureRetriesExhausted FailureCode = "retries_exhausted"
+	// FailureActionExpired is a card payment whose 3-D Secure challenge the
+	// customer did not pass in time.
+	FailureActionExpired FailureCode = "action_expired"
 )
 
 type Transaction struct {
 	tableName     struct{} `pg:"pay.transactions"`
 	TransactionId string   `json:"transaction_id"`
-	AccountId     string   `json:"account_id"`
-	Type          string   `json:"type"`
-	GateWay       string   `json:"gate_way"`
-	UserId        string   `json:"user_id"`
-	ClientCallback string `json:"client_callback"`
-	Amount        float64  `json:"amount"`
-	Currency      string   `json:"currency"`
-	CreatedAt     string   `json:"created_at"`
-	UpdatedAt     string   `json:"updated_at"`
-	Status        string   `json:"status"`
-	RetryCount    int      `json:"retry_count"`
+	// AccountId is only ever held in memory. It is stored as
+	// EncryptedAccountId, see the encryption package.
+	AccountId          string `pg:"-" json:"-"`
+	EncryptedAccountId string `pg:"account_id" json:"encrypted_account_id,omitempty"`
+	// AccountToken stands for AccountId in messages.
+	AccountToken string `pg:"-" json:"-"`
+	// CardToken is the card gateway's token of the card paid with, set
+	// instead of AccountId on card gateways. It is no secret and stored as is.
+	CardToken      string     `json:"card_token,omitempty"`
+	Type           string     `json:"type"`
+	GateWay        string     `json:"gate_way"`
+	UserId         string     `json:"user_id"`
+	ClientCallback string     `json:"client_callback"`
+	Amount         float64    `json:"amount"`
+	Currency       string     `json:"currency"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+	// SubmittedAt is when the transaction was last sent to its gateway.
+	SubmittedAt *time.Time `json:"submitted_at,omitempty"`
+	// CompletedAt is when the transaction succeeded, FailedAt when it failed.
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	FailedAt    *time.Time `json:"failed_at,omitempty"`
+	Status      string     `json:"status"`
+	// GatewayReference is the gateway's own id of the transaction.
+	GatewayReference string `json:"gateway_reference,omitempty"`
+	// FailureCode and FailureMessage tell why a failed transaction failed, or
+	// why the last attempt at a transaction still going failed.
+	FailureCode    string `json:"failure_code,omitempty"`
+	FailureMessage string `json:"failure_message,omitempty"`
+	// ActionUrl is where the customer completes a 3-D Secure challenge while
+	// the transaction is pending_action.
+	ActionUrl string `json:"action_url,omitempty"`
+	// ReturnUrl is where the customer is sent back to after the challenge.
+	ReturnUrl     string     `json:"return_url,omitempty"`
+	RetryCount    int        `json:"retry_count"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	Version       int        `pg:",use_zero" json:"version"`
 }
 type User struct {
 	tableName struct{} `pg:"pay.users"`
 	Guid      string   `json:"guid"`
-	AccountId string   `json:"account_id"`
-	GateWay   string   `json:"gate_way"`
-	CreatedAt string   `json:"created_at"`
-	UpdatedAt string   `json:"updated_at"`
+	// AccountId is only ever held in memory, like Transaction.AccountId.
+	AccountId          string `pg:"-" json:"-"`
+	EncryptedAccountId string `pg:"account_id" json:"encrypted_account_id,omitempty"`
+	// AccountIndex is the blind index of AccountId, unique per gateway.
+	AccountIndex string `json:"account_index,omitempty"`
+	// CardToken is set instead of AccountId on card gateways, unique per
+	// gateway like the account.
+	CardToken string     `json:"card_token,omitempty"`
+	GateWay   string     `json:"gate_way"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// SetStatus changes the status of t at now, stamping UpdatedAt and the
+// lifecycle timestamp of the status, if it has one.
+func (t *Transaction) SetStatus(status TransactionStatus, now time.Time) {
+	t.Status = string(status)
+	t.UpdatedAt = &now
+	switch status {
+	case Processing:
+		t.SubmittedAt = &now
+	case Successful:
+		t.CompletedAt = &now
+	case Failed:
+		t.FailedAt = &now
+	}
+}
+
+// SetFailure records why t, or its last attempt, failed.
+func (t *Transaction) SetFailure(code FailureCode, message string) {
+	t.FailureCode = string(code)
+	t.FailureMessage = message
 }
 
-func DbGetUser(db *pg.DB, userId string) (User, error) {
-	var user User
-	err := db.Model(&user).Where("guid = ?", userId).Select()
-	return user, err
+// AuditEntry records an API call or a change to a user or transaction. Entries
+// are only ever appended.
+type AuditEntry struct {
+	tableName  struct{}        `pg:"pay.audit_log"`
+	Id         int64           `pg:",pk" json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetId   string          `json:"target_id,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	RequestId  string          `json:"request_id,omitempty"`
 }
@@ -1,129 +1,277 @@
 package payment_processor
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/afex/hystrix-go/hystrix"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"github.com/go-pg/pg/v10"
-	"github.com/redis/go-redis/v9"
-	"log"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"payments/config"
+	"payments/events"
 	"payments/gateways"
+	"payments/logging"
+	"payments/messaging"
 	"payments/models"
+	"payments/store"
+	"payments/tracing"
 	"payments/utils"
+	"payments/worker"
 	"time"
 )
 
 type PaymentProcessor struct {
-	gateWays map[string]gateways.PaymentGateway
-	db       *pg.DB
-	redisDb  *redis.Client
-	producer *kafka.Producer
-	cfg      *config.Config
+	gateWays     map[string]gateways.PaymentGateway
+	transactions store.TransactionRepository
+	publisher    messaging.Publisher
+	cfg          *config.Config
+	logger       zerolog.Logger
 }
 
-func NewPaymentProcessor(cfg *config.Config, db *pg.DB, rdb *redis.Client, producer *kafka.Producer, gateways map[string]gateways.PaymentGateway) *PaymentProcessor {
-	for key, _ := range gateways {
-		hystrix.ConfigureCommand(
-			key,
-			hystrix.CommandConfig{
-				Timeout:               config.GateWayTimeout,
-				MaxConcurrentRequests: config.MaxConcurrentRequests,
-				ErrorPercentThreshold: config.ErrorPercentThreshold,
-				SleepWindow:           config.CircuitBreakSleepWindow,
-			},
-		)
+func NewPaymentProcessor(cfg *config.Config, transactions store.TransactionRepository, publisher messaging.Publisher, gateways map[string]gateways.PaymentGateway) *PaymentProcessor {
+	processor := &PaymentProcessor{
+		gateWays:     gateways,
+		transactions: transactions,
+		publisher:    publisher,
+		cfg:          cfg,
+		logger:       logging.Component("payment_processor"),
 	}
-	return &PaymentProcessor{
-		gateWays: gateways,
-		db:       db,
-		cfg:      cfg,
-		producer: producer,
-		redisDb:  rdb,
+	processor.ConfigureCommands()
+	return processor
+}
+
+// ConfigureCommands applies the configured hystrix settings to every gateway.
+// It is called again when the config is reloaded.
+func (p *PaymentProcessor) ConfigureCommands() {
+	for key := range p.gateWays {
+		hystrix.ConfigureCommand(key, p.cfg.GateWaySettings(key).HystrixConfig())
 	}
 }
 
-func (p *PaymentProcessor) Process(payload models.Transaction) error {
-	var transaction models.Transaction
-	err := p.db.Model(&transaction).Where("transaction_id = ?", payload.TransactionId).Select()
+// HandleMessage is the worker.Handler for the transaction topic.
+func (p *PaymentProcessor) HandleMessage(ctx context.Context, msg *messaging.Message) error {
+	var event events.PaymentRequested
+	err := events.DecodeMessage(msg, &event)
 	if err != nil {
-		return err
+		p.logger.Error().Err(err).Msg("Error decoding payment request")
+		return worker.Permanent(err)
 	}
-	if transaction.Status != string(models.Pending) {
+	ctx, span := tracing.StartConsumerSpan(ctx, msg, "payment_processor.process")
+	defer span.End()
+	return p.Process(ctx, event)
+}
+
+// maxStartAttempts bounds how often Process reads a transaction again after it
+// changed concurrently, before it leaves the message to the worker's retries.
+const maxStartAttempts = 3
+
+// Process submits the requested transaction to its gateway. Only the id is
+// taken from the event; the rest is read from the store.
+func (p *PaymentProcessor) Process(ctx context.Context, payload events.PaymentRequested) error {
+	for attempt := 1; ; attempt++ {
+		transaction, gateway, started, err := p.start(ctx, payload.TransactionId)
+		if errors.Is(err, store.ErrConflict) && attempt < maxStartAttempts {
+			// changed since it was read, by another processor or the retry
+			// scheduler claiming it: whether it is still ours to submit
+			// depends on where it stands now
+			p.logger.Info().Str("transaction_id", payload.TransactionId).Int("attempt", attempt).Msg("Transaction was changed concurrently, reading it again")
+			continue
+		}
+		if err != nil || !started {
+			return err
+		}
+		p.publishEvent(ctx, events.NewTransactionSubmitted(transaction, time.Now()))
+		p.callGateway(ctx, gateway, transaction)
 		return nil
 	}
+}
+
+// start moves a pending transaction whose retry, if any, is due to processing.
+// It reports whether it did, and returns ErrConflict if the transaction changed
+// since it was read.
+func (p *PaymentProcessor) start(ctx context.Context, transactionId string) (models.Transaction, gateways.PaymentGateway, bool, error) {
+	transaction, err := p.transactions.Get(ctx, transactionId)
+	if err != nil {
+		return transaction, nil, false, err
+	}
+	if transaction.Status != string(models.Pending) {
+		return transaction, nil, false, nil
+	}
+	// a new transaction's next_attempt_at is only when the retry scheduler
+	// recovers it, should this request have been lost
+	if transaction.RetryCount > 0 && transaction.NextAttemptAt != nil && transaction.NextAttemptAt.After(utils.Now()) {
+		// a duplicate of an earlier request: the retry scheduler publishes
+		// the transaction again once its backoff is over
+		p.logger.Info().Str("transaction_id", transaction.TransactionId).Time("next_attempt_at", *transaction.NextAttemptAt).Msg("Retry not due yet, skipping")
+		return transaction, nil, false, nil
+	}
 	gateway, ok := p.gateWays[transaction.GateWay]
 	if !ok {
-		return errors.New(fmt.Sprintf("Payment Gateway not found for gate id: %s", transaction.GateWay))
+		return transaction, nil, false, errors.New(fmt.Sprintf("Payment Gateway not found for gate id: %s", transaction.GateWay))
+	}
+	// a deposit back from its 3-D Secure challenge carries on with the attempt
+	// that sent the customer there
+	if !resumed(transaction) {
+		transaction.RetryCount = transaction.RetryCount + 1
 	}
-	mutexLock := utils.GetMutexLock(p.redisDb, config.TransactionDomain, transaction.TransactionId)
-	err = mutexLock.Lock()
+	transaction.SetStatus(models.Processing, utils.Now())
+	transaction.NextAttemptAt = nil
+	err = p.transactions.Update(ctx, &transaction, models.Pending)
 	if err != nil {
-		return err
+		return transaction, nil, false, err
 	}
-	transaction.Status = string(models.Processing)
-	transaction.UpdatedAt = utils.FmtTimestamp(time.Now())
-	transaction.RetryCount = transaction.RetryCount + 1
-	_, err = p.db.Model(&transaction).Where("transaction_id = ?", transaction.TransactionId).Update()
-	mutexLock.Unlock()
+	return transaction, gateway, true, nil
+}
+
+// resumed tells whether a pending transaction is a deposit back from its 3-D
+// Secure challenge. awaitAction clears the failure of the attempts before the
+// challenge, so one with a failure is a retry of the resumed deposit.
+func resumed(transaction models.Transaction) bool {
+	return transaction.Type == string(models.Deposit) && transaction.GatewayReference != "" && transaction.FailureCode == ""
+}
+
+// publishEvent publishes a lifecycle event. The change it reports is committed
+// already and the gateway call must go ahead, so a failure is only logged.
+func (p *PaymentProcessor) publishEvent(ctx context.Context, event events.Event) {
+	err := events.Publish(ctx, p.publisher, p.cfg.KafkaTopics.EventsTopic, event)
 	if err != nil {
-		return err
+		p.logger.Error().Err(err).Str("event_type", event.EventType()).Str("transaction_id", event.EventKey()).Msg("Error publishing lifecycle event")
 	}
-	hystrix.Go(transaction.GateWay, func() error {
+}
+
+func (p *PaymentProcessor) callGateway(ctx context.Context, gateway gateways.PaymentGateway, transaction models.Transaction) {
+	// a permanent error is not the gateway failing: it is kept from hystrix so
+	// it does not count toward opening the circuit, and fails the transaction
+	// without retrying
+	var permanentErr error
+	// nor is a card payment waiting for the customer's 3-D Secure challenge
+	var actionRequired *gateways.ActionRequired
+	fellBack := false
+	timeout := time.Duration(p.cfg.GateWaySettings(transaction.GateWay).Timeout) * time.Millisecond
+	err := hystrix.Do(transaction.GateWay, func() error {
+		// hystrix stops waiting after its timeout; the request is cancelled
+		// then too rather than left running
+		callCtx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		ctx, span := tracing.Tracer().Start(callCtx, "gateway."+transaction.Type,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("payments.transaction_id", transaction.TransactionId),
+				attribute.String("payments.gateway", transaction.GateWay),
+				attribute.Int("payments.attempt", transaction.RetryCount),
+			),
+		)
+		defer span.End()
+		var err error
 		switch transaction.Type {
 		case string(models.Deposit):
-			err := gateway.Deposit(transaction)
-			if err != nil {
-				log.Printf("Calling getway deposit error: %s", err)
-				return err
-			}
-
+			err = gateway.Deposit(ctx, transaction)
 		case string(models.Withdraw):
-			err := gateway.Withdraw(transaction)
-			if err != nil {
-				log.Printf("Calling getway withdraw error: %s", err)
-				return err
+			err = gateway.Withdraw(ctx, transaction)
+		}
+		if errors.As(err, &actionRequired) {
+			p.logger.Info().Str("transaction_id", transaction.TransactionId).Msg("Gateway requires customer action")
+			return nil
+		}
+		if err != nil {
+			p.logger.Warn().Err(err).Str("transaction_id", transaction.TransactionId).Str("type", transaction.Type).Bool("retryable", gateways.IsRetryable(err)).Msg("Gateway call failed")
+			span.SetStatus(codes.Error, err.Error())
+			if !gateways.IsRetryable(err) {
+				permanentErr = err
+				return nil
 			}
 		}
-		return nil
+		return err
 	}, func(err error) error {
-		if transaction.RetryCount < config.MaxGateWayRetries {
-			duration := utils.ExponentialBackoff(transaction.RetryCount)
-			mutexLock := utils.GetMutexLock(p.redisDb, config.TransactionDomain, transaction.TransactionId)
-			err = mutexLock.Lock()
-			if err != nil {
-				return err
-			}
-			transaction.Status = string(models.Pending)
-			_, dbErr := p.db.Model(&transaction).Where("transaction_id = ?", transaction.TransactionId).Update()
-			mutexLock.Unlock()
-			if dbErr != nil {
-				return dbErr
-			}
-
-			time.AfterFunc(duration, func() {
-				jsonData, _ := json.Marshal(transaction)
-				err = p.producer.Produce(
-					&kafka.Message{
-						Value: jsonData,
-						TopicPartition: kafka.TopicPartition{
-							Topic: &p.cfg.KafkaTopics.TransactionTopic, Partition: kafka.PartitionAny,
-						},
-					}, nil)
-			})
-		} else {
-			mutexLock := utils.GetMutexLock(p.redisDb, config.TransactionDomain, transaction.TransactionId)
-			err = mutexLock.Lock()
-			transaction.Status = string(models.Failed)
-			_, dbErr := p.db.Model(&transaction).Where("transaction_id = ?", transaction.TransactionId).Update()
-			mutexLock.Unlock()
+		fellBack = true
+		// after a timeout the call can still be running and reading transaction
+		transaction := transaction
+		code := failureCode(err)
+		transaction.SetFailure(code, err.Error())
+		if transaction.RetryCount < p.cfg.MaxGateWayRetries(transaction.GateWay) {
+			nextAttemptAt := utils.Now().Add(utils.ExponentialBackoffWithJitter(transaction.RetryCount))
+			transaction.SetStatus(models.Pending, utils.Now())
+			transaction.NextAttemptAt = &nextAttemptAt
+			dbErr := p.transactions.Update(ctx, &transaction, models.Processing)
 			if dbErr != nil {
 				return dbErr
 			}
+			p.publishEvent(ctx, events.NewTransactionRetryScheduled(transaction, time.Now()))
+			// the retry scheduler publishes the transaction again once it is due
+			p.logger.Info().Str("transaction_id", transaction.TransactionId).Int("retry", transaction.RetryCount).Time("next_attempt_at", nextAttemptAt).Msg("Retry scheduled")
+			return nil
 		}
-		return nil
+		transaction.SetFailure(models.FailureRetriesExhausted, fmt.Sprintf("%d attempts failed, the last with %s: %v", transaction.RetryCount, code, err))
+		return p.fail(ctx, transaction)
 	})
+	// without a fallback the call ran to the end, so permanentErr is set if
+	// it failed permanently; after a timeout it could still be set late
+	if err == nil && !fellBack && permanentErr != nil {
+		transaction.SetFailure(failureCode(permanentErr), permanentErr.Error())
+		err = p.fail(ctx, transaction)
+	}
+	if err == nil && !fellBack && actionRequired != nil {
+		err = p.awaitAction(ctx, transaction, actionRequired)
+	}
+	if err != nil {
+		p.logger.Error().Err(err).Str("transaction_id", transaction.TransactionId).Msg("Error handling gateway failure")
+	}
+}
+
+// fail records the failure of a transaction being processed.
+func (p *PaymentProcessor) fail(ctx context.Context, transaction models.Transaction) error {
+	transaction.SetStatus(models.Failed, utils.Now())
+	err := p.transactions.Update(ctx, &transaction, models.Processing)
+	if err != nil {
+		return err
+	}
+	p.publishEvent(ctx, events.NewTransactionFailed(transaction, time.Now()))
 	return nil
 }
+
+// awaitAction records the 3-D Secure challenge a card gateway sent the
+// customer to, and tells the client where it is. The transaction waits at
+// pending_action until the customer is back, see api.Handler.Return.
+func (p *PaymentProcessor) awaitAction(ctx context.Context, transaction models.Transaction, action *gateways.ActionRequired) error {
+	transaction.SetStatus(models.PendingAction, utils.Now())
+	// the attempt went through, up to the challenge
+	transaction.SetFailure("", "")
+	transaction.ActionUrl = action.RedirectUrl
+	if action.Reference != "" {
+		transaction.GatewayReference = action.Reference
+	}
+	// encoded first, so the update is not committed without its event
+	envelope, err := events.Encode(events.NewPaymentStatusChanged(transaction, time.Now().UTC()))
+	if err != nil {
+		return err
+	}
+	err = p.transactions.Update(ctx, &transaction, models.Processing)
+	if err != nil {
+		return err
+	}
+	p.publishEvent(ctx, events.NewTransactionActionRequired(transaction, time.Now()))
+	msg := envelope.Message(p.cfg.KafkaTopics.DispatcherTopic)
+	tracing.InjectMessage(ctx, msg)
+	return p.publisher.Publish(ctx, msg)
+}
+
+// failureCode classifies the error of a failed gateway call.
+func failureCode(err error) models.FailureCode {
+	var gatewayErr *gateways.Error
+	switch {
+	case errors.As(err, &gatewayErr):
+		return gatewayErr.Code
+	case errors.Is(err, hystrix.ErrCircuitOpen):
+		return models.FailureCircuitOpen
+	case errors.Is(err, hystrix.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return models.FailureGatewayTimeout
+	default:
+		return models.FailureGatewayError
+	}
+}
@@ -0,0 +1,326 @@
+package payment_processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/afex/hystrix-go/hystrix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"payments/config"
+	"payments/events"
+	"payments/gateways"
+	"payments/messaging"
+	"payments/models"
+	"payments/store"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeGateway struct {
+	err   error
+	calls atomic.Int32
+	// hang makes calls wait for their context to end
+	hang      bool
+	cancelled atomic.Bool
+}
+
+func (g *fakeGateway) Deposit(ctx context.Context, transaction models.Transaction) error {
+	g.calls.Add(1)
+	if g.hang {
+		<-ctx.Done()
+		g.cancelled.Store(true)
+		return ctx.Err()
+	}
+	return g.err
+}
+
+func (g *fakeGateway) Withdraw(ctx context.Context, transaction models.Transaction) error {
+	g.calls.Add(1)
+	return g.err
+}
+
+func (g *fakeGateway) HandleCallback(payload []byte) (gateways.GateWayResponse, error) {
+	return gateways.GateWayResponse{}, nil
+}
+
+func newTestProcessor(t *testing.T, gateWay string, gateway gateways.PaymentGateway, transaction models.Transaction) (*PaymentProcessor, store.TransactionRepository, *messaging.MemoryBus) {
+	cfg := &config.Config{}
+	cfg.Resilience.Defaults.MaxRetries = 2
+	cfg.KafkaTopics.EventsTopic = "payments.events"
+	transactions := store.NewMemoryTransactionRepository()
+	require.NoError(t, transactions.Create(context.Background(), &transaction))
+	bus := messaging.NewMemoryBus(1)
+	processor := NewPaymentProcessor(cfg, transactions, bus.Publisher(), map[string]gateways.PaymentGateway{gateWay: gateway})
+	return processor, transactions, bus
+}
+
+func eventTypes(bus *messaging.MemoryBus) []string {
+	var types []string
+	for _, msg := range bus.Messages("payments.events") {
+		types = append(types, msg.Header(messaging.EventTypeHeader))
+	}
+	return types
+}
+
+func TestPaymentProcessor_Process(t *testing.T) {
+	gateway := &fakeGateway{}
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_ok", Type: string(models.Deposit), Amount: 10, Currency: "USD", Status: string(models.Pending)}
+	processor, transactions, bus := newTestProcessor(t, "test_ok", gateway, transaction)
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), gateway.calls.Load())
+	assert.Equal(t, string(models.Processing), stored.Status)
+	assert.Equal(t, 1, stored.RetryCount)
+	assert.Nil(t, stored.NextAttemptAt)
+	require.NotNil(t, stored.SubmittedAt)
+	assert.Equal(t, stored.SubmittedAt, stored.UpdatedAt)
+
+	// a redelivered message does not call the gateway again
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	assert.Equal(t, int32(1), gateway.calls.Load())
+	assert.Equal(t, []string{events.TransactionSubmittedType}, eventTypes(bus))
+}
+
+func TestPaymentProcessor_Process_SchedulesRetry(t *testing.T) {
+	gateway := &fakeGateway{err: errors.New("gateway failed with status code 503")}
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_retry", Type: string(models.Withdraw), Amount: 10, Currency: "USD", Status: string(models.Pending)}
+	processor, transactions, bus := newTestProcessor(t, "test_retry", gateway, transaction)
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Pending), stored.Status)
+	assert.NotNil(t, stored.NextAttemptAt)
+	assert.Equal(t, string(models.FailureGatewayError), stored.FailureCode)
+	assert.Equal(t, "gateway failed with status code 503", stored.FailureMessage)
+
+	// the last attempt, once due, fails the transaction
+	due := time.Now().Add(-time.Second)
+	stored.NextAttemptAt = &due
+	require.NoError(t, transactions.Update(context.Background(), &stored, models.Pending))
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	stored, err = transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), gateway.calls.Load())
+	assert.Equal(t, string(models.Failed), stored.Status)
+	assert.NotNil(t, stored.FailedAt)
+	assert.Nil(t, stored.CompletedAt)
+	assert.Equal(t, string(models.FailureRetriesExhausted), stored.FailureCode)
+	assert.Equal(t, "2 attempts failed, the last with gateway_error: gateway failed with status code 503", stored.FailureMessage)
+	assert.Equal(t, []string{
+		events.TransactionSubmittedType,
+		events.TransactionRetryScheduledType,
+		events.TransactionSubmittedType,
+		events.TransactionFailedType,
+	}, eventTypes(bus))
+}
+
+func TestPaymentProcessor_Process_RetryNotDue(t *testing.T) {
+	gateway := &fakeGateway{}
+	nextAttemptAt := time.Now().Add(time.Minute)
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_not_due", Type: string(models.Deposit), Amount: 10, Currency: "USD",
+		Status: string(models.Pending), RetryCount: 1, NextAttemptAt: &nextAttemptAt}
+	processor, transactions, _ := newTestProcessor(t, "test_not_due", gateway, transaction)
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	assert.Equal(t, int32(0), gateway.calls.Load(), "a redelivered request does not skip the backoff")
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Pending), stored.Status)
+	assert.Equal(t, 1, stored.RetryCount)
+
+	// once it is due the retry goes ahead
+	past := time.Now().Add(-time.Second)
+	stored.NextAttemptAt = &past
+	require.NoError(t, transactions.Update(context.Background(), &stored, models.Pending))
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	assert.Equal(t, int32(1), gateway.calls.Load())
+}
+
+func TestPaymentProcessor_Process_PermanentError(t *testing.T) {
+	gateway := &fakeGateway{err: &gateways.Error{Kind: gateways.KindDeclined, StatusCode: 402, Code: models.FailureInsufficientFunds, Message: "Insufficient funds"}}
+	transaction := models.Transaction{TransactionId: "0", GateWay: "test_permanent", Type: string(models.Withdraw), Amount: 10, Currency: "USD", Status: string(models.Pending)}
+	processor, transactions, bus := newTestProcessor(t, "test_permanent", gateway, transaction)
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	stored, err := transactions.Get(context.Background(), "0")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Failed), stored.Status, "a permanent error is not retried")
+	assert.Equal(t, 1, stored.RetryCount)
+	assert.Equal(t, string(models.FailureInsufficientFunds), stored.FailureCode)
+	assert.Equal(t, "gateway failed with status code 402: Insufficient funds", stored.FailureMessage)
+	assert.Equal(t, []string{events.TransactionSubmittedType, events.TransactionFailedType}, eventTypes(bus))
+
+	// permanent errors do not open the circuit
+	for i := 1; i < 30; i++ {
+		transaction.TransactionId = fmt.Sprint(i)
+		require.NoError(t, transactions.Create(context.Background(), &transaction))
+		require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	}
+	assert.Equal(t, int32(30), gateway.calls.Load())
+	circuit, _, err := hystrix.GetCircuit("test_permanent")
+	require.NoError(t, err)
+	assert.False(t, circuit.IsOpen())
+}
+
+func TestPaymentProcessor_Process_ActionRequired(t *testing.T) {
+	gateway := &fakeGateway{err: &gateways.ActionRequired{RedirectUrl: "https://acs.example.com/challenge/auth_1", Reference: "auth_1"}}
+	// an earlier attempt failed
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_action", Type: string(models.Deposit), Amount: 10, Currency: "EUR",
+		CardToken: "card_4242", ClientCallback: "https://client.example.com/callback", Status: string(models.Pending),
+		RetryCount: 1, FailureCode: string(models.FailureGatewayTimeout)}
+	processor, transactions, bus := newTestProcessor(t, "test_action", gateway, transaction)
+	processor.cfg.KafkaTopics.DispatcherTopic = "pay.dispatcher"
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.PendingAction), stored.Status, "the transaction waits for the customer")
+	assert.Equal(t, "https://acs.example.com/challenge/auth_1", stored.ActionUrl)
+	assert.Equal(t, "auth_1", stored.GatewayReference)
+	assert.Nil(t, stored.NextAttemptAt)
+	assert.Empty(t, stored.FailureCode)
+	assert.Equal(t, []string{events.TransactionSubmittedType, events.TransactionActionRequiredType}, eventTypes(bus))
+
+	// the client is told where to send the customer
+	messages := bus.Messages("pay.dispatcher")
+	require.Len(t, messages, 1)
+	var changed events.PaymentStatusChanged
+	require.NoError(t, events.DecodeMessage(&messages[0], &changed))
+	assert.Equal(t, string(models.PendingAction), changed.Status)
+	assert.Equal(t, "https://acs.example.com/challenge/auth_1", changed.ActionUrl)
+
+	// nor does a challenge open the circuit
+	for i := 2; i < 30; i++ {
+		transaction.TransactionId = fmt.Sprint(i)
+		require.NoError(t, transactions.Create(context.Background(), &transaction))
+		require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	}
+	assert.Equal(t, int32(29), gateway.calls.Load())
+}
+
+func TestPaymentProcessor_Process_Resumed(t *testing.T) {
+	gateway := &fakeGateway{err: &gateways.Error{Kind: gateways.KindServer, StatusCode: 503, Code: models.FailureGatewayError, Message: "Service unavailable"}}
+	now := time.Now()
+	// back from its challenge, which took the last of its attempts
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_resumed", Type: string(models.Deposit), Amount: 10, Currency: "EUR",
+		CardToken: "card_4242", GatewayReference: "auth_1", Status: string(models.Pending), RetryCount: 2, NextAttemptAt: &now}
+	processor, transactions, _ := newTestProcessor(t, "test_resumed", gateway, transaction)
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), gateway.calls.Load())
+	assert.Equal(t, 2, stored.RetryCount, "resuming is not a retry")
+	assert.Equal(t, string(models.Failed), stored.Status, "but a failed resumed call is")
+	assert.Equal(t, string(models.FailureRetriesExhausted), stored.FailureCode)
+}
+
+func TestPaymentProcessor_Process_ResumedRetry(t *testing.T) {
+	gateway := &fakeGateway{}
+	past := time.Now().Add(-time.Minute)
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_resumed_retry", Type: string(models.Deposit), Amount: 10, Currency: "EUR",
+		CardToken: "card_4242", GatewayReference: "auth_1", Status: string(models.Pending), RetryCount: 1, NextAttemptAt: &past,
+		FailureCode: string(models.FailureGatewayError), FailureMessage: "gateway failed with status code 503: Service unavailable"}
+	processor, transactions, _ := newTestProcessor(t, "test_resumed_retry", gateway, transaction)
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Processing), stored.Status)
+	assert.Equal(t, 2, stored.RetryCount, "the resumed call failed, so this is a retry")
+}
+
+func TestPaymentProcessor_Process_CancelsTimedOutCall(t *testing.T) {
+	gateway := &fakeGateway{hang: true}
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_timeout", Type: string(models.Deposit), Amount: 10, Currency: "USD", Status: string(models.Pending)}
+	processor, transactions, _ := newTestProcessor(t, "test_timeout", gateway, transaction)
+	processor.cfg.Resilience.Defaults.Timeout = 50
+	processor.ConfigureCommands()
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Pending), stored.Status)
+	assert.Equal(t, string(models.FailureGatewayTimeout), stored.FailureCode)
+	assert.Eventually(t, gateway.cancelled.Load, time.Second, 10*time.Millisecond, "the abandoned call is cancelled")
+}
+
+func TestFailureCode(t *testing.T) {
+	assert.Equal(t, models.FailureCircuitOpen, failureCode(hystrix.ErrCircuitOpen))
+	assert.Equal(t, models.FailureGatewayTimeout, failureCode(hystrix.ErrTimeout))
+	assert.Equal(t, models.FailureGatewayTimeout, failureCode(fmt.Errorf("calling gateway: %w", context.DeadlineExceeded)))
+	assert.Equal(t, models.FailureGatewayError, failureCode(errors.New("gateway failed with status code 500")))
+}
+
+func TestPaymentProcessor_Process_Concurrent(t *testing.T) {
+	gateway := &fakeGateway{}
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_concurrent", Type: string(models.Deposit), Amount: 10, Currency: "USD", Status: string(models.Pending)}
+	processor, transactions, _ := newTestProcessor(t, "test_concurrent", gateway, transaction)
+
+	// redelivered copies of the message race to claim the transaction
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), gateway.calls.Load())
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, stored.RetryCount)
+}
+
+// racingRepository changes a transaction between it being read and updated,
+// as a retry claim committing in between does.
+type racingRepository struct {
+	store.TransactionRepository
+	races int
+}
+
+func (r *racingRepository) Update(ctx context.Context, transaction *models.Transaction, expectedStatus models.TransactionStatus) error {
+	if r.races > 0 {
+		r.races--
+		current, err := r.TransactionRepository.Get(ctx, transaction.TransactionId)
+		if err != nil {
+			return err
+		}
+		current.NextAttemptAt = nil
+		if err := r.TransactionRepository.Update(ctx, &current, expectedStatus); err != nil {
+			return err
+		}
+	}
+	return r.TransactionRepository.Update(ctx, transaction, expectedStatus)
+}
+
+func TestPaymentProcessor_Process_ReadsAgainOnConflict(t *testing.T) {
+	gateway := &fakeGateway{}
+	due := time.Now().Add(-time.Second)
+	transaction := models.Transaction{TransactionId: "1", GateWay: "test_conflict", Type: string(models.Deposit), Amount: 10, Currency: "USD",
+		Status: string(models.Pending), RetryCount: 1, NextAttemptAt: &due}
+	_, transactions, _ := newTestProcessor(t, "test_conflict", gateway, transaction)
+	racing := &racingRepository{TransactionRepository: transactions, races: 1}
+	processor := NewPaymentProcessor(&config.Config{}, racing, messaging.NewMemoryBus(1).Publisher(), map[string]gateways.PaymentGateway{"test_conflict": gateway})
+
+	require.NoError(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)))
+	assert.Equal(t, int32(1), gateway.calls.Load(), "the transaction is still submitted")
+	stored, err := transactions.Get(context.Background(), "1")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Processing), stored.Status)
+	assert.Equal(t, 2, stored.RetryCount)
+
+	// a transaction that keeps changing is left to the worker's retries
+	stored.SetStatus(models.Pending, time.Now())
+	require.NoError(t, transactions.Update(context.Background(), &stored, models.Processing))
+	racing.races = maxStartAttempts
+	assert.ErrorIs(t, processor.Process(context.Background(), events.NewPaymentRequested(transaction)), store.ErrConflict)
+	assert.Equal(t, int32(1), gateway.calls.Load())
+}
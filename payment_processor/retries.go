@@ -0,0 +1,136 @@
+package payment_processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"payments/config"
+	"payments/events"
+	"payments/logging"
+	"payments/messaging"
+	"payments/models"
+	"payments/store"
+	"payments/utils"
+	"time"
+)
+
+// RetryScheduler publishes transactions whose retry is due back to the
+// transaction topic. Retries live in the next_attempt_at column, so they
+// survive restarts, and several schedulers can poll the same table. It also
+// fails the card payments whose customer did not pass the 3-D Secure challenge
+// within the action timeout.
+type RetryScheduler struct {
+	transactions store.TransactionRepository
+	publisher    messaging.Publisher
+	cfg          *config.Config
+	logger       zerolog.Logger
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+func NewRetryScheduler(cfg *config.Config, transactions store.TransactionRepository, publisher messaging.Publisher) *RetryScheduler {
+	return &RetryScheduler{
+		transactions: transactions,
+		publisher:    publisher,
+		cfg:          cfg,
+		logger:       logging.Component("retry_scheduler"),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+func (s *RetryScheduler) Start() {
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.cfg.Retry.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				count, err := s.publishDue(context.Background())
+				if err != nil {
+					s.logger.Error().Err(err).Msg("Error publishing due retries")
+				} else if count > 0 {
+					s.logger.Info().Int("count", count).Msg("Published due retries")
+				}
+				count, err = s.expireActions(context.Background())
+				if err != nil {
+					s.logger.Error().Err(err).Msg("Error expiring customer actions")
+				} else if count > 0 {
+					s.logger.Info().Int("count", count).Msg("Expired customer actions")
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for the current poll to finish. It matches worker.ShutdownHook.
+func (s *RetryScheduler) Stop(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publishDue publishes a batch of due retries and clears their schedule. A
+// failed publish leaves the batch scheduled for the next poll.
+func (s *RetryScheduler) publishDue(ctx context.Context) (int, error) {
+	return s.transactions.ClaimDueRetries(ctx, s.cfg.Retry.BatchSize, func(transaction models.Transaction) error {
+		return s.publish(ctx, transaction)
+	})
+}
+
+// publish waits for the broker to acknowledge the message, since the schedule
+// is cleared on the strength of it.
+func (s *RetryScheduler) publish(ctx context.Context, transaction models.Transaction) error {
+	envelope, err := events.Encode(events.NewPaymentRequested(transaction))
+	if err != nil {
+		return err
+	}
+	return s.publisher.Publish(ctx, envelope.Message(s.cfg.KafkaTopics.TransactionTopic))
+}
+
+// expireActions fails a batch of transactions left at pending_action for longer
+// than the action timeout, unless the customer comes back meanwhile.
+func (s *RetryScheduler) expireActions(ctx context.Context) (int, error) {
+	stale, err := s.transactions.StaleActions(ctx, utils.Now().Add(-s.cfg.Retry.ActionTimeout), s.cfg.Retry.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, transaction := range stale {
+		transaction.SetStatus(models.Failed, utils.Now())
+		transaction.SetFailure(models.FailureActionExpired, fmt.Sprintf("the 3-D Secure challenge was not passed within %s", s.cfg.Retry.ActionTimeout))
+		transaction.ActionUrl = ""
+		// encoded first, so the update is not committed without its event
+		changed, err := events.Encode(events.NewPaymentStatusChanged(transaction, *transaction.UpdatedAt))
+		if err != nil {
+			return count, err
+		}
+		err = s.transactions.Update(ctx, &transaction, models.PendingAction)
+		if errors.Is(err, store.ErrConflict) {
+			// the customer is back, or the gateway settled the transaction
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+		// the failure is committed, so a failure to publish it is only logged
+		err = s.publisher.Publish(ctx, changed.Message(s.cfg.KafkaTopics.DispatcherTopic))
+		if err != nil {
+			s.logger.Error().Err(err).Str("transaction_id", transaction.TransactionId).Msg("Error publishing status change")
+		}
+		err = events.Publish(ctx, s.publisher, s.cfg.KafkaTopics.EventsTopic, events.NewTransactionFailed(transaction, time.Now()))
+		if err != nil {
+			s.logger.Error().Err(err).Str("transaction_id", transaction.TransactionId).Msg("Error publishing lifecycle event")
+		}
+	}
+	return count, nil
+}
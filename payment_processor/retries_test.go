@@ -0,0 +1,83 @@
+package payment_processor
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"payments/config"
+	"payments/events"
+	"payments/messaging"
+	"payments/models"
+	"payments/store"
+	"testing"
+	"time"
+)
+
+func TestRetryScheduler_PublishDue(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.KafkaTopics.TransactionTopic = "pay.transaction"
+	cfg.Retry.BatchSize = 10
+	transactions := store.NewMemoryTransactionRepository()
+	past, future := time.Now().Add(-time.Second), time.Now().Add(time.Hour)
+	require.NoError(t, transactions.Create(context.Background(), &models.Transaction{TransactionId: "due", Type: string(models.Deposit), GateWay: "a", Amount: 10, Currency: "USD", Status: string(models.Pending), NextAttemptAt: &past}))
+	require.NoError(t, transactions.Create(context.Background(), &models.Transaction{TransactionId: "later", Type: string(models.Deposit), GateWay: "a", Amount: 10, Currency: "USD", Status: string(models.Pending), NextAttemptAt: &future}))
+	bus := messaging.NewMemoryBus(1)
+	scheduler := NewRetryScheduler(cfg, transactions, bus.Publisher())
+
+	count, err := scheduler.publishDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	messages := bus.Messages("pay.transaction")
+	require.Len(t, messages, 1)
+	var published events.PaymentRequested
+	require.NoError(t, events.DecodeMessage(&messages[0], &published))
+	assert.Equal(t, "due", published.TransactionId)
+	assert.Equal(t, []byte("due"), messages[0].Key)
+
+	count, err = scheduler.publishDue(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestRetryScheduler_ExpireActions(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.KafkaTopics.DispatcherTopic = "pay.dispatcher"
+	cfg.KafkaTopics.EventsTopic = "payments.events"
+	cfg.Retry.BatchSize = 10
+	cfg.Retry.ActionTimeout = 30 * time.Minute
+	transactions := store.NewMemoryTransactionRepository()
+	stale, recent := time.Now().Add(-time.Hour), time.Now().Add(-time.Minute)
+	for id, updatedAt := range map[string]*time.Time{"stale": &stale, "recent": &recent} {
+		require.NoError(t, transactions.Create(context.Background(), &models.Transaction{TransactionId: id, Type: string(models.Deposit), GateWay: "c", Amount: 10, Currency: "USD",
+			Status: string(models.PendingAction), UpdatedAt: updatedAt, ActionUrl: "https://c.gateway.com/3ds/C-1", GatewayReference: "C-1", RetryCount: 1}))
+	}
+	bus := messaging.NewMemoryBus(1)
+	scheduler := NewRetryScheduler(cfg, transactions, bus.Publisher())
+
+	count, err := scheduler.expireActions(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	stored, err := transactions.Get(context.Background(), "stale")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Failed), stored.Status)
+	assert.Equal(t, string(models.FailureActionExpired), stored.FailureCode)
+	assert.Empty(t, stored.ActionUrl)
+	stored, err = transactions.Get(context.Background(), "recent")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.PendingAction), stored.Status, "the customer still has time")
+
+	messages := bus.Messages("pay.dispatcher")
+	require.Len(t, messages, 1, "the client is told")
+	var changed events.PaymentStatusChanged
+	require.NoError(t, events.DecodeMessage(&messages[0], &changed))
+	assert.Equal(t, "stale", changed.TransactionId)
+	assert.Equal(t, string(models.FailureActionExpired), changed.FailureCode)
+	lifecycle := bus.Messages("payments.events")
+	require.Len(t, lifecycle, 1)
+	var failed events.TransactionFailed
+	require.NoError(t, events.DecodeMessage(&lifecycle[0], &failed))
+
+	count, err = scheduler.expireActions(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,129 @@
+package soap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// maxResponse caps how much of a response is read.
+const maxResponse = 1 << 20
+
+// StatusError is a call answered with a status code other than 2xx, or with a
+// fault whatever its status code.
+type StatusError struct {
+	StatusCode int
+	// Fault is the fault the service answered with, nil if the response was
+	// not a fault.
+	Fault *Fault
+}
+
+func (e *StatusError) Error() string {
+	if e.Fault == nil {
+		return fmt.Sprintf("soap: status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("soap: status code %d: %s", e.StatusCode, e.Fault.Error())
+}
+
+func (e *StatusError) Unwrap() error {
+	if e.Fault == nil {
+		return nil
+	}
+	return e.Fault
+}
+
+// Client calls the operations of a SOAP service over HTTP.
+type Client struct {
+	httpClient *http.Client
+	url        string
+	version    Version
+	// Header returns the header blocks of a call, if set.
+	Header func() ([]any, error)
+}
+
+// NewClient returns a client of the service at url, speaking version.
+func NewClient(httpClient *http.Client, url string, version Version) *Client {
+	return &Client{httpClient: httpClient, url: url, version: version}
+}
+
+// HTTPClient is the http client calls are made with.
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
+}
+
+// Version is the version of SOAP the client speaks.
+func (c *Client) Version() Version {
+	return c.version
+}
+
+// NewRequest returns the request calling action with body. action is sent in
+// the SOAPAction header with SOAP 1.1 and in the content type with SOAP 1.2.
+func (c *Client) NewRequest(ctx context.Context, action string, body any) (*http.Request, error) {
+	envelope := Envelope{Version: c.version, Body: body}
+	if c.Header != nil {
+		header, err := c.Header()
+		if err != nil {
+			return nil, err
+		}
+		envelope.Header = header
+	}
+	payload, err := Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", c.version.ContentType(action))
+	if c.version == V11 {
+		req.Header.Set("SOAPAction", strconv.Quote(action))
+	}
+	return req, nil
+}
+
+// Call calls action with body and decodes the content of the response into
+// response, unless it is nil or the response is empty, e.g. a 202 Accepted.
+// Errors of the http client are returned as they are, and responses that are
+// not 2xx or are faults as a *StatusError.
+func (c *Client) Call(ctx context.Context, action string, body, response any) error {
+	req, err := c.NewRequest(ctx, action, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return err
+	}
+	success := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if len(bytes.TrimSpace(payload)) == 0 {
+		if success {
+			return nil
+		}
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+	if !success {
+		// only the fault of an error response is of interest
+		response = nil
+	}
+	err = Unmarshal(payload, c.version, response)
+	var fault *Fault
+	switch {
+	case errors.As(err, &fault):
+		return &StatusError{StatusCode: resp.StatusCode, Fault: fault}
+	case !success:
+		return &StatusError{StatusCode: resp.StatusCode}
+	case err != nil:
+		return fmt.Errorf("soap: decoding response: %w", err)
+	}
+	return nil
+}
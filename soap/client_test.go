@@ -0,0 +1,93 @@
+package soap
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestService returns a stand-in for a SOAP service answering every call
+// with statusCode and body, and the last request it received.
+func newTestService(t *testing.T, statusCode int, body []byte) (*httptest.Server, *http.Request) {
+	received := &http.Request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = *r.Clone(context.Background())
+		w.WriteHeader(statusCode)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func TestClient_Call(t *testing.T) {
+	response, err := Marshal(Envelope{Version: V11, Body: echo{Message: "pong"}})
+	require.NoError(t, err)
+	server, received := newTestService(t, http.StatusOK, response)
+	client := NewClient(server.Client(), server.URL, V11)
+	client.Header = func() ([]any, error) {
+		return []any{token{MustUnderstand: "1", Value: "abc"}}, nil
+	}
+
+	var resp echo
+	err = client.Call(context.Background(), "urn:example:echo/Echo", echo{Message: "ping"}, &resp)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", resp.Message)
+	assert.Equal(t, http.MethodPost, received.Method)
+	assert.Equal(t, `"urn:example:echo/Echo"`, received.Header.Get("SOAPAction"))
+	assert.Equal(t, "text/xml; charset=utf-8", received.Header.Get("Content-Type"))
+}
+
+func TestClient_NewRequest_V12(t *testing.T) {
+	client := NewClient(http.DefaultClient, "http://service.example.com", V12)
+	req, err := client.NewRequest(context.Background(), "urn:example:echo/Echo", echo{Message: "ping"})
+	require.NoError(t, err)
+	assert.Empty(t, req.Header.Get("SOAPAction"), "SOAP 1.2 sends the action in the content type")
+	assert.Equal(t, `application/soap+xml; action="urn:example:echo/Echo"; charset=utf-8`, req.Header.Get("Content-Type"))
+	payload, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	var body echo
+	require.NoError(t, Unmarshal(payload, V12, &body))
+	assert.Equal(t, "ping", body.Message)
+}
+
+func TestClient_Call_Accepted(t *testing.T) {
+	server, _ := newTestService(t, http.StatusAccepted, nil)
+	client := NewClient(server.Client(), server.URL, V11)
+	var resp echo
+	assert.NoError(t, client.Call(context.Background(), "urn:example:echo/Echo", echo{Message: "ping"}, &resp))
+}
+
+func TestClient_Call_Fault(t *testing.T) {
+	for _, statusCode := range []int{http.StatusInternalServerError, http.StatusOK} {
+		t.Run(http.StatusText(statusCode), func(t *testing.T) {
+			fault, err := Marshal(Envelope{Version: V12, Body: &Fault{Code: "soapenv:Receiver", String: "Try again later"}})
+			require.NoError(t, err)
+			server, _ := newTestService(t, statusCode, fault)
+			client := NewClient(server.Client(), server.URL, V12)
+
+			err = client.Call(context.Background(), "urn:example:echo/Echo", echo{Message: "ping"}, &echo{})
+			var statusErr *StatusError
+			require.ErrorAs(t, err, &statusErr)
+			assert.Equal(t, statusCode, statusErr.StatusCode)
+			var decoded *Fault
+			require.ErrorAs(t, err, &decoded, "a fault is returned whatever the status code")
+			assert.Equal(t, "Try again later", decoded.String)
+		})
+	}
+}
+
+func TestClient_Call_StatusError(t *testing.T) {
+	server, _ := newTestService(t, http.StatusServiceUnavailable, []byte("<html>Service Unavailable</html>"))
+	client := NewClient(server.Client(), server.URL, V11)
+
+	err := client.Call(context.Background(), "urn:example:echo/Echo", echo{Message: "ping"}, nil)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+	assert.Nil(t, statusErr.Fault)
+	assert.Equal(t, "soap: status code 503", err.Error())
+}
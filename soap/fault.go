@@ -0,0 +1,146 @@
+package soap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+// Fault is a SOAP fault, of either version. It is the error of a call the
+// service answered with a fault.
+type Fault struct {
+	// Code is the faultcode of SOAP 1.1 or the Code Value of SOAP 1.2, a
+	// qualified name such as soapenv:Client or soapenv:Sender.
+	Code string
+	// Subcode is the Subcode Value of a SOAP 1.2 fault.
+	Subcode string
+	// String is the faultstring of SOAP 1.1 or the Reason Text of SOAP 1.2.
+	String string
+	// Actor is the faultactor of SOAP 1.1 or the Role of SOAP 1.2.
+	Actor string
+	// Detail is the content of the detail element, as is, see DecodeDetail.
+	Detail []byte
+}
+
+func (f *Fault) Error() string {
+	return "soap: fault " + f.Code + ": " + f.String
+}
+
+// Client tells whether the fault blames the message rather than the service:
+// a Client fault of SOAP 1.1 or a Sender fault of SOAP 1.2.
+func (f *Fault) Client() bool {
+	code := f.Code
+	if i := strings.IndexByte(code, ':'); i >= 0 {
+		code = code[i+1:]
+	}
+	return code == "Client" || strings.HasPrefix(code, "Client.") || code == "Sender"
+}
+
+// DecodeDetail decodes the first entry of the detail of the fault into v. It
+// returns io.EOF if the detail has none.
+func (f *Fault) DecodeDetail(v any) error {
+	d := xml.NewDecoder(bytes.NewReader(f.Detail))
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return d.DecodeElement(v, &start)
+		}
+	}
+}
+
+// innerXML writes or reads the content of an element as is.
+type innerXML struct {
+	Content []byte `xml:",innerxml"`
+}
+
+func (f *Fault) detail() *innerXML {
+	if len(f.Detail) == 0 {
+		return nil
+	}
+	return &innerXML{Content: f.Detail}
+}
+
+type fault11 struct {
+	XMLName xml.Name  `xml:"soapenv:Fault"`
+	Code    string    `xml:"faultcode"`
+	String  string    `xml:"faultstring"`
+	Actor   string    `xml:"faultactor,omitempty"`
+	Detail  *innerXML `xml:"detail"`
+}
+
+type fault12 struct {
+	XMLName xml.Name `xml:"soapenv:Fault"`
+	Code    code12   `xml:"soapenv:Code"`
+	Reason  struct {
+		Text text12 `xml:"soapenv:Text"`
+	} `xml:"soapenv:Reason"`
+	Role   string    `xml:"soapenv:Role,omitempty"`
+	Detail *innerXML `xml:"soapenv:Detail"`
+}
+
+type code12 struct {
+	Value   string  `xml:"soapenv:Value"`
+	Subcode *code12 `xml:"soapenv:Subcode"`
+}
+
+type text12 struct {
+	Lang  string `xml:"xml:lang,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (f *Fault) encode(enc *xml.Encoder, version Version) error {
+	if version != V12 {
+		return enc.Encode(fault11{Code: f.Code, String: f.String, Actor: f.Actor, Detail: f.detail()})
+	}
+	fault := fault12{Code: code12{Value: f.Code}, Role: f.Actor, Detail: f.detail()}
+	if f.Subcode != "" {
+		fault.Code.Subcode = &code12{Value: f.Subcode}
+	}
+	fault.Reason.Text = text12{Lang: "en", Value: f.String}
+	return enc.Encode(fault)
+}
+
+func (f *Fault) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	// the fields of SOAP 1.1 faults are unqualified and those of SOAP 1.2 are
+	// not, and they are told apart by their names alone
+	var fault struct {
+		FaultCode   string   `xml:"faultcode"`
+		FaultString string   `xml:"faultstring"`
+		FaultActor  string   `xml:"faultactor"`
+		Detail11    innerXML `xml:"detail"`
+		Code        struct {
+			Value   string `xml:"Value"`
+			Subcode struct {
+				Value string `xml:"Value"`
+			} `xml:"Subcode"`
+		} `xml:"Code"`
+		Reason struct {
+			Text []string `xml:"Text"`
+		} `xml:"Reason"`
+		Role     string   `xml:"Role"`
+		Detail12 innerXML `xml:"Detail"`
+	}
+	err := d.DecodeElement(&fault, &start)
+	if err != nil {
+		return err
+	}
+	*f = Fault{
+		Code:   strings.TrimSpace(fault.FaultCode),
+		String: strings.TrimSpace(fault.FaultString),
+		Actor:  strings.TrimSpace(fault.FaultActor),
+		Detail: fault.Detail11.Content,
+	}
+	if fault.Code.Value != "" {
+		f.Code = strings.TrimSpace(fault.Code.Value)
+		f.Subcode = strings.TrimSpace(fault.Code.Subcode.Value)
+		if len(fault.Reason.Text) > 0 {
+			f.String = strings.TrimSpace(fault.Reason.Text[0])
+		}
+		f.Actor = strings.TrimSpace(fault.Role)
+		f.Detail = fault.Detail12.Content
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+// Package soap encodes and decodes SOAP 1.1 and 1.2 envelopes and calls SOAP
+// services over HTTP, see Client.
+//
+// Envelopes are written with the soapenv prefix, which header blocks can use
+// for soapenv:mustUnderstand. The blocks and the body content are encoded
+// with encoding/xml, so they should name their elements with a namespace,
+// e.g. `xml:"urn:example:payments Deposit"`, for them to be qualified.
+package soap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+)
+
+// Version is a version of SOAP.
+type Version int
+
+const (
+	V11 Version = iota + 1
+	V12
+)
+
+// Namespaces of the SOAP 1.1 and 1.2 envelopes.
+const (
+	Namespace11 = "http://schemas.xmlsoap.org/soap/envelope/"
+	Namespace12 = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// prefix is the prefix envelopes are written with.
+const prefix = "soapenv"
+
+var (
+	// ErrVersionMismatch is returned when an envelope is not of the version
+	// expected.
+	ErrVersionMismatch = errors.New("soap: version mismatch")
+	// ErrNotEnvelope is returned when a message is not a SOAP envelope.
+	ErrNotEnvelope = errors.New("soap: not an envelope")
+)
+
+// ParseVersion parses "1.1" or "1.2".
+func ParseVersion(s string) (Version, error) {
+	switch s {
+	case "1.1":
+		return V11, nil
+	case "1.2":
+		return V12, nil
+	default:
+		return 0, fmt.Errorf("soap: unknown version %q", s)
+	}
+}
+
+func (v Version) String() string {
+	switch v {
+	case V11:
+		return "1.1"
+	case V12:
+		return "1.2"
+	default:
+		return fmt.Sprintf("Version(%d)", int(v))
+	}
+}
+
+// Namespace is that of the envelope.
+func (v Version) Namespace() string {
+	if v == V12 {
+		return Namespace12
+	}
+	return Namespace11
+}
+
+// ClientFaultCode is the code of faults blaming the message, soapenv:Client
+// with SOAP 1.1 and soapenv:Sender with SOAP 1.2.
+func (v Version) ClientFaultCode() string {
+	if v == V12 {
+		return prefix + ":Sender"
+	}
+	return prefix + ":Client"
+}
+
+// ContentType is the media type of a request for action. SOAP 1.1 sends the
+// action in a SOAPAction header instead, see Client.
+func (v Version) ContentType(action string) string {
+	if v == V12 {
+		params := map[string]string{"charset": "utf-8"}
+		if action != "" {
+			params["action"] = action
+		}
+		return mime.FormatMediaType("application/soap+xml", params)
+	}
+	return "text/xml; charset=utf-8"
+}
+
+// Envelope is a SOAP message.
+type Envelope struct {
+	Version Version
+	// Header holds the header blocks, written in order. The Header element is
+	// left out without any.
+	Header []any
+	// Body is the content of the Body element, a *Fault for a fault.
+	Body any
+}
+
+// Marshal encodes the envelope with an XML declaration, indented.
+func Marshal(envelope Envelope) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	err := enc.Encode(envelope)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (e Envelope) MarshalXML(enc *xml.Encoder, _ xml.StartElement) error {
+	envelope := xml.StartElement{
+		Name: xml.Name{Local: prefix + ":Envelope"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns:" + prefix}, Value: e.Version.Namespace()}},
+	}
+	err := enc.EncodeToken(envelope)
+	if err != nil {
+		return err
+	}
+	if len(e.Header) > 0 {
+		header := xml.StartElement{Name: xml.Name{Local: prefix + ":Header"}}
+		err = enc.EncodeToken(header)
+		if err != nil {
+			return err
+		}
+		for _, block := range e.Header {
+			err = enc.Encode(block)
+			if err != nil {
+				return err
+			}
+		}
+		err = enc.EncodeToken(header.End())
+		if err != nil {
+			return err
+		}
+	}
+	body := xml.StartElement{Name: xml.Name{Local: prefix + ":Body"}}
+	err = enc.EncodeToken(body)
+	if err != nil {
+		return err
+	}
+	switch content := e.Body.(type) {
+	case nil:
+	case *Fault:
+		err = content.encode(enc, e.Version)
+	default:
+		err = enc.Encode(content)
+	}
+	if err != nil {
+		return err
+	}
+	err = enc.EncodeToken(body.End())
+	if err != nil {
+		return err
+	}
+	return enc.EncodeToken(envelope.End())
+}
+
+// Decode reads an envelope of version from r into body, skipping the header.
+// If the envelope holds a fault, it is returned as a *Fault and body is left
+// as is. body can be nil to only check for a fault.
+func Decode(r io.Reader, version Version, body any) error {
+	in := envelopeIn{body: bodyIn{content: body}}
+	err := xml.NewDecoder(r).Decode(&in)
+	if err != nil {
+		return err
+	}
+	if in.XMLName.Local != "Envelope" {
+		return fmt.Errorf("%w: found %s", ErrNotEnvelope, in.XMLName.Local)
+	}
+	if in.XMLName.Space != version.Namespace() {
+		return fmt.Errorf("%w: expected %s, found %q", ErrVersionMismatch, version.Namespace(), in.XMLName.Space)
+	}
+	if in.body.fault != nil {
+		return in.body.fault
+	}
+	return nil
+}
+
+// Unmarshal is Decode of data.
+func Unmarshal(data []byte, version Version, body any) error {
+	return Decode(bytes.NewReader(data), version, body)
+}
+
+type envelopeIn struct {
+	XMLName xml.Name
+	body    bodyIn
+}
+
+func (e *envelopeIn) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	e.XMLName = start.Name
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if token.Name.Local == "Body" && token.Name.Space == start.Name.Space {
+				err = e.body.UnmarshalXML(d, token)
+			} else {
+				err = d.Skip()
+			}
+			if err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// bodyIn decodes the first element of a Body into content, or into fault if
+// it is a Fault.
+type bodyIn struct {
+	content any
+	fault   *Fault
+	decoded bool
+}
+
+func (b *bodyIn) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch {
+			case b.decoded || b.fault != nil:
+				err = d.Skip()
+			case token.Name.Local == "Fault" && token.Name.Space == start.Name.Space:
+				b.fault = &Fault{}
+				err = d.DecodeElement(b.fault, &token)
+			case b.content != nil:
+				b.decoded = true
+				err = d.DecodeElement(b.content, &token)
+			default:
+				err = d.Skip()
+			}
+			if err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
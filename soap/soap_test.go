@@ -0,0 +1,143 @@
+package soap
+
+import (
+	"encoding/xml"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// assertGolden compares got with testdata/name, rewriting it with -update.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		require.NoError(t, os.WriteFile(path, got, 0o644))
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+}
+
+type echo struct {
+	XMLName xml.Name `xml:"urn:example:echo Echo"`
+	Message string   `xml:"Message"`
+}
+
+type token struct {
+	XMLName        xml.Name `xml:"urn:example:auth Token"`
+	MustUnderstand string   `xml:"soapenv:mustUnderstand,attr"`
+	Value          string   `xml:",chardata"`
+}
+
+func TestMarshal(t *testing.T) {
+	for _, version := range []Version{V11, V12} {
+		t.Run(version.String(), func(t *testing.T) {
+			data, err := Marshal(Envelope{
+				Version: version,
+				Header:  []any{token{MustUnderstand: "1", Value: "abc"}},
+				Body:    echo{Message: "hello & goodbye"},
+			})
+			require.NoError(t, err)
+			assertGolden(t, "envelope.soap"+version.String()+".xml", data)
+
+			var body echo
+			require.NoError(t, Unmarshal(data, version, &body))
+			assert.Equal(t, "hello & goodbye", body.Message)
+		})
+	}
+}
+
+func TestMarshal_Fault(t *testing.T) {
+	for _, version := range []Version{V11, V12} {
+		t.Run(version.String(), func(t *testing.T) {
+			fault := &Fault{
+				Code:   version.ClientFaultCode(),
+				String: "Invalid account",
+				Actor:  "urn:example:payments",
+				Detail: []byte(`<Code xmlns="urn:example:payments">14</Code>`),
+			}
+			if version == V12 {
+				fault.Subcode = "soapenv:InvalidAccount"
+			}
+			data, err := Marshal(Envelope{Version: version, Body: fault})
+			require.NoError(t, err)
+			assertGolden(t, "fault.soap"+version.String()+".xml", data)
+
+			var body echo
+			err = Unmarshal(data, version, &body)
+			var decoded *Fault
+			require.ErrorAs(t, err, &decoded)
+			assert.Equal(t, fault, decoded)
+			assert.True(t, decoded.Client())
+			assert.Empty(t, body.Message)
+			var detail struct {
+				Value string `xml:",chardata"`
+			}
+			require.NoError(t, decoded.DecodeDetail(&detail))
+			assert.Equal(t, "14", detail.Value)
+		})
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	data := []byte(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">
+  <s:Header><Token xmlns="urn:example:auth">abc</Token></s:Header>
+  <s:Body><e:Echo xmlns:e="urn:example:echo"><e:Message>hi</e:Message></e:Echo></s:Body>
+</s:Envelope>`)
+	var body echo
+	require.NoError(t, Unmarshal(data, V11, &body))
+	assert.Equal(t, "hi", body.Message)
+	assert.NoError(t, Unmarshal(data, V11, nil))
+
+	assert.ErrorIs(t, Unmarshal(data, V12, &body), ErrVersionMismatch)
+	assert.ErrorIs(t, Unmarshal([]byte(`<Echo xmlns="urn:example:echo"/>`), V11, &body), ErrNotEnvelope)
+	assert.Error(t, Unmarshal([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><Other/></s:Body></s:Envelope>`), V11, &body),
+		"the body must be the element expected")
+}
+
+func TestUnmarshal_Fault11(t *testing.T) {
+	data := []byte(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>
+    <soap:Fault>
+      <faultcode>soap:Server</faultcode>
+      <faultstring> Try again later </faultstring>
+    </soap:Fault>
+  </soap:Body>
+</soap:Envelope>`)
+	err := Unmarshal(data, V11, nil)
+	var fault *Fault
+	require.ErrorAs(t, err, &fault)
+	assert.Equal(t, "soap:Server", fault.Code)
+	assert.Equal(t, "Try again later", fault.String)
+	assert.False(t, fault.Client())
+	assert.Equal(t, "soap: fault soap:Server: Try again later", err.Error())
+}
+
+func TestVersion_ContentType(t *testing.T) {
+	assert.Equal(t, "text/xml; charset=utf-8", V11.ContentType("urn:example/Echo"))
+	assert.Equal(t, `application/soap+xml; action="urn:example/Echo"; charset=utf-8`, V12.ContentType("urn:example/Echo"))
+	assert.Equal(t, "application/soap+xml; charset=utf-8", V12.ContentType(""))
+}
+
+func TestParseVersion(t *testing.T) {
+	version, err := ParseVersion("1.2")
+	require.NoError(t, err)
+	assert.Equal(t, V12, version)
+	_, err = ParseVersion("2")
+	assert.Error(t, err)
+}
+
+func TestFault_Client(t *testing.T) {
+	assert.True(t, (&Fault{Code: "soapenv:Client"}).Client())
+	assert.True(t, (&Fault{Code: "Client.Authentication"}).Client())
+	assert.True(t, (&Fault{Code: "env:Sender"}).Client())
+	assert.False(t, (&Fault{Code: "soapenv:Server"}).Client())
+	assert.False(t, (&Fault{Code: "env:Receiver"}).Client())
+}
@@ -0,0 +1,5 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+DROP TABLE IF EXISTS pay.transactions;
+DROP TABLE IF EXISTS pay.users;
+DROP SCHEMA IF EXISTS pay;
@@ -1,8 +1,11 @@
 -- noinspection SqlNoDataSourceInspectionForFile
 
+-- the migrations up to 0005 were applied by Postgres's docker entrypoint before
+-- there were migrations, and can be applied again over what they created
+
 CREATE SCHEMA IF NOT EXISTS pay;
 
-CREATE TABLE pay.users (
+CREATE TABLE IF NOT EXISTS pay.users (
    guid VARCHAR(255) PRIMARY KEY,
    gate_way VARCHAR(50) NOT NULL,
    account_id VARCHAR(50) NOT NULL,
@@ -12,7 +15,7 @@ CREATE TABLE pay.users (
 );
 
 
-CREATE TABLE pay.transactions (
+CREATE TABLE IF NOT EXISTS pay.transactions (
       transaction_id VARCHAR(255) PRIMARY KEY,
       type VARCHAR(50) NOT NULL,
       gate_way VARCHAR(50) NOT NULL,
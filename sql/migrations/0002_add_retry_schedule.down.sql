@@ -0,0 +1,4 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+DROP INDEX IF EXISTS pay.transactions_next_attempt_at_idx;
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS next_attempt_at;
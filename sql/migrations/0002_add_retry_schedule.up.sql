@@ -0,0 +1,7 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS transactions_next_attempt_at_idx
+    ON pay.transactions (next_attempt_at)
+    WHERE next_attempt_at IS NOT NULL;
@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS version;
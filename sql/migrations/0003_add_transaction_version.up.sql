@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+DROP TABLE IF EXISTS pay.audit_log;
+DROP FUNCTION IF EXISTS pay.reject_audit_log_change();
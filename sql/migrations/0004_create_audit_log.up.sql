@@ -0,0 +1,34 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+CREATE TABLE IF NOT EXISTS pay.audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    action VARCHAR(255) NOT NULL,
+    target_type VARCHAR(50),
+    target_id VARCHAR(255),
+    before JSONB,
+    after JSONB,
+    request_id VARCHAR(255)
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON pay.audit_log (actor, occurred_at);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON pay.audit_log (target_type, target_id, occurred_at);
+CREATE INDEX IF NOT EXISTS audit_log_occurred_at_idx ON pay.audit_log (occurred_at);
+
+-- the audit log is append-only
+CREATE OR REPLACE FUNCTION pay.reject_audit_log_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'pay.audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON pay.audit_log;
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON pay.audit_log
+    FOR EACH ROW EXECUTE FUNCTION pay.reject_audit_log_change();
+
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON pay.audit_log;
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE ON pay.audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION pay.reject_audit_log_change();
@@ -0,0 +1,7 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- account_id stays TEXT, as encrypted account ids do not fit VARCHAR(50). The
+-- constraint only keeps accounts unique again once their ids are decrypted.
+DROP INDEX IF EXISTS pay.unique_gateway_account_index;
+ALTER TABLE pay.users DROP COLUMN IF EXISTS account_index;
+ALTER TABLE pay.users ADD CONSTRAINT unique_gateway_account UNIQUE (gate_way, account_id);
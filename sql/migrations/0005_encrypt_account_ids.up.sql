@@ -0,0 +1,12 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- account_id holds the account id encrypted by the encryption package, see
+-- cmd/keys for encrypting rows written before
+ALTER TABLE pay.users ALTER COLUMN account_id TYPE TEXT;
+ALTER TABLE pay.transactions ALTER COLUMN account_id TYPE TEXT;
+
+-- encrypted account ids cannot be compared, accounts are unique by their
+-- blind index instead
+ALTER TABLE pay.users ADD COLUMN IF NOT EXISTS account_index VARCHAR(64);
+ALTER TABLE pay.users DROP CONSTRAINT IF EXISTS unique_gateway_account;
+CREATE UNIQUE INDEX IF NOT EXISTS unique_gateway_account_index ON pay.users (gate_way, account_index);
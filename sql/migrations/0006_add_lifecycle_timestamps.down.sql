@@ -0,0 +1,5 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS failed_at;
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS completed_at;
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS submitted_at;
@@ -0,0 +1,9 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS submitted_at TIMESTAMPTZ;
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS failed_at TIMESTAMPTZ;
+
+-- settled transactions only had updated_at
+UPDATE pay.transactions SET completed_at = updated_at WHERE status = 'successful' AND completed_at IS NULL;
+UPDATE pay.transactions SET failed_at = updated_at WHERE status = 'failed' AND failed_at IS NULL;
@@ -0,0 +1,5 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS failure_message;
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS failure_code;
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS gateway_reference;
@@ -0,0 +1,5 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS gateway_reference VARCHAR(255);
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS failure_code VARCHAR(50);
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS failure_message TEXT;
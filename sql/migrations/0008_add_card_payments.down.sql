@@ -0,0 +1,14 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- account_id cannot be required again while card payments are stored, they
+-- have to be removed first
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS return_url;
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS action_url;
+ALTER TABLE pay.transactions DROP CONSTRAINT IF EXISTS transactions_account_or_card;
+ALTER TABLE pay.transactions DROP COLUMN IF EXISTS card_token;
+ALTER TABLE pay.transactions ALTER COLUMN account_id SET NOT NULL;
+
+DROP INDEX IF EXISTS pay.unique_gateway_card_token;
+ALTER TABLE pay.users DROP CONSTRAINT IF EXISTS users_account_or_card;
+ALTER TABLE pay.users DROP COLUMN IF EXISTS card_token;
+ALTER TABLE pay.users ALTER COLUMN account_id SET NOT NULL;
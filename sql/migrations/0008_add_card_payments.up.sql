@@ -0,0 +1,18 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- users and transactions of card gateways carry the gateway's card token
+-- instead of an account id
+ALTER TABLE pay.users ALTER COLUMN account_id DROP NOT NULL;
+ALTER TABLE pay.users ADD COLUMN IF NOT EXISTS card_token VARCHAR(255);
+ALTER TABLE pay.users DROP CONSTRAINT IF EXISTS users_account_or_card;
+ALTER TABLE pay.users ADD CONSTRAINT users_account_or_card CHECK (account_id IS NOT NULL OR card_token IS NOT NULL);
+CREATE UNIQUE INDEX IF NOT EXISTS unique_gateway_card_token ON pay.users (gate_way, card_token) WHERE card_token IS NOT NULL;
+
+ALTER TABLE pay.transactions ALTER COLUMN account_id DROP NOT NULL;
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS card_token VARCHAR(255);
+ALTER TABLE pay.transactions DROP CONSTRAINT IF EXISTS transactions_account_or_card;
+ALTER TABLE pay.transactions ADD CONSTRAINT transactions_account_or_card CHECK (account_id IS NOT NULL OR card_token IS NOT NULL);
+
+-- a card payment waiting on a 3-D Secure challenge
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS action_url TEXT;
+ALTER TABLE pay.transactions ADD COLUMN IF NOT EXISTS return_url TEXT;
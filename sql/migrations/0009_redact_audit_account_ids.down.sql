@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- the redacted account ids are gone, rolling back leaves the entries as they are
@@ -0,0 +1,13 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- audit entries written before account ids were encrypted hold them in plain
+-- text. The append-only trigger is disabled to redact them alone: the
+-- migration runs in a transaction, so no other session sees it disabled.
+ALTER TABLE pay.audit_log DISABLE TRIGGER audit_log_append_only;
+
+UPDATE pay.audit_log SET before = jsonb_set(before, '{account_id}', '"redacted"')
+    WHERE before ? 'account_id' AND before->'account_id' <> 'null'::jsonb;
+UPDATE pay.audit_log SET after = jsonb_set(after, '{account_id}', '"redacted"')
+    WHERE after ? 'account_id' AND after->'account_id' <> 'null'::jsonb;
+
+ALTER TABLE pay.audit_log ENABLE TRIGGER audit_log_append_only;
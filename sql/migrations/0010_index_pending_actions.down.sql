@@ -0,0 +1,3 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+DROP INDEX IF EXISTS pay.transactions_pending_action_idx;
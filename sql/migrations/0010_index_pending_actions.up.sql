@@ -0,0 +1,6 @@
+-- noinspection SqlNoDataSourceInspectionForFile
+
+-- the retry scheduler fails card payments left at pending_action for too long
+CREATE INDEX IF NOT EXISTS transactions_pending_action_idx
+    ON pay.transactions (updated_at)
+    WHERE status = 'pending_action';
@@ -0,0 +1,68 @@
+package migrations
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, migration := range migrations {
+		assert.Equal(t, i+1, migration.Version)
+		assert.NotEmpty(t, migration.Up, migration.String())
+		assert.NotEmpty(t, migration.Down, migration.String())
+	}
+	assert.Equal(t, "0001_create_users_and_transactions", migrations[0].String())
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"misnamed": {
+			"0001_users.sql": {Data: []byte("SELECT 1;")},
+		},
+		"missing down": {
+			"0001_users.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"duplicate version": {
+			"0001_users.up.sql":        {Data: []byte("SELECT 1;")},
+			"0001_users.down.sql":      {Data: []byte("SELECT 1;")},
+			"0001_transactions.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"gap": {
+			"0002_users.up.sql":   {Data: []byte("SELECT 1;")},
+			"0002_users.down.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := load(fsys)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMigrator_Validate(t *testing.T) {
+	migrations, err := load(fstest.MapFS{
+		"0001_users.up.sql":   {Data: []byte("CREATE TABLE users ();")},
+		"0001_users.down.sql": {Data: []byte("DROP TABLE users;")},
+	})
+	require.NoError(t, err)
+	migrator := &Migrator{migrations: migrations}
+
+	applied, err := migrator.validate([]AppliedMigration{{Version: 1, Name: "users", Checksum: migrations[0].Checksum()}})
+	require.NoError(t, err)
+	assert.Contains(t, applied, 1)
+
+	_, err = migrator.validate([]AppliedMigration{{Version: 1, Name: "users", Checksum: "edited"}})
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	_, err = migrator.validate([]AppliedMigration{{Version: 2, Name: "fees"}})
+	assert.ErrorIs(t, err, ErrUnknownMigration)
+
+	migrations[0].Down = "DROP TABLE IF EXISTS users;"
+	_, err = migrator.validate([]AppliedMigration{{Version: 1, Name: "users", Checksum: Migration{Up: "CREATE TABLE users ();"}.Checksum()}})
+	assert.NoError(t, err, "down scripts can be fixed after they are applied")
+}
@@ -0,0 +1,191 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"time"
+)
+
+// lockKey is the Postgres advisory lock held while migrating, so services
+// starting together do not migrate at the same time.
+const lockKey = 7_326_041_118
+
+var (
+	// ErrChecksumMismatch is returned when an applied migration was edited.
+	ErrChecksumMismatch = errors.New("migrations: checksum mismatch")
+	// ErrUnknownMigration is returned when the database has a migration
+	// applied this build does not know, e.g. when a newer build migrated it.
+	ErrUnknownMigration = errors.New("migrations: unknown migration applied")
+)
+
+// AppliedMigration is a row of the schema_migrations table.
+type AppliedMigration struct {
+	tableName struct{}  `pg:"public.schema_migrations"`
+	Version   int       `pg:",pk"`
+	Name      string    `pg:",notnull"`
+	Checksum  string    `pg:",notnull"`
+	AppliedAt time.Time `pg:",notnull"`
+}
+
+// Status is a migration and when it was applied, if it was.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies migrations to a database and rolls them back, recording
+// them in public.schema_migrations. Every migration runs in a transaction of
+// its own with its record.
+type Migrator struct {
+	db         *pg.DB
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator applying the migrations of this package.
+func NewMigrator(db *pg.DB) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// Up applies the migrations not applied yet, up to and including version to,
+// or all of them if to is 0. It returns the migrations applied.
+func (m *Migrator) Up(ctx context.Context, to int) ([]Migration, error) {
+	if to == 0 && len(m.migrations) > 0 {
+		to = m.migrations[len(m.migrations)-1].Version
+	}
+	var applied []Migration
+	err := m.locked(ctx, func(conn *pg.Conn, records map[int]AppliedMigration) error {
+		for _, migration := range m.migrations {
+			if migration.Version > to {
+				break
+			}
+			if _, ok := records[migration.Version]; ok {
+				continue
+			}
+			err := conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				_, err := tx.ExecContext(ctx, migration.Up)
+				if err != nil {
+					return err
+				}
+				_, err = tx.ModelContext(ctx, &AppliedMigration{
+					Version:   migration.Version,
+					Name:      migration.Name,
+					Checksum:  migration.Checksum(),
+					AppliedAt: time.Now().UTC(),
+				}).Insert()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migrations: applying %s: %w", migration, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down rolls back the last steps migrations applied, latest first. It returns
+// the migrations rolled back.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var rolledBack []Migration
+	err := m.locked(ctx, func(conn *pg.Conn, records map[int]AppliedMigration) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := records[migration.Version]; !ok {
+				continue
+			}
+			err := conn.RunInTransaction(ctx, func(tx *pg.Tx) error {
+				_, err := tx.ExecContext(ctx, migration.Down)
+				if err != nil {
+					return err
+				}
+				_, err = tx.ModelContext(ctx, (*AppliedMigration)(nil)).Where("version = ?", migration.Version).Delete()
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migrations: rolling back %s: %w", migration, err)
+			}
+			rolledBack = append(rolledBack, migration)
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// Status lists every migration, applied or not.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.locked(ctx, func(conn *pg.Conn, records map[int]AppliedMigration) error {
+		for _, migration := range m.migrations {
+			status := Status{Migration: migration}
+			if record, ok := records[migration.Version]; ok {
+				status.AppliedAt = &record.AppliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Validate checks the migrations applied against those of this build, see
+// ErrChecksumMismatch and ErrUnknownMigration. Up, Down and Status validate
+// first.
+func (m *Migrator) Validate(ctx context.Context) error {
+	return m.locked(ctx, func(*pg.Conn, map[int]AppliedMigration) error {
+		return nil
+	})
+}
+
+// locked runs fn on a connection holding the migration lock, passing it the
+// migrations applied by version once they are validated.
+func (m *Migrator) locked(ctx context.Context, fn func(*pg.Conn, map[int]AppliedMigration) error) error {
+	conn := m.db.Conn()
+	defer conn.Close()
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock(?)", lockKey)
+	if err != nil {
+		return fmt.Errorf("migrations: locking: %w", err)
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), "SELECT pg_advisory_unlock(?)", lockKey)
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS public.schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			checksum VARCHAR(64) NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("migrations: creating schema_migrations: %w", err)
+	}
+	var records []AppliedMigration
+	err = conn.ModelContext(ctx, &records).Select()
+	if err != nil {
+		return fmt.Errorf("migrations: reading schema_migrations: %w", err)
+	}
+	byVersion, err := m.validate(records)
+	if err != nil {
+		return err
+	}
+	return fn(conn, byVersion)
+}
+
+func (m *Migrator) validate(records []AppliedMigration) (map[int]AppliedMigration, error) {
+	byVersion := make(map[int]AppliedMigration, len(records))
+	for _, record := range records {
+		if record.Version < 1 || record.Version > len(m.migrations) {
+			return nil, fmt.Errorf("%w: %04d_%s", ErrUnknownMigration, record.Version, record.Name)
+		}
+		migration := m.migrations[record.Version-1]
+		if record.Checksum != migration.Checksum() {
+			return nil, fmt.Errorf("%w: %s was edited after it was applied", ErrChecksumMismatch, migration)
+		}
+		byVersion[record.Version] = record
+	}
+	return byVersion, nil
+}
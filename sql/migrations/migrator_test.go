@@ -0,0 +1,86 @@
+//go:build integration
+
+package migrations
+
+import (
+	"context"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMigrator_UpDown(t *testing.T) {
+	postgres := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(15434).
+		Database("exinity_payments").
+		DataPath(t.TempDir()))
+	require.NoError(t, postgres.Start())
+	defer postgres.Stop()
+	db := pg.Connect(&pg.Options{Addr: "localhost:15434", User: "postgres", Password: "postgres", Database: "exinity_payments"})
+	defer db.Close()
+	ctx := context.Background()
+	migrator, err := NewMigrator(db)
+	require.NoError(t, err)
+	all := len(migrator.migrations)
+
+	applied, err := migrator.Up(ctx, 2)
+	require.NoError(t, err)
+	assert.Len(t, applied, 2)
+	applied, err = migrator.Up(ctx, 0)
+	require.NoError(t, err)
+	assert.Len(t, applied, all-2)
+	applied, err = migrator.Up(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt, status.String())
+	}
+
+	rolledBack, err := migrator.Down(ctx, all)
+	require.NoError(t, err)
+	assert.Len(t, rolledBack, all)
+	applied, err = migrator.Up(ctx, 0)
+	require.NoError(t, err)
+	assert.Len(t, applied, all, "every migration applies again after rolling back")
+
+	migrator.migrations[0].Up += "\n-- edited"
+	_, err = migrator.Up(ctx, 0)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestMigrator_RedactsAuditAccountIds(t *testing.T) {
+	postgres := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(15436).
+		Database("exinity_payments").
+		DataPath(t.TempDir()))
+	require.NoError(t, postgres.Start())
+	defer postgres.Stop()
+	db := pg.Connect(&pg.Options{Addr: "localhost:15436", User: "postgres", Password: "postgres", Database: "exinity_payments"})
+	defer db.Close()
+	ctx := context.Background()
+	migrator, err := NewMigrator(db)
+	require.NoError(t, err)
+
+	// an entry written before account ids were encrypted
+	_, err = migrator.Up(ctx, 8)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `INSERT INTO pay.audit_log (occurred_at, actor, action, before, after)
+		VALUES (now(), 'anonymous', 'user.update', '{"account_id":"234556780987","gate_way":"a"}', '{"account_id":"234556780987","gate_way":"b"}')`)
+	require.NoError(t, err)
+	_, err = migrator.Up(ctx, 0)
+	require.NoError(t, err)
+
+	var before, after string
+	_, err = db.QueryOneContext(ctx, pg.Scan(&before, &after), `SELECT before::text, after::text FROM pay.audit_log`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"account_id":"redacted","gate_way":"a"}`, before)
+	assert.JSONEq(t, `{"account_id":"redacted","gate_way":"b"}`, after)
+
+	_, err = db.ExecContext(ctx, `UPDATE pay.audit_log SET actor = 'someone'`)
+	assert.ErrorContains(t, err, "append-only", "the trigger is enabled again")
+}
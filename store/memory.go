@@ -0,0 +1,273 @@
+package store
+
+import (
+	"context"
+	"payments/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	_ TransactionRepository = (*MemoryTransactionRepository)(nil)
+	_ UserRepository        = (*MemoryUserRepository)(nil)
+	_ AuditRepository       = (*MemoryAuditRepository)(nil)
+
+	_ EncryptedAccountRepository = (*MemoryTransactionRepository)(nil)
+	_ EncryptedAccountRepository = (*MemoryUserRepository)(nil)
+)
+
+// MemoryTransactionRepository keeps transactions in memory for tests and local runs.
+type MemoryTransactionRepository struct {
+	mu           sync.Mutex
+	transactions map[string]models.Transaction
+}
+
+func NewMemoryTransactionRepository() *MemoryTransactionRepository {
+	return &MemoryTransactionRepository{transactions: map[string]models.Transaction{}}
+}
+
+func (r *MemoryTransactionRepository) Create(ctx context.Context, transaction *models.Transaction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.transactions[transaction.TransactionId]; ok {
+		return ErrAlreadyExists
+	}
+	r.transactions[transaction.TransactionId] = *transaction
+	return nil
+}
+
+func (r *MemoryTransactionRepository) Get(ctx context.Context, transactionId string) (models.Transaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transaction, ok := r.transactions[transactionId]
+	if !ok {
+		return models.Transaction{}, ErrNotFound
+	}
+	return transaction, nil
+}
+
+func (r *MemoryTransactionRepository) Update(ctx context.Context, transaction *models.Transaction, expectedStatus models.TransactionStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stored, ok := r.transactions[transaction.TransactionId]
+	if !ok || stored.Status != string(expectedStatus) || stored.Version != transaction.Version {
+		return ErrConflict
+	}
+	transaction.Version++
+	updated := *transaction
+	updated.EncryptedAccountId = stored.EncryptedAccountId
+	updated.CardToken = stored.CardToken
+	r.transactions[transaction.TransactionId] = updated
+	return nil
+}
+
+func (r *MemoryTransactionRepository) ScheduledRetries(ctx context.Context, gateWay string, limit int) ([]models.Transaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.scheduled(limit, func(transaction models.Transaction) bool {
+		return transaction.RetryCount > 0 && (gateWay == "" || transaction.GateWay == gateWay)
+	}), nil
+}
+
+// ClaimDueRetries holds the repository lock while handle runs, so concurrent
+// claims wait rather than skip.
+func (r *MemoryTransactionRepository) ClaimDueRetries(ctx context.Context, limit int, handle func(models.Transaction) error) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	due := r.scheduled(limit, func(transaction models.Transaction) bool {
+		return !transaction.NextAttemptAt.After(now)
+	})
+	for i := range due {
+		due[i].NextAttemptAt = nil
+		err := handle(due[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, transaction := range due {
+		r.transactions[transaction.TransactionId] = transaction
+	}
+	return len(due), nil
+}
+
+func (r *MemoryTransactionRepository) StaleActions(ctx context.Context, before time.Time, limit int) ([]models.Transaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var transactions []models.Transaction
+	for _, transaction := range r.transactions {
+		if transaction.Status == string(models.PendingAction) && transaction.UpdatedAt != nil && transaction.UpdatedAt.Before(before) {
+			transactions = append(transactions, transaction)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].UpdatedAt.Before(*transactions[j].UpdatedAt)
+	})
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+	return transactions, nil
+}
+
+func (r *MemoryTransactionRepository) EncryptedAccounts(ctx context.Context, after string, limit int) ([]EncryptedAccount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var accounts []EncryptedAccount
+	for id, transaction := range r.transactions {
+		if id > after && transaction.EncryptedAccountId != "" {
+			accounts = append(accounts, EncryptedAccount{Id: id, EncryptedAccountId: transaction.EncryptedAccountId})
+		}
+	}
+	return firstAccounts(accounts, limit), nil
+}
+
+func (r *MemoryTransactionRepository) ReplaceEncryptedAccount(ctx context.Context, account EncryptedAccount, previous string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transaction, ok := r.transactions[account.Id]
+	if !ok || transaction.EncryptedAccountId != previous {
+		return ErrConflict
+	}
+	transaction.EncryptedAccountId = account.EncryptedAccountId
+	r.transactions[account.Id] = transaction
+	return nil
+}
+
+// scheduled must be called with the lock held.
+func (r *MemoryTransactionRepository) scheduled(limit int, match func(models.Transaction) bool) []models.Transaction {
+	var transactions []models.Transaction
+	for _, transaction := range r.transactions {
+		if transaction.Status == string(models.Pending) && transaction.NextAttemptAt != nil && match(transaction) {
+			transactions = append(transactions, transaction)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return transactions[i].NextAttemptAt.Before(*transactions[j].NextAttemptAt)
+	})
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+	return transactions
+}
+
+// MemoryUserRepository keeps users in memory for tests and local runs.
+type MemoryUserRepository struct {
+	mu    sync.Mutex
+	users map[string]models.User
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[string]models.User{}}
+}
+
+func (r *MemoryUserRepository) Create(ctx context.Context, user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.users {
+		if existing.Guid == user.Guid || (existing.GateWay == user.GateWay && sameAccount(existing, *user)) {
+			return ErrAlreadyExists
+		}
+	}
+	r.users[user.Guid] = *user
+	return nil
+}
+
+func (r *MemoryUserRepository) Get(ctx context.Context, guid string) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[guid]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (r *MemoryUserRepository) EncryptedAccounts(ctx context.Context, after string, limit int) ([]EncryptedAccount, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var accounts []EncryptedAccount
+	for guid, user := range r.users {
+		if guid > after && user.EncryptedAccountId != "" {
+			accounts = append(accounts, EncryptedAccount{Id: guid, EncryptedAccountId: user.EncryptedAccountId, AccountIndex: user.AccountIndex})
+		}
+	}
+	return firstAccounts(accounts, limit), nil
+}
+
+func (r *MemoryUserRepository) ReplaceEncryptedAccount(ctx context.Context, account EncryptedAccount, previous string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[account.Id]
+	if !ok || user.EncryptedAccountId != previous {
+		return ErrConflict
+	}
+	user.EncryptedAccountId = account.EncryptedAccountId
+	user.AccountIndex = account.AccountIndex
+	r.users[account.Id] = user
+	return nil
+}
+
+// sameAccount compares users by their card token, their blind index, or by
+// their account id when stored without encryption.
+func sameAccount(a, b models.User) bool {
+	if a.CardToken != "" || b.CardToken != "" {
+		return a.CardToken == b.CardToken
+	}
+	if a.AccountIndex != "" || b.AccountIndex != "" {
+		return a.AccountIndex == b.AccountIndex
+	}
+	return a.AccountId == b.AccountId
+}
+
+func firstAccounts(accounts []EncryptedAccount, limit int) []EncryptedAccount {
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Id < accounts[j].Id
+	})
+	if len(accounts) > limit {
+		accounts = accounts[:limit]
+	}
+	return accounts
+}
+
+// MemoryAuditRepository keeps audit entries in memory for tests and local runs.
+type MemoryAuditRepository struct {
+	mu      sync.Mutex
+	entries []models.AuditEntry
+}
+
+func NewMemoryAuditRepository() *MemoryAuditRepository {
+	return &MemoryAuditRepository{}
+}
+
+func (r *MemoryAuditRepository) Append(ctx context.Context, entry *models.AuditEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry.Id = int64(len(r.entries) + 1)
+	r.entries = append(r.entries, *entry)
+	return nil
+}
+
+func (r *MemoryAuditRepository) List(ctx context.Context, filter AuditFilter) ([]models.AuditEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var entries []models.AuditEntry
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+		if filter.matches(r.entries[i]) {
+			entries = append(entries, r.entries[i])
+		}
+	}
+	return entries, nil
+}
+
+// matches reports whether entry passes every set field of f but Limit.
+func (f AuditFilter) matches(entry models.AuditEntry) bool {
+	return (f.Actor == "" || entry.Actor == f.Actor) &&
+		(f.TargetType == "" || entry.TargetType == f.TargetType) &&
+		(f.TargetId == "" || entry.TargetId == f.TargetId) &&
+		(f.From.IsZero() || !entry.OccurredAt.Before(f.From)) &&
+		(f.To.IsZero() || entry.OccurredAt.Before(f.To))
+}
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"payments/models"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransactionRepository_Update(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryTransactionRepository()
+	require.NoError(t, repo.Create(ctx, &models.Transaction{TransactionId: "1", Status: string(models.Pending)}))
+	assert.ErrorIs(t, repo.Create(ctx, &models.Transaction{TransactionId: "1"}), ErrAlreadyExists)
+
+	first, err := repo.Get(ctx, "1")
+	require.NoError(t, err)
+	second, err := repo.Get(ctx, "1")
+	require.NoError(t, err)
+
+	first.Status = string(models.Processing)
+	require.NoError(t, repo.Update(ctx, &first, models.Pending))
+	assert.Equal(t, 1, first.Version)
+
+	// second was read before first was written
+	second.Status = string(models.Failed)
+	assert.ErrorIs(t, repo.Update(ctx, &second, models.Pending), ErrConflict)
+	assert.Equal(t, 0, second.Version)
+
+	// first is at the latest version, but no longer pending
+	first.Status = string(models.Failed)
+	assert.ErrorIs(t, repo.Update(ctx, &first, models.Pending), ErrConflict)
+	first.Status = string(models.Successful)
+	require.NoError(t, repo.Update(ctx, &first, models.Processing))
+
+	stored, err := repo.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Successful), stored.Status)
+	assert.Equal(t, 2, stored.Version)
+
+	_, err = repo.Get(ctx, "2")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryTransactionRepository_ScheduledRetries(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryTransactionRepository()
+	now := time.Now()
+	later, soon, past := now.Add(time.Hour), now.Add(time.Minute), now.Add(-time.Minute)
+	for _, transaction := range []models.Transaction{
+		{TransactionId: "later", GateWay: "a", Status: string(models.Pending), RetryCount: 1, NextAttemptAt: &later},
+		{TransactionId: "soon", GateWay: "b", Status: string(models.Pending), RetryCount: 2, NextAttemptAt: &soon},
+		{TransactionId: "due", GateWay: "a", Status: string(models.Pending), RetryCount: 1, NextAttemptAt: &past},
+		{TransactionId: "new", GateWay: "a", Status: string(models.Pending)},
+		{TransactionId: "recovering", GateWay: "a", Status: string(models.Pending), NextAttemptAt: &past},
+		{TransactionId: "failed", GateWay: "a", Status: string(models.Failed), RetryCount: 1, NextAttemptAt: &past},
+	} {
+		require.NoError(t, repo.Create(ctx, &transaction))
+	}
+
+	transactions, err := repo.ScheduledRetries(ctx, "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"due", "soon", "later"}, ids(transactions))
+	transactions, err = repo.ScheduledRetries(ctx, "a", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"due"}, ids(transactions))
+}
+
+func TestMemoryTransactionRepository_ClaimDueRetries(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryTransactionRepository()
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, repo.Create(ctx, &models.Transaction{TransactionId: "due", Status: string(models.Pending), NextAttemptAt: &past}))
+
+	count, err := repo.ClaimDueRetries(ctx, 10, func(models.Transaction) error {
+		return errors.New("publish failed")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 0, count)
+	stored, err := repo.Get(ctx, "due")
+	require.NoError(t, err)
+	assert.NotNil(t, stored.NextAttemptAt)
+
+	read, err := repo.Get(ctx, "due")
+	require.NoError(t, err)
+	var claimed []models.Transaction
+	count, err = repo.ClaimDueRetries(ctx, 10, func(transaction models.Transaction) error {
+		claimed = append(claimed, transaction)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Nil(t, claimed[0].NextAttemptAt)
+	stored, err = repo.Get(ctx, "due")
+	require.NoError(t, err)
+	assert.Nil(t, stored.NextAttemptAt)
+	assert.Equal(t, claimed[0].Version, stored.Version)
+
+	// a processor that read the transaction before the claim still takes it
+	read.SetStatus(models.Processing, time.Now())
+	read.NextAttemptAt = nil
+	assert.NoError(t, repo.Update(ctx, &read, models.Pending))
+}
+
+func TestMemoryUserRepository(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryUserRepository()
+	require.NoError(t, repo.Create(ctx, &models.User{Guid: "1", GateWay: "a", AccountId: "acc"}))
+	assert.ErrorIs(t, repo.Create(ctx, &models.User{Guid: "2", GateWay: "a", AccountId: "acc"}), ErrAlreadyExists)
+	require.NoError(t, repo.Create(ctx, &models.User{Guid: "3", GateWay: "b", AccountId: "acc"}))
+	require.NoError(t, repo.Create(ctx, &models.User{Guid: "4", GateWay: "c", CardToken: "card_1"}))
+	require.NoError(t, repo.Create(ctx, &models.User{Guid: "5", GateWay: "c", CardToken: "card_2"}))
+	assert.ErrorIs(t, repo.Create(ctx, &models.User{Guid: "6", GateWay: "c", CardToken: "card_1"}), ErrAlreadyExists)
+
+	user, err := repo.Get(ctx, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "acc", user.AccountId)
+	_, err = repo.Get(ctx, "2")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func ids(transactions []models.Transaction) []string {
+	var ids []string
+	for _, transaction := range transactions {
+		ids = append(ids, transaction.TransactionId)
+	}
+	return ids
+}
+
+func TestMemoryAuditRepository_List(t *testing.T) {
+	entries := NewMemoryAuditRepository()
+	ctx := context.Background()
+	start := time.Now()
+	for i, actor := range []string{"system:api", "anonymous", "system:api"} {
+		entry := models.AuditEntry{OccurredAt: start.Add(time.Duration(i) * time.Second), Actor: actor, Action: "test", TargetType: "transaction", TargetId: "tx-1"}
+		require.NoError(t, entries.Append(ctx, &entry))
+		assert.Equal(t, int64(i+1), entry.Id)
+	}
+
+	listed, err := entries.List(ctx, AuditFilter{Actor: "system:api"})
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+	assert.Equal(t, int64(3), listed[0].Id)
+
+	listed, err = entries.List(ctx, AuditFilter{TargetId: "tx-1", From: start.Add(time.Second), To: start.Add(2 * time.Second)})
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, "anonymous", listed[0].Actor)
+
+	listed, err = entries.List(ctx, AuditFilter{Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, listed, 1)
+}
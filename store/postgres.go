@@ -0,0 +1,233 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/go-pg/pg/v10"
+	"payments/models"
+	"time"
+)
+
+// uniqueViolation is the Postgres error code of a unique constraint violation.
+const uniqueViolation = "23505"
+
+var (
+	_ TransactionRepository = (*PostgresTransactionRepository)(nil)
+	_ UserRepository        = (*PostgresUserRepository)(nil)
+	_ AuditRepository       = (*PostgresAuditRepository)(nil)
+
+	_ EncryptedAccountRepository = (*PostgresTransactionRepository)(nil)
+	_ EncryptedAccountRepository = (*PostgresUserRepository)(nil)
+)
+
+type PostgresTransactionRepository struct {
+	db *pg.DB
+}
+
+func NewPostgresTransactionRepository(db *pg.DB) *PostgresTransactionRepository {
+	return &PostgresTransactionRepository{db: db}
+}
+
+func (r *PostgresTransactionRepository) Create(ctx context.Context, transaction *models.Transaction) error {
+	_, err := r.db.ModelContext(ctx, transaction).Insert()
+	return mapError(err)
+}
+
+func (r *PostgresTransactionRepository) Get(ctx context.Context, transactionId string) (models.Transaction, error) {
+	var transaction models.Transaction
+	err := r.db.ModelContext(ctx, &transaction).Where("transaction_id = ?", transactionId).Select()
+	return transaction, mapError(err)
+}
+
+func (r *PostgresTransactionRepository) Update(ctx context.Context, transaction *models.Transaction, expectedStatus models.TransactionStatus) error {
+	version := transaction.Version
+	transaction.Version++
+	res, err := r.db.ModelContext(ctx, transaction).
+		ExcludeColumn("account_id", "card_token").
+		Where("transaction_id = ?", transaction.TransactionId).
+		Where("status = ?", string(expectedStatus)).
+		Where("version = ?", version).
+		Update()
+	if err == nil && res.RowsAffected() == 0 {
+		err = ErrConflict
+	}
+	if err != nil {
+		transaction.Version = version
+		return mapError(err)
+	}
+	return nil
+}
+
+func (r *PostgresTransactionRepository) ScheduledRetries(ctx context.Context, gateWay string, limit int) ([]models.Transaction, error) {
+	var transactions []models.Transaction
+	query := r.db.ModelContext(ctx, &transactions).
+		Where("status = ?", string(models.Pending)).
+		Where("next_attempt_at IS NOT NULL").
+		Where("retry_count > 0").
+		Order("next_attempt_at").
+		Limit(limit)
+	if gateWay != "" {
+		query = query.Where("gate_way = ?", gateWay)
+	}
+	err := query.Select()
+	return transactions, err
+}
+
+// ClaimDueRetries locks the due rows for the length of a database transaction,
+// skipping rows locked by another scheduler. handle runs while the rows are
+// locked, so a processor handling a transaction it read before the claim waits
+// for the claim to commit; the version is left alone so its update still
+// applies afterwards.
+func (r *PostgresTransactionRepository) ClaimDueRetries(ctx context.Context, limit int, handle func(models.Transaction) error) (int, error) {
+	var count int
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		var transactions []models.Transaction
+		err := tx.ModelContext(ctx, &transactions).
+			Where("status = ?", string(models.Pending)).
+			Where("next_attempt_at <= now()").
+			Order("next_attempt_at").
+			Limit(limit).
+			For("UPDATE SKIP LOCKED").
+			Select()
+		if err != nil || len(transactions) == 0 {
+			return err
+		}
+		ids := make([]string, 0, len(transactions))
+		for _, transaction := range transactions {
+			transaction.NextAttemptAt = nil
+			err = handle(transaction)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, transaction.TransactionId)
+		}
+		_, err = tx.ModelContext(ctx, (*models.Transaction)(nil)).
+			Set("next_attempt_at = NULL").
+			Where("transaction_id IN (?)", pg.In(ids)).
+			Update()
+		count = len(ids)
+		return err
+	})
+	return count, err
+}
+
+func (r *PostgresTransactionRepository) StaleActions(ctx context.Context, before time.Time, limit int) ([]models.Transaction, error) {
+	var transactions []models.Transaction
+	err := r.db.ModelContext(ctx, &transactions).
+		Where("status = ?", string(models.PendingAction)).
+		Where("updated_at < ?", before).
+		Order("updated_at").
+		Limit(limit).
+		Select()
+	return transactions, err
+}
+
+func (r *PostgresTransactionRepository) EncryptedAccounts(ctx context.Context, after string, limit int) ([]EncryptedAccount, error) {
+	var accounts []EncryptedAccount
+	_, err := r.db.QueryContext(ctx, &accounts, `
+		SELECT transaction_id AS id, account_id AS encrypted_account_id
+		FROM pay.transactions
+		WHERE transaction_id > ? AND account_id IS NOT NULL
+		ORDER BY transaction_id
+		LIMIT ?`, after, limit)
+	return accounts, err
+}
+
+func (r *PostgresTransactionRepository) ReplaceEncryptedAccount(ctx context.Context, account EncryptedAccount, previous string) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE pay.transactions SET account_id = ?
+		WHERE transaction_id = ? AND account_id = ?`, account.EncryptedAccountId, account.Id, previous)
+	if err == nil && res.RowsAffected() == 0 {
+		err = ErrConflict
+	}
+	return err
+}
+
+type PostgresUserRepository struct {
+	db *pg.DB
+}
+
+func NewPostgresUserRepository(db *pg.DB) *PostgresUserRepository {
+	return &PostgresUserRepository{db: db}
+}
+
+func (r *PostgresUserRepository) Create(ctx context.Context, user *models.User) error {
+	_, err := r.db.ModelContext(ctx, user).Insert()
+	return mapError(err)
+}
+
+func (r *PostgresUserRepository) Get(ctx context.Context, guid string) (models.User, error) {
+	var user models.User
+	err := r.db.ModelContext(ctx, &user).Where("guid = ?", guid).Select()
+	return user, mapError(err)
+}
+
+func (r *PostgresUserRepository) EncryptedAccounts(ctx context.Context, after string, limit int) ([]EncryptedAccount, error) {
+	var accounts []EncryptedAccount
+	_, err := r.db.QueryContext(ctx, &accounts, `
+		SELECT guid AS id, account_id AS encrypted_account_id, account_index
+		FROM pay.users
+		WHERE guid > ? AND account_id IS NOT NULL
+		ORDER BY guid
+		LIMIT ?`, after, limit)
+	return accounts, err
+}
+
+func (r *PostgresUserRepository) ReplaceEncryptedAccount(ctx context.Context, account EncryptedAccount, previous string) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE pay.users SET account_id = ?, account_index = ?
+		WHERE guid = ? AND account_id = ?`, account.EncryptedAccountId, account.AccountIndex, account.Id, previous)
+	if err == nil && res.RowsAffected() == 0 {
+		err = ErrConflict
+	}
+	return mapError(err)
+}
+
+type PostgresAuditRepository struct {
+	db *pg.DB
+}
+
+func NewPostgresAuditRepository(db *pg.DB) *PostgresAuditRepository {
+	return &PostgresAuditRepository{db: db}
+}
+
+func (r *PostgresAuditRepository) Append(ctx context.Context, entry *models.AuditEntry) error {
+	_, err := r.db.ModelContext(ctx, entry).Insert()
+	return err
+}
+
+func (r *PostgresAuditRepository) List(ctx context.Context, filter AuditFilter) ([]models.AuditEntry, error) {
+	var entries []models.AuditEntry
+	query := r.db.ModelContext(ctx, &entries).Order("occurred_at DESC", "id DESC")
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.TargetType != "" {
+		query = query.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetId != "" {
+		query = query.Where("target_id = ?", filter.TargetId)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("occurred_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("occurred_at < ?", filter.To)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	err := query.Select()
+	return entries, err
+}
+
+func mapError(err error) error {
+	if errors.Is(err, pg.ErrNoRows) {
+		return ErrNotFound
+	}
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) && pgErr.Field('C') == uniqueViolation {
+		return ErrAlreadyExists
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+//go:build integration
+
+package store
+
+import (
+	"context"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/go-pg/pg/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"payments/models"
+	"payments/sql/migrations"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *pg.DB {
+	postgres := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(15435).
+		Database("exinity_payments").
+		DataPath(t.TempDir()))
+	require.NoError(t, postgres.Start())
+	t.Cleanup(func() { postgres.Stop() })
+	db := pg.Connect(&pg.Options{Addr: "localhost:15435", User: "postgres", Password: "postgres", Database: "exinity_payments"})
+	t.Cleanup(func() { db.Close() })
+	migrator, err := migrations.NewMigrator(db)
+	require.NoError(t, err)
+	_, err = migrator.Up(context.Background(), 0)
+	require.NoError(t, err)
+	return db
+}
+
+func TestPostgresTransactionRepository_ClaimDueRetries_ConcurrentUpdate(t *testing.T) {
+	db := newTestDB(t)
+	repo := NewPostgresTransactionRepository(db)
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, repo.Create(ctx, &models.Transaction{TransactionId: "due", GateWay: "a", Type: string(models.Deposit),
+		EncryptedAccountId: "encrypted", UserId: "user-1", Amount: 10, Currency: "USD", CreatedAt: time.Now(),
+		Status: string(models.Pending), RetryCount: 1, NextAttemptAt: &past}))
+
+	// a processor handling a redelivered request read the transaction before
+	// the claim, and updates it while the claim is publishing
+	read, err := repo.Get(ctx, "due")
+	require.NoError(t, err)
+	publishing := make(chan struct{})
+	published := make(chan struct{})
+	claimed := make(chan error, 1)
+	go func() {
+		_, err := repo.ClaimDueRetries(ctx, 10, func(models.Transaction) error {
+			close(publishing)
+			<-published
+			return nil
+		})
+		claimed <- err
+	}()
+	<-publishing
+	updated := make(chan error, 1)
+	go func() {
+		read.SetStatus(models.Processing, time.Now())
+		read.NextAttemptAt = nil
+		read.RetryCount++
+		updated <- repo.Update(ctx, &read, models.Pending)
+	}()
+	select {
+	case err := <-updated:
+		t.Fatalf("the update did not wait for the claim: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(published)
+	require.NoError(t, <-claimed)
+	assert.NoError(t, <-updated, "the claim leaves the version alone")
+
+	stored, err := repo.Get(ctx, "due")
+	require.NoError(t, err)
+	assert.Equal(t, string(models.Processing), stored.Status)
+	assert.Nil(t, stored.NextAttemptAt)
+	assert.Equal(t, 2, stored.RetryCount)
+}
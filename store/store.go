@@ -0,0 +1,82 @@
+// Package store keeps users and transactions, in Postgres or in memory.
+package store
+
+import (
+	"context"
+	"errors"
+	"payments/models"
+	"time"
+)
+
+var (
+	ErrNotFound      = errors.New("store: not found")
+	ErrAlreadyExists = errors.New("store: already exists")
+	// ErrConflict is returned when a transaction was changed since it was read,
+	// or no longer has the status the update expects.
+	ErrConflict = errors.New("store: conflict")
+)
+
+type TransactionRepository interface {
+	Create(ctx context.Context, transaction *models.Transaction) error
+	Get(ctx context.Context, transactionId string) (models.Transaction, error)
+	// Update writes transaction if it still has expectedStatus and the version
+	// it was read at, and bumps the version. It returns ErrConflict otherwise.
+	Update(ctx context.Context, transaction *models.Transaction, expectedStatus models.TransactionStatus) error
+	// ScheduledRetries lists up to limit pending transactions with a retry
+	// scheduled, soonest first, optionally only those on gateWay. New
+	// transactions, whose next_attempt_at is only when they are recovered,
+	// are not retries.
+	ScheduledRetries(ctx context.Context, gateWay string, limit int) ([]models.Transaction, error)
+	// ClaimDueRetries passes up to limit transactions whose retry is due to
+	// handle and clears their schedule, without bumping their version. The
+	// schedule is left as it was if handle fails. Retries claimed by a
+	// concurrent call are skipped.
+	ClaimDueRetries(ctx context.Context, limit int, handle func(models.Transaction) error) (int, error)
+	// StaleActions lists up to limit transactions waiting at pending_action
+	// since before before, longest waiting first.
+	StaleActions(ctx context.Context, before time.Time, limit int) ([]models.Transaction, error)
+}
+
+type UserRepository interface {
+	// Create returns ErrAlreadyExists if the account is already registered on
+	// the gateway, compared by AccountIndex once users carry one.
+	Create(ctx context.Context, user *models.User) error
+	Get(ctx context.Context, guid string) (models.User, error)
+}
+
+// EncryptedAccountRepository rewrites the encrypted account ids of users or
+// transactions when the keys they are encrypted under are rotated.
+// Transaction updates leave them as they are.
+type EncryptedAccountRepository interface {
+	// EncryptedAccounts returns up to limit accounts with an id greater than
+	// after, by id. Card payments, which have no account id, are left out.
+	EncryptedAccounts(ctx context.Context, after string, limit int) ([]EncryptedAccount, error)
+	// ReplaceEncryptedAccount writes account if its row still holds
+	// previous, and returns ErrConflict otherwise.
+	ReplaceEncryptedAccount(ctx context.Context, account EncryptedAccount, previous string) error
+}
+
+// EncryptedAccount is the account id of a user or transaction as stored.
+type EncryptedAccount struct {
+	// Id is the guid of the user or the id of the transaction.
+	Id                 string
+	EncryptedAccountId string
+	// AccountIndex only applies to users.
+	AccountIndex string
+}
+
+type AuditRepository interface {
+	Append(ctx context.Context, entry *models.AuditEntry) error
+	// List returns the entries matching filter, newest first.
+	List(ctx context.Context, filter AuditFilter) ([]models.AuditEntry, error)
+}
+
+// AuditFilter selects audit entries. Zero fields match everything.
+type AuditFilter struct {
+	Actor      string
+	TargetType string
+	TargetId   string
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
@@ -0,0 +1,32 @@
+package tracing
+
+import (
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"net/http"
+)
+
+// defaultTransport resolves http.DefaultTransport on every request rather than
+// at construction, so interceptors replacing it keep working.
+type defaultTransport struct{}
+
+func (defaultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// NewHTTPClient returns a client that starts a span for each outbound request
+// and propagates the trace context in its headers.
+func NewHTTPClient() *http.Client {
+	return &http.Client{Transport: NewTransport(defaultTransport{})}
+}
+
+// NewTransport wraps transport to start a span for each outbound request and
+// propagate the trace context in its headers.
+func NewTransport(transport http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(transport)
+}
+
+// NewHandler wraps an http handler with a server span per request, continuing
+// any trace context sent by the caller.
+func NewHandler(handler http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(handler, operation)
+}
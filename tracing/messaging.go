@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"payments/messaging"
+)
+
+// MessageHeaderCarrier adapts message headers to the propagation.TextMapCarrier interface.
+type MessageHeaderCarrier struct {
+	msg *messaging.Message
+}
+
+func NewMessageHeaderCarrier(msg *messaging.Message) MessageHeaderCarrier {
+	return MessageHeaderCarrier{msg: msg}
+}
+
+func (c MessageHeaderCarrier) Get(key string) string {
+	return c.msg.Header(key)
+}
+
+func (c MessageHeaderCarrier) Set(key, value string) {
+	c.msg.SetHeader(key, value)
+}
+
+func (c MessageHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c.msg.Headers))
+	for _, header := range c.msg.Headers {
+		keys = append(keys, header.Key)
+	}
+	return keys
+}
+
+// InjectMessage writes the trace context carried by ctx into the message headers.
+func InjectMessage(ctx context.Context, msg *messaging.Message) {
+	otel.GetTextMapPropagator().Inject(ctx, NewMessageHeaderCarrier(msg))
+}
+
+// StartConsumerSpan extracts the producer's trace context from the message
+// headers and starts a consumer span as its child.
+func StartConsumerSpan(ctx context.Context, msg *messaging.Message, name string) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, NewMessageHeaderCarrier(msg))
+	return Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.Int("messaging.destination.partition.id", int(msg.Partition)),
+			attribute.Int64("messaging.message.offset", msg.Offset),
+		),
+	)
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"payments/messaging"
+	"testing"
+)
+
+func TestMessagePropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := Install("test", exporter)
+
+	ctx, producerSpan := Tracer().Start(context.Background(), "produce")
+	topic := "pay.transaction"
+	msg := &messaging.Message{Topic: topic, Partition: 2, Offset: 10}
+	InjectMessage(ctx, msg)
+	producerSpan.End()
+
+	assert.NotEmpty(t, NewMessageHeaderCarrier(msg).Get("traceparent"))
+
+	_, consumerSpan := StartConsumerSpan(context.Background(), msg, "consume")
+	consumerSpan.End()
+	assert.NoError(t, provider.ForceFlush(context.Background()))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, spans[0].SpanContext.TraceID(), spans[1].SpanContext.TraceID())
+	assert.Equal(t, spans[0].SpanContext.SpanID(), spans[1].Parent.SpanID())
+	assert.Equal(t, trace.SpanKindConsumer, spans[1].SpanKind)
+	assert.Contains(t, spans[1].Attributes, attribute.String("messaging.destination.name", topic))
+}
+
+func TestMessageHeaderCarrier_Set(t *testing.T) {
+	msg := &messaging.Message{Headers: []messaging.Header{{Key: "traceparent", Value: []byte("old")}}}
+	carrier := NewMessageHeaderCarrier(msg)
+	carrier.Set("traceparent", "new")
+	carrier.Set("tracestate", "state")
+
+	assert.Len(t, msg.Headers, 2)
+	assert.Equal(t, "new", carrier.Get("traceparent"))
+	assert.ElementsMatch(t, []string{"traceparent", "tracestate"}, carrier.Keys())
+}
+
+func TestHTTPPropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := Install("test", exporter)
+
+	var received trace.SpanContext
+	var requestID string
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(RequestIDMiddleware)
+	router.Post("/callback", func(w http.ResponseWriter, r *http.Request) {
+		received = trace.SpanContextFromContext(r.Context())
+		requestID = middleware.GetReqID(r.Context())
+	})
+	server := httptest.NewServer(NewHandler(router, "api"))
+	defer server.Close()
+
+	ctx, span := Tracer().Start(context.Background(), "dispatch")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/callback", nil)
+	assert.NoError(t, err)
+	resp, err := NewHTTPClient().Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	span.End()
+	assert.NoError(t, provider.ForceFlush(context.Background()))
+
+	assert.Equal(t, span.SpanContext().TraceID(), received.TraceID())
+	var serverSpan *tracetest.SpanStub
+	spans := exporter.GetSpans()
+	for i := range spans {
+		if spans[i].SpanKind == trace.SpanKindServer {
+			serverSpan = &spans[i]
+		}
+	}
+	if assert.NotNil(t, serverSpan) {
+		assert.Contains(t, serverSpan.Attributes, attribute.String("http.request_id", requestID))
+	}
+}
@@ -1,26 +1,23 @@
 package utils
 
 import (
+	"context"
 	"github.com/go-pg/pg/v10"
-	"github.com/redis/go-redis/v9"
 	"payments/config"
 )
 
+// NewDbConnection connects to the configured database. Sessions use UTC, so
+// times are read back in UTC whatever the server's time zone.
 func NewDbConnection(cfg *config.Config) *pg.DB {
 	db := pg.Connect(&pg.Options{
 		User:     cfg.Database.Username,
 		Password: cfg.Database.Password,
 		Database: cfg.Database.Database,
 		Addr:     cfg.Database.HostName,
+		OnConnect: func(ctx context.Context, conn *pg.Conn) error {
+			_, err := conn.ExecContext(ctx, "SET TIME ZONE 'UTC'")
+			return err
+		},
 	})
 	return db
 }
-
-func NewRedisConnection(cfg *config.Config) *redis.Client {
-	client := redis.NewClient(&redis.Options{
-		Addr:     cfg.Redis.HostName,
-		Username: cfg.Redis.Username,
-		Password: cfg.Redis.Password,
-	})
-	return client
-}
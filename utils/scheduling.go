@@ -1,9 +1,20 @@
 package utils
 
-import "time"
+import (
+	"math/rand"
+	"time"
+)
 
 func ExponentialBackoff(attempts int) time.Duration {
 	base := 1 * time.Second
 	duration := time.Duration(float64(base) * float64(int(1)<<uint(attempts))) // 2^attempt
 	return duration
 }
+
+// ExponentialBackoffWithJitter spreads retries scheduled at the same time over
+// the upper half of the exponential backoff.
+func ExponentialBackoffWithJitter(attempts int) time.Duration {
+	duration := ExponentialBackoff(attempts)
+	half := duration / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
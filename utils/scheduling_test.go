@@ -26,3 +26,16 @@ func TestExponentialBackoff(t *testing.T) {
 		})
 	}
 }
+
+func TestExponentialBackoffWithJitter(t *testing.T) {
+	for attempts := 0; attempts < 5; attempts++ {
+		t.Run(fmt.Sprintf("Attempt %d", attempts), func(t *testing.T) {
+			upper := ExponentialBackoff(attempts)
+			for i := 0; i < 100; i++ {
+				result := ExponentialBackoffWithJitter(attempts)
+				assert.GreaterOrEqual(t, result, upper/2)
+				assert.LessOrEqual(t, result, upper)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package utils
 
 import "time"
 
-func FmtTimestamp(t time.Time) string {
-	return t.Format(time.RFC3339)
+// Now returns the current time in UTC, truncated to the microseconds Postgres
+// keeps, so a time read back from the database equals the one written.
+func Now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
 }
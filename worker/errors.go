@@ -0,0 +1,26 @@
+package worker
+
+import "errors"
+
+// permanentError marks a message that can never be processed, such as an
+// unparsable payload. It is dead-lettered without retrying.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
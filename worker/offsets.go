@@ -0,0 +1,52 @@
+package worker
+
+import "sync"
+
+// offsetTracker keeps the offsets of a partition that were handed to
+// handlers and computes how far the partition can be committed: up to, but
+// not including, the oldest offset that has not finished.
+type offsetTracker struct {
+	mu        sync.Mutex
+	started   []int64
+	done      map[int64]bool
+	committed int64
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		done:      map[int64]bool{},
+		committed: -1,
+	}
+}
+
+// start records an offset handed to a handler. Offsets of a partition are
+// delivered in increasing order.
+func (t *offsetTracker) start(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started = append(t.started, offset)
+}
+
+func (t *offsetTracker) finish(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[offset] = true
+}
+
+// commitOffset returns the next offset to commit and whether it moved since the
+// last call.
+func (t *offsetTracker) commitOffset() (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	next := t.committed
+	for len(t.started) > 0 && t.done[t.started[0]] {
+		delete(t.done, t.started[0])
+		next = t.started[0] + 1
+		t.started = t.started[1:]
+	}
+	if next == t.committed {
+		return next, false
+	}
+	t.committed = next
+	return next, true
+}
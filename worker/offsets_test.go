@@ -0,0 +1,34 @@
+package worker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOffsetTracker_CommitOffset(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, offset := range []int64{10, 11, 12, 13} {
+		tracker.start(offset)
+	}
+
+	_, moved := tracker.commitOffset()
+	assert.False(t, moved, "nothing finished yet")
+
+	tracker.finish(11)
+	tracker.finish(12)
+	_, moved = tracker.commitOffset()
+	assert.False(t, moved, "offset 10 still running")
+
+	tracker.finish(10)
+	offset, moved := tracker.commitOffset()
+	assert.True(t, moved)
+	assert.Equal(t, int64(13), offset)
+
+	_, moved = tracker.commitOffset()
+	assert.False(t, moved, "already committed")
+
+	tracker.finish(13)
+	offset, moved = tracker.commitOffset()
+	assert.True(t, moved)
+	assert.Equal(t, int64(14), offset)
+}
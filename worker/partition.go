@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"payments/messaging"
+	"sync"
+)
+
+// partitionWorker runs the messages of one partition. Messages sharing a key
+// are processed one after the other in offset order, messages with different
+// keys run concurrently up to maxInFlight.
+type partitionWorker struct {
+	process     func(msg *messaging.Message) bool
+	offsets     *offsetTracker
+	maxInFlight int
+	slots       chan struct{}
+	mu          sync.Mutex
+	lanes       map[string][]*messaging.Message
+	queued      int
+	wg          sync.WaitGroup
+}
+
+func newPartitionWorker(maxInFlight int, process func(msg *messaging.Message) bool) *partitionWorker {
+	return &partitionWorker{
+		process:     process,
+		offsets:     newOffsetTracker(),
+		maxInFlight: maxInFlight,
+		slots:       make(chan struct{}, maxInFlight),
+		lanes:       map[string][]*messaging.Message{},
+	}
+}
+
+// submit queues msg behind earlier messages with the same key without
+// blocking. It reports whether the partition is full, holding maxInFlight
+// messages queued or running, in which case it should be paused until it has
+// room again.
+func (w *partitionWorker) submit(msg *messaging.Message) bool {
+	w.offsets.start(msg.Offset)
+	key := string(msg.Key)
+	w.mu.Lock()
+	queue, busy := w.lanes[key]
+	w.lanes[key] = append(queue, msg)
+	w.queued++
+	full := w.queued >= w.maxInFlight
+	w.mu.Unlock()
+	if !busy {
+		w.wg.Add(1)
+		go w.runLane(key)
+	}
+	return full
+}
+
+// full reports whether the partition holds maxInFlight messages.
+func (w *partitionWorker) full() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.queued >= w.maxInFlight
+}
+
+func (w *partitionWorker) runLane(key string) {
+	defer w.wg.Done()
+	for {
+		w.mu.Lock()
+		queue := w.lanes[key]
+		if len(queue) == 0 {
+			delete(w.lanes, key)
+			w.mu.Unlock()
+			return
+		}
+		msg := queue[0]
+		w.lanes[key] = queue[1:]
+		w.mu.Unlock()
+		w.slots <- struct{}{}
+		if w.process(msg) {
+			w.offsets.finish(msg.Offset)
+		}
+		<-w.slots
+		w.mu.Lock()
+		w.queued--
+		w.mu.Unlock()
+	}
+}
+
+// wait blocks until every submitted message has been processed.
+func (w *partitionWorker) wait() {
+	w.wg.Wait()
+}
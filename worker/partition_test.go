@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"payments/messaging"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func message(key string, offset int64) *messaging.Message {
+	return &messaging.Message{
+		Topic:  "pay.transaction",
+		Key:    []byte(key),
+		Offset: offset,
+	}
+}
+
+func TestPartitionWorker_OrderPerKey(t *testing.T) {
+	var mu sync.Mutex
+	processed := map[string][]int64{}
+	worker := newPartitionWorker(4, func(msg *messaging.Message) bool {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		processed[string(msg.Key)] = append(processed[string(msg.Key)], msg.Offset)
+		return true
+	})
+
+	keys := []string{"tx-1", "tx-2", "tx-3"}
+	for offset := int64(0); offset < 30; offset++ {
+		worker.submit(message(keys[offset%3], offset))
+	}
+	worker.wait()
+
+	for i, key := range keys {
+		var expected []int64
+		for offset := int64(i); offset < 30; offset += 3 {
+			expected = append(expected, offset)
+		}
+		assert.Equal(t, expected, processed[key])
+	}
+	offset, moved := worker.offsets.commitOffset()
+	assert.True(t, moved)
+	assert.Equal(t, int64(30), offset)
+}
+
+func TestPartitionWorker_BoundedConcurrency(t *testing.T) {
+	var running, peak int32
+	worker := newPartitionWorker(2, func(msg *messaging.Message) bool {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			seen := atomic.LoadInt32(&peak)
+			if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return true
+	})
+
+	for offset := int64(0); offset < 10; offset++ {
+		worker.submit(message(string(rune('a'+offset)), offset))
+	}
+	worker.wait()
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&peak), int32(2))
+}
+
+func TestPartitionWorker_UnfinishedOffsetBlocksCommit(t *testing.T) {
+	worker := newPartitionWorker(4, func(msg *messaging.Message) bool {
+		return msg.Offset != 1 // dead-lettering offset 1 failed
+	})
+
+	for offset := int64(0); offset < 4; offset++ {
+		worker.submit(message(string(rune('a'+offset)), offset))
+	}
+	worker.wait()
+
+	offset, moved := worker.offsets.commitOffset()
+	assert.True(t, moved)
+	assert.Equal(t, int64(1), offset)
+}
+
+func TestPartitionWorker_SubmitReportsFull(t *testing.T) {
+	release := make(chan struct{})
+	worker := newPartitionWorker(2, func(msg *messaging.Message) bool {
+		<-release
+		return true
+	})
+
+	assert.False(t, worker.submit(message("a", 0)))
+	assert.True(t, worker.submit(message("b", 1)), "the second message fills the partition")
+	assert.True(t, worker.submit(message("a", 2)), "submit does not block on a full partition")
+	close(release)
+	worker.wait()
+	assert.False(t, worker.full())
+}
@@ -0,0 +1,371 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"os"
+	"os/signal"
+	"payments/config"
+	"payments/logging"
+	"payments/messaging"
+	"payments/utils"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const pollTimeout = 500 * time.Millisecond
+const commitInterval = time.Second
+
+// maxDeadLetterBackoff caps the wait between attempts to dead-letter a message.
+const maxDeadLetterBackoff = 30 * time.Second
+
+// Headers attached to dead-lettered messages.
+const (
+	HeaderDeadLetterError     = "dlq.error"
+	HeaderDeadLetterTopic     = "dlq.topic"
+	HeaderDeadLetterPartition = "dlq.partition"
+	HeaderDeadLetterOffset    = "dlq.offset"
+	HeaderDeadLetterAttempts  = "dlq.attempts"
+)
+
+// Handler processes one message. Returning an error retries the message up to
+// the configured attempts before it is dead-lettered, unless the error is
+// Permanent.
+type Handler func(ctx context.Context, msg *messaging.Message) error
+
+type ShutdownHook func(ctx context.Context) error
+
+type Options struct {
+	ShutdownTimeout         time.Duration
+	MaxInFlightPerPartition int
+	MaxAttempts             int
+	DeadLetterTopic         string
+}
+
+func NewOptions(cfg *config.Config) Options {
+	return Options{
+		ShutdownTimeout:         cfg.Worker.ShutdownTimeout,
+		MaxInFlightPerPartition: cfg.Worker.MaxInFlightPerPartition,
+		MaxAttempts:             cfg.Worker.MaxAttempts,
+		DeadLetterTopic:         cfg.KafkaTopics.DeadLetterTopic,
+	}
+}
+
+// Runtime runs a consume loop until it is stopped, then stops consuming,
+// drains in-flight work within the shutdown timeout and closes the subscriber
+// and publisher.
+//
+// Offsets are committed manually, only once a message and every message
+// before it on its partition have been processed or dead-lettered, so a crash
+// redelivers unfinished work. A partition holding MaxInFlightPerPartition
+// messages is paused rather than blocking the consume loop, which has to keep
+// polling to stay in the consumer group.
+type Runtime struct {
+	name       string
+	logger     zerolog.Logger
+	subscriber messaging.Subscriber
+	publisher  messaging.Publisher
+	opts       Options
+	handler    Handler
+	backoff    func(attempts int) time.Duration
+	mu         sync.Mutex
+	partitions map[messaging.Partition]*partitionWorker
+	// paused is only used by the consume loop.
+	paused map[messaging.Partition]bool
+	// aborted is closed when the shutdown timeout expires, to stop waiting
+	// before retries.
+	aborted chan struct{}
+	hooks   []ShutdownHook
+}
+
+func NewRuntime(name string, subscriber messaging.Subscriber, publisher messaging.Publisher, opts Options) *Runtime {
+	if opts.MaxInFlightPerPartition < 1 {
+		opts.MaxInFlightPerPartition = 1
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+	return &Runtime{
+		name:       name,
+		logger:     logging.Component(name),
+		subscriber: subscriber,
+		publisher:  publisher,
+		opts:       opts,
+		backoff:    utils.ExponentialBackoff,
+		partitions: map[messaging.Partition]*partitionWorker{},
+		paused:     map[messaging.Partition]bool{},
+		aborted:    make(chan struct{}),
+	}
+}
+
+// OnShutdown registers a hook run after in-flight work is drained, before the
+// subscriber and publisher are closed. Hooks run in registration order.
+func (r *Runtime) OnShutdown(hook ShutdownHook) {
+	r.hooks = append(r.hooks, hook)
+}
+
+// Run subscribes to topic and consumes it until SIGINT or SIGTERM is received.
+func (r *Runtime) Run(topic string, handler Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return r.RunContext(ctx, topic, handler)
+}
+
+// RunContext subscribes to topic and consumes it until ctx is done.
+func (r *Runtime) RunContext(ctx context.Context, topic string, handler Handler) error {
+	r.handler = handler
+	err := r.subscriber.Subscribe(topic, r.revoke)
+	if err != nil {
+		return err
+	}
+	r.logger.Info().Str("topic", topic).Msg("Consuming")
+	lastCommit := time.Now()
+	for ctx.Err() == nil {
+		if time.Since(lastCommit) >= commitInterval {
+			r.commit(r.assigned())
+			lastCommit = time.Now()
+		}
+		r.resume()
+		msg, err := r.subscriber.Poll(pollTimeout)
+		if err != nil {
+			r.logger.Error().Err(err).Str("topic", topic).Msg("Error reading message")
+			continue
+		}
+		if msg == nil {
+			continue // No message received, keep polling
+		}
+		if r.partition(msg).submit(msg) {
+			r.pause(messaging.Partition{Topic: msg.Topic, Partition: msg.Partition})
+		}
+	}
+	r.logger.Info().Msg("Shutting down")
+	return r.shutdown()
+}
+
+func (r *Runtime) partition(msg *messaging.Message) *partitionWorker {
+	key := messaging.Partition{Topic: msg.Topic, Partition: msg.Partition}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	worker, ok := r.partitions[key]
+	if !ok {
+		worker = newPartitionWorker(r.opts.MaxInFlightPerPartition, r.process)
+		r.partitions[key] = worker
+	}
+	return worker
+}
+
+func (r *Runtime) pause(partition messaging.Partition) {
+	err := r.subscriber.Pause([]messaging.Partition{partition})
+	if err != nil {
+		r.logger.Error().Err(err).Interface("partition", partition).Msg("Error pausing partition")
+		return
+	}
+	r.paused[partition] = true
+}
+
+// resume resumes the paused partitions that have room for messages again.
+func (r *Runtime) resume() {
+	var partitions []messaging.Partition
+	for partition := range r.paused {
+		r.mu.Lock()
+		worker, ok := r.partitions[partition]
+		r.mu.Unlock()
+		if !ok || !worker.full() {
+			partitions = append(partitions, partition)
+		}
+	}
+	if len(partitions) == 0 {
+		return
+	}
+	err := r.subscriber.Resume(partitions)
+	if err != nil {
+		r.logger.Error().Err(err).Interface("partitions", partitions).Msg("Error resuming partitions")
+		return
+	}
+	for _, partition := range partitions {
+		delete(r.paused, partition)
+	}
+}
+
+func (r *Runtime) assigned() []messaging.Partition {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	partitions := make([]messaging.Partition, 0, len(r.partitions))
+	for partition := range r.partitions {
+		partitions = append(partitions, partition)
+	}
+	return partitions
+}
+
+// revoke finishes the work of revoked partitions and commits them before
+// they are handed to another consumer.
+func (r *Runtime) revoke(partitions []messaging.Partition) {
+	r.drain(partitions)
+	r.commit(partitions)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, partition := range partitions {
+		delete(r.partitions, partition)
+		delete(r.paused, partition)
+	}
+}
+
+func (r *Runtime) drain(partitions []messaging.Partition) {
+	for _, partition := range partitions {
+		r.mu.Lock()
+		worker, ok := r.partitions[partition]
+		r.mu.Unlock()
+		if ok {
+			worker.wait()
+		}
+	}
+}
+
+func (r *Runtime) commit(partitions []messaging.Partition) {
+	var offsets []messaging.Offset
+	for _, partition := range partitions {
+		r.mu.Lock()
+		worker, ok := r.partitions[partition]
+		r.mu.Unlock()
+		if !ok {
+			continue
+		}
+		offset, moved := worker.offsets.commitOffset()
+		if moved {
+			offsets = append(offsets, messaging.Offset{Partition: partition, Offset: offset})
+		}
+	}
+	if len(offsets) == 0 {
+		return
+	}
+	err := r.subscriber.Commit(offsets)
+	if err != nil {
+		r.logger.Error().Err(err).Interface("offsets", offsets).Msg("Error committing offsets")
+	}
+}
+
+// process runs the handler with retries and dead-letters the message when it
+// keeps failing, retrying the dead letter until it is written. It reports
+// whether the message's offset may be committed, which only fails once the
+// shutdown timeout expired, leaving the message to be redelivered on restart.
+func (r *Runtime) process(msg *messaging.Message) bool {
+	r.logMessage(msg)
+	var err error
+	attempts := 0
+	for attempts < r.opts.MaxAttempts {
+		if attempts > 0 && !r.sleep(r.backoff(attempts-1)) {
+			return false
+		}
+		attempts++
+		// in-flight work must finish even though a shutdown was requested
+		err = r.handler(context.Background(), msg)
+		if err == nil || IsPermanent(err) {
+			break
+		}
+		r.messageLog(r.logger.Warn(), msg).Err(err).Int("attempt", attempts).Msg("Error handling message")
+	}
+	if err == nil {
+		return true
+	}
+	for retries := 0; ; retries++ {
+		deadLetterErr := r.deadLetter(msg, err, attempts)
+		if deadLetterErr == nil {
+			return true
+		}
+		// the partition cannot be committed past the message until it is stored
+		r.messageLog(r.logger.Error(), msg).Err(deadLetterErr).Int("retry", retries).Msg("Error dead-lettering message")
+		if !r.sleep(min(r.backoff(retries), maxDeadLetterBackoff)) {
+			return false
+		}
+	}
+}
+
+// sleep waits for d and reports whether the runtime was not aborted meanwhile.
+func (r *Runtime) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.aborted:
+		return false
+	}
+}
+
+func (r *Runtime) deadLetter(msg *messaging.Message, cause error, attempts int) error {
+	if r.publisher == nil || r.opts.DeadLetterTopic == "" {
+		return fmt.Errorf("no dead letter topic configured: %w", cause)
+	}
+	deadLetter := &messaging.Message{
+		Topic:   r.opts.DeadLetterTopic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: append([]messaging.Header(nil), msg.Headers...),
+	}
+	deadLetter.SetHeader(HeaderDeadLetterError, cause.Error())
+	deadLetter.SetHeader(HeaderDeadLetterTopic, msg.Topic)
+	deadLetter.SetHeader(HeaderDeadLetterPartition, strconv.Itoa(int(msg.Partition)))
+	deadLetter.SetHeader(HeaderDeadLetterOffset, strconv.FormatInt(msg.Offset, 10))
+	deadLetter.SetHeader(HeaderDeadLetterAttempts, strconv.Itoa(attempts))
+	// the offset is committed on the strength of this write
+	err := r.publisher.Publish(context.Background(), deadLetter)
+	if err != nil {
+		return err
+	}
+	r.messageLog(r.logger.Warn(), msg).Err(cause).Int("attempts", attempts).Msg("Dead-lettered message")
+	return nil
+}
+
+// logMessage logs msg with its payload at debug level. The payload is logged as
+// JSON, so the fields the logger redacts are masked in it too.
+func (r *Runtime) logMessage(msg *messaging.Message) {
+	event := r.logger.Debug()
+	if !event.Enabled() {
+		return
+	}
+	if json.Valid(msg.Value) {
+		event = event.RawJSON("payload", msg.Value)
+	}
+	r.messageLog(event, msg).Msg("Message received")
+}
+
+func (r *Runtime) messageLog(event *zerolog.Event, msg *messaging.Message) *zerolog.Event {
+	return event.Str("topic", msg.Topic).Int32("partition", msg.Partition).Int64("offset", msg.Offset).Bytes("key", msg.Key)
+}
+
+func (r *Runtime) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.ShutdownTimeout)
+	defer cancel()
+	var errs []error
+	drained := make(chan struct{})
+	go func() {
+		r.drain(r.assigned())
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		close(r.aborted)
+		errs = append(errs, errors.New("timed out waiting for in-flight messages"))
+	}
+	r.commit(r.assigned())
+	for _, hook := range r.hooks {
+		if err := hook(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := r.subscriber.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if r.publisher != nil {
+		if err := r.publisher.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"payments/messaging"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRuntime_OrderPerTransaction(t *testing.T) {
+	bus := messaging.NewMemoryBus(4)
+	publisher := bus.Publisher()
+	transactions := []string{"tx-1", "tx-2", "tx-3", "tx-4", "tx-5", "tx-6"}
+	const steps = 10
+	// each transaction's steps are published in order, interleaved with the others
+	for step := 0; step < steps; step++ {
+		for _, transactionId := range transactions {
+			msg := &messaging.Message{Topic: "pay.transaction", Key: []byte(transactionId), Value: []byte(strconv.Itoa(step))}
+			require.NoError(t, publisher.Publish(context.Background(), msg))
+		}
+	}
+
+	var mu sync.Mutex
+	seen := map[string][]int{}
+	total := 0
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	runtime := NewRuntime("test", bus.Subscriber("group"), publisher, Options{
+		ShutdownTimeout:         time.Second,
+		MaxInFlightPerPartition: 8,
+		MaxAttempts:             3,
+		DeadLetterTopic:         "pay.dlq",
+	})
+	go func() {
+		defer close(done)
+		err := runtime.RunContext(ctx, "pay.transaction", func(ctx context.Context, msg *messaging.Message) error {
+			// uneven handling times would reorder messages run concurrently
+			time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+			step, err := strconv.Atoi(string(msg.Value))
+			if err != nil {
+				return Permanent(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			seen[string(msg.Key)] = append(seen[string(msg.Key)], step)
+			total++
+			if total == len(transactions)*steps {
+				cancel()
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		cancel()
+		t.Fatal("messages were not processed in time")
+	}
+
+	for _, transactionId := range transactions {
+		expected := make([]int, steps)
+		for step := range expected {
+			expected[step] = step
+		}
+		assert.Equal(t, expected, seen[transactionId], fmt.Sprintf("steps of %s", transactionId))
+	}
+	assert.Empty(t, bus.Messages("pay.dlq"))
+}
+
+// flakyPublisher fails the first failures publishes.
+type flakyPublisher struct {
+	messaging.Publisher
+	mu       sync.Mutex
+	failures int
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, msg *messaging.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker unavailable")
+	}
+	return p.Publisher.Publish(ctx, msg)
+}
+
+func TestRuntime_RetriesDeadLetter(t *testing.T) {
+	bus := messaging.NewMemoryBus(1)
+	require.NoError(t, bus.Publisher().Publish(context.Background(), &messaging.Message{Topic: "pay.transaction", Key: []byte("tx-1")}))
+	subscriber := bus.Subscriber("group")
+	runtime := NewRuntime("test", subscriber, &flakyPublisher{Publisher: bus.Publisher(), failures: 3}, Options{
+		ShutdownTimeout:         time.Second,
+		MaxInFlightPerPartition: 1,
+		MaxAttempts:             1,
+		DeadLetterTopic:         "pay.dlq",
+	})
+	runtime.backoff = func(int) time.Duration { return time.Millisecond }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, runtime.RunContext(ctx, "pay.transaction", func(ctx context.Context, msg *messaging.Message) error {
+			return Permanent(errors.New("invalid message"))
+		}))
+	}()
+	require.Eventually(t, func() bool { return len(bus.Messages("pay.dlq")) == 1 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, int64(1), subscriber.Committed(messaging.Partition{Topic: "pay.transaction", Partition: 0}),
+		"the offset is committed once the dead letter is written")
+}
+
+// pausingSubscriber records the partitions paused and the polls made.
+type pausingSubscriber struct {
+	messaging.Subscriber
+	mu     sync.Mutex
+	paused map[messaging.Partition]bool
+	polls  int
+}
+
+func (s *pausingSubscriber) Poll(timeout time.Duration) (*messaging.Message, error) {
+	s.mu.Lock()
+	s.polls++
+	s.mu.Unlock()
+	return s.Subscriber.Poll(timeout)
+}
+
+func (s *pausingSubscriber) Pause(partitions []messaging.Partition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, partition := range partitions {
+		s.paused[partition] = true
+	}
+	return s.Subscriber.Pause(partitions)
+}
+
+func (s *pausingSubscriber) Resume(partitions []messaging.Partition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, partition := range partitions {
+		delete(s.paused, partition)
+	}
+	return s.Subscriber.Resume(partitions)
+}
+
+func (s *pausingSubscriber) state() (map[messaging.Partition]bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paused := map[messaging.Partition]bool{}
+	for partition := range s.paused {
+		paused[partition] = true
+	}
+	return paused, s.polls
+}
+
+func TestRuntime_PausesFullPartition(t *testing.T) {
+	bus := messaging.NewMemoryBus(1)
+	publisher := bus.Publisher()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, publisher.Publish(context.Background(), &messaging.Message{Topic: "pay.transaction", Key: []byte("tx-1")}))
+	}
+	subscriber := &pausingSubscriber{Subscriber: bus.Subscriber("group"), paused: map[messaging.Partition]bool{}}
+	runtime := NewRuntime("test", subscriber, publisher, Options{
+		ShutdownTimeout:         time.Second,
+		MaxInFlightPerPartition: 1,
+		MaxAttempts:             1,
+	})
+
+	var handled atomic.Int32
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, runtime.RunContext(ctx, "pay.transaction", func(ctx context.Context, msg *messaging.Message) error {
+			<-release
+			handled.Add(1)
+			return nil
+		}))
+	}()
+	partition := messaging.Partition{Topic: "pay.transaction", Partition: 0}
+	require.Eventually(t, func() bool {
+		paused, _ := subscriber.state()
+		return paused[partition]
+	}, 5*time.Second, 10*time.Millisecond)
+	_, polls := subscriber.state()
+	require.Eventually(t, func() bool {
+		_, more := subscriber.state()
+		return more > polls+1
+	}, 5*time.Second, 10*time.Millisecond, "the consume loop keeps polling while the handler is stuck")
+
+	close(release)
+	require.Eventually(t, func() bool { return handled.Load() == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		paused, _ := subscriber.state()
+		return len(paused) == 0
+	}, 5*time.Second, 10*time.Millisecond, "the partition is resumed once it has room")
+	cancel()
+	<-done
+}